@@ -0,0 +1,190 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// Adaptive quality watches how many frames the hub drops for a client
+// and, rather than let it stutter, sends it smaller or fewer frames.
+const (
+    // adaptWindow is how far back the drop rate looks.
+    adaptWindow = 2 * time.Second
+    // adaptTick is how often the pacing goroutine samples the counters.
+    adaptTick = 250 * time.Millisecond
+    // adaptThreshold is the share of dropped frames that steps down.
+    adaptThreshold = 0.1
+    // adaptRecover is how long a client must go without drops before it
+    // is tried one step higher.
+    adaptRecover = 6 * time.Second
+    // minAdaptQuality stops the quality ladder from going to mush.
+    minAdaptQuality = 10
+)
+
+// adaptLevel scales a client's JPEG quality to percent of what it asked
+// for and delivers one frame in every divisor, spaced by capture time.
+type adaptLevel struct {
+    percent int
+    divisor int
+}
+
+// adaptLevels go from full quality down. Quality is given up first since
+// it costs the viewer less than motion.
+var adaptLevels = []adaptLevel{
+    {100, 1},
+    {75, 1},
+    {50, 1},
+    {50, 2},
+    {35, 4},
+}
+
+func (l adaptLevel) quality(base int) int {
+    q := base * l.percent / 100
+    if q < minAdaptQuality {
+        q = minAdaptQuality
+    }
+    return q
+}
+
+type adaptSample struct {
+    at                 time.Time
+    dropped, delivered uint64
+}
+
+// dropWindow holds the samples of a client's drop and delivery counters
+// taken over the last adaptWindow.
+type dropWindow struct {
+    samples []adaptSample
+}
+
+func (w *dropWindow) add(s adaptSample) {
+    w.samples = append(w.samples, s)
+    for len(w.samples) > 1 && s.at.Sub(w.samples[0].at) > adaptWindow {
+        w.samples = w.samples[1:]
+    }
+}
+
+// dropRate is the share of frames dropped over the window.
+func (w *dropWindow) dropRate() float64 {
+    if len(w.samples) < 2 {
+        return 0
+    }
+    first, last := w.samples[0], w.samples[len(w.samples)-1]
+    d := last.dropped - first.dropped
+    total := d + last.delivered - first.delivered
+    if total == 0 {
+        return 0
+    }
+    return float64(d) / float64(total)
+}
+
+// adapter decides a client's level from samples of its drop and delivery
+// counters. It holds no locks; only the pacing goroutine uses it.
+type adapter struct {
+    dropWindow
+    level      int
+    changed    time.Time
+    cleanSince time.Time
+}
+
+// record adds a sample of the counters taken at now, forgetting those
+// older than adaptWindow.
+func (a *adapter) record(now time.Time, dropped, delivered uint64) {
+    if n := len(a.samples); a.cleanSince.IsZero() || n > 0 && dropped > a.samples[n-1].dropped {
+        a.cleanSince = now
+    }
+    a.add(adaptSample{now, dropped, delivered})
+}
+
+// decide moves one level down when the window's drop rate is over
+// adaptThreshold, or one up after adaptRecover without drops, and
+// reports whether the level changed.
+func (a *adapter) decide(now time.Time) bool {
+    // After a change, give the new level a full window before judging.
+    if now.Sub(a.changed) < adaptWindow {
+        return false
+    }
+    switch {
+    case a.dropRate() > adaptThreshold && a.level < len(adaptLevels)-1:
+        a.level++
+    case a.level > 0 && now.Sub(a.cleanSince) >= adaptRecover:
+        a.level--
+        a.cleanSince = now
+    default:
+        return false
+    }
+    a.changed = now
+    // Counts from the old level say nothing about the new one.
+    a.samples = a.samples[len(a.samples)-1:]
+    return true
+}
+
+// paceLoop is the client's pacing goroutine. It moves the client between
+// adaptLevels when adaptive quality is on and the stream is JPEG, and
+// reports the outcome in a stats message every adaptWindow either way.
+// With slow_client_policy disconnect it also closes a client that stays
+// slow for slow_client_timeout.
+func (c *client) paceLoop(ctx context.Context, sub *hub.Subscriber) {
+    tick := time.NewTicker(adaptTick)
+    defer tick.Stop()
+    var (
+        a        adapter
+        slow     = newSlowWatch()
+        slowFor  time.Duration
+        lastSent time.Time
+        // deltaFull and deltaSent are the client's delta counters when
+        // the last stats were sent.
+        deltaFull, deltaSent uint64
+    )
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-tick.C:
+            if c.replaying.Load() {
+                continue // drops are not settled until the replay ends
+            }
+            dropped, delivered := sub.Dropped()-c.excused.Load(), c.delivered.Load()
+            a.record(now, dropped, delivered)
+            var expired bool
+            slowFor, expired = slow.observe(now, dropped, delivered)
+            if expired && cfg.SlowPolicy == config.SlowDisconnect {
+                c.kick(slow.dropRate())
+                return
+            }
+            if cfg.AdaptiveQuality && c.stream.JPEG() && a.decide(now) {
+                c.mu.Lock()
+                c.level = a.level
+                c.mu.Unlock()
+                c.log.Debug("adaptive level changed", "level", a.level, "drop_rate", a.dropRate())
+            }
+            if now.Sub(lastSent) < adaptWindow {
+                continue
+            }
+            lastSent = now
+            c.mu.Lock()
+            lvl := adaptLevels[c.level]
+            q := lvl.quality(c.baseQuality())
+            c.mu.Unlock()
+            stats := protocol.NewStats(a.level, q, lvl.divisor, slow.dropRate())
+            if cfg.SlowPolicy == config.SlowDisconnect {
+                stats.SlowFor = slowFor.Seconds()
+            }
+            if full, sent := c.deltaFull.Load(), c.deltaSent.Load(); full > deltaFull {
+                saving := 1 - float64(sent-deltaSent)/float64(full-deltaFull)
+                stats.DeltaSaving = &saving
+                deltaFull, deltaSent = full, sent
+            }
+            stats.Latency = c.lat.snapshot()
+            // A stats message can wait for the next window; the slow
+            // client check cannot wait for a stalled frame write.
+            if err := c.tryWriteJSON(stats); err != nil {
+                return
+            }
+        }
+    }
+}
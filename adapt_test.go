@@ -0,0 +1,129 @@
+package main
+
+import (
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/encode"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/gorilla/websocket"
+)
+
+// wsPair returns the two ends of a websocket connection, the server's
+// first.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+    t.Helper()
+    conns := make(chan *websocket.Conn, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        conns <- conn
+    }))
+    t.Cleanup(srv.Close)
+    far := dialWS(t, srv, "/")
+    near := <-conns
+    t.Cleanup(func() { near.Close() })
+    return near, far
+}
+
+// testJPEG is a synthetic frame encoded as the hub would.
+func testJPEG(t *testing.T, width, height int) capture.Frame {
+    t.Helper()
+    src := capture.NewSyntheticSource(width, height, 1000)
+    if err := src.Open("synthetic"); err != nil {
+        t.Fatal(err)
+    }
+    defer src.Close()
+    raw, err := src.ReadFrame()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer raw.Release()
+    f, err := encode.NewJPEGEncoder().Encode(raw, 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Data = append([]byte(nil), f.Data...)
+    f.Buf.Release()
+    f.Buf = nil
+    return f
+}
+
+// A client stepped down to an adaptive level that halves its frame rate
+// has frames dropped before the writer too, since it is slow. The frames
+// it is sent stay evenly spaced by capture time rather than by how many
+// happened to survive.
+func TestAdaptiveDivisorSpacingWithSlowWriter(t *testing.T) {
+    setupServer(t, config.Default())
+    st := addStream(t, "default", nil, nil)
+    near, far := wsPair(t)
+    c := &client{stream: st, conn: near, log: slog.Default(), version: protocol.V1}
+    const level = 3 // half the frames
+    c.level = level
+    divisor := adaptLevels[level].divisor
+    sub := st.Hub.Subscribe(0)
+    defer st.Hub.Unsubscribe(sub)
+
+    const (
+        frames   = 300
+        interval = time.Second / 30
+    )
+    // The hub drops frames for a slow writer whenever its queue is full:
+    // here one in three or four, never two in a row.
+    dropped := func(seq uint64) bool { return seq%7 == 3 || seq%7 == 6 }
+    received := make(chan time.Time, frames)
+    go func() {
+        defer close(received)
+        for {
+            _, data, err := far.ReadMessage()
+            if err != nil {
+                return
+            }
+            h, _, err := protocol.DecodeFrame(data)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            received <- time.UnixMicro(h.Timestamp)
+        }
+    }()
+
+    jpeg := testJPEG(t, 64, 36)
+    start := time.Unix(1_700_000_000, 0)
+    for seq := uint64(1); seq <= frames; seq++ {
+        if dropped(seq) {
+            continue
+        }
+        f := &hub.Frame{Frame: jpeg, Seq: seq}
+        f.Timestamp = start.Add(time.Duration(seq) * interval)
+        if err := c.writeFrame(sub, f); err != nil {
+            t.Fatal(err)
+        }
+    }
+    near.Close()
+
+    var times []time.Time
+    for ts := range received {
+        times = append(times, ts)
+    }
+    if len(times) < frames/(divisor+1) {
+        t.Fatalf("%d frames sent of %d", len(times), frames)
+    }
+    // Every gap is the divisor's worth of source frames, or one more
+    // where the frame due was dropped; never fewer, which would bunch.
+    lo, hi := time.Duration(divisor)*interval-interval/2, time.Duration(divisor+1)*interval+interval/2
+    for i := 1; i < len(times); i++ {
+        if gap := times[i].Sub(times[i-1]); gap < lo || gap > hi {
+            t.Errorf("frames %d and %d are %v apart, want %v to %v", i-1, i, gap, lo, hi)
+        }
+    }
+}
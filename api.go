@@ -0,0 +1,153 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "log/slog"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/audit"
+    "github.com/Cdaprod/hdmi-streaming-app/auth"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+// auditLog records the API calls that change something.
+var auditLog *audit.Log
+
+// writeJSON sends v with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+type apiError struct {
+    Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+    writeJSON(w, code, apiError{Error: msg})
+}
+
+// apiHandler is an API handler and the least role whose tokens may call
+// it.
+type apiHandler struct {
+    role string
+    h    http.HandlerFunc
+}
+
+// api wraps an API handler with the token and role checks and a method
+// guard.
+func api(method, role string, h http.HandlerFunc) http.HandlerFunc {
+    return apiMethods(map[string]apiHandler{method: {role, h}})
+}
+
+// apiMethods is api for an endpoint with a handler per method. API
+// endpoints answer CORS requests from the cors_origins. Calls that can
+// change something, those beyond a viewer's role with a method other
+// than GET, are written to the audit log whether or not they are
+// allowed; only an allowed call's body is read, to be digested.
+func apiMethods(handlers map[string]apiHandler) http.HandlerFunc {
+    allowed := make([]string, 0, len(handlers))
+    for m := range handlers {
+        allowed = append(allowed, m)
+    }
+    sort.Strings(allowed)
+    allow := strings.Join(allowed, ", ")
+    return withCORS(func(w http.ResponseWriter, r *http.Request) {
+        h, ok := handlers[r.Method]
+        if !ok {
+            w.Header().Set("Allow", allow)
+            writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        var entry *audit.Entry
+        if r.Method != http.MethodGet && r.Method != http.MethodHead && h.role != config.RoleViewer {
+            sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+            entry, w = &audit.Entry{}, sw
+            defer func() {
+                entry.Status = sw.status
+                if err := auditLog.Write(*entry); err != nil {
+                    slog.Error("audit log write failed", "err", err)
+                }
+            }()
+            startAudit(r, entry)
+        }
+        tok, err := authn.Authenticate(r)
+        if err != nil {
+            writeError(w, http.StatusForbidden, err.Error())
+            return
+        }
+        if entry != nil && authn.TokensRequired() {
+            entry.Token, entry.Role = tok.ID, auth.Role(tok)
+        }
+        if !authn.Permits(tok, h.role) {
+            writeError(w, http.StatusForbidden, "requires the "+h.role+" role")
+            return
+        }
+        // The body is only read, to be digested, once the caller is known
+        // to be allowed it.
+        if entry != nil && !digestBody(w, r, entry) {
+            return
+        }
+        h.h(w, r)
+    })
+}
+
+// permit refuses a request from tok with 403, naming role, if tok's
+// role does not include it. It is the role check of api for endpoints
+// that answer in plain text rather than JSON.
+func permit(w http.ResponseWriter, tok config.Token, role string) bool {
+    if !authn.Permits(tok, role) {
+        http.Error(w, "requires the "+role+" role", http.StatusForbidden)
+        return false
+    }
+    return true
+}
+
+// maxAPIBody bounds the request bodies of audited calls, which are read
+// whole to be digested.
+const maxAPIBody = 1 << 20
+
+// startAudit fills in entry for r.
+func startAudit(r *http.Request, entry *audit.Entry) {
+    *entry = audit.Entry{
+        Time:   time.Now().UTC(),
+        Remote: limiter.ClientIP(r),
+        Method: r.Method,
+        Route:  r.URL.Path,
+    }
+}
+
+// digestBody adds r's body to entry as a digest, leaving it to be read
+// again. A body that cannot be read is refused.
+func digestBody(w http.ResponseWriter, r *http.Request, entry *audit.Entry) bool {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBody))
+    if err != nil {
+        writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+        return false
+    }
+    if len(body) > 0 {
+        sum := sha256.Sum256(body)
+        entry.BodySHA256 = hex.EncodeToString(sum[:])
+    }
+    r.Body = io.NopCloser(bytes.NewReader(body))
+    return true
+}
+
+// statusWriter remembers the status code written through it.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+    w.status = code
+    w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,71 @@
+// Package audit keeps an append-only record of the API calls that
+// change the server's state: who made each one, from where, and what
+// they sent.
+//
+// Entries are JSON lines. Request bodies are not kept, since they may
+// hold stream keys, only a SHA-256 digest to match a body against.
+package audit
+
+import (
+    "encoding/json"
+    "os"
+    "sync"
+    "time"
+)
+
+// Entry is one API call.
+type Entry struct {
+    Time   time.Time `json:"time"`
+    Token  string    `json:"token,omitempty"`
+    Role   string    `json:"role,omitempty"`
+    Remote string    `json:"remote"`
+    Method string    `json:"method"`
+    Route  string    `json:"route"`
+    Status int       `json:"status"`
+    // BodySHA256 is the hex digest of the request body, empty for none.
+    BodySHA256 string `json:"body_sha256,omitempty"`
+}
+
+// Log appends entries to a file. A nil Log records nothing.
+type Log struct {
+    mu sync.Mutex
+    f  *os.File
+}
+
+// Open opens path for appending, creating it readable only by its owner
+// if need be. An empty path returns a nil Log.
+func Open(path string) (*Log, error) {
+    if path == "" {
+        return nil, nil
+    }
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+    if err != nil {
+        return nil, err
+    }
+    return &Log{f: f}, nil
+}
+
+// Write appends e as one line. Each entry goes to the file in a single
+// write, so lines are whole even if the server dies mid-call.
+func (l *Log) Write(e Entry) error {
+    if l == nil {
+        return nil
+    }
+    line, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    _, err = l.f.Write(line)
+    return err
+}
+
+// Close closes the file.
+func (l *Log) Close() error {
+    if l == nil {
+        return nil
+    }
+    return l.f.Close()
+}
@@ -0,0 +1,163 @@
+// Package auth decides who may open the stream.
+package auth
+
+import (
+    "crypto/subtle"
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+var (
+    ErrMissingToken = errors.New("missing access token")
+    ErrInvalidToken = errors.New("invalid access token")
+    ErrExpiredToken = errors.New("access token expired")
+    ErrOrigin       = errors.New("origin not allowed")
+)
+
+// Authenticator checks request origins against an allowlist and access
+// tokens against those loaded at startup.
+type Authenticator struct {
+    // Host, when set, returns the host a request was addressed to, for
+    // the same-origin check behind a proxy that rewrites Host. By
+    // default it is the request's Host.
+    Host func(*http.Request) string
+
+    tokens  []config.Token
+    origins []string
+    now     func() time.Time
+}
+
+// New returns an Authenticator. With no tokens, token checks are disabled.
+// With no origins, only same-origin browser requests are accepted.
+func New(tokens []config.Token, allowedOrigins []string) *Authenticator {
+    return &Authenticator{tokens: tokens, origins: allowedOrigins, now: time.Now}
+}
+
+// TokensRequired reports whether requests must carry a token.
+func (a *Authenticator) TokensRequired() bool { return len(a.tokens) > 0 }
+
+// Check runs both the origin and the token check.
+func (a *Authenticator) Check(r *http.Request) (config.Token, error) {
+    if !a.CheckOrigin(r) {
+        return config.Token{}, ErrOrigin
+    }
+    return a.Authenticate(r)
+}
+
+// CheckOrigin reports whether the request's Origin header is allowed. It
+// has the signature websocket.Upgrader wants. Requests without an Origin
+// header come from non-browser clients and are let through.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    if err != nil || u.Host == "" {
+        return false
+    }
+    if len(a.origins) == 0 {
+        host := r.Host
+        if a.Host != nil {
+            host = a.Host(r)
+        }
+        return strings.EqualFold(u.Host, host)
+    }
+    return OriginAllowed(a.origins, u)
+}
+
+// OriginAllowed reports whether origin matches any of the patterns, as
+// allowed_origins entries are matched.
+func OriginAllowed(patterns []string, origin *url.URL) bool {
+    for _, pattern := range patterns {
+        if matchOrigin(pattern, origin) {
+            return true
+        }
+    }
+    return false
+}
+
+// matchOrigin compares an origin against one allowlist entry. Entries may
+// be a full origin ("https://a.example"), a host with or without port
+// ("a.example", "a.example:8443"), or a wildcard ("*.example") matching
+// any subdomain but not the bare domain.
+func matchOrigin(pattern string, origin *url.URL) bool {
+    pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+    if i := strings.Index(pattern, "://"); i >= 0 {
+        if pattern[:i] != strings.ToLower(origin.Scheme) {
+            return false
+        }
+        pattern = pattern[i+3:]
+    }
+    host := strings.ToLower(origin.Host)
+    if !strings.Contains(strings.TrimPrefix(pattern, "*."), ":") {
+        host = strings.ToLower(origin.Hostname())
+    }
+    if strings.HasPrefix(pattern, "*.") {
+        return strings.HasSuffix(host, pattern[1:])
+    }
+    return host == pattern
+}
+
+// Authenticate validates the token from the ?token= query parameter or an
+// "Authorization: Bearer" header.
+func (a *Authenticator) Authenticate(r *http.Request) (config.Token, error) {
+    if !a.TokensRequired() {
+        return config.Token{}, nil
+    }
+    secret := r.URL.Query().Get("token")
+    if h := r.Header.Get("Authorization"); secret == "" && h != "" {
+        if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+            secret = strings.TrimSpace(h[7:])
+        }
+    }
+    return a.Verify(secret)
+}
+
+// Role returns tok's role, RoleViewer when it has none.
+func Role(tok config.Token) string {
+    if tok.Role == "" {
+        return config.RoleViewer
+    }
+    return tok.Role
+}
+
+var roleRank = map[string]int{
+    config.RoleViewer:   0,
+    config.RoleOperator: 1,
+    config.RoleAdmin:    2,
+}
+
+// Permits reports whether tok's role includes role. Without tokens
+// anyone may do anything, as anyone may watch.
+func (a *Authenticator) Permits(tok config.Token, role string) bool {
+    if !a.TokensRequired() {
+        return true
+    }
+    return roleRank[Role(tok)] >= roleRank[role]
+}
+
+// Verify checks a token secret obtained some other way, such as from an
+// RTSP URL's password.
+func (a *Authenticator) Verify(secret string) (config.Token, error) {
+    if !a.TokensRequired() {
+        return config.Token{}, nil
+    }
+    if secret == "" {
+        return config.Token{}, ErrMissingToken
+    }
+    for _, t := range a.tokens {
+        if subtle.ConstantTimeCompare([]byte(t.Secret), []byte(secret)) == 1 {
+            if !t.Expires.IsZero() && !a.now().Before(t.Expires) {
+                return config.Token{}, ErrExpiredToken
+            }
+            return t, nil
+        }
+    }
+    return config.Token{}, ErrInvalidToken
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+var epoch = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestAuthenticate(t *testing.T) {
+    a := New([]config.Token{
+        {ID: "kiosk", Secret: "s3cret"},
+        {ID: "guest", Secret: "temp", Expires: epoch.Add(time.Hour)},
+    }, nil)
+    a.now = func() time.Time { return epoch }
+
+    for _, tc := range []struct {
+        name   string
+        target string
+        header string
+        id     string
+        err    error
+    }{
+        {name: "missing", target: "/ws", err: ErrMissingToken},
+        {name: "empty query", target: "/ws?token=", err: ErrMissingToken},
+        {name: "not bearer", target: "/ws", header: "Basic s3cret", err: ErrMissingToken},
+        {name: "wrong", target: "/ws?token=nope", err: ErrInvalidToken},
+        {name: "query", target: "/ws?token=s3cret", id: "kiosk"},
+        {name: "bearer", target: "/ws", header: "Bearer s3cret", id: "kiosk"},
+        {name: "bearer any case", target: "/ws", header: "bearer  s3cret ", id: "kiosk"},
+        {name: "not yet expired", target: "/ws?token=temp", id: "guest"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+            if tc.header != "" {
+                r.Header.Set("Authorization", tc.header)
+            }
+            tok, err := a.Authenticate(r)
+            if !errors.Is(err, tc.err) {
+                t.Fatalf("err = %v, want %v", err, tc.err)
+            }
+            if tok.ID != tc.id {
+                t.Errorf("token %q, want %q", tok.ID, tc.id)
+            }
+        })
+    }
+}
+
+func TestExpiredToken(t *testing.T) {
+    now := epoch
+    a := New([]config.Token{{ID: "guest", Secret: "temp", Expires: epoch.Add(time.Hour)}}, nil)
+    a.now = func() time.Time { return now }
+    if _, err := a.Verify("temp"); err != nil {
+        t.Fatalf("before expiry: %v", err)
+    }
+    for _, at := range []time.Duration{time.Hour, time.Hour + time.Second, 48 * time.Hour} {
+        now = epoch.Add(at)
+        if _, err := a.Verify("temp"); !errors.Is(err, ErrExpiredToken) {
+            t.Errorf("%v after issue: err = %v, want ErrExpiredToken", at, err)
+        }
+    }
+}
+
+func TestNoTokensConfigured(t *testing.T) {
+    a := New(nil, nil)
+    if a.TokensRequired() {
+        t.Fatal("tokens required without any configured")
+    }
+    if _, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/ws", nil)); err != nil {
+        t.Errorf("err = %v", err)
+    }
+    if !a.Permits(config.Token{}, config.RoleAdmin) {
+        t.Error("anonymous request refused without tokens")
+    }
+}
+
+func TestCheckOrigin(t *testing.T) {
+    for _, tc := range []struct {
+        name    string
+        allowed []string
+        host    string
+        origin  string
+        ok      bool
+    }{
+        {name: "no origin header", host: "cam.local:8080", ok: true},
+        {name: "same origin", host: "cam.local:8080", origin: "http://cam.local:8080", ok: true},
+        {name: "same origin any case", host: "CAM.local:8080", origin: "http://cam.LOCAL:8080", ok: true},
+        {name: "other host, empty allowlist", host: "cam.local:8080", origin: "http://evil.example"},
+        {name: "other port, empty allowlist", host: "cam.local:8080", origin: "http://cam.local:9090"},
+        {name: "garbage", host: "cam.local", origin: "::not a url"},
+        {name: "null origin", host: "cam.local", origin: "null"},
+        {name: "listed origin", allowed: []string{"https://app.example"}, host: "cam.local", origin: "https://app.example", ok: true},
+        {name: "wrong scheme", allowed: []string{"https://app.example"}, host: "cam.local", origin: "http://app.example"},
+        {name: "listed host any port", allowed: []string{"app.example"}, host: "cam.local", origin: "https://app.example:8443", ok: true},
+        {name: "listed host and port", allowed: []string{"app.example:8443"}, host: "cam.local", origin: "https://app.example:9443"},
+        {name: "wildcard subdomain", allowed: []string{"*.example"}, host: "cam.local", origin: "https://a.b.example", ok: true},
+        {name: "wildcard bare domain", allowed: []string{"*.example"}, host: "cam.local", origin: "https://example"},
+        {name: "wildcard suffix trick", allowed: []string{"*.example"}, host: "cam.local", origin: "https://evilexample"},
+        // An allowlist replaces the same-origin rule.
+        {name: "same origin not listed", allowed: []string{"app.example"}, host: "cam.local", origin: "http://cam.local"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            a := New(nil, tc.allowed)
+            r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+            r.Host = tc.host
+            if tc.origin != "" {
+                r.Header.Set("Origin", tc.origin)
+            }
+            if got := a.CheckOrigin(r); got != tc.ok {
+                t.Errorf("CheckOrigin = %v, want %v", got, tc.ok)
+            }
+        })
+    }
+}
+
+func TestCheckOriginBehindProxy(t *testing.T) {
+    a := New(nil, nil)
+    a.Host = func(r *http.Request) string { return r.Header.Get("X-Forwarded-Host") }
+    r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+    r.Host = "127.0.0.1:8080"
+    r.Header.Set("X-Forwarded-Host", "cam.example")
+    r.Header.Set("Origin", "https://cam.example")
+    if !a.CheckOrigin(r) {
+        t.Error("forwarded host not used")
+    }
+}
+
+func TestCheckWrongOrigin(t *testing.T) {
+    a := New([]config.Token{{Secret: "s3cret"}}, []string{"app.example"})
+    r := httptest.NewRequest(http.MethodGet, "/ws?token=s3cret", nil)
+    r.Header.Set("Origin", "https://evil.example")
+    if _, err := a.Check(r); !errors.Is(err, ErrOrigin) {
+        t.Errorf("err = %v, want ErrOrigin", err)
+    }
+    r.Header.Set("Origin", "https://app.example")
+    if _, err := a.Check(r); err != nil {
+        t.Errorf("allowed origin: %v", err)
+    }
+}
+
+func TestPermits(t *testing.T) {
+    a := New([]config.Token{{Secret: "x"}}, nil)
+    for _, tc := range []struct {
+        role, need string
+        ok         bool
+    }{
+        {"", config.RoleViewer, true},
+        {"", config.RoleOperator, false},
+        {config.RoleOperator, config.RoleViewer, true},
+        {config.RoleOperator, config.RoleAdmin, false},
+        {config.RoleAdmin, config.RoleOperator, true},
+    } {
+        if got := a.Permits(config.Token{Role: tc.role}, tc.need); got != tc.ok {
+            t.Errorf("role %q for %s: %v, want %v", tc.role, tc.need, got, tc.ok)
+        }
+    }
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package capture
+
+import "time"
+
+// ALSASource is only functional on Linux.
+type ALSASource struct {
+    Rate     int
+    Channels int
+    Period   time.Duration
+    Command  string
+}
+
+func NewALSASource(rate, channels int) *ALSASource {
+    return &ALSASource{Rate: rate, Channels: channels, Period: 20 * time.Millisecond, Command: "arecord"}
+}
+
+func (s *ALSASource) Open(device string) error { return ErrUnsupported }
+
+func (s *ALSASource) ReadChunk() (AudioChunk, error) { return AudioChunk{}, ErrNotOpen }
+
+func (s *ALSASource) Close() error { return nil }
@@ -0,0 +1,29 @@
+package capture
+
+import "time"
+
+// AudioChunk is a run of interleaved signed 16-bit little-endian PCM
+// samples. Timestamp is when the first sample was captured, on the same
+// wall clock as Frame.Timestamp so the two streams can be synchronised.
+type AudioChunk struct {
+    Data      []byte
+    Rate      int
+    Channels  int
+    Timestamp time.Time
+}
+
+// Duration reports how much time the chunk covers.
+func (c AudioChunk) Duration() time.Duration {
+    if c.Rate <= 0 || c.Channels <= 0 {
+        return 0
+    }
+    samples := len(c.Data) / (2 * c.Channels)
+    return time.Duration(samples) * time.Second / time.Duration(c.Rate)
+}
+
+// AudioSource is a device that produces audio.
+type AudioSource interface {
+    Open(device string) error
+    ReadChunk() (AudioChunk, error)
+    Close() error
+}
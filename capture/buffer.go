@@ -0,0 +1,86 @@
+package capture
+
+import (
+    "sync"
+    "sync/atomic"
+)
+
+// FrameBuffer holds the bytes of a frame on their way from the device to
+// every viewer. One buffer is shared by all of them rather than copied:
+// each holder of the frame owns a reference, and the buffer goes back to
+// a pool when the last one is released.
+//
+// A frame's Data must not be used after its holder has called Release,
+// since the memory may already belong to a later frame.
+type FrameBuffer struct {
+    b    []byte
+    refs atomic.Int32
+}
+
+var (
+    bufferPool = sync.Pool{New: func() any { return new(FrameBuffer) }}
+    // buffersInUse counts buffers taken from the pool and not yet
+    // returned, so leaks show up in metrics and tests.
+    buffersInUse atomic.Int64
+)
+
+// NewFrameBuffer returns a buffer of n bytes with one reference, reusing
+// pooled memory where it is large enough.
+func NewFrameBuffer(n int) *FrameBuffer {
+    fb := bufferPool.Get().(*FrameBuffer)
+    if cap(fb.b) < n {
+        fb.b = make([]byte, n)
+    }
+    fb.b = fb.b[:n]
+    fb.refs.Store(1)
+    buffersInUse.Add(1)
+    return fb
+}
+
+// Bytes returns the buffer's contents.
+func (fb *FrameBuffer) Bytes() []byte { return fb.b }
+
+// Write appends p, growing the buffer as needed, so an encoder can write
+// its output straight into a buffer from NewFrameBuffer(0).
+func (fb *FrameBuffer) Write(p []byte) (int, error) {
+    fb.b = append(fb.b, p...)
+    return len(p), nil
+}
+
+// Retain adds a reference.
+func (fb *FrameBuffer) Retain() {
+    if fb.refs.Add(1) <= 1 {
+        panic("capture: FrameBuffer retained after release")
+    }
+}
+
+// Release drops a reference, returning the buffer to the pool with the
+// last one.
+func (fb *FrameBuffer) Release() {
+    switch n := fb.refs.Add(-1); {
+    case n == 0:
+        buffersInUse.Add(-1)
+        bufferPool.Put(fb)
+    case n < 0:
+        panic("capture: FrameBuffer released too often")
+    }
+}
+
+// BuffersInUse reports how many frame buffers are held outside the pool.
+func BuffersInUse() int64 { return buffersInUse.Load() }
+
+// Retain adds a reference to the frame's buffer, for a holder that keeps
+// the frame beyond the call that handed it over. Frames without a buffer
+// are left to the garbage collector and need no counting.
+func (f Frame) Retain() {
+    if f.Buf != nil {
+        f.Buf.Retain()
+    }
+}
+
+// Release gives up the holder's reference to the frame's buffer.
+func (f Frame) Release() {
+    if f.Buf != nil {
+        f.Buf.Release()
+    }
+}
@@ -0,0 +1,126 @@
+package capture
+
+import (
+    "bytes"
+    "sync"
+    "testing"
+)
+
+func TestFrameBufferSharedAcrossGoroutines(t *testing.T) {
+    const (
+        holders = 16
+        rounds  = 200
+    )
+    before := BuffersInUse()
+    for r := 0; r < rounds; r++ {
+        fb := NewFrameBuffer(0)
+        fb.Write([]byte{byte(r), 1, 2, 3})
+        f := Frame{Data: fb.Bytes(), Buf: fb}
+        var wg sync.WaitGroup
+        bad := make(chan []byte, holders)
+        for i := 0; i < holders; i++ {
+            // Each holder takes its reference before the frame is handed
+            // over, as the hub does for every subscriber.
+            f.Retain()
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                defer f.Release()
+                if !bytes.Equal(f.Data, []byte{byte(r), 1, 2, 3}) {
+                    bad <- append([]byte(nil), f.Data...)
+                }
+            }()
+        }
+        f.Release()
+        wg.Wait()
+        close(bad)
+        for data := range bad {
+            t.Fatalf("round %d: a holder saw %v", r, data)
+        }
+    }
+    if n := BuffersInUse() - before; n != 0 {
+        t.Errorf("%d buffers still in use after every holder released", n)
+    }
+}
+
+func TestFrameBufferReuse(t *testing.T) {
+    fb := NewFrameBuffer(64)
+    if n := len(fb.Bytes()); n != 64 {
+        t.Fatalf("new buffer is %d bytes, want 64", n)
+    }
+    fb.Release()
+
+    // A pooled buffer comes back at the length asked for, whatever it
+    // held before.
+    fb = NewFrameBuffer(8)
+    defer fb.Release()
+    if n := len(fb.Bytes()); n != 8 {
+        t.Errorf("reused buffer is %d bytes, want 8", n)
+    }
+}
+
+func TestFrameBufferMisuse(t *testing.T) {
+    for _, tc := range []struct {
+        name string
+        fn   func(*FrameBuffer)
+    }{
+        {"released twice", func(fb *FrameBuffer) { fb.Release(); fb.Release() }},
+        {"retained after release", func(fb *FrameBuffer) { fb.Release(); fb.Retain() }},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            fb := NewFrameBuffer(0)
+            defer func() {
+                if recover() == nil {
+                    t.Error("no panic")
+                }
+            }()
+            tc.fn(fb)
+        })
+    }
+}
+
+// BenchmarkFanOut hands a 1080p JPEG's worth of bytes to several
+// viewers, by copying it for each as frames once were and by sharing one
+// pooled buffer.
+func BenchmarkFanOut(b *testing.B) {
+    const (
+        size    = 400 << 10
+        viewers = 8
+    )
+    src := bytes.Repeat([]byte{0xAB}, size)
+    sink := make(chan []byte, viewers)
+    b.Run("copy", func(b *testing.B) {
+        b.ReportAllocs()
+        b.SetBytes(size)
+        for i := 0; i < b.N; i++ {
+            data := make([]byte, size)
+            copy(data, src)
+            for v := 0; v < viewers; v++ {
+                own := make([]byte, len(data))
+                copy(own, data)
+                sink <- own
+            }
+            for v := 0; v < viewers; v++ {
+                <-sink
+            }
+        }
+    })
+    b.Run("shared", func(b *testing.B) {
+        b.ReportAllocs()
+        b.SetBytes(size)
+        for i := 0; i < b.N; i++ {
+            fb := NewFrameBuffer(size)
+            copy(fb.Bytes(), src)
+            f := Frame{Data: fb.Bytes(), Buf: fb}
+            for v := 0; v < viewers; v++ {
+                f.Retain()
+                sink <- f.Data
+            }
+            f.Release()
+            for v := 0; v < viewers; v++ {
+                <-sink
+                f.Release()
+            }
+        }
+    })
+}
@@ -0,0 +1,91 @@
+// Package capture reads video frames and audio from HDMI capture hardware.
+package capture
+
+import (
+    "errors"
+    "fmt"
+    "time"
+)
+
+// PixelFormat identifies how the bytes in a Frame are laid out.
+type PixelFormat int
+
+const (
+    FormatMJPEG PixelFormat = iota
+    FormatYUYV
+    // FormatH264 is Annex-B H.264, one access unit per frame. Devices do
+    // not deliver it; the hardware encoder in package encode produces it.
+    FormatH264
+)
+
+func (f PixelFormat) String() string {
+    switch f {
+    case FormatMJPEG:
+        return "MJPEG"
+    case FormatYUYV:
+        return "YUYV"
+    case FormatH264:
+        return "H264"
+    }
+    return fmt.Sprintf("PixelFormat(%d)", int(f))
+}
+
+// Frame is a single image read from a capture device.
+type Frame struct {
+    Data      []byte
+    Format    PixelFormat
+    Width     int
+    Height    int
+    Timestamp time.Time
+    // Key marks an H.264 frame a decoder can start from. Frames in other
+    // formats stand alone and leave it unset.
+    Key bool
+    // Placeholder marks a frame the server generated to stand in for
+    // the device's while it has no input signal.
+    Placeholder bool
+    // Buf, when set, is the pooled buffer Data lives in and must be
+    // released by whoever holds the frame last; see FrameBuffer.
+    Buf *FrameBuffer
+}
+
+// CaptureSource is a device that produces video frames. The caller of
+// ReadFrame owns the frame and releases it.
+type CaptureSource interface {
+    Open(devicePath string) error
+    ReadFrame() (Frame, error)
+    Close() error
+}
+
+var (
+    // ErrNotOpen is returned by ReadFrame when the source has not been opened.
+    ErrNotOpen = errors.New("capture: device not open")
+    // ErrTimeout is returned by ReadFrame when no frame arrived in time.
+    // The device is still usable and the caller may simply retry.
+    ErrTimeout = errors.New("capture: timed out waiting for frame")
+    // ErrNoSignal is wrapped by errors that mean the device is there but
+    // its input, such as the HDMI source, is not. Like ErrTimeout it
+    // leaves the source open, and ReadFrame may be called again.
+    ErrNoSignal = errors.New("capture: no input signal")
+    // ErrUnsupported is returned by sources that cannot run on this platform.
+    ErrUnsupported = errors.New("capture: not supported on this platform")
+)
+
+// DeviceLostError reports that the device went away while it was open,
+// typically because the capture card was unplugged. The source must be
+// closed and reopened before it can deliver frames again.
+type DeviceLostError struct {
+    Device string
+    Err    error
+}
+
+func (e *DeviceLostError) Error() string {
+    return fmt.Sprintf("capture: device %s lost: %v", e.Device, e.Err)
+}
+
+func (e *DeviceLostError) Unwrap() error { return e.Err }
+
+// IsDeviceLost reports whether err means the device has to be reopened.
+func IsDeviceLost(err error) bool {
+    var lost *DeviceLostError
+    return errors.As(err, &lost)
+}
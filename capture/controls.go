@@ -0,0 +1,215 @@
+package capture
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Control is an adjustable device setting such as brightness or the
+// selected input.
+type Control struct {
+    ID       uint32     `json:"id"`
+    Name     string     `json:"name"`
+    Type     string     `json:"type"` // integer, boolean, menu, integer_menu or button
+    Min      int64      `json:"min"`
+    Max      int64      `json:"max"`
+    Step     int64      `json:"step"`
+    Default  int64      `json:"default"`
+    Value    int64      `json:"value"`
+    Menu     []MenuItem `json:"menu,omitempty"`
+    ReadOnly bool       `json:"read_only,omitempty"`
+    // Inactive controls exist but are currently ignored by the driver,
+    // such as manual exposure while auto exposure is on.
+    Inactive bool `json:"inactive,omitempty"`
+}
+
+// MenuItem is one choice of a menu control.
+type MenuItem struct {
+    Index int64  `json:"index"`
+    Name  string `json:"name"`
+}
+
+// ControlDevice is the ioctl layer a ControlSet talks to, kept behind an
+// interface so it can be faked without hardware.
+type ControlDevice interface {
+    // QueryControls lists the controls with their current values.
+    QueryControls() ([]Control, error)
+    SetControl(c Control, value int64) error
+    Close() error
+}
+
+// UnknownControlError reports a control name the device does not have.
+type UnknownControlError struct {
+    Name  string
+    Valid []string
+}
+
+func (e *UnknownControlError) Error() string {
+    return fmt.Sprintf("capture: unknown control %q (valid: %s)", e.Name, strings.Join(e.Valid, ", "))
+}
+
+// ControlValueError reports a value a control cannot take.
+type ControlValueError struct {
+    Name   string
+    Value  int64
+    Reason string
+}
+
+func (e *ControlValueError) Error() string {
+    return fmt.Sprintf("capture: control %s: invalid value %d: %s", e.Name, e.Value, e.Reason)
+}
+
+// ControlSet reads and changes the controls of the device at Device.
+// Each call opens the device node for just as long as it needs, so it
+// works whether or not the capture loop has the device streaming.
+type ControlSet struct {
+    Device string
+    Open   func(device string) (ControlDevice, error)
+
+    // applied holds every value Set has changed, for Reapply.
+    mu      sync.Mutex
+    applied map[string]int64
+}
+
+// NewControlSet returns a ControlSet using V4L2.
+func NewControlSet(device string) *ControlSet {
+    return &ControlSet{Device: device, Open: OpenV4L2Controls}
+}
+
+// List returns the device's controls.
+func (s *ControlSet) List() ([]Control, error) {
+    dev, err := s.Open(s.Device)
+    if err != nil {
+        return nil, err
+    }
+    defer dev.Close()
+    return dev.QueryControls()
+}
+
+// Set applies values by control name and returns the controls as they
+// are afterwards. Every name and value is checked before anything is
+// changed, so a bad request changes nothing.
+func (s *ControlSet) Set(values map[string]int64) ([]Control, error) {
+    dev, err := s.Open(s.Device)
+    if err != nil {
+        return nil, err
+    }
+    defer dev.Close()
+    controls, err := dev.QueryControls()
+    if err != nil {
+        return nil, err
+    }
+    byName := make(map[string]Control, len(controls))
+    for _, c := range controls {
+        byName[c.Name] = c
+    }
+
+    names := make([]string, 0, len(values))
+    for name := range values {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        c, ok := byName[name]
+        if !ok {
+            valid := make([]string, 0, len(controls))
+            for _, c := range controls {
+                valid = append(valid, c.Name)
+            }
+            return nil, &UnknownControlError{Name: name, Valid: valid}
+        }
+        if err := c.check(values[name]); err != nil {
+            return nil, err
+        }
+    }
+    for _, name := range names {
+        if err := dev.SetControl(byName[name], values[name]); err != nil {
+            return nil, fmt.Errorf("capture: setting %s: %w", name, err)
+        }
+        if byName[name].Type == "button" {
+            continue // pressed once, not a setting
+        }
+        s.mu.Lock()
+        if s.applied == nil {
+            s.applied = make(map[string]int64)
+        }
+        s.applied[name] = values[name]
+        s.mu.Unlock()
+    }
+    return dev.QueryControls()
+}
+
+// Reapply sets again every value Set has changed, for a device that was
+// unplugged and has come back with its defaults.
+func (s *ControlSet) Reapply() error {
+    s.mu.Lock()
+    values := make(map[string]int64, len(s.applied))
+    for name, v := range s.applied {
+        values[name] = v
+    }
+    s.mu.Unlock()
+    if len(values) == 0 {
+        return nil
+    }
+    _, err := s.Set(values)
+    return err
+}
+
+func (c Control) check(v int64) error {
+    if c.ReadOnly {
+        return &ControlValueError{c.Name, v, "control is read-only"}
+    }
+    if v < c.Min || v > c.Max {
+        return &ControlValueError{c.Name, v, fmt.Sprintf("must be between %d and %d", c.Min, c.Max)}
+    }
+    if len(c.Menu) > 0 {
+        for _, m := range c.Menu {
+            if m.Index == v {
+                return nil
+            }
+        }
+        return &ControlValueError{c.Name, v, "not a menu index"}
+    }
+    if c.Step > 1 && (v-c.Min)%c.Step != 0 {
+        return &ControlValueError{c.Name, v, fmt.Sprintf("must be a multiple of %d from %d", c.Step, c.Min)}
+    }
+    return nil
+}
+
+// ControlName turns a driver's control label into the name used by the
+// API, the same way v4l2-ctl does: "White Balance Temperature, Auto"
+// becomes "white_balance_temperature_auto".
+func ControlName(label string) string {
+    var b strings.Builder
+    under := false
+    for _, r := range strings.ToLower(label) {
+        if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+            if under && b.Len() > 0 {
+                b.WriteByte('_')
+            }
+            b.WriteRune(r)
+            under = false
+        } else {
+            under = true
+        }
+    }
+    return b.String()
+}
+
+// Mode is the capture format chosen when the device is opened. Changing
+// it means reopening the device.
+type Mode struct {
+    Width  int         `json:"width"`
+    Height int         `json:"height"`
+    FPS    int         `json:"fps"`
+    Format PixelFormat `json:"-"`
+}
+
+// ModeSetter is implemented by sources whose capture format can be
+// changed for the next Open.
+type ModeSetter interface {
+    Mode() Mode
+    SetMode(Mode)
+}
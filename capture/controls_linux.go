@@ -0,0 +1,230 @@
+//go:build linux
+
+package capture
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+// Control ioctls from linux/videodev2.h. Only the single-value
+// VIDIOC_G_CTRL/S_CTRL pair is used, so 64-bit, string and compound
+// controls are left out of the list.
+
+const (
+    v4l2CtrlTypeInteger     = 1
+    v4l2CtrlTypeBoolean     = 2
+    v4l2CtrlTypeMenu        = 3
+    v4l2CtrlTypeButton      = 4
+    v4l2CtrlTypeIntegerMenu = 9
+
+    v4l2CtrlFlagDisabled  = 0x0001
+    v4l2CtrlFlagReadOnly  = 0x0004
+    v4l2CtrlFlagInactive  = 0x0010
+    v4l2CtrlFlagWriteOnly = 0x0040
+    v4l2CtrlFlagNextCtrl  = 0x80000000
+)
+
+// inputControlID stands for the VIDIOC_S_INPUT selector, which the API
+// lists as a menu control named "input". Real control IDs are never this
+// high.
+const inputControlID = 0xFFFFFFFF
+
+type v4l2QueryCtrl struct {
+    ID           uint32
+    Type         uint32
+    Name         [32]byte
+    Minimum      int32
+    Maximum      int32
+    Step         int32
+    DefaultValue int32
+    Flags        uint32
+    Reserved     [2]uint32
+}
+
+// v4l2QueryMenu is packed in C; the union holds the item's name or, for
+// integer menus, its int64 value.
+type v4l2QueryMenu struct {
+    ID       uint32
+    Index    uint32
+    Name     [32]byte
+    Reserved uint32
+}
+
+type v4l2Control struct {
+    ID    uint32
+    Value int32
+}
+
+type v4l2Input struct {
+    Index        uint32
+    Name         [32]byte
+    Type         uint32
+    Audioset     uint32
+    Tuner        uint32
+    Std          uint64
+    Status       uint32
+    Capabilities uint32
+    Reserved     [3]uint32
+}
+
+var (
+    vidiocEnumInput = ioc(iocRead|iocWrite, 26, unsafe.Sizeof(v4l2Input{}))
+    vidiocGCtrl     = ioc(iocRead|iocWrite, 27, unsafe.Sizeof(v4l2Control{}))
+    vidiocSCtrl     = ioc(iocRead|iocWrite, 28, unsafe.Sizeof(v4l2Control{}))
+    vidiocQueryCtrl = ioc(iocRead|iocWrite, 36, unsafe.Sizeof(v4l2QueryCtrl{}))
+    vidiocQueryMenu = ioc(iocRead|iocWrite, 37, unsafe.Sizeof(v4l2QueryMenu{}))
+    vidiocGInput    = ioc(iocRead, 38, unsafe.Sizeof(int32(0)))
+    vidiocSInput    = ioc(iocRead|iocWrite, 39, unsafe.Sizeof(int32(0)))
+)
+
+// v4l2Controls is a ControlDevice on an open V4L2 device node. Its
+// ioctls go through ioctl, which tests replace to fake a driver.
+type v4l2Controls struct {
+    device string
+    fd     int
+    ioctl  func(fd int, req uintptr, arg unsafe.Pointer) error
+}
+
+// OpenV4L2Controls opens device for reading and changing its controls.
+// V4L2 allows this alongside the fd the capture loop streams from.
+func OpenV4L2Controls(device string) (ControlDevice, error) {
+    fd, err := unix.Open(device, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, fmt.Errorf("capture: open %s: %w", device, err)
+    }
+    return &v4l2Controls{device: device, fd: fd, ioctl: ioctl}, nil
+}
+
+func (d *v4l2Controls) QueryControls() ([]Control, error) {
+    var out []Control
+    if in, ok := d.input(); ok {
+        out = append(out, in)
+    }
+    qc := v4l2QueryCtrl{ID: v4l2CtrlFlagNextCtrl}
+    for {
+        if err := d.ioctl(d.fd, vidiocQueryCtrl, unsafe.Pointer(&qc)); err != nil {
+            if err == unix.EINVAL {
+                break // past the last control
+            }
+            return nil, fmt.Errorf("capture: %s: VIDIOC_QUERYCTRL: %w", d.device, err)
+        }
+        if c, ok := d.control(qc); ok {
+            out = append(out, c)
+        }
+        qc = v4l2QueryCtrl{ID: qc.ID | v4l2CtrlFlagNextCtrl}
+    }
+    return out, nil
+}
+
+func (d *v4l2Controls) control(qc v4l2QueryCtrl) (Control, bool) {
+    if qc.Flags&v4l2CtrlFlagDisabled != 0 {
+        return Control{}, false
+    }
+    c := Control{
+        ID:       qc.ID,
+        Name:     ControlName(cString(qc.Name[:])),
+        Min:      int64(qc.Minimum),
+        Max:      int64(qc.Maximum),
+        Step:     int64(qc.Step),
+        Default:  int64(qc.DefaultValue),
+        ReadOnly: qc.Flags&v4l2CtrlFlagReadOnly != 0,
+        Inactive: qc.Flags&v4l2CtrlFlagInactive != 0,
+    }
+    switch qc.Type {
+    case v4l2CtrlTypeInteger:
+        c.Type = "integer"
+    case v4l2CtrlTypeBoolean:
+        c.Type = "boolean"
+    case v4l2CtrlTypeMenu:
+        c.Type = "menu"
+        c.Menu = d.menu(qc, false)
+    case v4l2CtrlTypeIntegerMenu:
+        c.Type = "integer_menu"
+        c.Menu = d.menu(qc, true)
+    case v4l2CtrlTypeButton:
+        c.Type = "button"
+        return c, true // buttons have no value to read
+    default:
+        return Control{}, false
+    }
+    if qc.Flags&v4l2CtrlFlagWriteOnly == 0 {
+        v := v4l2Control{ID: qc.ID}
+        if err := d.ioctl(d.fd, vidiocGCtrl, unsafe.Pointer(&v)); err == nil {
+            c.Value = int64(v.Value)
+        }
+    }
+    return c, true
+}
+
+// menu lists a menu control's items. Drivers leave gaps in the index
+// range, which VIDIOC_QUERYMENU reports as EINVAL.
+func (d *v4l2Controls) menu(qc v4l2QueryCtrl, integer bool) []MenuItem {
+    var items []MenuItem
+    for i := qc.Minimum; i <= qc.Maximum; i++ {
+        qm := v4l2QueryMenu{ID: qc.ID, Index: uint32(i)}
+        if d.ioctl(d.fd, vidiocQueryMenu, unsafe.Pointer(&qm)) != nil {
+            continue
+        }
+        name := cString(qm.Name[:])
+        if integer {
+            name = fmt.Sprint(int64(binary.LittleEndian.Uint64(qm.Name[:8])))
+        }
+        items = append(items, MenuItem{Index: int64(i), Name: name})
+    }
+    return items
+}
+
+// input describes the device's video inputs as a menu, or reports false
+// when it has no more than one to choose from.
+func (d *v4l2Controls) input() (Control, bool) {
+    var items []MenuItem
+    for i := uint32(0); ; i++ {
+        in := v4l2Input{Index: i}
+        if d.ioctl(d.fd, vidiocEnumInput, unsafe.Pointer(&in)) != nil {
+            break
+        }
+        items = append(items, MenuItem{Index: int64(i), Name: cString(in.Name[:])})
+    }
+    if len(items) < 2 {
+        return Control{}, false
+    }
+    var cur int32
+    if err := d.ioctl(d.fd, vidiocGInput, unsafe.Pointer(&cur)); err != nil {
+        return Control{}, false
+    }
+    return Control{
+        ID:    inputControlID,
+        Name:  "input",
+        Type:  "menu",
+        Min:   0,
+        Max:   int64(len(items) - 1),
+        Step:  1,
+        Value: int64(cur),
+        Menu:  items,
+    }, true
+}
+
+func (d *v4l2Controls) SetControl(c Control, value int64) error {
+    if c.ID == inputControlID {
+        in := int32(value)
+        return d.ioctl(d.fd, vidiocSInput, unsafe.Pointer(&in))
+    }
+    v := v4l2Control{ID: c.ID, Value: int32(value)}
+    return d.ioctl(d.fd, vidiocSCtrl, unsafe.Pointer(&v))
+}
+
+func (d *v4l2Controls) Close() error {
+    return unix.Close(d.fd)
+}
+
+func cString(b []byte) string {
+    if i := bytes.IndexByte(b, 0); i >= 0 {
+        b = b[:i]
+    }
+    return string(b)
+}
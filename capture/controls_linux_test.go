@@ -0,0 +1,158 @@
+//go:build linux
+
+package capture
+
+import (
+    "encoding/binary"
+    "reflect"
+    "testing"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+// fakeDriver answers control ioctls as a V4L2 driver would, from a
+// table of controls, menus and inputs.
+type fakeDriver struct {
+    ctrls  []v4l2QueryCtrl
+    values map[uint32]int32
+    // menus maps a control to its item names by index; an integer menu
+    // stores the value in the name's first 8 bytes.
+    menus  map[uint32]map[uint32][32]byte
+    inputs []string
+    input  int32
+    // sets records the controls written, in order.
+    sets []v4l2Control
+}
+
+func name32(s string) [32]byte {
+    var b [32]byte
+    copy(b[:], s)
+    return b
+}
+
+func (d *fakeDriver) ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+    switch req {
+    case vidiocQueryCtrl:
+        qc := (*v4l2QueryCtrl)(arg)
+        next := qc.ID&v4l2CtrlFlagNextCtrl != 0
+        id := qc.ID &^ v4l2CtrlFlagNextCtrl
+        for _, c := range d.ctrls {
+            if next && c.ID > id || !next && c.ID == id {
+                *qc = c
+                return nil
+            }
+        }
+        return unix.EINVAL
+    case vidiocQueryMenu:
+        qm := (*v4l2QueryMenu)(arg)
+        name, ok := d.menus[qm.ID][qm.Index]
+        if !ok {
+            return unix.EINVAL
+        }
+        qm.Name = name
+        return nil
+    case vidiocGCtrl:
+        v := (*v4l2Control)(arg)
+        val, ok := d.values[v.ID]
+        if !ok {
+            return unix.EINVAL
+        }
+        v.Value = val
+        return nil
+    case vidiocSCtrl:
+        v := (*v4l2Control)(arg)
+        d.sets = append(d.sets, *v)
+        d.values[v.ID] = v.Value
+        return nil
+    case vidiocEnumInput:
+        in := (*v4l2Input)(arg)
+        if int(in.Index) >= len(d.inputs) {
+            return unix.EINVAL
+        }
+        in.Name = name32(d.inputs[in.Index])
+        return nil
+    case vidiocGInput:
+        *(*int32)(arg) = d.input
+        return nil
+    case vidiocSInput:
+        d.input = *(*int32)(arg)
+        return nil
+    }
+    return unix.ENOTTY
+}
+
+func newFakeDriver() *fakeDriver {
+    var rate [32]byte
+    binary.LittleEndian.PutUint64(rate[:8], 48000)
+    return &fakeDriver{
+        ctrls: []v4l2QueryCtrl{
+            {ID: 0x00980900, Type: v4l2CtrlTypeInteger, Name: name32("Brightness"), Minimum: -64, Maximum: 64, Step: 1, DefaultValue: 0},
+            {ID: 0x00980901, Type: v4l2CtrlTypeInteger, Name: name32("Contrast"), Minimum: 0, Maximum: 100, Step: 10, DefaultValue: 50, Flags: v4l2CtrlFlagDisabled},
+            {ID: 0x0098090c, Type: v4l2CtrlTypeBoolean, Name: name32("White Balance Temperature, Auto"), Minimum: 0, Maximum: 1, Step: 1, DefaultValue: 1},
+            {ID: 0x00980918, Type: v4l2CtrlTypeMenu, Name: name32("Power Line Frequency"), Minimum: 0, Maximum: 2, Step: 1, DefaultValue: 1},
+            {ID: 0x00980920, Type: v4l2CtrlTypeButton, Name: name32("Do White Balance"), Flags: v4l2CtrlFlagWriteOnly},
+            {ID: 0x00980921, Type: v4l2CtrlTypeIntegerMenu, Name: name32("Sample Rate"), Minimum: 0, Maximum: 0, Step: 1, Flags: v4l2CtrlFlagReadOnly},
+            {ID: 0x00980922, Type: 7, Name: name32("Some String")}, // V4L2_CTRL_TYPE_STRING
+        },
+        values: map[uint32]int32{0x00980900: 12, 0x0098090c: 1, 0x00980918: 2, 0x00980921: 0},
+        menus: map[uint32]map[uint32][32]byte{
+            // Index 1 is a gap the driver skips.
+            0x00980918: {0: name32("Disabled"), 2: name32("60 Hz")},
+            0x00980921: {0: rate},
+        },
+        inputs: []string{"HDMI", "Composite"},
+        input:  1,
+    }
+}
+
+func TestV4L2ControlsQuery(t *testing.T) {
+    drv := newFakeDriver()
+    dev := &v4l2Controls{device: "/dev/fake", fd: -1, ioctl: drv.ioctl}
+    got, err := dev.QueryControls()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []Control{
+        {ID: inputControlID, Name: "input", Type: "menu", Min: 0, Max: 1, Step: 1, Value: 1,
+            Menu: []MenuItem{{0, "HDMI"}, {1, "Composite"}}},
+        {ID: 0x00980900, Name: "brightness", Type: "integer", Min: -64, Max: 64, Step: 1, Value: 12},
+        {ID: 0x0098090c, Name: "white_balance_temperature_auto", Type: "boolean", Min: 0, Max: 1, Step: 1, Default: 1, Value: 1},
+        {ID: 0x00980918, Name: "power_line_frequency", Type: "menu", Min: 0, Max: 2, Step: 1, Default: 1, Value: 2,
+            Menu: []MenuItem{{0, "Disabled"}, {2, "60 Hz"}}},
+        {ID: 0x00980920, Name: "do_white_balance", Type: "button"},
+        {ID: 0x00980921, Name: "sample_rate", Type: "integer_menu", Step: 1, ReadOnly: true,
+            Menu: []MenuItem{{0, "48000"}}},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("controls:\n got %+v\nwant %+v", got, want)
+    }
+}
+
+func TestV4L2ControlsSet(t *testing.T) {
+    drv := newFakeDriver()
+    s := &ControlSet{Device: "/dev/fake", Open: func(string) (ControlDevice, error) {
+        return &v4l2Controls{device: "/dev/fake", fd: -1, ioctl: drv.ioctl}, nil
+    }}
+    // Close fails on the fake fd; Set does not look at it.
+    controls, err := s.Set(map[string]int64{"brightness": -20, "input": 0})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if drv.input != 0 || drv.values[0x00980900] != -20 {
+        t.Errorf("driver has input %d, brightness %d", drv.input, drv.values[0x00980900])
+    }
+    for _, c := range controls {
+        if c.Name == "brightness" && c.Value != -20 || c.Name == "input" && c.Value != 0 {
+            t.Errorf("%s reads back as %d", c.Name, c.Value)
+        }
+    }
+
+    drv.sets = nil
+    if _, err := s.Set(map[string]int64{"power_line_frequency": 1}); err == nil {
+        t.Error("menu gap accepted")
+    }
+    if len(drv.sets) != 0 {
+        t.Errorf("a rejected request wrote %v", drv.sets)
+    }
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package capture
+
+// OpenV4L2Controls is only functional on Linux.
+func OpenV4L2Controls(device string) (ControlDevice, error) { return nil, ErrUnsupported }
@@ -0,0 +1,130 @@
+package capture
+
+import (
+    "errors"
+    "reflect"
+    "testing"
+)
+
+// fakeControls is a ControlDevice holding controls in memory.
+type fakeControls struct {
+    controls []Control
+    // sets records each value written, and opens and closes count
+    // device opens.
+    sets          []string
+    opens, closes int
+}
+
+func (f *fakeControls) QueryControls() ([]Control, error) {
+    return append([]Control(nil), f.controls...), nil
+}
+
+func (f *fakeControls) SetControl(c Control, v int64) error {
+    for i := range f.controls {
+        if f.controls[i].ID == c.ID {
+            f.controls[i].Value = v
+        }
+    }
+    f.sets = append(f.sets, c.Name)
+    return nil
+}
+
+func (f *fakeControls) Close() error {
+    f.closes++
+    return nil
+}
+
+func newFakeControlSet() (*ControlSet, *fakeControls) {
+    dev := &fakeControls{controls: []Control{
+        {ID: 1, Name: "brightness", Type: "integer", Min: -64, Max: 64, Step: 1},
+        {ID: 2, Name: "contrast", Type: "integer", Min: 0, Max: 100, Step: 10, Value: 50},
+        {ID: 3, Name: "power_line_frequency", Type: "menu", Min: 0, Max: 2, Step: 1, Value: 1,
+            Menu: []MenuItem{{0, "Disabled"}, {2, "60 Hz"}}},
+        {ID: 4, Name: "do_white_balance", Type: "button"},
+        {ID: 5, Name: "sample_rate", Type: "integer", Max: 48000, ReadOnly: true},
+    }}
+    s := &ControlSet{Device: "/dev/fake", Open: func(string) (ControlDevice, error) {
+        dev.opens++
+        return dev, nil
+    }}
+    return s, dev
+}
+
+func TestControlSetRejectsBadRequestsWhole(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        values map[string]int64
+        reason string
+    }{
+        {name: "unknown", values: map[string]int64{"brightness": 1, "zoom": 2}},
+        {name: "range", values: map[string]int64{"brightness": 65}, reason: "must be between -64 and 64"},
+        {name: "step", values: map[string]int64{"brightness": 1, "contrast": 55}, reason: "must be a multiple of 10 from 0"},
+        {name: "menu gap", values: map[string]int64{"power_line_frequency": 1}, reason: "not a menu index"},
+        {name: "read-only", values: map[string]int64{"sample_rate": 44100}, reason: "control is read-only"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            s, dev := newFakeControlSet()
+            _, err := s.Set(tc.values)
+            var unknown *UnknownControlError
+            var bad *ControlValueError
+            switch {
+            case tc.reason == "":
+                if !errors.As(err, &unknown) || unknown.Name != "zoom" || len(unknown.Valid) != len(dev.controls) {
+                    t.Errorf("err = %v, want UnknownControlError for zoom listing every control", err)
+                }
+            case !errors.As(err, &bad) || bad.Reason != tc.reason:
+                t.Errorf("err = %v, want %q", err, tc.reason)
+            }
+            if len(dev.sets) != 0 {
+                t.Errorf("rejected request set %v", dev.sets)
+            }
+            if dev.opens != dev.closes {
+                t.Errorf("%d opens, %d closes", dev.opens, dev.closes)
+            }
+        })
+    }
+}
+
+func TestControlSetReapply(t *testing.T) {
+    s, dev := newFakeControlSet()
+    if err := s.Reapply(); err != nil || dev.opens != 0 {
+        t.Fatalf("Reapply with nothing set: err %v, %d opens", err, dev.opens)
+    }
+    controls, err := s.Set(map[string]int64{"contrast": 80, "power_line_frequency": 2, "do_white_balance": 0})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if controls[1].Value != 80 || controls[2].Value != 2 {
+        t.Errorf("controls after Set: %+v", controls)
+    }
+    if _, err := s.Set(map[string]int64{"contrast": 30}); err != nil {
+        t.Fatal(err)
+    }
+
+    // The device comes back with its defaults.
+    dev.controls[1].Value, dev.controls[2].Value = 50, 1
+    dev.sets = nil
+    if err := s.Reapply(); err != nil {
+        t.Fatal(err)
+    }
+    // Buttons are pressed once, not restored; the later contrast wins.
+    if want := []string{"contrast", "power_line_frequency"}; !reflect.DeepEqual(dev.sets, want) {
+        t.Errorf("Reapply set %v, want %v", dev.sets, want)
+    }
+    if dev.controls[1].Value != 30 || dev.controls[2].Value != 2 {
+        t.Errorf("after Reapply: contrast %d, power_line_frequency %d", dev.controls[1].Value, dev.controls[2].Value)
+    }
+}
+
+func TestControlName(t *testing.T) {
+    for label, want := range map[string]string{
+        "Brightness":                      "brightness",
+        "White Balance Temperature, Auto": "white_balance_temperature_auto",
+        "  Exposure (Absolute) ":          "exposure_absolute",
+        "H.264 I-Frame Period":            "h_264_i_frame_period",
+    } {
+        if got := ControlName(label); got != want {
+            t.Errorf("ControlName(%q) = %q, want %q", label, got, want)
+        }
+    }
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package capture
+
+import (
+    "context"
+    "path/filepath"
+    "strings"
+
+    "golang.org/x/sys/unix"
+)
+
+// hotplugEvents are the inotify events that may mean a device node has
+// appeared or become usable; udev sets a new node's permissions just
+// after creating it.
+const hotplugEvents = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// WatchDevice sends on the returned channel whenever something appears
+// in /dev or in a directory on the way to device, such as
+// /dev/v4l/by-id, until ctx is done. It is only a hint that opening the
+// device again may now work: events are coalesced, and where inotify is
+// unavailable none ever come.
+func WatchDevice(ctx context.Context, device string) <-chan struct{} {
+    ch := make(chan struct{}, 1)
+    fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+    if err != nil {
+        return ch
+    }
+    dirs := watchDirs(device)
+    addWatches := func() {
+        // Directories missing now are watched once their parent says
+        // they have been created; watching one twice is harmless.
+        for _, d := range dirs {
+            unix.InotifyAddWatch(fd, d, hotplugEvents)
+        }
+    }
+    addWatches()
+    go func() {
+        defer unix.Close(fd)
+        buf := make([]byte, 4096)
+        fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+        for ctx.Err() == nil {
+            n, err := unix.Poll(fds, 500)
+            if err != nil && err != unix.EINTR {
+                return
+            }
+            if n <= 0 {
+                continue
+            }
+            if _, err := unix.Read(fd, buf); err != nil {
+                continue
+            }
+            addWatches()
+            select {
+            case ch <- struct{}{}:
+            default:
+            }
+        }
+    }()
+    return ch
+}
+
+// watchDirs returns /dev and the directories below it leading to device,
+// or just the device's directory for a node outside /dev.
+func watchDirs(device string) []string {
+    dirs := []string{"/dev"}
+    dir := filepath.Dir(filepath.Clean(device))
+    if dir != "/dev" && !strings.HasPrefix(dir, "/dev/") {
+        return []string{dir}
+    }
+    for d := "/dev"; d != dir; {
+        next, _, _ := strings.Cut(strings.TrimPrefix(dir, d+"/"), "/")
+        d = d + "/" + next
+        dirs = append(dirs, d)
+    }
+    return dirs
+}
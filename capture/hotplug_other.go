@@ -0,0 +1,11 @@
+//go:build !linux
+
+package capture
+
+import "context"
+
+// WatchDevice is only functional on Linux; elsewhere its channel never
+// fires.
+func WatchDevice(ctx context.Context, device string) <-chan struct{} {
+    return make(chan struct{})
+}
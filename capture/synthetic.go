@@ -0,0 +1,300 @@
+package capture
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/basicfont"
+    "golang.org/x/image/math/fixed"
+)
+
+// SyntheticPrefix starts a device that is not hardware but a generated
+// test picture: "synthetic", or "synthetic:1280x720@30" to choose its mode.
+const SyntheticPrefix = "synthetic"
+
+// Defaults, and the smallest picture the pattern fits in.
+const (
+    syntheticWidth     = 1280
+    syntheticHeight    = 720
+    syntheticFPS       = 30
+    syntheticMinWidth  = 128
+    syntheticMinHeight = 96
+)
+
+// The frame counter is drawn in the top left corner as barcodeCells
+// cells across the left half of the frame, barcodeRows of its height
+// tall: a white and a black guard cell, then the counter's 32 bits, most
+// significant first, white for a one. Cells are placed in proportions of
+// the frame, so the code survives rescaling as well as JPEG.
+const (
+    barcodeBits  = 32
+    barcodeCells = barcodeBits + 2
+    barcodeRows  = 24 // the code is 1/barcodeRows of the frame tall
+)
+
+// YCbCr values of the 75% SMPTE colour bars, left to right, and the
+// shortened bars below them in the reverse order with black between.
+var (
+    smpteBars = [7][3]byte{
+        {180, 128, 128}, // white
+        {162, 44, 142},  // yellow
+        {131, 156, 44},  // cyan
+        {112, 72, 58},   // green
+        {84, 184, 198},  // magenta
+        {65, 100, 212},  // red
+        {35, 212, 114},  // blue
+    }
+    smpteCastellations = [7][3]byte{
+        {35, 212, 114},
+        {16, 128, 128},
+        {84, 184, 198},
+        {16, 128, 128},
+        {131, 156, 44},
+        {16, 128, 128},
+        {180, 128, 128},
+    }
+    yuvBlack = [3]byte{16, 128, 128}
+    yuvWhite = [3]byte{235, 128, 128}
+)
+
+// ParseSynthetic reports whether device names a synthetic source, and
+// the mode it gives, zero where it leaves the choice to the stream.
+func ParseSynthetic(device string) (Mode, bool, error) {
+    if device == SyntheticPrefix {
+        return Mode{}, true, nil
+    }
+    spec, ok := strings.CutPrefix(device, SyntheticPrefix+":")
+    if !ok {
+        return Mode{}, false, nil
+    }
+    var m Mode
+    var err error
+    if strings.Contains(spec, "@") {
+        _, err = fmt.Sscanf(spec, "%dx%d@%d", &m.Width, &m.Height, &m.FPS)
+    } else {
+        _, err = fmt.Sscanf(spec, "%dx%d", &m.Width, &m.Height)
+    }
+    switch {
+    case err != nil:
+        return m, true, fmt.Errorf("capture: %q is not synthetic:WIDTHxHEIGHT[@FPS]", device)
+    case m.Width < syntheticMinWidth || m.Height < syntheticMinHeight || m.Width%2 != 0:
+        return m, true, fmt.Errorf("capture: %q needs an even width of at least %d and a height of at least %d", device, syntheticMinWidth, syntheticMinHeight)
+    case m.FPS < 0 || m.FPS > 120:
+        return m, true, fmt.Errorf("capture: %q frame rate must be at most 120", device)
+    }
+    return m, true, nil
+}
+
+// SyntheticSource generates YUYV frames of a fixed test pattern instead
+// of reading a device, so the whole pipeline can run without hardware:
+// colour bars, a box moving a few pixels a frame, and the frame's number
+// written out and as a barcode that ReadSyntheticCounter reads back. Frame
+// n looks the same every run.
+type SyntheticSource struct {
+    mu      sync.Mutex
+    mode    Mode
+    running bool
+    device  string
+    // base is the unchanging part of the picture for the open mode.
+    base []byte
+    n    uint64
+    next time.Time
+}
+
+// NewSyntheticSource returns a source of the given mode. Zero values are
+// 1280x720 at 30 fps.
+func NewSyntheticSource(width, height, fps int) *SyntheticSource {
+    s := &SyntheticSource{}
+    s.SetMode(Mode{Width: width, Height: height, FPS: fps})
+    return s
+}
+
+// Open starts generating frames. The device is only used in messages.
+func (s *SyntheticSource) Open(device string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.running {
+        return fmt.Errorf("capture: %s already open", s.device)
+    }
+    s.device = device
+    s.base = syntheticBase(s.mode.Width, s.mode.Height)
+    s.next = time.Time{}
+    s.running = true
+    return nil
+}
+
+// Mode returns the mode the next Open generates.
+func (s *SyntheticSource) Mode() Mode {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.mode
+}
+
+// SetMode changes the mode the next Open generates, filling in defaults.
+// The format is always YUYV.
+func (s *SyntheticSource) SetMode(m Mode) {
+    if m.Width <= 0 || m.Height <= 0 {
+        m.Width, m.Height = syntheticWidth, syntheticHeight
+    }
+    m.Width = max(m.Width&^1, syntheticMinWidth)
+    m.Height = max(m.Height, syntheticMinHeight)
+    if m.FPS <= 0 {
+        m.FPS = syntheticFPS
+    }
+    m.Format = FormatYUYV
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.mode = m
+}
+
+// ReadFrame waits for the next frame to be due and draws it. A caller
+// that falls behind is not sent the frames it missed, as with a device.
+func (s *SyntheticSource) ReadFrame() (Frame, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.running {
+        return Frame{}, ErrNotOpen
+    }
+    interval := time.Second / time.Duration(s.mode.FPS)
+    now := time.Now()
+    if s.next.IsZero() || now.Sub(s.next) > interval {
+        s.next = now
+    }
+    time.Sleep(time.Until(s.next))
+    s.next = s.next.Add(interval)
+
+    w, h := s.mode.Width, s.mode.Height
+    fb := NewFrameBuffer(len(s.base))
+    data := fb.Bytes()
+    copy(data, s.base)
+    drawSynthetic(data, w, h, s.n, fmt.Sprintf("%dx%d@%d", w, h, s.mode.FPS))
+    s.n++
+    return Frame{
+        Data:      data,
+        Format:    FormatYUYV,
+        Width:     w,
+        Height:    h,
+        Timestamp: time.Now(),
+        Buf:       fb,
+    }, nil
+}
+
+// Close stops the source. The frame count carries on at the next Open.
+func (s *SyntheticSource) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.running = false
+    return nil
+}
+
+// syntheticBase draws the bars, the shortened bars under them and the
+// black band at the bottom that the frame number is written in.
+func syntheticBase(w, h int) []byte {
+    b := make([]byte, w*h*2)
+    fillYUYV(b, w, image.Rect(0, 3*h/4, w, h), yuvBlack)
+    for i := 0; i < 7; i++ {
+        x0, x1 := i*w/7, (i+1)*w/7
+        fillYUYV(b, w, image.Rect(x0, 0, x1, 2*h/3), smpteBars[i])
+        fillYUYV(b, w, image.Rect(x0, 2*h/3, x1, 3*h/4), smpteCastellations[i])
+    }
+    return b
+}
+
+// drawSynthetic draws what changes from frame n to the next: the box,
+// the barcode and the text.
+func drawSynthetic(b []byte, w, h int, n uint64, mode string) {
+    size := h / 6 &^ 1
+    travel := w - size
+    x := int(n*uint64(max(w/128, 2))) % travel &^ 1
+    y := h/3 - size/2
+    fillYUYV(b, w, image.Rect(x, y, x+size, y+size), yuvWhite)
+
+    cellH := h / barcodeRows
+    counter := uint32(n)
+    for i := 0; i < barcodeCells; i++ {
+        on := i == 0
+        if i >= 2 {
+            on = counter&(1<<(barcodeBits-1-(i-2))) != 0
+        }
+        c := yuvBlack
+        if on {
+            c = yuvWhite
+        }
+        fillYUYV(b, w, image.Rect(i*w/(2*barcodeCells), 0, (i+1)*w/(2*barcodeCells), cellH), c)
+    }
+
+    scale := max(h/240, 1)
+    band := 3 * h / 4
+    drawText(b, w, fmt.Sprintf("FRAME %08d", n), 2*scale, scale*4, band+scale*4)
+    drawText(b, w, "SYNTHETIC "+mode, scale, scale*4, band+scale*36)
+}
+
+// fillYUYV paints r of a w-wide YUYV picture c. r's left and right edges
+// are rounded down to even pixels, which share chroma.
+func fillYUYV(b []byte, w int, r image.Rectangle, c [3]byte) {
+    x0, x1 := r.Min.X&^1, r.Max.X&^1
+    for y := r.Min.Y; y < r.Max.Y; y++ {
+        row := b[y*w*2:]
+        for x := x0; x < x1; x += 2 {
+            i := x * 2
+            row[i], row[i+1], row[i+2], row[i+3] = c[0], c[1], c[0], c[2]
+        }
+    }
+}
+
+// drawText writes s in white at scale times the 7x13 font, its top left
+// at x, y, onto the luma of a w-wide YUYV picture. Whatever does not fit is
+// cut off.
+func drawText(b []byte, w int, s string, scale, x, y int) {
+    face := basicfont.Face7x13
+    d := &font.Drawer{Face: face, Src: image.White}
+    tw := d.MeasureString(s).Ceil()
+    mask := image.NewGray(image.Rect(0, 0, tw, 13))
+    d.Dst = mask
+    d.Dot = fixed.P(0, 11)
+    d.DrawString(s)
+    h := len(b) / (w * 2)
+    for my := 0; my < 13; my++ {
+        for mx := 0; mx < tw; mx++ {
+            if mask.GrayAt(mx, my).Y < 128 {
+                continue
+            }
+            for py := y + my*scale; py < y+(my+1)*scale && py < h; py++ {
+                for px := x + mx*scale; px < x+(mx+1)*scale && px < w; px++ {
+                    b[(py*w+px)*2] = yuvWhite[0]
+                }
+            }
+        }
+    }
+}
+
+// ReadSyntheticCounter reads the frame number from the barcode of a
+// SyntheticSource frame, after any encoding and rescaling. It reports
+// false for a picture without the code.
+func ReadSyntheticCounter(img image.Image) (uint32, bool) {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    y := b.Min.Y + h/(2*barcodeRows)
+    luma := func(i int) int {
+        x := b.Min.X + (2*i+1)*w/(4*barcodeCells)
+        return int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+    }
+    white, black := luma(0), luma(1)
+    if white-black < 64 {
+        return 0, false
+    }
+    threshold := (white + black) / 2
+    var n uint32
+    for i := 2; i < barcodeCells; i++ {
+        n <<= 1
+        if luma(i) > threshold {
+            n |= 1
+        }
+    }
+    return n, true
+}
@@ -0,0 +1,507 @@
+//go:build linux
+
+package capture
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+    "unsafe"
+
+    "golang.org/x/sys/unix"
+)
+
+// Subset of the V4L2 ABI from linux/videodev2.h needed for mmap streaming.
+
+const (
+    v4l2BufTypeVideoCapture = 1
+    v4l2MemoryMmap          = 1
+    v4l2FieldAny            = 0
+    v4l2CapVideoCapture     = 0x00000001
+    v4l2CapStreaming        = 0x04000000
+    v4l2CapDeviceCaps       = 0x80000000
+)
+
+var (
+    pixFmtMJPEG = fourcc('M', 'J', 'P', 'G')
+    pixFmtYUYV  = fourcc('Y', 'U', 'Y', 'V')
+)
+
+func fourcc(a, b, c, d byte) uint32 {
+    return uint32(a) | uint32(b)<<8 | uint32(c)<<16 | uint32(d)<<24
+}
+
+type v4l2Capability struct {
+    Driver       [16]byte
+    Card         [32]byte
+    BusInfo      [32]byte
+    Version      uint32
+    Capabilities uint32
+    DeviceCaps   uint32
+    Reserved     [3]uint32
+}
+
+type v4l2PixFormat struct {
+    Width        uint32
+    Height       uint32
+    PixelFormat  uint32
+    Field        uint32
+    BytesPerLine uint32
+    SizeImage    uint32
+    Colorspace   uint32
+    Priv         uint32
+    Flags        uint32
+    YcbcrEnc     uint32
+    Quantization uint32
+    XferFunc     uint32
+}
+
+type v4l2Format struct {
+    Type uint32
+    Fmt  struct {
+        _   [0]uintptr // the C union contains pointers
+        Raw [200]byte
+    }
+}
+
+func (f *v4l2Format) pix() *v4l2PixFormat {
+    return (*v4l2PixFormat)(unsafe.Pointer(&f.Fmt.Raw[0]))
+}
+
+type v4l2Fract struct {
+    Numerator   uint32
+    Denominator uint32
+}
+
+type v4l2CaptureParm struct {
+    Capability   uint32
+    CaptureMode  uint32
+    TimePerFrame v4l2Fract
+    ExtendedMode uint32
+    ReadBuffers  uint32
+    Reserved     [4]uint32
+}
+
+type v4l2StreamParm struct {
+    Type uint32
+    Parm [200]byte
+}
+
+type v4l2RequestBuffers struct {
+    Count        uint32
+    Type         uint32
+    Memory       uint32
+    Capabilities uint32
+    Flags        uint8
+    Reserved     [3]uint8
+}
+
+type v4l2Timecode struct {
+    Type     uint32
+    Flags    uint32
+    Frames   uint8
+    Seconds  uint8
+    Minutes  uint8
+    Hours    uint8
+    UserBits [4]uint8
+}
+
+type v4l2Buffer struct {
+    Index     uint32
+    Type      uint32
+    BytesUsed uint32
+    Flags     uint32
+    Field     uint32
+    Timestamp unix.Timeval
+    Timecode  v4l2Timecode
+    Sequence  uint32
+    Memory    uint32
+    M         uintptr // union: offset, userptr, planes, fd
+    Length    uint32
+    Reserved2 uint32
+    RequestFD int32
+}
+
+const (
+    iocWrite = 1
+    iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+    return dir<<30 | size<<16 | uintptr('V')<<8 | nr
+}
+
+var (
+    vidiocQueryCap  = ioc(iocRead, 0, unsafe.Sizeof(v4l2Capability{}))
+    vidiocGFmt      = ioc(iocRead|iocWrite, 4, unsafe.Sizeof(v4l2Format{}))
+    vidiocSFmt      = ioc(iocRead|iocWrite, 5, unsafe.Sizeof(v4l2Format{}))
+    vidiocReqBufs   = ioc(iocRead|iocWrite, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+    vidiocQueryBuf  = ioc(iocRead|iocWrite, 9, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocQBuf      = ioc(iocRead|iocWrite, 15, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocDQBuf     = ioc(iocRead|iocWrite, 17, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocStreamOn  = ioc(iocWrite, 18, unsafe.Sizeof(int32(0)))
+    vidiocStreamOff = ioc(iocWrite, 19, unsafe.Sizeof(int32(0)))
+    vidiocSParm     = ioc(iocRead|iocWrite, 22, unsafe.Sizeof(v4l2StreamParm{}))
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+    for {
+        _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+        switch errno {
+        case 0:
+            return nil
+        case unix.EINTR:
+            continue
+        }
+        return errno
+    }
+}
+
+// V4L2Source captures frames from a Video4Linux2 device using mmap
+// streaming I/O. MJPEG is preferred unless Format says otherwise; the other
+// format is used when the device does not offer the preferred one.
+type V4L2Source struct {
+    Width   int
+    Height  int
+    FPS     int
+    Format  PixelFormat
+    Buffers int
+    // Timeout bounds how long ReadFrame waits for the next frame.
+    Timeout time.Duration
+
+    mu      sync.Mutex
+    device  string
+    fd      int
+    bufs    [][]byte
+    format  PixelFormat
+    width   int
+    height  int
+    running bool
+    // streaming is cleared while a restart after losing the signal has
+    // not yet succeeded.
+    streaming bool
+}
+
+// NewV4L2Source returns a source asking the device for the given mode.
+// Zero values leave the driver defaults in place.
+func NewV4L2Source(width, height, fps int) *V4L2Source {
+    return &V4L2Source{
+        Width:   width,
+        Height:  height,
+        FPS:     fps,
+        Buffers: 4,
+        Timeout: 2 * time.Second,
+        fd:      -1,
+    }
+}
+
+func (s *V4L2Source) Open(devicePath string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.running {
+        return fmt.Errorf("capture: %s already open", s.device)
+    }
+    fd, err := unix.Open(devicePath, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return fmt.Errorf("capture: open %s: %w", devicePath, err)
+    }
+    s.fd = fd
+    s.device = devicePath
+    if err := s.init(); err != nil {
+        s.teardown()
+        return fmt.Errorf("capture: %s: %w", devicePath, err)
+    }
+    s.running = true
+    return nil
+}
+
+func (s *V4L2Source) init() error {
+    if err := checkCaps(s.fd); err != nil {
+        return err
+    }
+    if err := s.setFormat(); err != nil {
+        return err
+    }
+    if s.FPS > 0 {
+        // Not every driver lets us pick the rate; carry on if it refuses.
+        parm := v4l2StreamParm{Type: v4l2BufTypeVideoCapture}
+        cp := (*v4l2CaptureParm)(unsafe.Pointer(&parm.Parm[0]))
+        cp.TimePerFrame = v4l2Fract{Numerator: 1, Denominator: uint32(s.FPS)}
+        _ = ioctl(s.fd, vidiocSParm, unsafe.Pointer(&parm))
+    }
+
+    n := s.Buffers
+    if n <= 0 {
+        n = 4
+    }
+    req := v4l2RequestBuffers{Count: uint32(n), Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+    if err := ioctl(s.fd, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+        return fmt.Errorf("VIDIOC_REQBUFS: %w", err)
+    }
+    if req.Count == 0 {
+        return errors.New("driver allocated no buffers")
+    }
+    for i := uint32(0); i < req.Count; i++ {
+        buf := v4l2Buffer{Index: i, Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+        if err := ioctl(s.fd, vidiocQueryBuf, unsafe.Pointer(&buf)); err != nil {
+            return fmt.Errorf("VIDIOC_QUERYBUF: %w", err)
+        }
+        mem, err := unix.Mmap(s.fd, int64(uint32(buf.M)), int(buf.Length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+        if err != nil {
+            return fmt.Errorf("mmap buffer %d: %w", i, err)
+        }
+        s.bufs = append(s.bufs, mem)
+        if err := ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+            return fmt.Errorf("VIDIOC_QBUF: %w", err)
+        }
+    }
+
+    typ := int32(v4l2BufTypeVideoCapture)
+    if err := ioctl(s.fd, vidiocStreamOn, unsafe.Pointer(&typ)); err != nil {
+        return fmt.Errorf("VIDIOC_STREAMON: %w", err)
+    }
+    s.streaming = true
+    return nil
+}
+
+// checkCaps verifies that fd is a capture device that can stream.
+func checkCaps(fd int) error {
+    var capability v4l2Capability
+    if err := ioctl(fd, vidiocQueryCap, unsafe.Pointer(&capability)); err != nil {
+        return fmt.Errorf("VIDIOC_QUERYCAP: %w", err)
+    }
+    caps := capability.Capabilities
+    if caps&v4l2CapDeviceCaps != 0 {
+        caps = capability.DeviceCaps
+    }
+    if caps&v4l2CapVideoCapture == 0 {
+        return errors.New("not a video capture device")
+    }
+    if caps&v4l2CapStreaming == 0 {
+        return errors.New("device does not support streaming I/O")
+    }
+    return nil
+}
+
+// Probe opens devicePath, checks that it is a streaming capture device
+// and closes it again. It sets no format and allocates no buffers, so it
+// does not disturb a source capturing from the same device. A synthetic
+// device only has its mode checked.
+func Probe(devicePath string) error {
+    if _, ok, err := ParseSynthetic(devicePath); ok {
+        return err
+    }
+    fd, err := unix.Open(devicePath, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return fmt.Errorf("capture: open %s: %w", devicePath, err)
+    }
+    defer unix.Close(fd)
+    if err := checkCaps(fd); err != nil {
+        return fmt.Errorf("capture: %s: %w", devicePath, err)
+    }
+    return nil
+}
+
+func (s *V4L2Source) setFormat() error {
+    cur := v4l2Format{Type: v4l2BufTypeVideoCapture}
+    if err := ioctl(s.fd, vidiocGFmt, unsafe.Pointer(&cur)); err != nil {
+        return fmt.Errorf("VIDIOC_G_FMT: %w", err)
+    }
+    width, height := uint32(s.Width), uint32(s.Height)
+    if width == 0 || height == 0 {
+        width, height = cur.pix().Width, cur.pix().Height
+    }
+
+    order := []uint32{pixFmtMJPEG, pixFmtYUYV}
+    if s.Format == FormatYUYV {
+        order[0], order[1] = order[1], order[0]
+    }
+    var lastErr error
+    for _, pf := range order {
+        f := v4l2Format{Type: v4l2BufTypeVideoCapture}
+        p := f.pix()
+        p.Width = width
+        p.Height = height
+        p.PixelFormat = pf
+        p.Field = v4l2FieldAny
+        if err := ioctl(s.fd, vidiocSFmt, unsafe.Pointer(&f)); err != nil {
+            lastErr = fmt.Errorf("VIDIOC_S_FMT: %w", err)
+            continue
+        }
+        // The driver silently substitutes a format it likes better.
+        switch p.PixelFormat {
+        case pixFmtMJPEG:
+            s.format = FormatMJPEG
+        case pixFmtYUYV:
+            s.format = FormatYUYV
+        default:
+            lastErr = fmt.Errorf("driver offered unsupported pixel format %#x", p.PixelFormat)
+            continue
+        }
+        s.width = int(p.Width)
+        s.height = int(p.Height)
+        return nil
+    }
+    return lastErr
+}
+
+// Mode returns the mode the next Open asks for.
+func (s *V4L2Source) Mode() Mode {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return Mode{Width: s.Width, Height: s.Height, FPS: s.FPS, Format: s.Format}
+}
+
+// SetMode changes the mode the next Open asks for. An open device keeps
+// its current mode until it is closed and reopened.
+func (s *V4L2Source) SetMode(m Mode) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Width, s.Height, s.FPS, s.Format = m.Width, m.Height, m.FPS, m.Format
+}
+
+func (s *V4L2Source) ReadFrame() (Frame, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.running {
+        return Frame{}, ErrNotOpen
+    }
+    if !s.streaming {
+        // Some bridges refuse to stream at all without a signal; wait as
+        // long as a read would before trying again.
+        if err := s.restartStreaming(); err != nil {
+            if !noSignal(err) {
+                return Frame{}, s.lost(err)
+            }
+            time.Sleep(s.Timeout)
+            return Frame{}, fmt.Errorf("capture: %s: %w: %v", s.device, ErrNoSignal, err)
+        }
+    }
+
+    timeout := -1
+    if s.Timeout > 0 {
+        timeout = int(s.Timeout / time.Millisecond)
+    }
+    fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+    for {
+        n, err := unix.Poll(fds, timeout)
+        if err == unix.EINTR {
+            continue
+        }
+        if err != nil {
+            return Frame{}, s.lost(err)
+        }
+        if n == 0 {
+            return Frame{}, ErrTimeout
+        }
+        break
+    }
+    if fds[0].Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+        return Frame{}, s.lost(unix.ENODEV)
+    }
+
+    buf := v4l2Buffer{Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+    if err := ioctl(s.fd, vidiocDQBuf, unsafe.Pointer(&buf)); err != nil {
+        if err == unix.EAGAIN {
+            return Frame{}, ErrTimeout
+        }
+        return Frame{}, s.lost(err)
+    }
+    ts := time.Now()
+    // The mapped buffer goes back to the driver at once, so this is the
+    // one copy a frame's bytes get on their way to the viewers.
+    fb := NewFrameBuffer(int(buf.BytesUsed))
+    copy(fb.Bytes(), s.bufs[buf.Index][:buf.BytesUsed])
+    if err := ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+        fb.Release()
+        return Frame{}, s.lost(err)
+    }
+    return Frame{
+        Data:      fb.Bytes(),
+        Format:    s.format,
+        Width:     s.width,
+        Height:    s.height,
+        Timestamp: ts,
+        Buf:       fb,
+    }, nil
+}
+
+// lost classifies an I/O error. Errors the kernel reports once the
+// device node is gone become a DeviceLostError; anything else is returned
+// wrapped as is. HDMI bridges fail a dequeue with EPIPE, ENODATA or
+// ENOLINK when the source goes away while the device itself stays; those
+// wrap ErrNoSignal, and streaming is restarted in place so frames flow
+// again once the source is back.
+func (s *V4L2Source) lost(err error) error {
+    switch {
+    case gone(err):
+        return &DeviceLostError{Device: s.device, Err: err}
+    case noSignal(err):
+        if rerr := s.restartStreaming(); gone(rerr) {
+            return &DeviceLostError{Device: s.device, Err: rerr}
+        }
+        return fmt.Errorf("capture: %s: %w: %v", s.device, ErrNoSignal, err)
+    }
+    return fmt.Errorf("capture: %s: %w", s.device, err)
+}
+
+// gone reports whether err means the device node has gone away.
+func gone(err error) bool {
+    switch err {
+    case unix.ENODEV, unix.ENXIO, unix.EIO, unix.EBADF:
+        return true
+    }
+    return false
+}
+
+// noSignal reports whether err means the device has lost its input.
+func noSignal(err error) bool {
+    switch err {
+    case unix.EPIPE, unix.ENODATA, unix.ENOLINK:
+        return true
+    }
+    return false
+}
+
+// restartStreaming stops streaming, which hands every buffer back, and
+// queues them all and starts it again. Until that succeeds ReadFrame
+// retries it rather than polling. The caller holds s.mu.
+func (s *V4L2Source) restartStreaming() error {
+    typ := int32(v4l2BufTypeVideoCapture)
+    _ = ioctl(s.fd, vidiocStreamOff, unsafe.Pointer(&typ))
+    s.streaming = false
+    for i := range s.bufs {
+        buf := v4l2Buffer{Index: uint32(i), Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+        if err := ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+            return err
+        }
+    }
+    if err := ioctl(s.fd, vidiocStreamOn, unsafe.Pointer(&typ)); err != nil {
+        return err
+    }
+    s.streaming = true
+    return nil
+}
+
+func (s *V4L2Source) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !s.running {
+        return nil
+    }
+    s.running = false
+    return s.teardown()
+}
+
+func (s *V4L2Source) teardown() error {
+    typ := int32(v4l2BufTypeVideoCapture)
+    _ = ioctl(s.fd, vidiocStreamOff, unsafe.Pointer(&typ))
+    for _, b := range s.bufs {
+        unix.Munmap(b)
+    }
+    s.bufs = nil
+    err := unix.Close(s.fd)
+    s.fd = -1
+    return err
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package capture
+
+import "time"
+
+// V4L2Source is only functional on Linux.
+type V4L2Source struct {
+    Width   int
+    Height  int
+    FPS     int
+    Format  PixelFormat
+    Buffers int
+    Timeout time.Duration
+}
+
+func NewV4L2Source(width, height, fps int) *V4L2Source {
+    return &V4L2Source{Width: width, Height: height, FPS: fps, Buffers: 4, Timeout: 2 * time.Second}
+}
+
+func (s *V4L2Source) Open(devicePath string) error { return ErrUnsupported }
+
+func Probe(devicePath string) error {
+    if _, ok, err := ParseSynthetic(devicePath); ok {
+        return err
+    }
+    return ErrUnsupported
+}
+
+func (s *V4L2Source) Mode() Mode {
+    return Mode{Width: s.Width, Height: s.Height, FPS: s.FPS, Format: s.Format}
+}
+
+func (s *V4L2Source) SetMode(m Mode) {
+    s.Width, s.Height, s.FPS, s.Format = m.Width, m.Height, m.FPS, m.Format
+}
+
+func (s *V4L2Source) ReadFrame() (Frame, error) { return Frame{}, ErrNotOpen }
+
+func (s *V4L2Source) Close() error { return nil }
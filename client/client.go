@@ -0,0 +1,512 @@
+// Package client watches a stream from Go. It does what a viewer must:
+// the upgrade and the hello, the binary frame headers of whichever
+// protocol version the server settles on, control messages, answering
+// pings and sending the heartbeats a server may require, and
+// reconnecting when the connection drops, resuming from the last frame
+// received so a server holding a history replays what was missed.
+//
+// The package is a module of its own, as is the protocol package it
+// imports, and needs nothing outside the standard library but
+// gorilla/websocket, so a program using it requires none of the
+// capture, encoding and streaming modules the server does.
+package client
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "image/jpeg"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+const (
+    handshakeTimeout = 10 * time.Second
+    writeWait        = 10 * time.Second
+    // readTimeout is how long a connection may go without a message or a
+    // ping before it is taken for dead. The server pings every
+    // ping_interval, 15 seconds unless configured otherwise.
+    readTimeout = time.Minute
+    // Reconnect attempts start minBackoff apart and back off to
+    // maxBackoff.
+    minBackoff = 500 * time.Millisecond
+    maxBackoff = 30 * time.Second
+    // frameBuffer is how many frames wait for the consumer before the
+    // reader stops reading, leaving the server to drop frames for it as
+    // for any slow viewer.
+    frameBuffer = 8
+)
+
+// Params adjusts the stream the server sends; see SetParams.
+type Params = protocol.Params
+
+var (
+    // ErrClosed is returned for a stream after Close.
+    ErrClosed = errors.New("client: stream closed")
+    // ErrH264 is returned by Frame.Image for an H.264 frame, which needs
+    // a video decoder.
+    ErrH264 = errors.New("client: H.264 frames do not decode to an image")
+)
+
+// Frame is a video frame as the server sent it.
+type Frame struct {
+    // Seq counts the stream's frames from 1. It is 0 for a still, the
+    // startup or offline picture a server may send before live frames.
+    Seq       uint64
+    Timestamp time.Time
+    // H264 is set for an H.264 access unit in Annex-B form, and Keyframe
+    // for one a decoder can start from. Data is otherwise a JPEG, every
+    // one of which is a keyframe.
+    H264     bool
+    Keyframe bool
+    Data     []byte
+}
+
+// Still reports whether f is a still rather than a captured frame.
+func (f Frame) Still() bool { return f.Seq == 0 }
+
+// Image decodes a JPEG frame.
+func (f Frame) Image() (image.Image, error) {
+    if f.H264 {
+        return nil, ErrH264
+    }
+    return jpeg.Decode(bytes.NewReader(f.Data))
+}
+
+// HTTPError is the server refusing a request with an HTTP status, such as
+// 403 for a bad token, 404 for an unknown stream or 429 for too many
+// viewers.
+type HTTPError struct {
+    StatusCode int
+    Message    string
+}
+
+func (e *HTTPError) Error() string {
+    if e.Message == "" {
+        return fmt.Sprintf("client: server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+    }
+    return fmt.Sprintf("client: server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// permanent reports whether asking again cannot help.
+func (e *HTTPError) permanent() bool {
+    switch e.StatusCode {
+    case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+        return true
+    }
+    return false
+}
+
+func httpError(resp *http.Response) error {
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+    return &HTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// Stream is a connection to one of the server's streams, kept up until
+// Close.
+type Stream struct {
+    url    *url.URL
+    opts   options
+    dialer websocket.Dialer
+    header http.Header
+    http   *http.Client
+    frames chan Frame
+    ctx    context.Context
+    cancel context.CancelFunc
+    done   chan struct{}
+
+    // lastSeq is the newest frame received, for resuming from. Only the
+    // reader touches it.
+    lastSeq uint64
+
+    // writeMu orders the messages written to the connection.
+    writeMu sync.Mutex
+
+    mu      sync.Mutex
+    conn    *websocket.Conn
+    hello   protocol.Hello
+    version protocol.Version
+    params  Params
+    err     error
+}
+
+// Dial connects to a stream's websocket URL, such as ws://host:8080/ws
+// for the default stream or wss://host/ws/{stream} for a named one, and
+// waits for the hello. ctx bounds the first connection only; the stream
+// runs until Close.
+func Dial(ctx context.Context, rawURL string, opts ...Option) (*Stream, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    if u.Scheme != "ws" && u.Scheme != "wss" {
+        return nil, fmt.Errorf("client: %s is not a ws:// or wss:// URL", rawURL)
+    }
+    s := &Stream{url: u, frames: make(chan Frame, frameBuffer), done: make(chan struct{})}
+    for _, opt := range opts {
+        opt(&s.opts)
+    }
+    if err := s.opts.params.Validate(); err != nil {
+        return nil, fmt.Errorf("client: %w", err)
+    }
+    s.params = s.opts.params
+    s.dialer = websocket.Dialer{
+        Proxy:            http.ProxyFromEnvironment,
+        HandshakeTimeout: handshakeTimeout,
+        TLSClientConfig:  s.opts.tls,
+        Subprotocols:     protocol.Subprotocols,
+    }
+    s.header = make(http.Header)
+    if s.opts.token != "" {
+        s.header.Set("Authorization", "Bearer "+s.opts.token)
+    }
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    t.TLSClientConfig = s.opts.tls
+    s.http = &http.Client{Transport: t}
+
+    s.ctx, s.cancel = context.WithCancel(context.Background())
+    conn, err := s.connect(ctx)
+    if err != nil {
+        s.cancel()
+        return nil, err
+    }
+    go s.run(conn)
+    return s, nil
+}
+
+// Frames returns the frames as they arrive. It is closed by Close, or
+// when the stream ends for good; Err then says why.
+func (s *Stream) Frames() <-chan Frame { return s.frames }
+
+// Err returns what ended the stream: nil while it runs and after Close,
+// otherwise the error it could not reconnect after.
+func (s *Stream) Err() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.err
+}
+
+// Hello returns the hello of the current connection.
+func (s *Stream) Hello() protocol.Hello {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.hello
+}
+
+// SetParams changes the size, rate and quality the server sends, as
+// set_params does; zero fields leave the stream's own. The parameters are
+// kept and sent again on every reconnect, so an error writing them to a
+// connection that has just dropped is not lost.
+func (s *Stream) SetParams(p Params) error {
+    if err := p.Validate(); err != nil {
+        return fmt.Errorf("client: %w", err)
+    }
+    s.mu.Lock()
+    s.params = p
+    conn := s.conn
+    s.mu.Unlock()
+    return s.write(conn, protocol.Control{Type: protocol.TypeSetParams, Params: p})
+}
+
+// Snapshot fetches the stream's latest frame from the server's /snapshot
+// endpoint, at the width last asked for with SetParams. H.264 streams
+// have none to give.
+func (s *Stream) Snapshot(ctx context.Context) (image.Image, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.snapshotURL(), nil)
+    if err != nil {
+        return nil, err
+    }
+    if s.opts.token != "" {
+        req.Header.Set("Authorization", "Bearer "+s.opts.token)
+    }
+    resp, err := s.http.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, httpError(resp)
+    }
+    return jpeg.Decode(resp.Body)
+}
+
+// snapshotURL is the stream's /snapshot URL: its websocket URL over HTTP,
+// with /ws swapped for /snapshot.
+func (s *Stream) snapshotURL() string {
+    u := *s.url
+    u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+    parts := strings.Split(u.Path, "/")
+    for i, p := range parts {
+        if p == "ws" {
+            parts[i] = "snapshot"
+            break
+        }
+    }
+    u.Path = strings.Join(parts, "/")
+    q := make(url.Values)
+    if tok := s.url.Query().Get("token"); tok != "" {
+        q.Set("token", tok)
+    }
+    s.mu.Lock()
+    width := s.params.Width
+    s.mu.Unlock()
+    if width > 0 {
+        q.Set("width", strconv.Itoa(width))
+    }
+    u.RawQuery = q.Encode()
+    return u.String()
+}
+
+// Close ends the stream and closes Frames.
+func (s *Stream) Close() error {
+    s.cancel()
+    s.mu.Lock()
+    conn := s.conn
+    s.conn = nil
+    s.mu.Unlock()
+    if conn != nil {
+        conn.WriteControl(websocket.CloseMessage,
+            websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+        conn.Close()
+    }
+    <-s.done
+    return nil
+}
+
+// connect opens a connection, reads the hello and greets the server.
+func (s *Stream) connect(ctx context.Context) (*websocket.Conn, error) {
+    conn, resp, err := s.dialer.DialContext(ctx, s.url.String(), s.header)
+    if err != nil {
+        if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+            return nil, httpError(resp)
+        }
+        return nil, err
+    }
+    v := protocol.Negotiated(conn.Subprotocol())
+    hello, err := readHello(conn, v)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    // Holding writeMu until the greeting is written keeps a SetParams on
+    // the new connection from going before it.
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    s.mu.Lock()
+    if s.ctx.Err() != nil {
+        s.mu.Unlock()
+        conn.Close()
+        return nil, ErrClosed
+    }
+    s.conn, s.hello, s.version = conn, hello, v
+    p := s.params
+    s.mu.Unlock()
+    if err := s.greet(conn, hello, p); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return conn, nil
+}
+
+func readHello(conn *websocket.Conn, v protocol.Version) (protocol.Hello, error) {
+    var h protocol.Hello
+    conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+    typ, msg, err := conn.ReadMessage()
+    if err != nil {
+        return h, err
+    }
+    if typ != websocket.TextMessage || json.Unmarshal(msg, &h) != nil || h.Type != protocol.TypeHello {
+        return h, errors.New("client: server did not open with a hello")
+    }
+    if h.Version != v {
+        return h, fmt.Errorf("client: hello says %s but %s was negotiated", h.Version, v)
+    }
+    return h, nil
+}
+
+// greet sends what a connection starts with: on a reconnect, a resume
+// from the last frame received, which must come first; audio off, since
+// only video is passed on; and the parameters. The caller holds writeMu.
+func (s *Stream) greet(conn *websocket.Conn, hello protocol.Hello, p Params) error {
+    var msgs []protocol.Control
+    if s.lastSeq > 0 {
+        from := s.lastSeq
+        msgs = append(msgs, protocol.Control{Type: protocol.TypeResume, FromSeq: &from})
+    }
+    if hello.Audio != nil {
+        msgs = append(msgs, protocol.Control{Type: protocol.TypeAudioOff})
+    }
+    if p != (Params{}) {
+        msgs = append(msgs, protocol.Control{Type: protocol.TypeSetParams, Params: p})
+    }
+    conn.SetWriteDeadline(time.Now().Add(writeWait))
+    for _, m := range msgs {
+        if err := conn.WriteJSON(m); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// write sends a control message on conn, which is nil after Close.
+func (s *Stream) write(conn *websocket.Conn, msg protocol.Control) error {
+    if conn == nil {
+        return ErrClosed
+    }
+    s.writeMu.Lock()
+    defer s.writeMu.Unlock()
+    conn.SetWriteDeadline(time.Now().Add(writeWait))
+    return conn.WriteJSON(msg)
+}
+
+// run reads from conn, and from each connection after it, until Close or
+// a failure reconnecting cannot get past.
+func (s *Stream) run(conn *websocket.Conn) {
+    defer close(s.done)
+    defer close(s.frames)
+    for {
+        retry, err := s.read(conn)
+        conn.Close()
+        if s.ctx.Err() != nil {
+            return
+        }
+        if retry {
+            conn, err = s.reconnect()
+        }
+        if err != nil {
+            if s.ctx.Err() == nil {
+                s.mu.Lock()
+                s.err = err
+                s.mu.Unlock()
+            }
+            return
+        }
+    }
+}
+
+// reconnect connects again, backing off between attempts, until it
+// succeeds, the stream is closed or the server refuses it for good.
+func (s *Stream) reconnect() (*websocket.Conn, error) {
+    backoff := minBackoff
+    for {
+        t := time.NewTimer(backoff)
+        select {
+        case <-s.ctx.Done():
+            t.Stop()
+            return nil, ErrClosed
+        case <-t.C:
+        }
+        conn, err := s.connect(s.ctx)
+        if err == nil {
+            return conn, nil
+        }
+        var he *HTTPError
+        if errors.As(err, &he) && he.permanent() {
+            return nil, err
+        }
+        backoff = min(backoff*2, maxBackoff)
+    }
+}
+
+// read passes on conn's frames until it fails, reporting whether to
+// reconnect. A session an administrator ended stays ended, and a message
+// that does not parse means the server is not one this package speaks
+// to; anything else, such as the network dropping or the server
+// restarting or closing a slow viewer, is worth reconnecting after.
+func (s *Stream) read(conn *websocket.Conn) (bool, error) {
+    s.mu.Lock()
+    v, hello := s.version, s.hello
+    s.mu.Unlock()
+    alive := func() { conn.SetReadDeadline(time.Now().Add(readTimeout)) }
+    conn.SetPingHandler(func(data string) error {
+        alive()
+        // A pong that fails to go shows up as a failed read soon enough.
+        conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+        return nil
+    })
+    if l := hello.Session; l != nil && l.RequireActivity && l.IdleMS > 0 {
+        stop := make(chan struct{})
+        defer close(stop)
+        go s.heartbeat(conn, time.Duration(l.IdleMS)*time.Millisecond/3, stop)
+    }
+    for {
+        alive()
+        typ, msg, err := conn.ReadMessage()
+        if err != nil {
+            var ce *websocket.CloseError
+            return !errors.As(err, &ce) || ce.Code != protocol.CloseTerminated, err
+        }
+        if typ == websocket.TextMessage {
+            s.control(msg)
+            continue
+        }
+        h, payload, err := v.Decode(msg)
+        if err != nil {
+            return false, fmt.Errorf("client: %w", err)
+        }
+        f := Frame{Seq: h.Seq, Timestamp: time.UnixMicro(h.Timestamp), Data: payload}
+        switch h.Magic {
+        case protocol.FrameMagic:
+            f.Keyframe = true
+        case protocol.H264KeyMagic:
+            f.H264, f.Keyframe = true, true
+        case protocol.H264Magic:
+            f.H264 = true
+        default:
+            continue // audio, which was turned off, or tiles, never asked for
+        }
+        if f.Seq != 0 {
+            s.lastSeq = f.Seq
+        }
+        select {
+        case s.frames <- f:
+        case <-s.ctx.Done():
+            return false, nil
+        }
+    }
+}
+
+// control handles a text message. Only stats are passed on.
+func (s *Stream) control(msg []byte) {
+    var m struct {
+        Type string `json:"type"`
+    }
+    if json.Unmarshal(msg, &m) != nil {
+        return
+    }
+    if m.Type == protocol.TypeStats && s.opts.onStats != nil {
+        var st protocol.Stats
+        if json.Unmarshal(msg, &st) == nil {
+            s.opts.onStats(st)
+        }
+    }
+}
+
+// heartbeat keeps a server that requires activity from taking the
+// viewer for idle, until stop is closed.
+func (s *Stream) heartbeat(conn *websocket.Conn, every time.Duration, stop <-chan struct{}) {
+    t := time.NewTicker(every)
+    defer t.Stop()
+    for {
+        select {
+        case <-stop:
+            return
+        case <-t.C:
+            if s.write(conn, protocol.Control{Type: protocol.TypeHeartbeat}) != nil {
+                return
+            }
+        }
+    }
+}
@@ -0,0 +1,10 @@
+module github.com/Cdaprod/hdmi-streaming-app/client
+
+go 1.21
+
+require (
+	github.com/Cdaprod/hdmi-streaming-app/protocol v0.0.0
+	github.com/gorilla/websocket v1.4.2
+)
+
+replace github.com/Cdaprod/hdmi-streaming-app/protocol => ../protocol
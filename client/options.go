@@ -0,0 +1,47 @@
+package client
+
+import (
+    "crypto/tls"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// An Option configures a Stream.
+type Option func(*options)
+
+type options struct {
+    token   string
+    tls     *tls.Config
+    params  protocol.Params
+    onStats func(protocol.Stats)
+}
+
+// WithToken authenticates with an API token, sent as a bearer token on
+// the upgrade and on snapshot requests.
+func WithToken(token string) Option {
+    return func(o *options) { o.token = token }
+}
+
+// WithTLSConfig sets the TLS configuration for wss:// and https://
+// connections, such as a pool holding a self-signed server certificate.
+func WithTLSConfig(c *tls.Config) Option {
+    return func(o *options) { o.tls = c }
+}
+
+// WithFPS caps the frame rate the server sends, as set_params does. Zero
+// leaves the stream's own rate.
+func WithFPS(fps int) Option {
+    return func(o *options) { o.params.FPS = fps }
+}
+
+// WithQuality sets the JPEG quality the server encodes at, 1 to 100. Zero
+// leaves the stream's own quality.
+func WithQuality(quality int) Option {
+    return func(o *options) { o.params.Quality = quality }
+}
+
+// WithStats calls fn with each stats message, every couple of seconds.
+// It runs on the stream's reader, so frames wait while it does.
+func WithStats(fn func(protocol.Stats)) Option {
+    return func(o *options) { o.onStats = fn }
+}
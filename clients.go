@@ -0,0 +1,135 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/quota"
+)
+
+// Kinds of viewer listed by /api/clients.
+const (
+    viewerWebsocket = "websocket"
+    viewerMJPEG     = "mjpeg"
+    viewerReplay    = "replay"
+)
+
+// viewers holds every websocket, MJPEG and replay connection being
+// served.
+var viewers viewerSet
+
+type viewerSet struct {
+    mu sync.Mutex
+    m  map[string]*viewer
+}
+
+// counters are what a viewer has been sent, as a hub subscription
+// counts them.
+type counters interface {
+    FramesSent() uint64
+    BytesSent() uint64
+    Dropped() uint64
+}
+
+// viewer is one connection; its counters are read from its subscription,
+// or for a replay from the player. Its session can end it. latency, for a
+// live websocket viewer, reports what its frame acks measured.
+type viewer struct {
+    id        string
+    kind      string
+    stream    string
+    remote    string
+    token     string
+    connected time.Time
+    sub       counters
+    session   *session
+    latency   func() *protocol.Latency
+}
+
+// add lists v until the returned remove is called.
+func (s *viewerSet) add(v *viewer) (remove func()) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.m == nil {
+        s.m = make(map[string]*viewer)
+    }
+    s.m[v.id] = v
+    return func() {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        delete(s.m, v.id)
+    }
+}
+
+type clientInfo struct {
+    ID            string    `json:"id"`
+    Kind          string    `json:"kind"`
+    Stream        string    `json:"stream"`
+    Remote        string    `json:"remote"`
+    Token         string    `json:"token,omitempty"`
+    Connected     time.Time `json:"connected"`
+    FramesSent    uint64    `json:"frames_sent"`
+    BytesSent     uint64    `json:"bytes_sent"`
+    FramesDropped uint64    `json:"frames_dropped"`
+    // SessionRemaining and IdleRemaining are the seconds left before
+    // session_max_duration and session_idle_timeout end the session.
+    SessionRemaining *float64 `json:"session_remaining,omitempty"`
+    IdleRemaining    *float64 `json:"idle_remaining,omitempty"`
+    // Latency is set once the viewer has sent frame acks.
+    Latency *protocol.Latency `json:"latency,omitempty"`
+}
+
+// info describes v at now.
+func (v *viewer) info(now time.Time) clientInfo {
+    ci := clientInfo{
+        ID:            v.id,
+        Kind:          v.kind,
+        Stream:        v.stream,
+        Remote:        v.remote,
+        Token:         v.token,
+        Connected:     v.connected,
+        FramesSent:    v.sub.FramesSent(),
+        BytesSent:     v.sub.BytesSent(),
+        FramesDropped: v.sub.Dropped(),
+    }
+    max, idle := v.session.remaining(now)
+    if max != nil {
+        s := max.Seconds()
+        ci.SessionRemaining = &s
+    }
+    if idle != nil {
+        s := idle.Seconds()
+        ci.IdleRemaining = &s
+    }
+    if v.latency != nil {
+        ci.Latency = v.latency()
+    }
+    return ci
+}
+
+type clientsResponse struct {
+    Clients []clientInfo `json:"clients"`
+    // Tokens is today's usage of every token seen since startup.
+    Tokens []quota.Usage `json:"tokens"`
+}
+
+// clientsHandler serves GET /api/clients: the connected viewers, oldest
+// first, with the time left in their sessions, and what each token has
+// been sent today.
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+    resp := clientsResponse{Clients: []clientInfo{}, Tokens: []quota.Usage{}}
+    now := time.Now()
+    viewers.mu.Lock()
+    for _, v := range viewers.m {
+        resp.Clients = append(resp.Clients, v.info(now))
+    }
+    viewers.mu.Unlock()
+    sort.Slice(resp.Clients, func(i, j int) bool { return resp.Clients[i].Connected.Before(resp.Clients[j].Connected) })
+    if authn.TokensRequired() {
+        resp.Tokens = meter.Snapshot()
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
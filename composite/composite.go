@@ -0,0 +1,297 @@
+// Package composite builds a picture-in-picture stream out of two others:
+// a Source that subscribes to both streams' hubs and draws one as an
+// inset over the other, for a hub of its own to publish like any capture
+// device's frames.
+package composite
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/image/draw"
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/basicfont"
+    "golang.org/x/image/math/fixed"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// frameTimeout is how long ReadFrame waits for a base frame before
+// reporting capture.ErrTimeout, so the hub can look up between frames.
+const frameTimeout = time.Second
+
+// ErrNotJPEG is returned by Open when a source stream publishes H.264,
+// which cannot be decoded to draw with.
+var ErrNotJPEG = errors.New("composite: source streams must be JPEG")
+
+// Source composites the frames of two streams. Each frame of the base
+// stream, scaled to the mode's size, becomes a frame with the latest
+// inset frame drawn over it, so the composite keeps the base's pace.
+// An inset that has sent nothing new for longer than the stale time is
+// still shown, marked as stale.
+type Source struct {
+    // Lookup finds a source stream's hub by name when the source is
+    // opened.
+    Lookup func(name string) (*hub.Hub, bool)
+
+    base, inset string
+    stale       time.Duration
+    layout      atomic.Pointer[config.Layout]
+
+    mu   sync.Mutex
+    mode capture.Mode
+    // The subscriptions while open, and the newest inset frame with the
+    // time it was captured.
+    baseSub, insetSub *hub.Subscriber
+    baseHub, insetHub *hub.Hub
+    insetImg          image.Image
+    insetTS           time.Time
+    // scaled is insetImg drawn at the size of the inset last composited.
+    scaled *image.RGBA
+}
+
+// New returns a source for c, framing its pictures at width by height,
+// or at the base stream's size when both are zero.
+func New(c config.Composite, width, height int) *Source {
+    s := &Source{base: c.Base, inset: c.Inset, stale: c.Stale}
+    s.SetLayout(c.Layout)
+    s.SetMode(capture.Mode{Width: width, Height: height})
+    return s
+}
+
+// Layout returns where the inset is drawn.
+func (s *Source) Layout() config.Layout { return *s.layout.Load() }
+
+// SetLayout moves the inset; it applies from the next frame.
+func (s *Source) SetLayout(l config.Layout) { s.layout.Store(&l) }
+
+// Mode returns the size frames are composited at.
+func (s *Source) Mode() capture.Mode {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.mode
+}
+
+// SetMode changes the size frames are composited at. The rate follows
+// the base stream and the format is always YUYV, whatever m says.
+func (s *Source) SetMode(m capture.Mode) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.mode = capture.Mode{Width: m.Width &^ 1, Height: m.Height, Format: capture.FormatYUYV}
+}
+
+// Open subscribes to the two streams. The device is only used in
+// messages.
+func (s *Source) Open(device string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.baseSub != nil {
+        return fmt.Errorf("composite: %s already open", device)
+    }
+    base, ok := s.Lookup(s.base)
+    if !ok {
+        return fmt.Errorf("composite: no stream %q", s.base)
+    }
+    inset, ok := s.Lookup(s.inset)
+    if !ok {
+        return fmt.Errorf("composite: no stream %q", s.inset)
+    }
+    if base.OutputFormat() != capture.FormatMJPEG || inset.OutputFormat() != capture.FormatMJPEG {
+        return ErrNotJPEG
+    }
+    s.baseHub, s.insetHub = base, inset
+    s.baseSub, s.insetSub = base.Subscribe(1), inset.Subscribe(1)
+    // The inset's latest frame starts it off, stale or not.
+    if f := inset.Latest(); f != nil {
+        s.takeInset(f)
+    }
+    return nil
+}
+
+// ReadFrame waits for the next base frame and composites it. A source
+// stream that stops is reported as a lost device, so the hub waits and
+// opens the source again.
+func (s *Source) ReadFrame() (capture.Frame, error) {
+    s.mu.Lock()
+    sub := s.baseSub
+    s.mu.Unlock()
+    if sub == nil {
+        return capture.Frame{}, capture.ErrNotOpen
+    }
+    var f *hub.Frame
+    select {
+    case fr, ok := <-sub.Frames():
+        if !ok {
+            return capture.Frame{}, &capture.DeviceLostError{Device: s.base, Err: streamStopped(sub)}
+        }
+        f = fr
+    case <-time.After(frameTimeout):
+        return capture.Frame{}, capture.ErrTimeout
+    }
+    defer f.Release()
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.baseSub == nil {
+        return capture.Frame{}, capture.ErrNotOpen
+    }
+    img, err := imaging.Decode(f.Frame)
+    if err != nil {
+        return capture.Frame{}, err
+    }
+    s.drainInset()
+    w, h := s.mode.Width, s.mode.Height
+    if w == 0 || h == 0 {
+        b := img.Bounds()
+        w, h = b.Dx()&^1, b.Dy()
+    }
+    out := image.NewRGBA(image.Rect(0, 0, w, h))
+    if img.Bounds().Size() == out.Rect.Size() {
+        draw.Draw(out, out.Rect, img, img.Bounds().Min, draw.Src)
+    } else {
+        draw.ApproxBiLinear.Scale(out, out.Rect, img, img.Bounds(), draw.Src, nil)
+    }
+    if s.insetImg != nil {
+        r := insetRect(s.Layout(), out.Rect, s.insetImg.Bounds().Size())
+        s.drawInset(out, r, s.Layout().Opacity)
+        if time.Since(s.insetTS) > s.stale {
+            drawStale(out, r)
+        }
+    }
+    fb := capture.NewFrameBuffer(w * h * 2)
+    if err := imaging.EncodeYUYVInto(fb.Bytes(), out); err != nil {
+        fb.Release()
+        return capture.Frame{}, err
+    }
+    return capture.Frame{
+        Data:      fb.Bytes(),
+        Format:    capture.FormatYUYV,
+        Width:     w,
+        Height:    h,
+        Timestamp: f.Timestamp,
+        Buf:       fb,
+    }, nil
+}
+
+// streamStopped says why a source stream's subscription closed.
+func streamStopped(sub *hub.Subscriber) error {
+    if err := sub.Err(); err != nil {
+        return err
+    }
+    return hub.ErrStopped
+}
+
+// drainInset takes the newest queued inset frame, if any. A closed
+// subscription leaves the last frame to go stale. The caller holds s.mu.
+func (s *Source) drainInset() {
+    for {
+        select {
+        case f, ok := <-s.insetSub.Frames():
+            if !ok {
+                return
+            }
+            s.takeInset(f)
+        default:
+            return
+        }
+    }
+}
+
+// takeInset decodes f as the inset to draw and releases it. A frame that
+// does not decode leaves the previous one. The caller holds s.mu.
+func (s *Source) takeInset(f *hub.Frame) {
+    defer f.Release()
+    img, err := imaging.Decode(f.Frame)
+    if err != nil {
+        return
+    }
+    s.insetImg, s.insetTS, s.scaled = img, f.Timestamp, nil
+}
+
+// drawInset draws the inset into r of out at opacity, scaling it only
+// when it or r has changed. The caller holds s.mu.
+func (s *Source) drawInset(out *image.RGBA, r image.Rectangle, opacity float64) {
+    if s.scaled == nil || s.scaled.Rect.Size() != r.Size() {
+        s.scaled = image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+        draw.ApproxBiLinear.Scale(s.scaled, s.scaled.Rect, s.insetImg, s.insetImg.Bounds(), draw.Src, nil)
+    }
+    if opacity >= 1 {
+        draw.Draw(out, r, s.scaled, image.Point{}, draw.Src)
+        return
+    }
+    mask := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+    draw.DrawMask(out, r, s.scaled, image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// insetRect is where an inset of size goes in out under l: l.Size of
+// out's width, keeping its shape but no taller than out, in l's corner
+// with a margin of 1/40 of out's width.
+func insetRect(l config.Layout, out image.Rectangle, size image.Point) image.Rectangle {
+    margin := out.Dx() / 40
+    w := max(int(float64(out.Dx())*l.Size), 2)
+    h := w * size.Y / max(size.X, 1)
+    if maxH := out.Dy() - 2*margin; h > maxH {
+        h = max(maxH, 2)
+        w = h * size.X / max(size.Y, 1)
+    }
+    w = min(w, out.Dx()-2*margin)
+    x, y := out.Min.X+margin, out.Min.Y+margin
+    if l.Position == config.TopRight || l.Position == config.BottomRight {
+        x = out.Max.X - margin - w
+    }
+    if l.Position == config.BottomLeft || l.Position == config.BottomRight {
+        y = out.Max.Y - margin - h
+    }
+    return image.Rect(x, y, x+w, y+h).Intersect(out)
+}
+
+var (
+    badgeOnce sync.Once
+    badge     *image.RGBA
+)
+
+// staleBadge is the marker drawn on a stale inset, at 1x: white text on
+// red, scaled up to suit the picture.
+func staleBadge() *image.RGBA {
+    badgeOnce.Do(func() {
+        const text = "STALE"
+        face := basicfont.Face7x13
+        b := image.NewRGBA(image.Rect(0, 0, len(text)*face.Advance+4, face.Height+2))
+        draw.Draw(b, b.Rect, image.NewUniform(color.RGBA{R: 0xC0, A: 0xFF}), image.Point{}, draw.Src)
+        d := &font.Drawer{Dst: b, Src: image.White, Face: face, Dot: fixed.P(2, face.Ascent+1)}
+        d.DrawString(text)
+        badge = b
+    })
+    return badge
+}
+
+// drawStale marks the inset at r of out as stale, in its top left corner.
+func drawStale(out *image.RGBA, r image.Rectangle) {
+    b := staleBadge()
+    scale := max(out.Rect.Dy()/360, 1)
+    dst := image.Rect(0, 0, b.Rect.Dx()*scale, b.Rect.Dy()*scale).Add(r.Min).Intersect(r)
+    draw.NearestNeighbor.Scale(out, dst, b, image.Rect(0, 0, dst.Dx()/scale, dst.Dy()/scale), draw.Src, nil)
+}
+
+// Close ends the subscriptions. The stream's frames stop, and the inset
+// is forgotten.
+func (s *Source) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.baseSub == nil {
+        return nil
+    }
+    s.baseHub.Unsubscribe(s.baseSub)
+    s.insetHub.Unsubscribe(s.insetSub)
+    s.baseSub, s.insetSub, s.baseHub, s.insetHub = nil, nil, nil, nil
+    s.insetImg, s.scaled = nil, nil
+    return nil
+}
@@ -0,0 +1,998 @@
+// Package config loads server settings from a YAML file, the environment
+// and the command line.
+package config
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/url"
+    "os"
+    "path"
+    "reflect"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to the upper-cased YAML key to form the
+// environment variable for a setting, e.g. HDMI_STREAM_LISTEN_ADDR.
+const EnvPrefix = "HDMI_STREAM_"
+
+// Config holds every setting. Each field is addressed by its yaml tag: the
+// same name (with '-' for '_') is the command-line flag and, prefixed with
+// EnvPrefix, the environment variable. Fields tagged secret are redacted
+// by String, and fields tagged flag:"-" can only be set from the file.
+type Config struct {
+    ListenAddr      string        `yaml:"listen_addr" help:"address to serve HTTP on"`
+    DevicePath      string        `yaml:"device" help:"V4L2 capture device, or synthetic:WIDTHxHEIGHT@FPS for a generated test picture"`
+    Width           int           `yaml:"width" help:"capture width (0 = driver default)"`
+    Height          int           `yaml:"height" help:"capture height (0 = driver default)"`
+    FPS             int           `yaml:"fps" help:"capture frame rate (0 = driver default)"`
+    JPEGQuality     int           `yaml:"jpeg_quality" help:"JPEG quality for re-encoded frames"`
+    EncodeWorkers   int           `yaml:"encode_workers" help:"JPEG encoder goroutines (0 = GOMAXPROCS)"`
+    Encoder         string        `yaml:"encoder" help:"websocket video encoder: jpeg or h264-v4l2m2m"`
+    H264Device      string        `yaml:"h264_device" help:"V4L2 memory-to-memory H.264 encoder device"`
+    KeyframeEvery   int           `yaml:"keyframe_interval" help:"frames between H.264 keyframes"`
+    H264Bitrate     int           `yaml:"h264_bitrate" help:"H.264 target bitrate in bits per second"`
+    AllowedOrigins  []string      `yaml:"allowed_origins" help:"comma-separated origins allowed to open the websocket"`
+    TLSCert         string        `yaml:"tls_cert" help:"TLS certificate file"`
+    TLSKey          string        `yaml:"tls_key" secret:"true" help:"TLS private key file"`
+    TLSAutocert     bool          `yaml:"tls_autocert" help:"obtain certificates from Let's Encrypt"`
+    AutocertHosts   []string      `yaml:"autocert_hosts" help:"comma-separated host names autocert may request certificates for"`
+    AutocertCache   string        `yaml:"autocert_cache" help:"directory autocert stores certificates in"`
+    RedirectAddr    string        `yaml:"redirect_addr" help:"plain-HTTP address redirecting to HTTPS when TLS is on (empty = none)"`
+    BasePath        string        `yaml:"base_path" help:"path prefix a reverse proxy serves the server under, e.g. /hdmi (empty = none)"`
+    CORSOrigins     []string      `yaml:"cors_origins" help:"comma-separated origins whose pages may call the API, snapshots and HLS from scripts (* = any)"`
+    CORSMethods     []string      `yaml:"cors_methods" help:"comma-separated methods allowed in cross-origin requests"`
+    CORSHeaders     []string      `yaml:"cors_headers" help:"comma-separated request headers allowed in cross-origin requests"`
+    CORSMaxAge      time.Duration `yaml:"cors_max_age" help:"how long browsers may cache a CORS preflight answer"`
+    ShutdownGrace   time.Duration `yaml:"shutdown_grace" help:"how long shutdown waits for clients to finish"`
+    PingInterval    time.Duration `yaml:"ping_interval" help:"websocket keepalive ping interval"`
+    MJPEGFPS        int           `yaml:"mjpeg_fps" help:"frame rate MJPEG viewers are sent unless they ask for one with ?fps= (0 = the device's)"`
+    MaxConnections  int           `yaml:"max_connections" help:"most websocket and MJPEG viewers served at once (0 = unlimited)"`
+    MaxPerIP        int           `yaml:"max_connections_per_ip" help:"most viewers served at once to one address (0 = unlimited)"`
+    ConnectRate     int           `yaml:"connect_rate" help:"viewer connection attempts allowed per address per minute (0 = unlimited)"`
+    SessionMax      time.Duration `yaml:"session_max_duration" help:"longest a viewer connection may last (0 = unlimited)"`
+    SessionIdle     time.Duration `yaml:"session_idle_timeout" help:"how long a websocket viewer may go unheard from before it is closed (0 = never)"`
+    RequireActivity bool          `yaml:"require_activity" help:"count only the viewer's own messages, not pongs, as activity for session_idle_timeout"`
+    TrustedProxies  []string      `yaml:"trusted_proxies" help:"comma-separated CIDRs of proxies whose X-Forwarded-For is believed"`
+    AudioDevice     string        `yaml:"audio_device" help:"ALSA capture device, e.g. hw:1,0 (empty = no audio)"`
+    AudioRate       int           `yaml:"audio_rate" help:"audio sample rate in Hz"`
+    AudioChannels   int           `yaml:"audio_channels" help:"audio channel count"`
+    ReplayWindow    time.Duration `yaml:"replay_window" help:"how much recent video is kept for websocket clients resuming after a reconnect (0 = none)"`
+    ReplayBytes     int           `yaml:"replay_bytes" help:"memory cap per stream for replay_window, in bytes"`
+    RTSPAddr        string        `yaml:"rtsp_addr" help:"address to serve RTSP on (empty = off)"`
+    MDNS            bool          `yaml:"mdns" help:"advertise the server on the local network over mDNS"`
+    StartupImage    string        `yaml:"startup_image" help:"PNG or JPEG viewers see while a stream's device opens (empty = generated)"`
+    OfflineImage    string        `yaml:"offline_image" help:"PNG or JPEG viewers see while a stream's device has failed to open (empty = generated)"`
+    RecordDir       string        `yaml:"record_dir" help:"directory recordings are written to"`
+    RecordSegment   time.Duration `yaml:"record_segment" help:"length of each recording file"`
+    RecordFPS       int           `yaml:"record_fps" help:"frame rate recordings are made at unless started with another (0 = the device's)"`
+    RecordPrebuffer time.Duration `yaml:"record_prebuffer" help:"how much recent video is kept per stream for recordings to start with; needs on_demand off (0 = none)"`
+    PrebufferBytes  int           `yaml:"record_prebuffer_bytes" help:"memory cap per stream for record_prebuffer, in bytes"`
+    AdaptiveQuality bool          `yaml:"adaptive_quality" help:"lower quality or frame rate for websocket clients that fall behind"`
+    SlowPolicy      string        `yaml:"slow_client_policy" help:"what happens to websocket clients that keep dropping frames: drop or disconnect"`
+    SlowPercent     int           `yaml:"slow_client_drop_percent" help:"share of frames a client must be dropping to count as slow, in percent"`
+    SlowTimeout     time.Duration `yaml:"slow_client_timeout" help:"how long a client may stay slow before slow_client_policy disconnect closes it"`
+    Delta           bool          `yaml:"delta" help:"let websocket clients of JPEG streams ask for only the changed tiles of each frame"`
+    DeltaKeyframe   time.Duration `yaml:"delta_keyframe_interval" help:"how often a delta client is sent a whole frame regardless"`
+    MotionWebhook   string        `yaml:"motion_webhook" secret:"true" help:"URL motion events are POSTed to (empty = no motion detection)"`
+    MotionThreshold float64       `yaml:"motion_threshold" help:"change score, 0 to 1, over which a frame counts as motion"`
+    MotionFrames    int           `yaml:"motion_frames" help:"consecutive changed frames that start a motion event"`
+    MotionCooldown  time.Duration `yaml:"motion_cooldown" help:"how long the picture must be still for a motion event to end"`
+    MotionFPS       int           `yaml:"motion_sample_fps" help:"frames a second the motion detector looks at"`
+    MotionClip      bool          `yaml:"motion_clip" help:"save the record_prebuffer before each motion_started event as a recording named in the event"`
+    OnDemand        bool          `yaml:"on_demand" help:"open the capture device only while clients are watching"`
+    IdleTimeout     time.Duration `yaml:"idle_timeout" help:"how long an on-demand device stays open with no clients"`
+    FFmpegPath      string        `yaml:"ffmpeg_path" help:"ffmpeg binary used to encode WebRTC and HLS video"`
+    LogLevel        slog.Level    `yaml:"log_level" help:"debug, info, warn or error"`
+    ReadyFrameAge   time.Duration `yaml:"ready_frame_age" help:"how recent the last frame must be for /readyz to report a running device ready"`
+    FrozenFrames    int           `yaml:"signal_frozen_frames" help:"identical frames in a row that count as a lost input signal (0 = off)"`
+    TokenDailyBytes int64         `yaml:"token_daily_bytes" help:"bytes each access token may be sent per day before its viewers are cut off (0 = unlimited)"`
+    AuditLog        string        `yaml:"audit_log" help:"file every state-changing API call is appended to as a JSON line; required with tokens (empty = none)"`
+    StatsFile       string        `yaml:"stats_file" help:"file per-minute stream statistics are kept in for /api/stats (empty = none)"`
+    StatsRetention  time.Duration `yaml:"stats_retention" help:"how long stream statistics are kept (0 = forever)"`
+    Tokens          []Token       `yaml:"tokens" secret:"true" flag:"-"`
+    ICEServers      []ICEServer   `yaml:"ice_servers" secret:"true" flag:"-"`
+    Overlay         Overlay       `yaml:"overlay" flag:"-"`
+    Streams         []Stream      `yaml:"streams" flag:"-"`
+    Sinks           []Sink        `yaml:"sinks" secret:"true" flag:"-"`
+
+    // SelfTest is the -selftest flag: probe the devices and exit instead
+    // of serving. It is not a setting, so it has no key.
+    SelfTest bool `yaml:"-"`
+}
+
+// Stream declares one capture device served under its own name. Zero
+// fields take the value of the top-level setting of the same name.
+type Stream struct {
+    Name          string `yaml:"name"`
+    Device        string `yaml:"device"`
+    Width         int    `yaml:"width"`
+    Height        int    `yaml:"height"`
+    FPS           int    `yaml:"fps"`
+    JPEGQuality   int    `yaml:"jpeg_quality"`
+    EncodeWorkers int    `yaml:"encode_workers"`
+    AudioDevice   string `yaml:"audio_device"`
+    AudioRate     int    `yaml:"audio_rate"`
+    AudioChannels int    `yaml:"audio_channels"`
+    // Overlay, when set, says which elements this stream draws; its zero
+    // position, font size and opacity take the top-level one's.
+    Overlay *Overlay `yaml:"overlay"`
+    // StartupImage and OfflineImage take the top-level ones when empty.
+    StartupImage string `yaml:"startup_image"`
+    OfflineImage string `yaml:"offline_image"`
+    // Composite, when set, makes the stream a picture-in-picture of two
+    // others instead of a device of its own. Width and height are then
+    // the size of the picture, zero for the base stream's.
+    Composite *Composite `yaml:"composite"`
+}
+
+// Composite shows the stream Inset as a small picture over a corner of
+// the stream Base. Frames come as Base's do.
+type Composite struct {
+    Base   string `yaml:"base"`
+    Inset  string `yaml:"inset"`
+    Layout Layout `yaml:"layout"`
+    // Stale is how long the inset may go without a new frame before its
+    // last one is shown marked as stale.
+    Stale time.Duration `yaml:"stale"`
+}
+
+// Layout places a composite's inset. It is also the body of
+// /api/streams/{name}/layout.
+type Layout struct {
+    // Position is the corner the inset sits in.
+    Position string `yaml:"position" json:"position"`
+    // Size is the inset's width as a share of the picture's; its height
+    // keeps the inset stream's shape.
+    Size    float64 `yaml:"size" json:"size"`
+    Opacity float64 `yaml:"opacity" json:"opacity"`
+}
+
+// Validate checks l, naming its settings under key.
+func (l Layout) Validate(key string) error {
+    switch l.Position {
+    case TopLeft, TopRight, BottomLeft, BottomRight:
+    default:
+        return &FieldError{key + ".position", l.Position, "must be top-left, top-right, bottom-left or bottom-right"}
+    }
+    if l.Size < 0.05 || l.Size > 1 {
+        return &FieldError{key + ".size", l.Size, "must be between 0.05 and 1"}
+    }
+    if l.Opacity <= 0 || l.Opacity > 1 {
+        return &FieldError{key + ".opacity", l.Opacity, "must be above 0 and at most 1"}
+    }
+    return nil
+}
+
+// Overlay is text burned into a stream's frames before any output sees
+// them. It is also the body of /api/overlay.
+type Overlay struct {
+    Timestamp  bool   `yaml:"timestamp" json:"timestamp"`
+    StreamName bool   `yaml:"stream_name" json:"stream_name"`
+    Watermark  string `yaml:"watermark" json:"watermark"`
+    // Position is the corner the text sits in.
+    Position string `yaml:"position" json:"position"`
+    // FontSize is the height of a line of text in pixels, rounded to a
+    // multiple of 13, the height of the built-in font.
+    FontSize int `yaml:"font_size" json:"font_size"`
+    // Opacity is that of the text; its backing box is half as opaque.
+    Opacity float64 `yaml:"opacity" json:"opacity"`
+}
+
+// Enabled reports whether the overlay draws anything.
+func (o Overlay) Enabled() bool { return o.Timestamp || o.StreamName || o.Watermark != "" }
+
+// Corners accepted by an overlay's position.
+const (
+    TopLeft     = "top-left"
+    TopRight    = "top-right"
+    BottomLeft  = "bottom-left"
+    BottomRight = "bottom-right"
+)
+
+// Validate checks o, naming its settings under key.
+func (o Overlay) Validate(key string) error {
+    switch o.Position {
+    case TopLeft, TopRight, BottomLeft, BottomRight:
+    default:
+        return &FieldError{key + ".position", o.Position, "must be top-left, top-right, bottom-left or bottom-right"}
+    }
+    if o.FontSize < 13 || o.FontSize > 130 {
+        return &FieldError{key + ".font_size", o.FontSize, "must be between 13 and 130"}
+    }
+    if o.Opacity <= 0 || o.Opacity > 1 {
+        return &FieldError{key + ".opacity", o.Opacity, "must be above 0 and at most 1"}
+    }
+    for _, r := range o.Watermark {
+        if r < ' ' || r > '~' {
+            return &FieldError{key + ".watermark", o.Watermark, "must be printable ASCII"}
+        }
+    }
+    return nil
+}
+
+// DefaultStream names the stream built from the top-level settings when
+// no streams are declared.
+const DefaultStream = "default"
+
+var validStreamName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ReservedStream cannot name a stream: /ws/replay/ serves recordings.
+const ReservedStream = "replay"
+
+// Token is an access token accepted by the websocket endpoint. A zero
+// Expires never expires, and a zero DailyBytes takes token_daily_bytes.
+// Role says which API endpoints it may call; empty is RoleViewer.
+type Token struct {
+    ID         string    `yaml:"id"`
+    Secret     string    `yaml:"token"`
+    Expires    time.Time `yaml:"expires"`
+    DailyBytes int64     `yaml:"daily_bytes"`
+    Role       string    `yaml:"role"`
+}
+
+// Token roles, each allowed everything the ones before it are. A viewer
+// may only watch over the websocket and take snapshots; an operator may
+// also watch over MJPEG, HLS, WebRTC and RTSP, list and replay recordings,
+// read the API's streams and stats, record and control sinks; an admin
+// may also change device controls and end sessions.
+const (
+    RoleViewer   = "viewer"
+    RoleOperator = "operator"
+    RoleAdmin    = "admin"
+)
+
+// Sink is a command fed one stream's frames on its standard input, such
+// as ffmpeg pushing to an RTMP server. An empty Stream is the first
+// stream, and a zero MaxRestarts takes DefaultSinkRestarts.
+type Sink struct {
+    Name        string   `yaml:"name"`
+    Stream      string   `yaml:"stream"`
+    Command     []string `yaml:"command"`
+    Input       string   `yaml:"input"`
+    AutoStart   bool     `yaml:"autostart"`
+    MaxRestarts int      `yaml:"max_restarts"`
+    // FPS caps the frames the command is fed a second; zero feeds it
+    // every frame.
+    FPS int `yaml:"fps"`
+}
+
+// Inputs accepted by a sink's input setting: frames as the stream
+// publishes them, JPEG or H.264, or JPEG decoded to packed YUYV 4:2:2.
+const (
+    SinkEncoded = "encoded"
+    SinkRaw     = "raw"
+)
+
+// DefaultSinkRestarts is how many times in a row a sink's command is
+// restarted before it is given up on.
+const DefaultSinkRestarts = 5
+
+// ICEServer is a STUN or TURN server offered to WebRTC peers.
+type ICEServer struct {
+    URLs       []string `yaml:"urls"`
+    Username   string   `yaml:"username"`
+    Credential string   `yaml:"credential"`
+}
+
+// Encoders accepted by the encoder setting.
+const (
+    EncoderJPEG = "jpeg"
+    EncoderH264 = "h264-v4l2m2m"
+)
+
+// Policies accepted by slow_client_policy: keep dropping frames for a
+// client that cannot keep up, or disconnect it.
+const (
+    SlowDrop       = "drop"
+    SlowDisconnect = "disconnect"
+)
+
+// Default returns the settings used when nothing overrides them.
+func Default() Config {
+    return Config{
+        ListenAddr:      ":8080",
+        DevicePath:      "/dev/video0",
+        JPEGQuality:     80,
+        Encoder:         EncoderJPEG,
+        H264Device:      "/dev/video11",
+        KeyframeEvery:   60,
+        H264Bitrate:     4000000,
+        AutocertCache:   "autocert-cache",
+        RedirectAddr:    ":80",
+        CORSMethods:     []string{"GET", "POST", "DELETE"},
+        CORSHeaders:     []string{"Authorization", "Content-Type"},
+        CORSMaxAge:      10 * time.Minute,
+        ShutdownGrace:   10 * time.Second,
+        PingInterval:    15 * time.Second,
+        MaxConnections:  64,
+        MaxPerIP:        8,
+        ConnectRate:     30,
+        AudioRate:       48000,
+        AudioChannels:   2,
+        ReplayWindow:    2 * time.Second,
+        ReplayBytes:     8 << 20,
+        RTSPAddr:        ":8554",
+        MDNS:            true,
+        RecordDir:       "recordings",
+        StatsFile:       "stats.log",
+        StatsRetention:  30 * 24 * time.Hour,
+        RecordSegment:   5 * time.Minute,
+        PrebufferBytes:  32 << 20,
+        AdaptiveQuality: true,
+        SlowPolicy:      SlowDrop,
+        SlowPercent:     50,
+        SlowTimeout:     10 * time.Second,
+        DeltaKeyframe:   10 * time.Second,
+        MotionThreshold: 0.05,
+        MotionFrames:    3,
+        MotionCooldown:  10 * time.Second,
+        MotionFPS:       5,
+        OnDemand:        true,
+        IdleTimeout:     30 * time.Second,
+        FFmpegPath:      "ffmpeg",
+        ReadyFrameAge:   5 * time.Second,
+        Overlay:         Overlay{Position: TopLeft, FontSize: 26, Opacity: 0.8},
+    }
+}
+
+// FieldError reports a setting with an unacceptable value.
+type FieldError struct {
+    Field  string
+    Value  interface{}
+    Reason string
+}
+
+func (e *FieldError) Error() string {
+    return fmt.Sprintf("config: %s: invalid value %v: %s", e.Field, e.Value, e.Reason)
+}
+
+// Load builds the configuration from defaults, then the YAML file named by
+// -config, then environment variables, then the remaining flags in args.
+// lookupEnv is normally os.LookupEnv.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+    cfg := Default()
+
+    fs := flag.NewFlagSet("hdmi-streaming-app", flag.ContinueOnError)
+    path := fs.String("config", "", "YAML configuration file")
+    fs.BoolVar(&cfg.SelfTest, "selftest", false, "check that every capture device can be opened, print the result and exit")
+    set := map[string]string{}
+    for _, f := range fields() {
+        f := f
+        if f.fileOnly {
+            continue
+        }
+        fs.Func(flagName(f.key), f.help, func(v string) error {
+            set[f.key] = v
+            return nil
+        })
+    }
+    if err := fs.Parse(args); err != nil {
+        return cfg, err
+    }
+
+    if *path != "" {
+        if err := cfg.loadFile(*path); err != nil {
+            return cfg, err
+        }
+    }
+
+    for _, f := range fields() {
+        if f.fileOnly {
+            continue
+        }
+        if v, ok := lookupEnv(envName(f.key)); ok {
+            if err := cfg.set(f.key, v); err != nil {
+                return cfg, err
+            }
+        }
+    }
+    for _, f := range fields() {
+        if v, ok := set[f.key]; ok {
+            if err := cfg.set(f.key, v); err != nil {
+                return cfg, err
+            }
+        }
+    }
+    return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("config: %w", err)
+    }
+    defer f.Close()
+    dec := yaml.NewDecoder(f)
+    dec.KnownFields(true)
+    if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+        return fmt.Errorf("config: %s: %w", path, err)
+    }
+    return nil
+}
+
+// Validate checks every field and reports the first bad one.
+func (c Config) Validate() error {
+    if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+        return &FieldError{"listen_addr", c.ListenAddr, "must be host:port"}
+    }
+    if c.DevicePath == "" {
+        return &FieldError{"device", `""`, "must not be empty"}
+    }
+    if c.Width < 0 {
+        return &FieldError{"width", c.Width, "must not be negative"}
+    }
+    if c.Height < 0 {
+        return &FieldError{"height", c.Height, "must not be negative"}
+    }
+    if c.FPS < 0 || c.FPS > 120 {
+        return &FieldError{"fps", c.FPS, "must be between 0 and 120"}
+    }
+    if c.JPEGQuality < 1 || c.JPEGQuality > 100 {
+        return &FieldError{"jpeg_quality", c.JPEGQuality, "must be between 1 and 100"}
+    }
+    if c.EncodeWorkers < 0 {
+        return &FieldError{"encode_workers", c.EncodeWorkers, "must not be negative"}
+    }
+    if c.Encoder != EncoderJPEG && c.Encoder != EncoderH264 {
+        return &FieldError{"encoder", c.Encoder, "must be " + EncoderJPEG + " or " + EncoderH264}
+    }
+    if c.KeyframeEvery <= 0 {
+        return &FieldError{"keyframe_interval", c.KeyframeEvery, "must be positive"}
+    }
+    if c.H264Bitrate <= 0 {
+        return &FieldError{"h264_bitrate", c.H264Bitrate, "must be positive"}
+    }
+    if err := c.validateTLS(); err != nil {
+        return err
+    }
+    if c.ShutdownGrace < 0 {
+        return &FieldError{"shutdown_grace", c.ShutdownGrace, "must not be negative"}
+    }
+    if c.PingInterval <= 0 {
+        return &FieldError{"ping_interval", c.PingInterval, "must be positive"}
+    }
+    if c.MaxConnections < 0 {
+        return &FieldError{"max_connections", c.MaxConnections, "must not be negative"}
+    }
+    if c.MaxPerIP < 0 {
+        return &FieldError{"max_connections_per_ip", c.MaxPerIP, "must not be negative"}
+    }
+    if c.SessionMax < 0 {
+        return &FieldError{"session_max_duration", c.SessionMax, "must not be negative"}
+    }
+    // Pongs only arrive every ping_interval.
+    if c.SessionIdle != 0 && c.SessionIdle <= c.PingInterval {
+        return &FieldError{"session_idle_timeout", c.SessionIdle, "must be 0 or longer than ping_interval"}
+    }
+    if c.RequireActivity && c.SessionIdle == 0 {
+        return &FieldError{"require_activity", c.RequireActivity, "needs a session_idle_timeout"}
+    }
+    if c.StatsRetention < 0 {
+        return &FieldError{"stats_retention", c.StatsRetention, "must not be negative"}
+    }
+    if c.ConnectRate < 0 {
+        return &FieldError{"connect_rate", c.ConnectRate, "must not be negative"}
+    }
+    for _, p := range c.TrustedProxies {
+        if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+            return &FieldError{"trusted_proxies", p, "must be a CIDR or an IP address"}
+        }
+    }
+    if c.AudioRate < 8000 || c.AudioRate > 192000 {
+        return &FieldError{"audio_rate", c.AudioRate, "must be between 8000 and 192000"}
+    }
+    if c.AudioChannels < 1 || c.AudioChannels > 8 {
+        return &FieldError{"audio_channels", c.AudioChannels, "must be between 1 and 8"}
+    }
+    if c.ReplayWindow < 0 {
+        return &FieldError{"replay_window", c.ReplayWindow, "must not be negative"}
+    }
+    if c.ReplayBytes < 0 {
+        return &FieldError{"replay_bytes", c.ReplayBytes, "must not be negative"}
+    }
+    if c.RTSPAddr != "" {
+        if _, _, err := net.SplitHostPort(c.RTSPAddr); err != nil {
+            return &FieldError{"rtsp_addr", c.RTSPAddr, "must be host:port"}
+        }
+    }
+    if c.RecordDir == "" {
+        return &FieldError{"record_dir", `""`, "must not be empty"}
+    }
+    if c.RecordSegment <= 0 {
+        return &FieldError{"record_segment", c.RecordSegment, "must be positive"}
+    }
+    if c.RecordFPS < 0 || c.RecordFPS > 120 {
+        return &FieldError{"record_fps", c.RecordFPS, "must be between 0 and 120"}
+    }
+    if c.RecordPrebuffer < 0 {
+        return &FieldError{"record_prebuffer", c.RecordPrebuffer, "must not be negative"}
+    }
+    if c.RecordPrebuffer > 0 && c.PrebufferBytes <= 0 {
+        return &FieldError{"record_prebuffer_bytes", c.PrebufferBytes, "must be positive"}
+    }
+    // The prebuffer watches the stream all the time, so the device would
+    // never close.
+    if c.RecordPrebuffer > 0 && c.OnDemand {
+        return &FieldError{"record_prebuffer", c.RecordPrebuffer, "keeps the capture device open, so needs on_demand: false"}
+    }
+    if c.MJPEGFPS < 0 || c.MJPEGFPS > 120 {
+        return &FieldError{"mjpeg_fps", c.MJPEGFPS, "must be between 0 and 120"}
+    }
+    if c.SlowPolicy != SlowDrop && c.SlowPolicy != SlowDisconnect {
+        return &FieldError{"slow_client_policy", c.SlowPolicy, "must be " + SlowDrop + " or " + SlowDisconnect}
+    }
+    if c.SlowPercent < 1 || c.SlowPercent > 100 {
+        return &FieldError{"slow_client_drop_percent", c.SlowPercent, "must be between 1 and 100"}
+    }
+    if c.SlowTimeout <= 0 {
+        return &FieldError{"slow_client_timeout", c.SlowTimeout, "must be positive"}
+    }
+    if c.DeltaKeyframe <= 0 {
+        return &FieldError{"delta_keyframe_interval", c.DeltaKeyframe, "must be positive"}
+    }
+    if err := c.validateMotion(); err != nil {
+        return err
+    }
+    if err := c.validateSinks(); err != nil {
+        return err
+    }
+    if p := c.BasePath; p != "" && (p == "/" || !strings.HasPrefix(p, "/") || path.Clean(p) != p) {
+        return &FieldError{"base_path", c.BasePath, "must start with / and not end with one, e.g. /hdmi"}
+    }
+    if c.CORSMaxAge < 0 {
+        return &FieldError{"cors_max_age", c.CORSMaxAge, "must not be negative"}
+    }
+    if c.IdleTimeout < 0 {
+        return &FieldError{"idle_timeout", c.IdleTimeout, "must not be negative"}
+    }
+    if c.ReadyFrameAge <= 0 {
+        return &FieldError{"ready_frame_age", c.ReadyFrameAge, "must be positive"}
+    }
+    if c.FrozenFrames < 0 {
+        return &FieldError{"signal_frozen_frames", c.FrozenFrames, "must not be negative"}
+    }
+    for i, ice := range c.ICEServers {
+        if len(ice.URLs) == 0 {
+            return &FieldError{fmt.Sprintf("ice_servers[%d].urls", i), "[]", "must list at least one URL"}
+        }
+    }
+    names := map[string]bool{}
+    for i, st := range c.Streams {
+        key := fmt.Sprintf("streams[%d]", i)
+        if !validStreamName.MatchString(st.Name) {
+            return &FieldError{key + ".name", fmt.Sprintf("%q", st.Name), "must be letters, digits, '-' and '_'"}
+        }
+        if names[st.Name] {
+            return &FieldError{key + ".name", st.Name, "duplicate stream name"}
+        }
+        if st.Name == ReservedStream {
+            return &FieldError{key + ".name", st.Name, "is reserved for /ws/replay"}
+        }
+        names[st.Name] = true
+        if st.Device == "" && st.Composite == nil {
+            return &FieldError{key + ".device", `""`, "must not be empty"}
+        }
+    }
+    for i, st := range c.Streams {
+        if err := c.validateComposite(fmt.Sprintf("streams[%d]", i), st); err != nil {
+            return err
+        }
+    }
+    for _, st := range c.StreamList() {
+        if err := st.validate(); err != nil {
+            return err
+        }
+    }
+    if c.TokenDailyBytes < 0 {
+        return &FieldError{"token_daily_bytes", c.TokenDailyBytes, "must not be negative"}
+    }
+    seen := map[string]bool{}
+    for i, t := range c.Tokens {
+        if t.Secret == "" {
+            return &FieldError{fmt.Sprintf("tokens[%d].token", i), `""`, "must not be empty"}
+        }
+        if seen[t.Secret] {
+            return &FieldError{fmt.Sprintf("tokens[%d].token", i), "[redacted]", "duplicate token"}
+        }
+        seen[t.Secret] = true
+        if t.DailyBytes < 0 {
+            return &FieldError{fmt.Sprintf("tokens[%d].daily_bytes", i), t.DailyBytes, "must not be negative"}
+        }
+        switch t.Role {
+        case "", RoleViewer, RoleOperator, RoleAdmin:
+        default:
+            return &FieldError{fmt.Sprintf("tokens[%d].role", i), t.Role, "must be " + RoleViewer + ", " + RoleOperator + " or " + RoleAdmin}
+        }
+        // Usage is counted by ID, so a budget needs one.
+        if t.ID == "" && (t.DailyBytes > 0 || c.TokenDailyBytes > 0) {
+            return &FieldError{fmt.Sprintf("tokens[%d].id", i), `""`, "must be set for a token with a byte budget"}
+        }
+    }
+    // With tokens, calls are made by someone the log can name, and
+    // every one that changes something must be recorded.
+    if len(c.Tokens) > 0 && c.AuditLog == "" {
+        return &FieldError{"audit_log", `""`, "must be set when tokens are configured"}
+    }
+    return nil
+}
+
+// validateComposite checks that a composite stream has no device of its
+// own and is made of two other streams that are not composites.
+func (c Config) validateComposite(key string, st Stream) error {
+    if st.Composite == nil {
+        return nil
+    }
+    if st.Device != "" {
+        return &FieldError{key + ".device", st.Device, "must be empty for a composite stream"}
+    }
+    if st.AudioDevice != "" {
+        return &FieldError{key + ".audio_device", st.AudioDevice, "must be empty for a composite stream"}
+    }
+    for _, src := range []struct{ field, name string }{
+        {"base", st.Composite.Base},
+        {"inset", st.Composite.Inset},
+    } {
+        field := key + ".composite." + src.field
+        if src.name == st.Name {
+            return &FieldError{field, src.name, "must be another stream"}
+        }
+        found := false
+        for _, o := range c.Streams {
+            if o.Name != src.name {
+                continue
+            }
+            if o.Composite != nil {
+                return &FieldError{field, src.name, "must not be a composite stream"}
+            }
+            found = true
+        }
+        if !found {
+            return &FieldError{field, fmt.Sprintf("%q", src.name), "must name a stream"}
+        }
+    }
+    if st.Composite.Base == st.Composite.Inset {
+        return &FieldError{key + ".composite.inset", st.Composite.Inset, "must not be the base stream"}
+    }
+    return nil
+}
+
+// StreamList returns the streams to serve with top-level settings filled
+// in. Without a streams section it is a single stream named DefaultStream
+// on device.
+func (c Config) StreamList() []Stream {
+    top := Stream{
+        Name:          DefaultStream,
+        Device:        c.DevicePath,
+        Width:         c.Width,
+        Height:        c.Height,
+        FPS:           c.FPS,
+        JPEGQuality:   c.JPEGQuality,
+        EncodeWorkers: c.EncodeWorkers,
+        AudioDevice:   c.AudioDevice,
+        AudioRate:     c.AudioRate,
+        AudioChannels: c.AudioChannels,
+        Overlay:       &c.Overlay,
+        StartupImage:  c.StartupImage,
+        OfflineImage:  c.OfflineImage,
+    }
+    if len(c.Streams) == 0 {
+        return []Stream{top}
+    }
+    out := make([]Stream, len(c.Streams))
+    for i, st := range c.Streams {
+        if st.Width == 0 && st.Height == 0 {
+            st.Width, st.Height = top.Width, top.Height
+        }
+        if st.FPS == 0 {
+            st.FPS = top.FPS
+        }
+        if st.JPEGQuality == 0 {
+            st.JPEGQuality = top.JPEGQuality
+        }
+        if st.EncodeWorkers == 0 {
+            st.EncodeWorkers = top.EncodeWorkers
+        }
+        if st.AudioRate == 0 {
+            st.AudioRate = top.AudioRate
+        }
+        if st.AudioChannels == 0 {
+            st.AudioChannels = top.AudioChannels
+        }
+        if st.StartupImage == "" {
+            st.StartupImage = top.StartupImage
+        }
+        if st.OfflineImage == "" {
+            st.OfflineImage = top.OfflineImage
+        }
+        o := *top.Overlay
+        if st.Overlay != nil {
+            o.Timestamp, o.StreamName, o.Watermark = st.Overlay.Timestamp, st.Overlay.StreamName, st.Overlay.Watermark
+            if st.Overlay.Position != "" {
+                o.Position = st.Overlay.Position
+            }
+            if st.Overlay.FontSize != 0 {
+                o.FontSize = st.Overlay.FontSize
+            }
+            if st.Overlay.Opacity != 0 {
+                o.Opacity = st.Overlay.Opacity
+            }
+        }
+        st.Overlay = &o
+        if st.Composite != nil {
+            cs := *st.Composite
+            if cs.Layout.Position == "" {
+                cs.Layout.Position = BottomRight
+            }
+            if cs.Layout.Size == 0 {
+                cs.Layout.Size = 0.25
+            }
+            if cs.Layout.Opacity == 0 {
+                cs.Layout.Opacity = 1
+            }
+            if cs.Stale == 0 {
+                cs.Stale = 2 * time.Second
+            }
+            st.Composite = &cs
+        }
+        out[i] = st
+    }
+    return out
+}
+
+func (s Stream) validate() error {
+    key := "streams." + s.Name
+    if s.Width < 0 || s.Height < 0 {
+        return &FieldError{key + ".width", fmt.Sprintf("%dx%d", s.Width, s.Height), "must not be negative"}
+    }
+    if s.FPS < 0 || s.FPS > 120 {
+        return &FieldError{key + ".fps", s.FPS, "must be between 0 and 120"}
+    }
+    if s.JPEGQuality < 1 || s.JPEGQuality > 100 {
+        return &FieldError{key + ".jpeg_quality", s.JPEGQuality, "must be between 1 and 100"}
+    }
+    if s.EncodeWorkers < 0 {
+        return &FieldError{key + ".encode_workers", s.EncodeWorkers, "must not be negative"}
+    }
+    if s.AudioRate < 8000 || s.AudioRate > 192000 {
+        return &FieldError{key + ".audio_rate", s.AudioRate, "must be between 8000 and 192000"}
+    }
+    if s.AudioChannels < 1 || s.AudioChannels > 8 {
+        return &FieldError{key + ".audio_channels", s.AudioChannels, "must be between 1 and 8"}
+    }
+    if err := s.Overlay.Validate(key + ".overlay"); err != nil {
+        return err
+    }
+    if s.Composite != nil {
+        if s.Width%2 != 0 {
+            return &FieldError{key + ".width", s.Width, "must be even for a composite stream"}
+        }
+        if s.Composite.Stale < 0 {
+            return &FieldError{key + ".composite.stale", s.Composite.Stale, "must not be negative"}
+        }
+        return s.Composite.Layout.Validate(key + ".composite.layout")
+    }
+    return nil
+}
+
+// TLS reports whether the server should listen with TLS.
+func (c Config) TLS() bool { return c.TLSAutocert || c.TLSCert != "" }
+
+// validateSinks checks each sink's settings and that its stream exists.
+func (c Config) validateSinks() error {
+    streams := map[string]bool{}
+    for _, st := range c.StreamList() {
+        streams[st.Name] = true
+    }
+    names := map[string]bool{}
+    for i, sk := range c.Sinks {
+        key := fmt.Sprintf("sinks[%d]", i)
+        if !validStreamName.MatchString(sk.Name) {
+            return &FieldError{key + ".name", fmt.Sprintf("%q", sk.Name), "must be letters, digits, '-' and '_'"}
+        }
+        if names[sk.Name] {
+            return &FieldError{key + ".name", sk.Name, "duplicate sink name"}
+        }
+        names[sk.Name] = true
+        if sk.Stream != "" && !streams[sk.Stream] {
+            return &FieldError{key + ".stream", sk.Stream, "no such stream"}
+        }
+        if len(sk.Command) == 0 || sk.Command[0] == "" {
+            return &FieldError{key + ".command", "[]", "must name a program"}
+        }
+        if sk.Input != "" && sk.Input != SinkEncoded && sk.Input != SinkRaw {
+            return &FieldError{key + ".input", sk.Input, "must be " + SinkEncoded + " or " + SinkRaw}
+        }
+        if sk.MaxRestarts < 0 {
+            return &FieldError{key + ".max_restarts", sk.MaxRestarts, "must not be negative"}
+        }
+        if sk.FPS < 0 || sk.FPS > 120 {
+            return &FieldError{key + ".fps", sk.FPS, "must be between 0 and 120"}
+        }
+    }
+    return nil
+}
+
+// validateMotion checks the motion settings, which only matter with a
+// webhook to report to.
+func (c Config) validateMotion() error {
+    if c.MotionWebhook == "" {
+        return nil
+    }
+    if u, err := url.Parse(c.MotionWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return &FieldError{"motion_webhook", "[redacted]", "must be an http or https URL"}
+    }
+    if c.MotionThreshold <= 0 || c.MotionThreshold >= 1 {
+        return &FieldError{"motion_threshold", c.MotionThreshold, "must be between 0 and 1"}
+    }
+    if c.MotionFrames < 1 {
+        return &FieldError{"motion_frames", c.MotionFrames, "must be at least 1"}
+    }
+    if c.MotionCooldown < 0 {
+        return &FieldError{"motion_cooldown", c.MotionCooldown, "must not be negative"}
+    }
+    if c.MotionFPS < 1 || c.MotionFPS > 30 {
+        return &FieldError{"motion_sample_fps", c.MotionFPS, "must be between 1 and 30"}
+    }
+    if c.MotionClip && c.RecordPrebuffer <= 0 {
+        return &FieldError{"motion_clip", c.MotionClip, "needs record_prebuffer"}
+    }
+    return nil
+}
+
+func (c Config) validateTLS() error {
+    if c.TLSAutocert {
+        if c.TLSCert != "" || c.TLSKey != "" {
+            return &FieldError{"tls_autocert", true, "cannot be combined with tls_cert/tls_key"}
+        }
+        if len(c.AutocertHosts) == 0 {
+            return &FieldError{"autocert_hosts", "[]", "must list at least one host when tls_autocert is on"}
+        }
+        if c.AutocertCache == "" {
+            return &FieldError{"autocert_cache", `""`, "must not be empty when tls_autocert is on"}
+        }
+        return nil
+    }
+    if c.TLSCert == "" && c.TLSKey == "" {
+        return nil
+    }
+    if c.TLSCert == "" {
+        return &FieldError{"tls_cert", `""`, "must be set when tls_key is"}
+    }
+    if _, err := os.ReadFile(c.TLSCert); err != nil {
+        return &FieldError{"tls_cert", c.TLSCert, "cannot read certificate: " + err.Error()}
+    }
+    if c.TLSKey == "" {
+        return &FieldError{"tls_key", `""`, "must be set when tls_cert is"}
+    }
+    // Read rather than stat, so a key that is there but cannot be read,
+    // such as a directory or one the server's user has no access to,
+    // fails here too.
+    if _, err := os.ReadFile(c.TLSKey); err != nil {
+        return &FieldError{"tls_key", c.TLSKey, "certificate exists but key cannot be read: " + err.Error()}
+    }
+    return nil
+}
+
+// String renders the effective configuration for logging, with secrets
+// replaced.
+func (c Config) String() string {
+    var b strings.Builder
+    v := reflect.ValueOf(c)
+    for i, f := range fields() {
+        if i > 0 {
+            b.WriteByte(' ')
+        }
+        val := v.Field(f.index).Interface()
+        if s, ok := val.([]string); ok {
+            val = strings.Join(s, ",")
+        }
+        if f.secret && !v.Field(f.index).IsZero() {
+            val = "[redacted]"
+        }
+        fmt.Fprintf(&b, "%s=%v", f.key, val)
+    }
+    return b.String()
+}
+
+type field struct {
+    key      string
+    help     string
+    secret   bool
+    fileOnly bool
+    index    int
+}
+
+func fields() []field {
+    t := reflect.TypeOf(Config{})
+    out := make([]field, 0, t.NumField())
+    for i := 0; i < t.NumField(); i++ {
+        sf := t.Field(i)
+        if sf.Tag.Get("yaml") == "-" {
+            continue
+        }
+        out = append(out, field{
+            key:      sf.Tag.Get("yaml"),
+            help:     sf.Tag.Get("help"),
+            secret:   sf.Tag.Get("secret") == "true",
+            fileOnly: sf.Tag.Get("flag") == "-",
+            index:    i,
+        })
+    }
+    return out
+}
+
+func flagName(key string) string { return strings.ReplaceAll(key, "_", "-") }
+
+func envName(key string) string { return EnvPrefix + strings.ToUpper(key) }
+
+// set parses s into the field with the given key.
+func (c *Config) set(key, s string) error {
+    for _, f := range fields() {
+        if f.key != key {
+            continue
+        }
+        fv := reflect.ValueOf(c).Elem().Field(f.index)
+        switch fv.Interface().(type) {
+        case string:
+            fv.SetString(s)
+        case bool:
+            b, err := strconv.ParseBool(s)
+            if err != nil {
+                return &FieldError{key, s, "not a boolean"}
+            }
+            fv.SetBool(b)
+        case slog.Level:
+            var l slog.Level
+            if err := l.UnmarshalText([]byte(s)); err != nil {
+                return &FieldError{key, s, "not a log level"}
+            }
+            fv.Set(reflect.ValueOf(l))
+        case int:
+            n, err := strconv.Atoi(s)
+            if err != nil {
+                return &FieldError{key, s, "not an integer"}
+            }
+            fv.SetInt(int64(n))
+        case int64:
+            n, err := strconv.ParseInt(s, 10, 64)
+            if err != nil {
+                return &FieldError{key, s, "not an integer"}
+            }
+            fv.SetInt(n)
+        case float64:
+            x, err := strconv.ParseFloat(s, 64)
+            if err != nil {
+                return &FieldError{key, s, "not a number"}
+            }
+            fv.SetFloat(x)
+        case time.Duration:
+            d, err := time.ParseDuration(s)
+            if err != nil {
+                return &FieldError{key, s, "not a duration"}
+            }
+            fv.SetInt(int64(d))
+        case []string:
+            var list []string
+            for _, item := range strings.Split(s, ",") {
+                if item = strings.TrimSpace(item); item != "" {
+                    list = append(list, item)
+                }
+            }
+            fv.Set(reflect.ValueOf(list))
+        default:
+            return fmt.Errorf("config: %s: unsupported field type %s", key, fv.Type())
+        }
+        return nil
+    }
+    return fmt.Errorf("config: unknown setting %q", key)
+}
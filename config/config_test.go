@@ -0,0 +1,164 @@
+package config
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// env returns a lookupEnv serving vars.
+func env(vars map[string]string) func(string) (string, bool) {
+    return func(k string) (string, bool) {
+        v, ok := vars[k]
+        return v, ok
+    }
+}
+
+func writeFile(t *testing.T, body string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "config.yaml")
+    if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+    file := writeFile(t, "fps: 10\njpeg_quality: 60\nmax_connections_per_ip: 3\n")
+    for _, tc := range []struct {
+        name    string
+        file    bool
+        env     map[string]string
+        args    []string
+        fps     int
+        quality int
+        perIP   int
+    }{
+        {name: "defaults", fps: Default().FPS, quality: Default().JPEGQuality, perIP: Default().MaxPerIP},
+        {name: "file", file: true, fps: 10, quality: 60, perIP: 3},
+        {
+            name: "env over file", file: true,
+            env: map[string]string{"HDMI_STREAM_FPS": "20", "HDMI_STREAM_JPEG_QUALITY": "70"},
+            fps: 20, quality: 70, perIP: 3,
+        },
+        {
+            name: "flag over env", file: true,
+            env:  map[string]string{"HDMI_STREAM_FPS": "20", "HDMI_STREAM_JPEG_QUALITY": "70"},
+            args: []string{"-fps", "30"},
+            fps:  30, quality: 70, perIP: 3,
+        },
+        {
+            name: "flag over file without env", file: true,
+            args: []string{"-max-connections-per-ip", "5"},
+            fps:  10, quality: 60, perIP: 5,
+        },
+        {
+            name: "env without file",
+            env:  map[string]string{"HDMI_STREAM_MAX_CONNECTIONS_PER_IP": "9"},
+            fps:  Default().FPS, quality: Default().JPEGQuality, perIP: 9,
+        },
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            var args []string
+            if tc.file {
+                args = append(args, "-config", file)
+            }
+            cfg, err := Load(append(args, tc.args...), env(tc.env))
+            if err != nil {
+                t.Fatal(err)
+            }
+            if cfg.FPS != tc.fps || cfg.JPEGQuality != tc.quality || cfg.MaxPerIP != tc.perIP {
+                t.Errorf("fps %d, jpeg_quality %d, max_connections_per_ip %d; want %d, %d, %d",
+                    cfg.FPS, cfg.JPEGQuality, cfg.MaxPerIP, tc.fps, tc.quality, tc.perIP)
+            }
+        })
+    }
+}
+
+func TestLoadFieldError(t *testing.T) {
+    for _, tc := range []struct {
+        name  string
+        file  string
+        env   map[string]string
+        args  []string
+        field string
+    }{
+        {name: "flag out of range", args: []string{"-fps", "500"}, field: "fps"},
+        {name: "flag not an integer", args: []string{"-jpeg-quality", "high"}, field: "jpeg_quality"},
+        {name: "env not a duration", env: map[string]string{"HDMI_STREAM_PING_INTERVAL": "soon"}, field: "ping_interval"},
+        {name: "env not a boolean", env: map[string]string{"HDMI_STREAM_ON_DEMAND": "maybe"}, field: "on_demand"},
+        {name: "file out of range", file: "jpeg_quality: 0\n", field: "jpeg_quality"},
+        {name: "file bad address", file: "listen_addr: nowhere\n", field: "listen_addr"},
+        {name: "file bad proxy", file: "trusted_proxies: [not-an-ip]\n", field: "trusted_proxies"},
+        {name: "file stream", file: "streams:\n  - name: a b\n    device: /dev/video0\n", field: "streams[0].name"},
+        {name: "prebuffer on demand", file: "record_prebuffer: 2s\n", field: "record_prebuffer"},
+        {name: "tokens without audit log", file: "tokens:\n  - token: secret\n", field: "audit_log"},
+        {name: "first of two", file: "fps: 500\n", args: []string{"-mjpeg-fps", "500"}, field: "fps"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            var args []string
+            if tc.file != "" {
+                args = append(args, "-config", writeFile(t, tc.file))
+            }
+            _, err := Load(append(args, tc.args...), env(tc.env))
+            var fe *FieldError
+            if !errors.As(err, &fe) {
+                t.Fatalf("err = %v, want a FieldError", err)
+            }
+            if fe.Field != tc.field {
+                t.Errorf("field = %q, want %q (%v)", fe.Field, tc.field, err)
+            }
+        })
+    }
+}
+
+func TestLoadRejectsUnknownFileKey(t *testing.T) {
+    if _, err := Load([]string{"-config", writeFile(t, "no_such_setting: 1\n")}, env(nil)); err == nil {
+        t.Fatal("unknown key accepted")
+    }
+}
+
+func TestValidateTLS(t *testing.T) {
+    dir := t.TempDir()
+    cert := filepath.Join(dir, "cert.pem")
+    key := filepath.Join(dir, "key.pem")
+    for _, p := range []string{cert, key} {
+        if err := os.WriteFile(p, []byte("pem"), 0o600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    keyDir := filepath.Join(dir, "keys")
+    if err := os.Mkdir(keyDir, 0o700); err != nil {
+        t.Fatal(err)
+    }
+    for _, tc := range []struct {
+        name      string
+        cert, key string
+        field     string
+    }{
+        {name: "off"},
+        {name: "pair", cert: cert, key: key},
+        {name: "key only", key: key, field: "tls_cert"},
+        {name: "cert only", cert: cert, field: "tls_key"},
+        {name: "missing cert", cert: filepath.Join(dir, "none.pem"), key: key, field: "tls_cert"},
+        {name: "missing key", cert: cert, key: filepath.Join(dir, "none.pem"), field: "tls_key"},
+        {name: "unreadable key", cert: cert, key: keyDir, field: "tls_key"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            c := Default()
+            c.TLSCert, c.TLSKey = tc.cert, tc.key
+            err := c.validateTLS()
+            if tc.field == "" {
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            var fe *FieldError
+            if !errors.As(err, &fe) || fe.Field != tc.field {
+                t.Fatalf("err = %v, want a FieldError for %s", err, tc.field)
+            }
+        })
+    }
+}
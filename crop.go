@@ -0,0 +1,48 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// parseCrop reads a crop from the x, y, w and h query parameters, the
+// fields of set_crop. All four are needed, or none for no crop.
+func parseCrop(q url.Values) (protocol.Rect, error) {
+    var r protocol.Rect
+    fields := []struct {
+        name string
+        v    *int
+    }{{"x", &r.X}, {"y", &r.Y}, {"w", &r.W}, {"h", &r.H}}
+    given := 0
+    for _, f := range fields {
+        s := q.Get(f.name)
+        if s == "" {
+            continue
+        }
+        n, err := strconv.Atoi(s)
+        if err != nil {
+            return r, fmt.Errorf("invalid crop %s %q", f.name, s)
+        }
+        *f.v = n
+        given++
+    }
+    if given != 0 && given != len(fields) {
+        return r, fmt.Errorf("a crop needs all of x, y, w and h")
+    }
+    return r, r.Validate()
+}
+
+// fitCrop clamps r to the size of the hub's source. Before the first
+// frame the size is not known, and r is kept to be fitted to each frame
+// as it is rendered.
+func fitCrop(h *hub.Hub, r protocol.Rect) (protocol.Rect, string, error) {
+    w, ht := h.Size()
+    if w == 0 || ht == 0 {
+        return r, "", nil
+    }
+    return r.Clamp(w, ht)
+}
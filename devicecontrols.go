@@ -0,0 +1,235 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+)
+
+// modeKeys are the settings POST /api/device/controls accepts besides
+// the driver's controls. They are fixed when the device is opened, so
+// changing one restarts capture.
+var modeKeys = []string{"width", "height", "fps", "pixel_format"}
+
+type deviceMode struct {
+    Width       int    `json:"width"`
+    Height      int    `json:"height"`
+    FPS         int    `json:"fps"`
+    PixelFormat string `json:"pixel_format"`
+}
+
+type controlsResponse struct {
+    Controls        []capture.Control `json:"controls"`
+    Mode            deviceMode        `json:"mode"`
+    RestartRequired []string          `json:"restart_required"`
+}
+
+type controlsError struct {
+    Error string   `json:"error"`
+    Valid []string `json:"valid,omitempty"`
+    Hint  string   `json:"hint,omitempty"`
+}
+
+// The device control endpoints act on the default stream unless ?stream=
+// names another.
+
+// controlsGetHandler serves GET /api/device/controls.
+func controlsGetHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    controls, err := st.Controls.List()
+    if err != nil {
+        writeError(w, http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, newControlsResponse(st, controls))
+}
+
+// controlsPostHandler serves POST /api/device/controls. The body maps
+// control names to values, e.g. {"brightness": 140, "width": 1280};
+// booleans may be given as true or false. Controls apply while capture
+// runs. Mode settings need ?restart=true, which reopens the device and
+// briefly pauses every viewer of the stream.
+func controlsPostHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    var body map[string]json.RawMessage
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+        return
+    }
+    if len(body) == 0 {
+        writeError(w, http.StatusBadRequest, "no controls given")
+        return
+    }
+    controls, err := st.Controls.List()
+    if err != nil {
+        writeError(w, http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    known := make(map[string]bool, len(controls))
+    for _, c := range controls {
+        known[c.Name] = true
+    }
+
+    values := map[string]int64{}
+    mode := st.Source.Mode()
+    names := make([]string, 0, len(body))
+    for name := range body {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var changed []string
+    for _, name := range names {
+        raw := body[name]
+        if isModeKey(name) {
+            if err := setModeKey(&mode, name, raw); err != nil {
+                writeError(w, http.StatusBadRequest, err.Error())
+                return
+            }
+            changed = append(changed, name)
+            continue
+        }
+        if !known[name] {
+            writeJSON(w, http.StatusBadRequest, controlsError{
+                Error: "unknown control " + name,
+                Valid: validControls(controls),
+            })
+            return
+        }
+        v, err := controlValue(raw)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, fmt.Sprintf("control %s: %v", name, err))
+            return
+        }
+        values[name] = v
+    }
+    restart, _ := strconv.ParseBool(r.URL.Query().Get("restart"))
+    if len(changed) > 0 && !restart {
+        writeJSON(w, http.StatusConflict, controlsError{
+            Error: strings.Join(changed, ", ") + " can only change by reopening the device",
+            Hint:  "repeat the request with ?restart=true; viewers see a short pause while capture restarts",
+        })
+        return
+    }
+
+    if len(values) > 0 {
+        var unknown *capture.UnknownControlError
+        var invalid *capture.ControlValueError
+        controls, err = st.Controls.Set(values)
+        switch {
+        case errors.As(err, &unknown):
+            writeJSON(w, http.StatusBadRequest, controlsError{Error: err.Error(), Valid: append(unknown.Valid, modeKeys...)})
+            return
+        case errors.As(err, &invalid):
+            writeError(w, http.StatusBadRequest, err.Error())
+            return
+        case err != nil:
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+    if len(changed) > 0 {
+        old := st.Source.Mode()
+        st.Source.SetMode(mode)
+        err := st.Hub.Restart(r.Context(), func() { st.Source.SetMode(old) })
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, "device refused the new mode, previous mode restored: "+err.Error())
+            return
+        }
+    }
+    writeJSON(w, http.StatusOK, newControlsResponse(st, controls))
+}
+
+func newControlsResponse(st *stream.Stream, controls []capture.Control) controlsResponse {
+    if controls == nil {
+        controls = []capture.Control{}
+    }
+    m := st.Source.Mode()
+    return controlsResponse{
+        Controls: controls,
+        Mode: deviceMode{
+            Width:       m.Width,
+            Height:      m.Height,
+            FPS:         m.FPS,
+            PixelFormat: strings.ToLower(m.Format.String()),
+        },
+        RestartRequired: modeKeys,
+    }
+}
+
+func validControls(controls []capture.Control) []string {
+    names := make([]string, 0, len(controls)+len(modeKeys))
+    for _, c := range controls {
+        names = append(names, c.Name)
+    }
+    return append(names, modeKeys...)
+}
+
+func isModeKey(name string) bool {
+    for _, k := range modeKeys {
+        if k == name {
+            return true
+        }
+    }
+    return false
+}
+
+// setModeKey applies one mode setting from a request to m.
+func setModeKey(m *capture.Mode, name string, raw json.RawMessage) error {
+    if name == "pixel_format" {
+        var s string
+        if err := json.Unmarshal(raw, &s); err != nil {
+            return errors.New(`pixel_format must be "mjpeg" or "yuyv"`)
+        }
+        switch strings.ToLower(s) {
+        case "mjpeg":
+            m.Format = capture.FormatMJPEG
+        case "yuyv":
+            m.Format = capture.FormatYUYV
+        default:
+            return errors.New(`pixel_format must be "mjpeg" or "yuyv"`)
+        }
+        return nil
+    }
+    var n int
+    if err := json.Unmarshal(raw, &n); err != nil || n <= 0 {
+        return fmt.Errorf("%s must be a positive integer", name)
+    }
+    switch name {
+    case "width":
+        m.Width = n
+    case "height":
+        m.Height = n
+    case "fps":
+        m.FPS = n
+    }
+    return nil
+}
+
+// controlValue reads a control value given as a number or a boolean.
+func controlValue(raw json.RawMessage) (int64, error) {
+    var n int64
+    if err := json.Unmarshal(raw, &n); err == nil {
+        return n, nil
+    }
+    var b bool
+    if err := json.Unmarshal(raw, &b); err == nil {
+        if b {
+            return 1, nil
+        }
+        return 0, nil
+    }
+    return 0, errors.New("value must be an integer or a boolean")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/discovery"
+    "github.com/Cdaprod/hdmi-streaming-app/web"
+)
+
+// advertise announces the server over mDNS, or logs why it cannot and
+// returns nil. The instance is named after the host.
+func advertise() *discovery.Advertiser {
+    _, p, _ := net.SplitHostPort(cfg.ListenAddr)
+    port, err := strconv.Atoi(p)
+    if err != nil || port == 0 {
+        slog.Warn("mdns needs a fixed listen port, not advertising", "addr", cfg.ListenAddr)
+        return nil
+    }
+    name, err := os.Hostname()
+    if err != nil {
+        slog.Warn("mdns needs a host name, not advertising", "err", err)
+        return nil
+    }
+    adv, err := discovery.Advertise(name, port, advertInfo)
+    if err != nil {
+        slog.Warn("mdns advertisement unavailable", "err", err)
+        return nil
+    }
+    slog.Info("advertising over mdns", "service", discovery.Service, "name", name, "port", port)
+    return adv
+}
+
+// advertInfo describes the server for its mDNS TXT record. A stream's
+// resolution is that of its latest frame, or the configured one while
+// the device is closed.
+func advertInfo() discovery.Info {
+    info := discovery.Info{Version: web.Version(), TLS: cfg.TLS(), Auth: authn.TokensRequired()}
+    for _, st := range streams.All() {
+        s := discovery.Stream{Name: st.Name, Width: st.Config.Width, Height: st.Config.Height}
+        if i := st.Info(); i.Width > 0 && i.Height > 0 {
+            s.Width, s.Height = i.Width, i.Height
+        }
+        info.Streams = append(info.Streams, s)
+    }
+    return info
+}
+
+// discoverCommand runs "discover": it browses for servers and prints a
+// table of those that answered, returning the exit status.
+func discoverCommand(args []string) int {
+    fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+    wait := fs.Duration("timeout", 3*time.Second, "how long to wait for answers")
+    fs.Usage = func() {
+        fmt.Fprintln(fs.Output(), "usage: hdmi-streaming-app discover [-timeout 3s]")
+        fmt.Fprintln(fs.Output(), "Lists the servers advertising "+discovery.Service+" on the local network.")
+        fs.PrintDefaults()
+    }
+    if err := fs.Parse(args); err != nil {
+        if err == flag.ErrHelp {
+            return 0
+        }
+        return 2
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), *wait)
+    defer cancel()
+    found, err := discovery.Browse(ctx)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "discover:", err)
+        return 1
+    }
+    if len(found) == 0 {
+        fmt.Fprintln(os.Stderr, "no servers found")
+        return 1
+    }
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "HOST\tADDRESS\tPORT\tTLS\tSTREAMS\tVERSION")
+    for _, in := range found {
+        addrs := make([]string, len(in.Addrs))
+        for i, a := range in.Addrs {
+            addrs[i] = a.String()
+        }
+        names := make([]string, len(in.Streams))
+        for i, s := range in.Streams {
+            names[i] = s.String()
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%d\t%t\t%s\t%s\n", in.Host, strings.Join(addrs, ","), in.Port, in.TLS, strings.Join(names, ", "), in.Version)
+    }
+    tw.Flush()
+    return 0
+}
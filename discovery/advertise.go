@@ -0,0 +1,445 @@
+package discovery
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+    "golang.org/x/net/ipv4"
+)
+
+const (
+    // refreshInterval is how often the advertiser looks for a changed
+    // TXT record or a changed set of interfaces and announces the change.
+    refreshInterval = 10 * time.Second
+    // legacyTTL caps the TTLs in replies to one-shot queriers, which are
+    // plain DNS clients that would otherwise cache them for too long.
+    legacyTTL = 10
+)
+
+// Advertiser answers queries for one server and announces it, once on
+// every interface, whenever what it says about itself changes.
+type Advertiser struct {
+    service  dnsmessage.Name // _hdmi-stream._tcp.local.
+    instance dnsmessage.Name // name._hdmi-stream._tcp.local.
+    host     dnsmessage.Name // name.local.
+    port     uint16
+    info     func() Info
+    log      *slog.Logger
+
+    conn   *ipv4.PacketConn
+    cancel context.CancelFunc
+    done   chan struct{}
+
+    mu     sync.Mutex
+    txt    []string
+    ifaces map[int]ifaceAddr // the interfaces joined to the group
+}
+
+// Advertise starts announcing a server called name, listening on port,
+// and answering for it, until Close. info is called now and then for
+// the TXT record, so it may change while the server runs.
+func Advertise(name string, port int, info func() Info) (*Advertiser, error) {
+    // An instance name may hold dots, but a host name's first label is
+    // all that is wanted here.
+    name, _, _ = strings.Cut(name, ".")
+    service, err := dnsmessage.NewName(Service + "." + domain)
+    if err != nil {
+        return nil, err
+    }
+    instance, err := dnsmessage.NewName(name + "." + Service + "." + domain)
+    if err != nil {
+        return nil, err
+    }
+    host, err := dnsmessage.NewName(name + "." + domain)
+    if err != nil {
+        return nil, err
+    }
+    c, err := listenMDNS()
+    if err != nil {
+        return nil, err
+    }
+    p := ipv4.NewPacketConn(c)
+    p.SetMulticastTTL(255)
+    p.SetMulticastLoopback(true)
+    if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+        c.Close()
+        return nil, err
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    a := &Advertiser{
+        service:  service,
+        instance: instance,
+        host:     host,
+        port:     uint16(port),
+        info:     info,
+        log:      slog.With("instance", name),
+        conn:     p,
+        cancel:   cancel,
+        done:     make(chan struct{}),
+        txt:      info().txt(),
+        ifaces:   map[int]ifaceAddr{},
+    }
+    a.join()
+    go a.serve()
+    go a.run(ctx)
+    return a, nil
+}
+
+// Close says goodbye on every interface and stops answering.
+func (a *Advertiser) Close() error {
+    a.cancel()
+    <-a.done
+    return nil
+}
+
+// run announces the server twice, a second apart as RFC 6762 asks, and
+// then whenever refresh finds a change, until ctx is done.
+func (a *Advertiser) run(ctx context.Context) {
+    defer close(a.done)
+    defer a.conn.Close()
+    a.announce(a.joined(), false)
+    again := time.After(time.Second)
+    tick := time.NewTicker(refreshInterval)
+    defer tick.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            a.announce(a.joined(), true)
+            return
+        case <-again:
+            a.announce(a.joined(), false)
+        case <-tick.C:
+            a.refresh()
+        }
+    }
+}
+
+// refresh announces a changed TXT record on every interface, and the
+// server on any interface that is new or has a new address.
+func (a *Advertiser) refresh() {
+    txt := a.info().txt()
+    a.mu.Lock()
+    changed := !slices.Equal(txt, a.txt)
+    a.txt = txt
+    a.mu.Unlock()
+    fresh := a.join()
+    if changed {
+        a.log.Debug("mdns record changed, announcing", "txt", txt)
+        a.announce(a.joined(), false)
+        return
+    }
+    a.announce(fresh, false)
+}
+
+// join brings the group memberships in line with the interfaces now up
+// and returns the indexes of those that are new or readdressed.
+func (a *Advertiser) join() []int {
+    now, err := multicastInterfaces()
+    if err != nil {
+        a.log.Warn("mdns: cannot list interfaces", "err", err)
+        return nil
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    var fresh []int
+    for _, idx := range sortedIndexes(now) {
+        ia := now[idx]
+        old, ok := a.ifaces[idx]
+        if ok {
+            if !old.ip.Equal(ia.ip) {
+                a.ifaces[idx] = ia
+                fresh = append(fresh, idx)
+            }
+            continue
+        }
+        if err := a.conn.JoinGroup(&ia.ifi, &net.UDPAddr{IP: mdnsGroup.IP}); err != nil {
+            a.log.Debug("mdns: cannot join group", "interface", ia.ifi.Name, "err", err)
+            continue
+        }
+        a.ifaces[idx] = ia
+        fresh = append(fresh, idx)
+    }
+    for idx, ia := range a.ifaces {
+        if _, ok := now[idx]; !ok {
+            a.conn.LeaveGroup(&ia.ifi, &net.UDPAddr{IP: mdnsGroup.IP})
+            delete(a.ifaces, idx)
+        }
+    }
+    return fresh
+}
+
+// joined returns the indexes of the joined interfaces in order.
+func (a *Advertiser) joined() []int {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return sortedIndexes(a.ifaces)
+}
+
+// announce multicasts every record on each of the interfaces, with the
+// interface's own address, or with TTL 0 when goodbye is set.
+func (a *Advertiser) announce(indexes []int, goodbye bool) {
+    for _, idx := range indexes {
+        a.mu.Lock()
+        ia, ok := a.ifaces[idx]
+        a.mu.Unlock()
+        if !ok {
+            continue
+        }
+        set := recPTR | recSRV | recTXT | recA
+        if goodbye {
+            // The host name may be answered for by others, such as
+            // avahi, so only the service records are withdrawn.
+            set = recPTR | recSRV | recTXT
+        }
+        msg, err := a.message(0, nil, set, 0, ia.ip, replyMulticast, goodbye)
+        if err != nil {
+            a.log.Warn("mdns: cannot build announcement", "err", err)
+            return
+        }
+        if _, err := a.conn.WriteTo(msg, &ipv4.ControlMessage{IfIndex: idx}, mdnsGroup); err != nil {
+            a.log.Debug("mdns: announcement failed", "interface", ia.ifi.Name, "err", err)
+        }
+    }
+}
+
+// serve answers queries until the connection is closed.
+func (a *Advertiser) serve() {
+    buf := make([]byte, maxMessage)
+    for {
+        n, cm, src, err := a.conn.ReadFrom(buf)
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                a.log.Debug("mdns: read failed", "err", err)
+            }
+            return
+        }
+        from, ok := src.(*net.UDPAddr)
+        if !ok {
+            continue
+        }
+        idx := 0
+        if cm != nil {
+            idx = cm.IfIndex
+        }
+        a.reply(buf[:n], from, idx)
+    }
+}
+
+// reply answers one query, if it asks about this server. A query from a
+// port other than 5353 comes from a one-shot querier, which is answered
+// directly as plain DNS would be; other queries are answered on the
+// group unless they ask for a unicast reply.
+func (a *Advertiser) reply(msg []byte, from *net.UDPAddr, idx int) {
+    var p dnsmessage.Parser
+    h, err := p.Start(msg)
+    if err != nil || h.Response {
+        return
+    }
+    qs, err := p.AllQuestions()
+    if err != nil {
+        return
+    }
+    answers, unicast := a.match(qs)
+    if answers == 0 {
+        return
+    }
+    ip := a.addressFor(idx)
+    if ip == nil {
+        return
+    }
+    // Whatever a querier is about to ask next goes along with the answer.
+    var extra records
+    switch {
+    case answers&recPTR != 0:
+        extra = (recSRV | recTXT | recA) &^ answers
+    case answers&recSRV != 0:
+        extra = recA &^ answers
+    }
+    mode := replyMulticast
+    switch {
+    case from.Port != mdnsPort:
+        mode = replyLegacy
+    case unicast:
+        mode = replyUnicast
+    }
+    var id uint16
+    var echo []dnsmessage.Question
+    if mode == replyLegacy {
+        id, echo = h.ID, qs
+    }
+    out, err := a.message(id, echo, answers, extra, ip, mode, false)
+    if err != nil {
+        a.log.Warn("mdns: cannot build reply", "err", err)
+        return
+    }
+    var cm *ipv4.ControlMessage
+    to := from
+    if mode == replyMulticast {
+        to = mdnsGroup
+    }
+    if idx != 0 {
+        cm = &ipv4.ControlMessage{IfIndex: idx}
+    }
+    if _, err := a.conn.WriteTo(out, cm, to); err != nil {
+        a.log.Debug("mdns: reply failed", "to", to, "err", err)
+    }
+}
+
+// addressFor returns the address to answer with on the interface with
+// index idx. A query looped back from this host may name an interface
+// that was not joined, such as loopback, and gets the first one's.
+func (a *Advertiser) addressFor(idx int) net.IP {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if ia, ok := a.ifaces[idx]; ok {
+        return ia.ip
+    }
+    if idxs := sortedIndexes(a.ifaces); len(idxs) > 0 {
+        return a.ifaces[idxs[0]].ip
+    }
+    return nil
+}
+
+// records is a set of the records the advertiser can send.
+type records uint8
+
+const (
+    recPTR records = 1 << iota
+    recSRV
+    recTXT
+    recA
+    // recServices is the DNS-SD service type enumeration record.
+    recServices
+)
+
+var servicesName = dnsmessage.MustNewName("_services._dns-sd._udp." + domain)
+
+// match returns the records that answer qs and whether any question
+// asked for a unicast reply. Names compare without regard to case.
+func (a *Advertiser) match(qs []dnsmessage.Question) (records, bool) {
+    var set records
+    unicast := false
+    for _, q := range qs {
+        name := strings.ToLower(q.Name.String())
+        all := q.Type == dnsmessage.TypeALL
+        before := set
+        switch name {
+        case strings.ToLower(a.service.String()):
+            if all || q.Type == dnsmessage.TypePTR {
+                set |= recPTR
+            }
+        case strings.ToLower(servicesName.String()):
+            if all || q.Type == dnsmessage.TypePTR {
+                set |= recServices
+            }
+        case strings.ToLower(a.instance.String()):
+            if all || q.Type == dnsmessage.TypeSRV {
+                set |= recSRV
+            }
+            if all || q.Type == dnsmessage.TypeTXT {
+                set |= recTXT
+            }
+        case strings.ToLower(a.host.String()):
+            if all || q.Type == dnsmessage.TypeA {
+                set |= recA
+            }
+        }
+        if set != before && q.Class&qu != 0 {
+            unicast = true
+        }
+    }
+    return set, unicast
+}
+
+type replyMode int
+
+const (
+    replyMulticast replyMode = iota
+    replyUnicast
+    replyLegacy
+)
+
+// message builds a response holding answers, with extra as additional
+// records and ip as the host's address. Only multicast records claim
+// their names with the cache-flush bit; legacy replies echo the query
+// and have short TTLs.
+func (a *Advertiser) message(id uint16, qs []dnsmessage.Question, answers, extra records, ip net.IP, mode replyMode, goodbye bool) ([]byte, error) {
+    b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+    b.EnableCompression()
+    if err := b.StartQuestions(); err != nil {
+        return nil, err
+    }
+    for _, q := range qs {
+        if err := b.Question(q); err != nil {
+            return nil, err
+        }
+    }
+    if err := b.StartAnswers(); err != nil {
+        return nil, err
+    }
+    if err := a.add(&b, answers, ip, mode, goodbye); err != nil {
+        return nil, err
+    }
+    if err := b.StartAdditionals(); err != nil {
+        return nil, err
+    }
+    if err := a.add(&b, extra, ip, mode, goodbye); err != nil {
+        return nil, err
+    }
+    return b.Finish()
+}
+
+// add writes the records in set to the current section of b.
+func (a *Advertiser) add(b *dnsmessage.Builder, set records, ip net.IP, mode replyMode, goodbye bool) error {
+    hdr := func(name dnsmessage.Name, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+        class := dnsmessage.ClassINET
+        if unique && mode != replyLegacy {
+            class |= cacheFlush
+        }
+        switch {
+        case goodbye:
+            ttl = 0
+        case mode == replyLegacy && ttl > legacyTTL:
+            ttl = legacyTTL
+        }
+        return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+    }
+    a.mu.Lock()
+    txt := a.txt
+    a.mu.Unlock()
+    if set&recServices != 0 {
+        if err := b.PTRResource(hdr(servicesName, serviceTTL, false), dnsmessage.PTRResource{PTR: a.service}); err != nil {
+            return err
+        }
+    }
+    if set&recPTR != 0 {
+        if err := b.PTRResource(hdr(a.service, serviceTTL, false), dnsmessage.PTRResource{PTR: a.instance}); err != nil {
+            return err
+        }
+    }
+    if set&recSRV != 0 {
+        if err := b.SRVResource(hdr(a.instance, hostTTL, true), dnsmessage.SRVResource{Port: a.port, Target: a.host}); err != nil {
+            return err
+        }
+    }
+    if set&recTXT != 0 {
+        if err := b.TXTResource(hdr(a.instance, serviceTTL, true), dnsmessage.TXTResource{TXT: txt}); err != nil {
+            return err
+        }
+    }
+    if set&recA != 0 {
+        var a4 [4]byte
+        copy(a4[:], ip.To4())
+        if err := b.AResource(hdr(a.host, hostTTL, true), dnsmessage.AResource{A: a4}); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,195 @@
+package discovery
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    "net"
+    "sort"
+    "strings"
+    "time"
+
+    "golang.org/x/net/dns/dnsmessage"
+    "golang.org/x/net/ipv4"
+)
+
+// queryInterval is how often Browse repeats its query, since a single
+// multicast packet is easily lost.
+const queryInterval = time.Second
+
+// Browse asks the local network for servers until ctx is done and
+// returns those that answered, by name. A server reachable over several
+// interfaces is listed once, with all of its addresses.
+func Browse(ctx context.Context) ([]Instance, error) {
+    c, err := net.ListenPacket("udp4", ":0")
+    if err != nil {
+        return nil, err
+    }
+    defer c.Close()
+    p := ipv4.NewPacketConn(c)
+    p.SetMulticastTTL(255)
+    p.SetMulticastLoopback(true)
+    ifaces, err := multicastInterfaces()
+    if err != nil {
+        return nil, err
+    }
+    query, err := browseQuery()
+    if err != nil {
+        return nil, err
+    }
+    // Queried from a port of its own, a responder answers this socket
+    // directly rather than the group.
+    send := func() {
+        if len(ifaces) == 0 {
+            p.WriteTo(query, nil, mdnsGroup)
+        }
+        for _, idx := range sortedIndexes(ifaces) {
+            p.WriteTo(query, &ipv4.ControlMessage{IfIndex: idx}, mdnsGroup)
+        }
+    }
+    go func() {
+        tick := time.NewTicker(queryInterval)
+        defer tick.Stop()
+        for {
+            send()
+            select {
+            case <-ctx.Done():
+                return
+            case <-tick.C:
+            }
+        }
+    }()
+    stop := context.AfterFunc(ctx, func() { c.SetReadDeadline(time.Now()) })
+    defer stop()
+
+    found := newResults()
+    buf := make([]byte, maxMessage)
+    for {
+        n, _, err := c.ReadFrom(buf)
+        if err != nil {
+            var ne net.Error
+            if ctx.Err() != nil && errors.As(err, &ne) && ne.Timeout() {
+                return found.instances(), nil
+            }
+            return nil, err
+        }
+        found.add(buf[:n])
+    }
+}
+
+// browseQuery asks for the service's instances.
+func browseQuery() ([]byte, error) {
+    service, err := dnsmessage.NewName(Service + "." + domain)
+    if err != nil {
+        return nil, err
+    }
+    b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(1 << 16))})
+    if err := b.StartQuestions(); err != nil {
+        return nil, err
+    }
+    if err := b.Question(dnsmessage.Question{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+        return nil, err
+    }
+    return b.Finish()
+}
+
+type srvTarget struct {
+    host string
+    port int
+}
+
+// results gathers the records of every response by lowercased name, for
+// the answers to one question may arrive split across several.
+type results struct {
+    service string
+    names   map[string]string // instance key to its name as sent
+    srv     map[string]srvTarget
+    txt     map[string][]string
+    addrs   map[string][]net.IP
+}
+
+func newResults() *results {
+    return &results{
+        service: strings.ToLower(Service + "." + domain),
+        names:   map[string]string{},
+        srv:     map[string]srvTarget{},
+        txt:     map[string][]string{},
+        addrs:   map[string][]net.IP{},
+    }
+}
+
+func (r *results) add(msg []byte) {
+    var p dnsmessage.Parser
+    h, err := p.Start(msg)
+    if err != nil || !h.Response {
+        return
+    }
+    if err := p.SkipAllQuestions(); err != nil {
+        return
+    }
+    var all []dnsmessage.Resource
+    for _, section := range []func() ([]dnsmessage.Resource, error){p.AllAnswers, p.AllAuthorities, p.AllAdditionals} {
+        rs, err := section()
+        if err != nil {
+            break
+        }
+        all = append(all, rs...)
+    }
+    for _, rr := range all {
+        key := strings.ToLower(rr.Header.Name.String())
+        switch body := rr.Body.(type) {
+        case *dnsmessage.PTRResource:
+            if key != r.service {
+                continue
+            }
+            inst := strings.ToLower(body.PTR.String())
+            if rr.Header.TTL == 0 {
+                delete(r.names, inst) // goodbye
+                continue
+            }
+            r.names[inst] = body.PTR.String()
+        case *dnsmessage.SRVResource:
+            r.srv[key] = srvTarget{host: strings.ToLower(body.Target.String()), port: int(body.Port)}
+        case *dnsmessage.TXTResource:
+            r.txt[key] = body.TXT
+        case *dnsmessage.AResource:
+            ip := net.IP(body.A[:])
+            if !containsIP(r.addrs[key], ip) {
+                r.addrs[key] = append(r.addrs[key], ip)
+            }
+        }
+    }
+}
+
+// instances returns the instances whose service record arrived, by name.
+func (r *results) instances() []Instance {
+    suffix := strings.ToLower("." + Service + "." + domain)
+    var out []Instance
+    for key, name := range r.names {
+        srv, ok := r.srv[key]
+        if !ok {
+            continue
+        }
+        if strings.HasSuffix(strings.ToLower(name), suffix) {
+            name = name[:len(name)-len(suffix)]
+        }
+        out = append(out, Instance{
+            Name:  name,
+            Host:  strings.TrimSuffix(srv.host, "."+domain),
+            Addrs: r.addrs[srv.host],
+            Port:  srv.port,
+            Info:  parseTXT(r.txt[key]),
+        })
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+    for _, x := range list {
+        if x.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
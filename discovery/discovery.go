@@ -0,0 +1,170 @@
+// Package discovery announces the server on the local network with
+// multicast DNS and DNS service discovery (RFCs 6762 and 6763), and finds
+// servers that announce themselves.
+//
+// Only what a viewer needs to find a server is implemented: answering
+// queries for the service, announcing changes and saying goodbye. There
+// is no probing for name conflicts, so instances are named after the
+// host, which the network already expects to be unique.
+package discovery
+
+import (
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Service is the DNS-SD service type servers are announced under.
+const Service = "_hdmi-stream._tcp"
+
+const (
+    domain   = "local."
+    mdnsPort = 5353
+    // Host records live for two minutes and the rest for 75, as RFC 6762
+    // recommends.
+    hostTTL    = 120
+    serviceTTL = 4500
+    // cacheFlush, in a record's class, says it replaces any others of its
+    // name and type; qu, in a question's, asks for a unicast reply.
+    cacheFlush = 1 << 15
+    qu         = 1 << 15
+    // maxMessage is the largest mDNS message read or written.
+    maxMessage = 9000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// Info is what a server says about itself in its TXT record.
+type Info struct {
+    Version string
+    // TLS is whether the server only speaks HTTPS, and Auth whether it
+    // wants an access token.
+    TLS     bool
+    Auth    bool
+    Streams []Stream
+}
+
+// Stream is one advertised stream. Width and Height are zero when the
+// resolution is not known.
+type Stream struct {
+    Name          string
+    Width, Height int
+}
+
+func (s Stream) String() string {
+    if s.Width == 0 || s.Height == 0 {
+        return s.Name
+    }
+    return fmt.Sprintf("%s %dx%d", s.Name, s.Width, s.Height)
+}
+
+// txt encodes info as TXT strings: version, tls and auth, streams with
+// the names, and res.<name> with each known resolution.
+func (info Info) txt() []string {
+    txt := []string{
+        "version=" + info.Version,
+        "tls=" + strconv.FormatBool(info.TLS),
+        "auth=" + strconv.FormatBool(info.Auth),
+    }
+    names := make([]string, len(info.Streams))
+    for i, s := range info.Streams {
+        names[i] = s.Name
+    }
+    txt = append(txt, "streams="+strings.Join(names, ","))
+    for _, s := range info.Streams {
+        if s.Width > 0 && s.Height > 0 {
+            txt = append(txt, fmt.Sprintf("res.%s=%dx%d", s.Name, s.Width, s.Height))
+        }
+    }
+    return txt
+}
+
+// parseTXT is the inverse of txt, ignoring what it does not know.
+func parseTXT(txt []string) Info {
+    var info Info
+    res := map[string][2]int{}
+    var names []string
+    for _, kv := range txt {
+        k, v, _ := strings.Cut(kv, "=")
+        switch {
+        case k == "version":
+            info.Version = v
+        case k == "tls":
+            info.TLS, _ = strconv.ParseBool(v)
+        case k == "auth":
+            info.Auth, _ = strconv.ParseBool(v)
+        case k == "streams" && v != "":
+            names = strings.Split(v, ",")
+        case strings.HasPrefix(k, "res."):
+            var w, h int
+            if _, err := fmt.Sscanf(v, "%dx%d", &w, &h); err == nil {
+                res[k[len("res."):]] = [2]int{w, h}
+            }
+        }
+    }
+    for _, n := range names {
+        r := res[n]
+        info.Streams = append(info.Streams, Stream{Name: n, Width: r[0], Height: r[1]})
+    }
+    return info
+}
+
+// Instance is a server found by Browse.
+type Instance struct {
+    Name string
+    // Host is the server's mDNS host name, without the .local suffix.
+    Host  string
+    Addrs []net.IP
+    Port  int
+    Info
+}
+
+// multicastInterfaces returns the interfaces mDNS runs on, those that
+// are up, multicast-capable and have an IPv4 address, with that address.
+// Loopback is left out: announcements sent on the other interfaces are
+// looped back to this host anyway.
+func multicastInterfaces() (map[int]ifaceAddr, error) {
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return nil, err
+    }
+    out := make(map[int]ifaceAddr)
+    for _, ifi := range ifaces {
+        if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+            continue
+        }
+        addrs, err := ifi.Addrs()
+        if err != nil {
+            continue
+        }
+        for _, a := range addrs {
+            ipn, ok := a.(*net.IPNet)
+            if !ok {
+                continue
+            }
+            if ip4 := ipn.IP.To4(); ip4 != nil {
+                out[ifi.Index] = ifaceAddr{ifi: ifi, ip: ip4}
+                break
+            }
+        }
+    }
+    return out, nil
+}
+
+type ifaceAddr struct {
+    ifi net.Interface
+    ip  net.IP
+}
+
+// sortedIndexes returns the keys of m in order, so interfaces are always
+// visited the same way.
+func sortedIndexes(m map[int]ifaceAddr) []int {
+    out := make([]int, 0, len(m))
+    for i := range m {
+        out = append(out, i)
+    }
+    sort.Ints(out)
+    return out
+}
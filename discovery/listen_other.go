@@ -0,0 +1,14 @@
+//go:build !unix
+
+package discovery
+
+import (
+    "net"
+    "strconv"
+)
+
+// listenMDNS opens the mDNS port. Without SO_REUSEPORT it fails if
+// another responder on the host holds it.
+func listenMDNS() (net.PacketConn, error) {
+    return net.ListenPacket("udp4", ":"+strconv.Itoa(mdnsPort))
+}
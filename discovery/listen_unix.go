@@ -0,0 +1,31 @@
+//go:build unix
+
+package discovery
+
+import (
+    "context"
+    "net"
+    "strconv"
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// listenMDNS opens the mDNS port shared with any other responder on the
+// host, such as avahi, which would otherwise hold it alone.
+func listenMDNS() (net.PacketConn, error) {
+    lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+        var serr error
+        err := c.Control(func(fd uintptr) {
+            if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+                return
+            }
+            serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+        })
+        if err != nil {
+            return err
+        }
+        return serr
+    }}
+    return lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(mdnsPort))
+}
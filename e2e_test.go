@@ -0,0 +1,263 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/testclient"
+    "github.com/gorilla/websocket"
+)
+
+// The tests here run the whole path a viewer sees, from a synthetic
+// source through the hub and the websocket handler to testclient, which
+// reads each frame's counter back out of the JPEG.
+
+// e2eServer serves the websocket handler for a running stream from src,
+// with configure applied to its hub, and returns the /ws URL.
+func e2eServer(t *testing.T, c config.Config, src capture.CaptureSource, configure func(*hub.Hub)) string {
+    t.Helper()
+    setupServer(t, c)
+    startStream(t, "default", src, configure)
+    srv := httptest.NewUnstartedServer(http.HandlerFunc(streamHandler))
+    srv.Listener = smallBuffers{srv.Listener}
+    srv.Start()
+    t.Cleanup(srv.Close)
+    return wsURL(srv, "/ws")
+}
+
+// smallBuffers gives the connections it accepts small socket buffers,
+// so a client that reads slowly holds the server up in seconds rather
+// than once the kernel has queued megabytes for it, as it would over a
+// real network.
+type smallBuffers struct{ net.Listener }
+
+func (l smallBuffers) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    if err == nil {
+        conn.(*net.TCPConn).SetWriteBuffer(16 << 10)
+    }
+    return conn, err
+}
+
+// dialTestClient connects to url with a small receive buffer, the
+// client's half of smallBuffers.
+func dialTestClient(t *testing.T, url string) *testclient.Client {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    d := &websocket.Dialer{
+        Subprotocols: protocol.Subprotocols,
+        NetDial: func(network, addr string) (net.Conn, error) {
+            conn, err := net.Dial(network, addr)
+            if err == nil {
+                conn.(*net.TCPConn).SetReadBuffer(16 << 10)
+            }
+            return conn, err
+        },
+    }
+    c, err := testclient.DialWith(ctx, d, url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { c.Close() })
+    return c
+}
+
+// readFrames reads n frames within timeout and fails unless all came.
+func readFrames(t *testing.T, c *testclient.Client, n int, timeout time.Duration) []testclient.Frame {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    frames, err := c.ReadFrames(ctx, n)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(frames) < n {
+        t.Fatalf("%d of %d frames in %v", len(frames), n, timeout)
+    }
+    return frames
+}
+
+// seqGaps counts the sequence numbers missing from frames, which the
+// server dropped for the client. Counters can skip as well when the
+// machine is too busy for the source to keep up.
+func seqGaps(frames []testclient.Frame) int {
+    gaps := 0
+    for i := 1; i < len(frames); i++ {
+        if d := frames[i].Header.Seq - frames[i-1].Header.Seq; d > 1 {
+            gaps += int(d - 1)
+        }
+    }
+    return gaps
+}
+
+// stats returns the stats messages c has been sent.
+func stats(t *testing.T, c *testclient.Client) []protocol.Stats {
+    t.Helper()
+    var out []protocol.Stats
+    for _, msg := range c.Controls {
+        var s protocol.Stats
+        if err := json.Unmarshal(msg, &s); err != nil {
+            t.Fatal(err)
+        }
+        if s.Type == protocol.TypeStats {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+func TestEndToEndInOrder(t *testing.T) {
+    c := dialTestClient(t, e2eServer(t, config.Default(), capture.NewSyntheticSource(320, 180, 30), nil))
+    if c.Version != protocol.V2 {
+        t.Errorf("negotiated %v, want the newest", c.Version)
+    }
+    frames := readFrames(t, c, 45, 10*time.Second)
+    r := testclient.Check(frames)
+    if err := r.Err(); err != nil {
+        t.Fatal(err)
+    }
+    // A client keeping up loses at most the odd frame on a busy machine.
+    if gaps := seqGaps(frames); gaps > 2 {
+        t.Errorf("%d frames dropped for a client keeping up: %+v", gaps, r)
+    }
+    for _, f := range frames {
+        if f.Header.SendTS < f.Header.Timestamp {
+            t.Fatalf("frame %d sent at %d, before it was captured at %d", f.Header.Seq, f.Header.SendTS, f.Header.Timestamp)
+        }
+    }
+}
+
+func TestEndToEndFrameRateDropsEvenly(t *testing.T) {
+    c := dialTestClient(t, e2eServer(t, config.Default(), capture.NewSyntheticSource(320, 180, 30), nil))
+    if err := c.Send(protocol.Control{Type: protocol.TypeSetParams, Params: protocol.Params{FPS: 10}}); err != nil {
+        t.Fatal(err)
+    }
+    // Skip what was sent before the change took effect.
+    readFrames(t, c, 3, 5*time.Second)
+    frames := readFrames(t, c, 15, 10*time.Second)
+    r := testclient.Check(frames)
+    if err := r.Err(); err != nil {
+        t.Fatal(err)
+    }
+    // One frame in three, so two counter values between each.
+    if r.Missing < 2*(r.Frames-1)-2 || r.MaxGap > 5 {
+        t.Errorf("at 10 of 30 fps: %+v", r)
+    }
+}
+
+func TestEndToEndSlowReaderLosesFramesNotOrder(t *testing.T) {
+    c := config.Default()
+    c.AdaptiveQuality = true
+    tc := dialTestClient(t, e2eServer(t, c, capture.NewSyntheticSource(320, 180, 30), nil))
+    // Reading five frames a second of thirty, the client falls behind
+    // and the hub drops for it.
+    var frames []testclient.Frame
+    deadline := time.Now().Add(5 * time.Second)
+    for time.Now().Before(deadline) {
+        frames = append(frames, readFrames(t, tc, 1, 5*time.Second)...)
+        time.Sleep(200 * time.Millisecond)
+    }
+    r := testclient.Check(frames)
+    if err := r.Err(); err != nil {
+        t.Fatal(err)
+    }
+    if seqGaps(frames) == 0 {
+        t.Errorf("a client reading at 5 fps missed nothing: %+v", r)
+    }
+
+    // Caught up, the client hears it was stepped down; the writer was too
+    // busy to send stats while it was behind.
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for level := 0; level == 0; {
+        f, err := tc.ReadFrames(ctx, 1)
+        if err != nil || len(f) == 0 {
+            t.Fatalf("no stats with a lower level; got %+v", stats(t, tc))
+        }
+        for _, s := range stats(t, tc) {
+            level = max(level, s.Level)
+        }
+    }
+}
+
+func TestEndToEndResumeFillsTheGap(t *testing.T) {
+    url := e2eServer(t, config.Default(), capture.NewSyntheticSource(320, 180, 30), func(h *hub.Hub) {
+        h.HistoryBytes = 16 << 20
+        h.HistoryAge = 10 * time.Second
+    })
+    first := dialTestClient(t, url)
+    before := readFrames(t, first, 20, 10*time.Second)
+    first.Close()
+    // Frames go on being captured while the viewer is away.
+    time.Sleep(500 * time.Millisecond)
+
+    second := dialTestClient(t, url)
+    last := before[len(before)-1].Header.Seq
+    st, _ := streams.Get("default")
+    latest := st.Hub.Latest()
+    held := latest.Seq
+    latest.Release()
+    if err := second.Send(protocol.Control{Type: protocol.TypeResume, FromSeq: &last}); err != nil {
+        t.Fatal(err)
+    }
+    after := readFrames(t, second, 40, 10*time.Second)
+    if err := testclient.Check(append(before, after...)).Err(); err != nil {
+        t.Fatal(err)
+    }
+    // Every frame captured while the viewer was away is replayed. Live
+    // ones after them may be dropped like any others.
+    var replayed []testclient.Frame
+    for _, f := range after {
+        if f.Header.Seq <= held {
+            replayed = append(replayed, f)
+        }
+    }
+    if len(replayed) == 0 || replayed[0].Header.Seq != last+1 || replayed[len(replayed)-1].Header.Seq != held {
+        t.Fatalf("replayed %d frames, want %d through %d", len(replayed), last+1, held)
+    }
+    if gaps := seqGaps(replayed); gaps != 0 {
+        t.Errorf("%d frames lost across the reconnect", gaps)
+    }
+}
+
+// A viewer of a server since restarted asks to resume from a sequence
+// number the hub has not reached.
+func TestEndToEndResumeFromAnotherRun(t *testing.T) {
+    url := e2eServer(t, config.Default(), capture.NewSyntheticSource(320, 180, 30), func(h *hub.Hub) {
+        h.HistoryBytes = 16 << 20
+        h.HistoryAge = 10 * time.Second
+    })
+    c := dialTestClient(t, url)
+    readFrames(t, c, 5, 10*time.Second)
+    c.Close()
+
+    c = dialTestClient(t, url)
+    from := uint64(1 << 40)
+    if err := c.Send(protocol.Control{Type: protocol.TypeResume, FromSeq: &from}); err != nil {
+        t.Fatal(err)
+    }
+    // Live frames follow the refusal.
+    frames := readFrames(t, c, 5, 10*time.Second)
+    if err := testclient.Check(frames).Err(); err != nil {
+        t.Fatal(err)
+    }
+    var failed protocol.ResumeFailed
+    for _, msg := range c.Controls {
+        if json.Unmarshal(msg, &failed) == nil && failed.Type == protocol.TypeResumeFailed {
+            break
+        }
+    }
+    if failed.Type != protocol.TypeResumeFailed || failed.OldestSeq == 0 {
+        t.Errorf("no resume_failed naming the oldest frame kept in %q", c.Controls)
+    }
+}
@@ -0,0 +1,82 @@
+// Package encode compresses raw frames before they reach the hub.
+package encode
+
+import (
+    "image"
+    "image/jpeg"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// Encoder turns a raw frame into a compressed one. The input frame stays
+// the caller's to release.
+type Encoder interface {
+    Encode(f capture.Frame, quality int) (capture.Frame, error)
+}
+
+// StreamEncoder is an Encoder whose frames depend on earlier ones, such
+// as H.264. It is given every frame, one at a time and in order,
+// including frames the device already compressed, and is closed when
+// capture stops; the first Encode after that starts with a keyframe.
+type StreamEncoder interface {
+    Encoder
+    // Format is the format of the frames Encode returns.
+    Format() capture.PixelFormat
+    Close() error
+}
+
+// JPEGEncoder compresses frames with image/jpeg. It is safe for concurrent
+// use and recycles its scratch images between calls.
+type JPEGEncoder struct {
+    images sync.Pool // *image.YCbCr
+}
+
+func NewJPEGEncoder() *JPEGEncoder {
+    return &JPEGEncoder{}
+}
+
+func (e *JPEGEncoder) Encode(f capture.Frame, quality int) (capture.Frame, error) {
+    if quality <= 0 {
+        quality = imaging.DefaultQuality
+    }
+    var img image.Image
+    var err error
+    if f.Format == capture.FormatYUYV {
+        ycc := e.image(f.Width, f.Height)
+        defer e.images.Put(ycc)
+        err = imaging.DecodeYUYVInto(ycc, f.Data)
+        img = ycc
+    } else {
+        img, err = imaging.Decode(f)
+    }
+    if err != nil {
+        return capture.Frame{}, err
+    }
+
+    // The JPEG goes straight into a pooled frame buffer that the hub and
+    // its subscribers then share.
+    buf := capture.NewFrameBuffer(0)
+    if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+        buf.Release()
+        return capture.Frame{}, err
+    }
+    out := f
+    out.Data = buf.Bytes()
+    out.Buf = buf
+    out.Format = capture.FormatMJPEG
+    return out, nil
+}
+
+// image returns a pooled 4:2:2 image of the given size, replacing pooled
+// images left over from a different resolution.
+func (e *JPEGEncoder) image(w, h int) *image.YCbCr {
+    if v := e.images.Get(); v != nil {
+        img := v.(*image.YCbCr)
+        if img.Rect.Dx() == w && img.Rect.Dy() == h {
+            return img
+        }
+    }
+    return image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio422)
+}
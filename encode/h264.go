@@ -0,0 +1,70 @@
+package encode
+
+import (
+    "bytes"
+    "errors"
+)
+
+// DefaultH264Device is where Raspberry Pi OS exposes the VideoCore
+// hardware encoder.
+const DefaultH264Device = "/dev/video11"
+
+// ErrUnsupported is returned by encoders that cannot run on this platform.
+var ErrUnsupported = errors.New("encode: not supported on this platform")
+
+// H264Options configures the hardware H.264 encoder.
+type H264Options struct {
+    // Device is the V4L2 memory-to-memory encoder node.
+    Device string
+    // KeyframeInterval is the number of frames from one keyframe to the
+    // next. A new viewer waits for a keyframe before it sees anything.
+    KeyframeInterval int
+    // Bitrate is the target in bits per second.
+    Bitrate int
+}
+
+// NAL unit types that matter for splitting encoder output.
+const (
+    nalSlice    = 1
+    nalIDRSlice = 5
+    nalSPS      = 7
+)
+
+// nalTypes lists the types of the NAL units in an Annex-B buffer.
+func nalTypes(b []byte) []byte {
+    var types []byte
+    for {
+        i := bytes.Index(b, []byte{0, 0, 1})
+        if i < 0 || i+3 >= len(b) {
+            return types
+        }
+        b = b[i+3:]
+        types = append(types, b[0]&0x1F)
+    }
+}
+
+// accessUnit describes an encoder output buffer: whether it holds a
+// picture at all, rather than only parameter sets, and whether it is a
+// keyframe.
+func accessUnit(b []byte) (picture, key bool) {
+    for _, t := range nalTypes(b) {
+        switch t {
+        case nalSlice:
+            picture = true
+        case nalIDRSlice:
+            picture, key = true, true
+        }
+    }
+    return picture, key
+}
+
+// hasSPS reports whether an Annex-B buffer carries a sequence parameter
+// set.
+func hasSPS(b []byte) bool {
+    for _, t := range nalTypes(b) {
+        if t == nalSPS {
+            return true
+        }
+    }
+    return false
+}
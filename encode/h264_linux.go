@@ -0,0 +1,507 @@
+//go:build linux
+
+package encode
+
+import (
+    "errors"
+    "fmt"
+    "time"
+    "unsafe"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+    "golang.org/x/sys/unix"
+)
+
+// The hardware encoder is a V4L2 memory-to-memory device: raw frames are
+// queued on its OUTPUT queue and H.264 comes back on its CAPTURE queue.
+// Raspberry Pi's bcm2835-codec only offers the multi-planar API, so that
+// is the one used. The ABI subset below is from linux/videodev2.h and
+// v4l2-controls.h, as in package capture.
+
+const (
+    v4l2BufTypeCaptureMplane = 9
+    v4l2BufTypeOutputMplane  = 10
+    v4l2MemoryMmap           = 1
+    v4l2FieldNone            = 1
+    v4l2CapM2MMplane         = 0x00004000
+    v4l2CapStreaming         = 0x04000000
+    v4l2CapDeviceCaps        = 0x80000000
+    v4l2BufFlagKeyframe      = 0x00000008
+
+    v4l2CIDBitrate         = 0x009909cf
+    v4l2CIDGOPSize         = 0x009909cb
+    v4l2CIDRepeatSeqHeader = 0x009909e2
+    v4l2CIDH264IPeriod     = 0x00990a66
+
+    // m2mBuffers is how many buffers each queue gets. Frames are encoded
+    // one at a time, so a second buffer only hides the driver's latency.
+    m2mBuffers = 2
+    // m2mTimeout bounds the wait for one frame's output.
+    m2mTimeout = time.Second
+)
+
+var (
+    pixFmtYUYV = fourcc('Y', 'U', 'Y', 'V')
+    pixFmtH264 = fourcc('H', '2', '6', '4')
+)
+
+func fourcc(a, b, c, d byte) uint32 {
+    return uint32(a) | uint32(b)<<8 | uint32(c)<<16 | uint32(d)<<24
+}
+
+type v4l2Capability struct {
+    Driver       [16]byte
+    Card         [32]byte
+    BusInfo      [32]byte
+    Version      uint32
+    Capabilities uint32
+    DeviceCaps   uint32
+    Reserved     [3]uint32
+}
+
+type v4l2PlanePixFormat struct {
+    SizeImage    uint32
+    BytesPerLine uint32
+    Reserved     [6]uint16
+}
+
+type v4l2PixFormatMplane struct {
+    Width        uint32
+    Height       uint32
+    PixelFormat  uint32
+    Field        uint32
+    Colorspace   uint32
+    PlaneFmt     [8]v4l2PlanePixFormat
+    NumPlanes    uint8
+    Flags        uint8
+    YcbcrEnc     uint8
+    Quantization uint8
+    XferFunc     uint8
+    Reserved     [7]uint8
+}
+
+type v4l2Format struct {
+    Type uint32
+    Fmt  struct {
+        _   [0]uintptr // the C union contains pointers
+        Raw [200]byte
+    }
+}
+
+func (f *v4l2Format) pixMp() *v4l2PixFormatMplane {
+    return (*v4l2PixFormatMplane)(unsafe.Pointer(&f.Fmt.Raw[0]))
+}
+
+type v4l2RequestBuffers struct {
+    Count        uint32
+    Type         uint32
+    Memory       uint32
+    Capabilities uint32
+    Flags        uint8
+    Reserved     [3]uint8
+}
+
+type v4l2Timecode struct {
+    Type     uint32
+    Flags    uint32
+    Frames   uint8
+    Seconds  uint8
+    Minutes  uint8
+    Hours    uint8
+    UserBits [4]uint8
+}
+
+type v4l2Plane struct {
+    BytesUsed  uint32
+    Length     uint32
+    M          uintptr // union: mem_offset, userptr, fd
+    DataOffset uint32
+    Reserved   [11]uint32
+}
+
+type v4l2Buffer struct {
+    Index     uint32
+    Type      uint32
+    BytesUsed uint32
+    Flags     uint32
+    Field     uint32
+    Timestamp unix.Timeval
+    Timecode  v4l2Timecode
+    Sequence  uint32
+    Memory    uint32
+    M         uintptr // union; the planes array for multi-planar buffers
+    Length    uint32
+    Reserved2 uint32
+    RequestFD int32
+}
+
+type v4l2Control struct {
+    ID    uint32
+    Value int32
+}
+
+const (
+    iocWrite = 1
+    iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+    return dir<<30 | size<<16 | uintptr('V')<<8 | nr
+}
+
+var (
+    vidiocQueryCap  = ioc(iocRead, 0, unsafe.Sizeof(v4l2Capability{}))
+    vidiocSFmt      = ioc(iocRead|iocWrite, 5, unsafe.Sizeof(v4l2Format{}))
+    vidiocReqBufs   = ioc(iocRead|iocWrite, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+    vidiocQueryBuf  = ioc(iocRead|iocWrite, 9, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocQBuf      = ioc(iocRead|iocWrite, 15, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocDQBuf     = ioc(iocRead|iocWrite, 17, unsafe.Sizeof(v4l2Buffer{}))
+    vidiocStreamOn  = ioc(iocWrite, 18, unsafe.Sizeof(int32(0)))
+    vidiocStreamOff = ioc(iocWrite, 19, unsafe.Sizeof(int32(0)))
+    vidiocSCtrl     = ioc(iocRead|iocWrite, 28, unsafe.Sizeof(v4l2Control{}))
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+    for {
+        _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+        switch errno {
+        case 0:
+            return nil
+        case unix.EINTR:
+            continue
+        }
+        return errno
+    }
+}
+
+// V4L2H264Encoder encodes frames to H.264 on a V4L2 memory-to-memory
+// device. The device is opened on the first frame, reopened when the
+// frame size changes, and closed by Close. It is not safe for concurrent
+// use; the hub encodes stream encoders one frame at a time.
+type V4L2H264Encoder struct {
+    opts H264Options
+
+    fd            int
+    width, height int
+    out, cap      [][]byte // mapped OUTPUT and CAPTURE buffers
+    free          []uint32 // OUTPUT buffers not queued to the driver
+    pending       uint32   // CAPTURE buffer dequeued and not yet requeued
+    // header holds parameter sets the driver returned on their own, to
+    // go in front of the next picture.
+    header []byte
+    // planes is passed to the driver by address inside a v4l2Buffer, so
+    // it lives here rather than on a stack that could move.
+    planes [1]v4l2Plane
+}
+
+// NewV4L2H264 checks that opts.Device is a multi-planar memory-to-memory
+// encoder and returns an encoder for it.
+func NewV4L2H264(opts H264Options) (*V4L2H264Encoder, error) {
+    if opts.Device == "" {
+        opts.Device = DefaultH264Device
+    }
+    fd, err := unix.Open(opts.Device, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, fmt.Errorf("encode: open %s: %w", opts.Device, err)
+    }
+    defer unix.Close(fd)
+    var capability v4l2Capability
+    if err := ioctl(fd, vidiocQueryCap, unsafe.Pointer(&capability)); err != nil {
+        return nil, fmt.Errorf("encode: %s: VIDIOC_QUERYCAP: %w", opts.Device, err)
+    }
+    caps := capability.Capabilities
+    if caps&v4l2CapDeviceCaps != 0 {
+        caps = capability.DeviceCaps
+    }
+    if caps&v4l2CapM2MMplane == 0 || caps&v4l2CapStreaming == 0 {
+        return nil, fmt.Errorf("encode: %s is not a multi-planar memory-to-memory device", opts.Device)
+    }
+    return &V4L2H264Encoder{opts: opts, fd: -1}, nil
+}
+
+func (e *V4L2H264Encoder) Format() capture.PixelFormat { return capture.FormatH264 }
+
+// Encode compresses f, which may be YUYV or anything imaging can decode,
+// and returns the access unit the device produced for it. quality is
+// ignored in favour of the configured bitrate.
+func (e *V4L2H264Encoder) Encode(f capture.Frame, quality int) (capture.Frame, error) {
+    if e.fd >= 0 && (f.Width != e.width || f.Height != e.height) {
+        e.Close()
+    }
+    if e.fd < 0 {
+        if err := e.open(f.Width, f.Height); err != nil {
+            e.Close()
+            return capture.Frame{}, err
+        }
+    }
+    idx, err := e.outputBuffer()
+    if err != nil {
+        return capture.Frame{}, err
+    }
+    dst := e.out[idx][:f.Width*f.Height*2]
+    if f.Format == capture.FormatYUYV {
+        copy(dst, f.Data)
+    } else {
+        img, err := imaging.Decode(f)
+        if err != nil {
+            e.free = append(e.free, idx)
+            return capture.Frame{}, err
+        }
+        if err := imaging.EncodeYUYVInto(dst, img); err != nil {
+            e.free = append(e.free, idx)
+            return capture.Frame{}, err
+        }
+    }
+    e.planes[0] = v4l2Plane{BytesUsed: uint32(len(dst)), Length: uint32(len(e.out[idx]))}
+    buf := e.buffer(v4l2BufTypeOutputMplane, idx)
+    buf.Timestamp = unix.NsecToTimeval(f.Timestamp.UnixNano())
+    if err := ioctl(e.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+        e.free = append(e.free, idx)
+        return capture.Frame{}, fmt.Errorf("encode: queue raw frame: %w", err)
+    }
+
+    for {
+        data, key, err := e.dequeue()
+        if err != nil {
+            return capture.Frame{}, err
+        }
+        picture, idr := accessUnit(data)
+        if !picture {
+            e.header = append(e.header[:0], data...)
+            e.requeueCapture()
+            continue
+        }
+        key = key || idr
+        prefix := key && len(e.header) > 0 && !hasSPS(data)
+        fb := capture.NewFrameBuffer(0)
+        if prefix {
+            fb.Write(e.header)
+        }
+        fb.Write(data)
+        e.requeueCapture()
+        return capture.Frame{
+            Data:        fb.Bytes(),
+            Format:      capture.FormatH264,
+            Width:       f.Width,
+            Height:      f.Height,
+            Timestamp:   f.Timestamp,
+            Key:         key,
+            Placeholder: f.Placeholder,
+            Buf:         fb,
+        }, nil
+    }
+}
+
+// open configures the device for w by h YUYV in and H.264 out, maps its
+// buffers and starts both queues.
+func (e *V4L2H264Encoder) open(w, h int) error {
+    if w <= 0 || h <= 0 || w%2 != 0 {
+        return fmt.Errorf("encode: cannot H.264 encode %dx%d", w, h)
+    }
+    fd, err := unix.Open(e.opts.Device, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+    if err != nil {
+        return fmt.Errorf("encode: open %s: %w", e.opts.Device, err)
+    }
+    e.fd, e.width, e.height = fd, w, h
+    e.header = e.header[:0]
+
+    in := v4l2Format{Type: v4l2BufTypeOutputMplane}
+    p := in.pixMp()
+    p.Width, p.Height, p.PixelFormat, p.Field = uint32(w), uint32(h), pixFmtYUYV, v4l2FieldNone
+    p.NumPlanes = 1
+    p.PlaneFmt[0] = v4l2PlanePixFormat{BytesPerLine: uint32(w * 2), SizeImage: uint32(w * h * 2)}
+    if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&in)); err != nil {
+        return fmt.Errorf("encode: %s: set YUYV input: %w", e.opts.Device, err)
+    }
+    if p.PixelFormat != pixFmtYUYV || p.Width != uint32(w) || p.Height != uint32(h) {
+        return fmt.Errorf("encode: %s does not take %dx%d YUYV", e.opts.Device, w, h)
+    }
+    out := v4l2Format{Type: v4l2BufTypeCaptureMplane}
+    p = out.pixMp()
+    p.Width, p.Height, p.PixelFormat, p.Field = uint32(w), uint32(h), pixFmtH264, v4l2FieldNone
+    p.NumPlanes = 1
+    p.PlaneFmt[0].SizeImage = uint32(max(w*h, 512<<10))
+    if err := ioctl(fd, vidiocSFmt, unsafe.Pointer(&out)); err != nil {
+        return fmt.Errorf("encode: %s: set H.264 output: %w", e.opts.Device, err)
+    }
+    if p.PixelFormat != pixFmtH264 {
+        return fmt.Errorf("encode: %s does not produce H.264", e.opts.Device)
+    }
+
+    // Drivers differ in which of these they know; each is best effort.
+    interval := int32(e.opts.KeyframeInterval)
+    for _, c := range []v4l2Control{
+        {ID: v4l2CIDBitrate, Value: int32(e.opts.Bitrate)},
+        {ID: v4l2CIDH264IPeriod, Value: interval},
+        {ID: v4l2CIDGOPSize, Value: interval},
+        // Parameter sets before every keyframe, so a viewer can join at
+        // any of them.
+        {ID: v4l2CIDRepeatSeqHeader, Value: 1},
+    } {
+        if c.Value > 0 {
+            _ = ioctl(fd, vidiocSCtrl, unsafe.Pointer(&c))
+        }
+    }
+
+    if e.out, err = e.mapBuffers(v4l2BufTypeOutputMplane); err != nil {
+        return err
+    }
+    e.free = e.free[:0]
+    for i := range e.out {
+        e.free = append(e.free, uint32(i))
+    }
+    if e.cap, err = e.mapBuffers(v4l2BufTypeCaptureMplane); err != nil {
+        return err
+    }
+    for i := range e.cap {
+        e.planes[0] = v4l2Plane{Length: uint32(len(e.cap[i]))}
+        buf := e.buffer(v4l2BufTypeCaptureMplane, uint32(i))
+        if err := ioctl(fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+            return fmt.Errorf("encode: %s: VIDIOC_QBUF: %w", e.opts.Device, err)
+        }
+    }
+    for _, typ := range []int32{v4l2BufTypeOutputMplane, v4l2BufTypeCaptureMplane} {
+        typ := typ
+        if err := ioctl(fd, vidiocStreamOn, unsafe.Pointer(&typ)); err != nil {
+            return fmt.Errorf("encode: %s: VIDIOC_STREAMON: %w", e.opts.Device, err)
+        }
+    }
+    return nil
+}
+
+func (e *V4L2H264Encoder) mapBuffers(typ uint32) ([][]byte, error) {
+    req := v4l2RequestBuffers{Count: m2mBuffers, Type: typ, Memory: v4l2MemoryMmap}
+    if err := ioctl(e.fd, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+        return nil, fmt.Errorf("encode: %s: VIDIOC_REQBUFS: %w", e.opts.Device, err)
+    }
+    if req.Count == 0 {
+        return nil, fmt.Errorf("encode: %s allocated no buffers", e.opts.Device)
+    }
+    var bufs [][]byte
+    for i := uint32(0); i < req.Count; i++ {
+        buf := e.buffer(typ, i)
+        if err := ioctl(e.fd, vidiocQueryBuf, unsafe.Pointer(&buf)); err != nil {
+            unmap(bufs)
+            return nil, fmt.Errorf("encode: %s: VIDIOC_QUERYBUF: %w", e.opts.Device, err)
+        }
+        mem, err := unix.Mmap(e.fd, int64(uint32(e.planes[0].M)), int(e.planes[0].Length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+        if err != nil {
+            unmap(bufs)
+            return nil, fmt.Errorf("encode: %s: mmap buffer %d: %w", e.opts.Device, i, err)
+        }
+        bufs = append(bufs, mem)
+    }
+    return bufs, nil
+}
+
+// buffer returns a v4l2Buffer for index idx of queue typ pointing at
+// e.planes.
+func (e *V4L2H264Encoder) buffer(typ, idx uint32) v4l2Buffer {
+    return v4l2Buffer{
+        Index:  idx,
+        Type:   typ,
+        Memory: v4l2MemoryMmap,
+        M:      uintptr(unsafe.Pointer(&e.planes[0])),
+        Length: 1,
+    }
+}
+
+// outputBuffer returns a free OUTPUT buffer, taking back one the driver
+// has finished reading if none is free.
+func (e *V4L2H264Encoder) outputBuffer() (uint32, error) {
+    for len(e.free) == 0 {
+        buf := e.buffer(v4l2BufTypeOutputMplane, 0)
+        err := ioctl(e.fd, vidiocDQBuf, unsafe.Pointer(&buf))
+        if err == unix.EAGAIN {
+            if err := e.poll(unix.POLLOUT); err != nil {
+                return 0, err
+            }
+            continue
+        }
+        if err != nil {
+            return 0, fmt.Errorf("encode: reclaim input buffer: %w", err)
+        }
+        e.free = append(e.free, buf.Index)
+    }
+    idx := e.free[len(e.free)-1]
+    e.free = e.free[:len(e.free)-1]
+    return idx, nil
+}
+
+// dequeue waits for the next CAPTURE buffer and returns its contents,
+// which stay valid until requeueCapture.
+func (e *V4L2H264Encoder) dequeue() ([]byte, bool, error) {
+    for {
+        buf := e.buffer(v4l2BufTypeCaptureMplane, 0)
+        err := ioctl(e.fd, vidiocDQBuf, unsafe.Pointer(&buf))
+        if err == unix.EAGAIN {
+            if err := e.poll(unix.POLLIN); err != nil {
+                return nil, false, err
+            }
+            continue
+        }
+        if err != nil {
+            return nil, false, fmt.Errorf("encode: dequeue H.264: %w", err)
+        }
+        p := e.planes[0]
+        data := e.cap[buf.Index][p.DataOffset:p.BytesUsed]
+        e.pending = buf.Index
+        if len(data) == 0 {
+            e.requeueCapture()
+            continue
+        }
+        return data, buf.Flags&v4l2BufFlagKeyframe != 0, nil
+    }
+}
+
+// requeueCapture hands the last dequeued CAPTURE buffer back to the
+// driver.
+func (e *V4L2H264Encoder) requeueCapture() {
+    e.planes[0] = v4l2Plane{Length: uint32(len(e.cap[e.pending]))}
+    buf := e.buffer(v4l2BufTypeCaptureMplane, e.pending)
+    _ = ioctl(e.fd, vidiocQBuf, unsafe.Pointer(&buf))
+}
+
+var errM2MTimeout = errors.New("encode: hardware encoder timed out")
+
+func (e *V4L2H264Encoder) poll(events int16) error {
+    fds := []unix.PollFd{{Fd: int32(e.fd), Events: events}}
+    for {
+        n, err := unix.Poll(fds, int(m2mTimeout/time.Millisecond))
+        if err == unix.EINTR {
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("encode: poll: %w", err)
+        }
+        if n == 0 {
+            return errM2MTimeout
+        }
+        return nil
+    }
+}
+
+// Close stops the device and releases its buffers. The next Encode opens
+// the device again, starting a new stream.
+func (e *V4L2H264Encoder) Close() error {
+    if e.fd < 0 {
+        return nil
+    }
+    for _, typ := range []int32{v4l2BufTypeOutputMplane, v4l2BufTypeCaptureMplane} {
+        typ := typ
+        _ = ioctl(e.fd, vidiocStreamOff, unsafe.Pointer(&typ))
+    }
+    unmap(e.out)
+    unmap(e.cap)
+    e.out, e.cap, e.free = nil, nil, e.free[:0]
+    err := unix.Close(e.fd)
+    e.fd = -1
+    return err
+}
+
+func unmap(bufs [][]byte) {
+    for _, b := range bufs {
+        unix.Munmap(b)
+    }
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package encode
+
+import "github.com/Cdaprod/hdmi-streaming-app/capture"
+
+// V4L2H264Encoder is only functional on Linux.
+type V4L2H264Encoder struct{}
+
+func NewV4L2H264(opts H264Options) (*V4L2H264Encoder, error) { return nil, ErrUnsupported }
+
+func (e *V4L2H264Encoder) Format() capture.PixelFormat { return capture.FormatH264 }
+
+func (e *V4L2H264Encoder) Encode(f capture.Frame, quality int) (capture.Frame, error) {
+    return capture.Frame{}, ErrUnsupported
+}
+
+func (e *V4L2H264Encoder) Close() error { return nil }
@@ -0,0 +1,129 @@
+package encode
+
+import (
+    "log/slog"
+    "runtime"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/metrics"
+)
+
+// Pipeline encodes frames on a pool of workers and hands the results to
+// out in the order they were submitted. out takes over each result's
+// buffer.
+type Pipeline struct {
+    enc     Encoder
+    quality func() int
+    out     func(capture.Frame)
+    m       *metrics.Metrics
+
+    in       chan job
+    done     chan result
+    wg       sync.WaitGroup
+    seq      uint64
+    released chan struct{}
+}
+
+type job struct {
+    n uint64
+    f capture.Frame
+}
+
+type result struct {
+    n  uint64
+    f  capture.Frame
+    ok bool
+}
+
+// NewPipeline starts workers goroutines (GOMAXPROCS when zero) behind an
+// input queue of queue frames (twice the workers when zero). quality is
+// consulted per frame so it can change while running.
+func NewPipeline(enc Encoder, workers, queue int, quality func() int, out func(capture.Frame), m *metrics.Metrics) *Pipeline {
+    if workers <= 0 {
+        workers = runtime.GOMAXPROCS(0)
+    }
+    if queue <= 0 {
+        queue = 2 * workers
+    }
+    if m == nil {
+        m = metrics.New(nil).Stream("")
+    }
+    p := &Pipeline{
+        enc:     enc,
+        quality: quality,
+        out:     out,
+        m:       m,
+        in:      make(chan job, queue),
+        done:    make(chan result, queue+workers),
+
+        released: make(chan struct{}),
+    }
+    p.wg.Add(workers)
+    for i := 0; i < workers; i++ {
+        go p.work()
+    }
+    go p.order()
+    return p
+}
+
+// Submit queues f for encoding, taking over the caller's reference to
+// its buffer. When the queue is full the frame is dropped and Submit
+// returns false; the capture loop must never wait on the encoder. Submit
+// must not be called concurrently or after Close.
+func (p *Pipeline) Submit(f capture.Frame) bool {
+    select {
+    case p.in <- job{n: p.seq, f: f}:
+        p.seq++
+        return true
+    default:
+        f.Release()
+        p.m.FramesEncodeDropped.Inc()
+        return false
+    }
+}
+
+// Close waits for queued frames to be encoded and delivered.
+func (p *Pipeline) Close() {
+    close(p.in)
+    p.wg.Wait()
+    close(p.done)
+    <-p.released
+}
+
+func (p *Pipeline) work() {
+    defer p.wg.Done()
+    for j := range p.in {
+        start := time.Now()
+        f, err := p.enc.Encode(j.f, p.quality())
+        j.f.Release()
+        p.m.EncodeDuration.Observe(time.Since(start).Seconds())
+        if err != nil {
+            slog.Warn("encode failed", "err", err)
+        }
+        p.done <- result{n: j.n, f: f, ok: err == nil}
+    }
+}
+
+// order releases results in submission order. Failed frames still occupy
+// their slot so that a single bad frame cannot stall the stream.
+func (p *Pipeline) order() {
+    defer close(p.released)
+    pending := map[uint64]result{}
+    var next uint64
+    for r := range p.done {
+        pending[r.n] = r
+        for {
+            r, ok := pending[next]
+            if !ok {
+                break
+            }
+            delete(pending, next)
+            next++
+            if r.ok {
+                p.out(r.f)
+            }
+        }
+    }
+}
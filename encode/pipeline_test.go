@@ -0,0 +1,86 @@
+package encode
+
+import (
+    "fmt"
+    "testing"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+)
+
+// frame1080p is one synthetic 1080p YUYV frame, not pooled, so it can
+// be submitted again and again.
+func frame1080p(tb testing.TB) capture.Frame {
+    tb.Helper()
+    src := capture.NewSyntheticSource(1920, 1080, 1000)
+    if err := src.Open("synthetic"); err != nil {
+        tb.Fatal(err)
+    }
+    defer src.Close()
+    f, err := src.ReadFrame()
+    if err != nil {
+        tb.Fatal(err)
+    }
+    defer f.Release()
+    if f.Format != capture.FormatYUYV {
+        tb.Fatalf("synthetic frame is %s, want YUYV", f.Format)
+    }
+    frame := f
+    frame.Data = append([]byte(nil), f.Data...)
+    frame.Buf = nil
+    return frame
+}
+
+func TestPipelineKeepsOrder(t *testing.T) {
+    f := frame1080p(t)
+    f.Width, f.Height = 64, 36
+    f.Data = f.Data[:64*36*2]
+    var got []int
+    p := NewPipeline(NewJPEGEncoder(), 4, 64, func() int { return 80 }, func(out capture.Frame) {
+        got = append(got, out.Width)
+        out.Release()
+    }, nil)
+    // Widths tell the frames apart; every even width is a whole number
+    // of YUYV pairs.
+    for i := 0; i < 32; i++ {
+        f.Width = 64 - 2*(i%16)
+        f.Height = 36
+        f.Data = f.Data[:f.Width*f.Height*2]
+        if !p.Submit(f) {
+            t.Fatalf("frame %d dropped with room in the queue", i)
+        }
+    }
+    p.Close()
+    if len(got) != 32 {
+        t.Fatalf("%d frames out, want 32", len(got))
+    }
+    for i, w := range got {
+        if want := 64 - 2*(i%16); w != want {
+            t.Fatalf("frame %d out of order: width %d, want %d", i, w, want)
+        }
+    }
+}
+
+func BenchmarkPipeline1080p(b *testing.B) {
+    f := frame1080p(b)
+    for _, workers := range []int{1, 2, 4} {
+        b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+            queue := 2 * workers
+            // Submit drops when the queue is full, so slots keep it from
+            // filling: each frame delivered frees one.
+            slots := make(chan struct{}, queue)
+            p := NewPipeline(NewJPEGEncoder(), workers, queue, func() int { return 80 }, func(out capture.Frame) {
+                out.Release()
+                <-slots
+            }, nil)
+            b.SetBytes(int64(len(f.Data)))
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                slots <- struct{}{}
+                if !p.Submit(f) {
+                    b.Fatal("frame dropped")
+                }
+            }
+            p.Close()
+        })
+    }
+}
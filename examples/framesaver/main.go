@@ -0,0 +1,69 @@
+// Command framesaver watches a stream with the client package and saves
+// one frame a second to a directory, as frame-{seq}.jpg, until it is
+// interrupted.
+//
+//	go run ./examples/framesaver -url ws://localhost:8080/ws -dir frames
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/client"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+func main() {
+    url := flag.String("url", "ws://localhost:8080/ws", "stream websocket URL")
+    token := flag.String("token", "", "API token, when the server requires one")
+    dir := flag.String("dir", "frames", "directory to save frames in")
+    flag.Parse()
+    if err := os.MkdirAll(*dir, 0o755); err != nil {
+        log.Fatal(err)
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    s, err := client.Dial(dialCtx, *url,
+        client.WithToken(*token),
+        // The server thins the stream to a frame a second, so every
+        // frame that arrives is one to save.
+        client.WithFPS(1),
+        client.WithStats(func(st protocol.Stats) {
+            if st.Level > 0 {
+                log.Printf("server lowered quality: level %d, drop rate %.1f%%", st.Level, st.DropPercent)
+            }
+        }))
+    cancel()
+    if err != nil {
+        log.Fatal(err)
+    }
+    if s.Hello().Video != protocol.VideoJPEG {
+        log.Fatalf("stream sends %s, not JPEG frames", s.Hello().Video)
+    }
+    go func() {
+        <-ctx.Done()
+        s.Close()
+    }()
+
+    for f := range s.Frames() {
+        if f.Still() {
+            continue
+        }
+        name := filepath.Join(*dir, fmt.Sprintf("frame-%d.jpg", f.Seq))
+        if err := os.WriteFile(name, f.Data, 0o644); err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("saved %s, captured %s", name, f.Timestamp.Format(time.RFC3339Nano))
+    }
+    if err := s.Err(); err != nil {
+        log.Fatal(err)
+    }
+}
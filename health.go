@@ -0,0 +1,161 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+)
+
+// probeInterval limits how often readiness opens an idle device, so a
+// busy health checker does not keep the hardware waking up.
+const probeInterval = 30 * time.Second
+
+// probeDevice is capture.Probe, replaceable for tests without hardware.
+var probeDevice = capture.Probe
+
+type checkResult struct {
+    Name   string    `json:"name"`
+    Device string    `json:"device"`
+    State  hub.State `json:"state"`
+    OK     bool      `json:"ok"`
+    Error  string    `json:"error,omitempty"`
+    // Signal is whether the device sees an input signal.
+    Signal bool `json:"signal"`
+    // Checked is when the result was established, which for an idle
+    // device is the time of the last probe.
+    Checked time.Time `json:"checked"`
+}
+
+type readyResponse struct {
+    Ready  bool          `json:"ready"`
+    Checks []checkResult `json:"checks"`
+}
+
+// prober remembers the last probe of each idle device.
+type prober struct {
+    mu   sync.Mutex
+    last map[string]probeResult
+}
+
+type probeResult struct {
+    at  time.Time
+    err error
+}
+
+var probes = &prober{last: map[string]probeResult{}}
+
+// probe opens device unless it was tried within probeInterval, in which
+// case that attempt's result is returned.
+func (p *prober) probe(device string, now time.Time) probeResult {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if r, ok := p.last[device]; ok && now.Sub(r.at) < probeInterval {
+        return r
+    }
+    r := probeResult{at: now, err: probeDevice(device)}
+    p.last[device] = r
+    return r
+}
+
+// healthzHandler serves GET /healthz: the process is up and serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler serves GET /readyz, answering 503 unless every stream
+// can deliver frames.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+    resp := readyResponse{Ready: true, Checks: []checkResult{}}
+    now := time.Now()
+    for _, st := range streams.All() {
+        c := checkStream(st, now)
+        resp.Ready = resp.Ready && c.OK
+        resp.Checks = append(resp.Checks, c)
+    }
+    code := http.StatusOK
+    if !resp.Ready {
+        code = http.StatusServiceUnavailable
+    }
+    writeJSON(w, code, resp)
+}
+
+// checkStream decides whether one stream is ready. A running device must
+// have an input signal and have produced a frame within ready_frame_age. An on-demand device that
+// is closed, or whose last run failed, is ready if it can be opened,
+// since the next viewer will open it; one that is always meant to be
+// open is not ready until capture runs.
+func checkStream(st *stream.Stream, now time.Time) checkResult {
+    h := st.Hub
+    c := checkResult{Name: st.Name, Device: st.Config.Device, State: h.State(), Signal: h.SignalPresent(), Checked: now}
+    switch c.State {
+    case hub.StateRunning:
+        f := h.Latest()
+        if f != nil {
+            // Only the timestamp is needed.
+            f.Release()
+        }
+        switch {
+        case !c.Signal:
+            c.Error = "no input signal"
+        case f == nil:
+            c.Error = "no frame received yet"
+        case now.Sub(f.Timestamp) > cfg.ReadyFrameAge:
+            c.Error = fmt.Sprintf("no frame for %s", now.Sub(f.Timestamp).Round(time.Millisecond))
+        default:
+            c.OK = true
+        }
+    case hub.StateStarting:
+        c.Error = "device is opening"
+    default:
+        if !h.OnDemand {
+            c.Error = "capture is not running"
+            if err := h.RunErr(); err != nil {
+                c.Error = err.Error()
+            }
+            break
+        }
+        p := probes.probe(probedDevice(st.Config), now)
+        c.Checked = p.at
+        c.OK = p.err == nil
+        if p.err != nil {
+            c.Error = p.err.Error()
+        }
+    }
+    return c
+}
+
+// probedDevice is the device whose presence decides whether sc can run:
+// its own, or a composite's base stream's, since without the inset the
+// picture only goes stale.
+func probedDevice(sc config.Stream) string {
+    if sc.Composite == nil {
+        return sc.Device
+    }
+    for _, o := range cfg.StreamList() {
+        if o.Name == sc.Composite.Base {
+            return o.Device
+        }
+    }
+    return sc.Device
+}
+
+// selfTest probes every configured device once and prints the outcome,
+// returning the process exit status.
+func selfTest() int {
+    status := 0
+    for _, sc := range cfg.StreamList() {
+        if err := probeDevice(probedDevice(sc)); err != nil {
+            fmt.Printf("FAIL %s %s: %v\n", sc.Name, sc.Device, err)
+            status = 1
+            continue
+        }
+        fmt.Printf("ok   %s %s\n", sc.Name, sc.Device)
+    }
+    return status
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/rollup"
+)
+
+// Each stream's instruments are sampled every statsSample into the
+// rollups, which are written every statsFlush and pruned every
+// statsPrune.
+const (
+    statsSample = 5 * time.Second
+    statsFlush  = time.Minute
+    statsPrune  = time.Hour
+)
+
+// statsStore is the stream statistics history; nil without a stats_file.
+var statsStore *rollup.Store
+
+// recordStats samples every stream into statsStore until ctx is done.
+func recordStats(ctx context.Context) {
+    if statsStore == nil {
+        return
+    }
+    tick := time.NewTicker(statsSample)
+    defer tick.Stop()
+    var flushed, pruned time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-tick.C:
+            for _, st := range streams.All() {
+                r := st.Metrics.Read()
+                statsStore.Record(rollup.Sample{
+                    Time:          now,
+                    Stream:        st.Name,
+                    FPS:           r.FPS,
+                    Clients:       r.Clients,
+                    BytesSent:     r.BytesSent,
+                    FramesDropped: r.FramesDropped,
+                    CaptureErrors: r.CaptureErrors,
+                    Signal:        r.Signal,
+                })
+            }
+            if now.Sub(flushed) >= statsFlush {
+                flushed = now
+                if err := statsStore.Flush(); err != nil {
+                    slog.Warn("stats not written", "file", cfg.StatsFile, "err", err)
+                }
+            }
+            if now.Sub(pruned) >= statsPrune {
+                pruned = now
+                if err := statsStore.Prune(); err != nil {
+                    slog.Warn("stats not pruned", "file", cfg.StatsFile, "err", err)
+                }
+            }
+        }
+    }
+}
+
+type statsHistoryResponse struct {
+    From       time.Time      `json:"from"`
+    To         time.Time      `json:"to"`
+    Resolution string         `json:"resolution"`
+    Points     []rollup.Point `json:"points"`
+}
+
+// statsHistoryHandler serves GET /api/stats: the rollups from ?from= to
+// ?to=, RFC 3339 times defaulting to the last day, at ?resolution=minute
+// or hour, for ?stream= or every stream.
+func statsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+    if statsStore == nil {
+        writeError(w, http.StatusNotFound, "stats history is off; set stats_file")
+        return
+    }
+    q := r.URL.Query()
+    resp := statsHistoryResponse{To: time.Now(), Resolution: rollup.Minute}
+    if v := q.Get("to"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+            return
+        }
+        resp.To = t
+    }
+    resp.From = resp.To.Add(-24 * time.Hour)
+    if v := q.Get("from"); v != "" {
+        t, err := time.Parse(time.RFC3339, v)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+            return
+        }
+        resp.From = t
+    }
+    if v := q.Get("resolution"); v != "" {
+        resp.Resolution = v
+    }
+    points, err := statsStore.Query(resp.From, resp.To, resp.Resolution, q.Get("stream"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    resp.Points = points
+    writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,311 @@
+// Package hls serves a hub as HTTP Live Streaming, for players such as
+// iOS Safari that cannot be relied on to keep a websocket open.
+//
+// H.264 is encoded by an ffmpeg child process fed the hub's JPEGs, and
+// its MPEG-TS output is cut into segments held in memory. The encoder
+// starts with the first playlist request and stops once players have
+// stopped asking, so an unwatched stream costs nothing.
+package hls
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os/exec"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+const (
+    // SegmentDuration is the keyframe interval ffmpeg is told to keep,
+    // and so the length of every segment.
+    SegmentDuration = 2 * time.Second
+    // WindowSegments is how many segments the playlist lists and memory
+    // holds.
+    WindowSegments = 6
+    // idleTimeout stops the encoder once no player has fetched the
+    // playlist for this long.
+    idleTimeout = 30 * time.Second
+    // firstSegmentWait bounds how long a playlist request waits for a
+    // freshly started encoder.
+    firstSegmentWait = 3 * SegmentDuration
+    minBackoff       = time.Second
+    maxBackoff       = 30 * time.Second
+)
+
+// Server encodes a hub to HLS on demand and serves the playlist and
+// segments.
+type Server struct {
+    // Charge, when set, returns what counts the bytes of the reply to a
+    // request, or nil to count nothing. Refusing requests once a budget
+    // is spent is left to the caller, as authentication is.
+    Charge func(r *http.Request) func(n int) error
+
+    hub    *hub.Hub
+    ffmpeg string
+    log    *slog.Logger
+    ring   *ring
+
+    ctx    context.Context
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+
+    mu          sync.Mutex
+    running     bool
+    lastRequest time.Time
+}
+
+// NewServer returns a server encoding h with the ffmpeg binary at ffmpeg,
+// which must have libx264.
+func NewServer(h *hub.Hub, ffmpeg string, log *slog.Logger) *Server {
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Server{
+        hub:    h,
+        ffmpeg: ffmpeg,
+        log:    log.With("transport", "hls"),
+        ring:   newRing(WindowSegments),
+        ctx:    ctx,
+        cancel: cancel,
+    }
+}
+
+// Close stops the encoder and waits for it to exit.
+func (s *Server) Close() {
+    s.cancel()
+    s.wg.Wait()
+}
+
+// ServeHTTP serves playlist.m3u8 and segmentN.ts at the end of the
+// request path. Authentication is left to the caller; a token in the
+// playlist request is carried on to the segment URLs.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if s.Charge != nil {
+        if charge := s.Charge(r); charge != nil {
+            w = chargedWriter{w, charge}
+        }
+    }
+    name := path.Base(r.URL.Path)
+    switch {
+    case name == "playlist.m3u8":
+        s.servePlaylist(w, r)
+    case strings.HasPrefix(name, "segment") && strings.HasSuffix(name, ".ts"):
+        seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "segment"), ".ts"), 10, 64)
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        seg := s.ring.get(seq)
+        if seg == nil {
+            http.Error(w, "segment expired", http.StatusNotFound)
+            return
+        }
+        // A number is never reused, so a segment can be cached for as
+        // long as anyone could still want it.
+        w.Header().Set("Content-Type", "video/mp2t")
+        w.Header().Set("Cache-Control", "public, max-age=60")
+        w.Header().Set("Content-Length", strconv.Itoa(len(seg.Data)))
+        w.Write(seg.Data)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// chargedWriter passes the size of each write to charge, returning its
+// error from the write.
+type chargedWriter struct {
+    http.ResponseWriter
+    charge func(n int) error
+}
+
+func (w chargedWriter) Write(b []byte) (int, error) {
+    n, err := w.ResponseWriter.Write(b)
+    if cerr := w.charge(n); err == nil {
+        err = cerr
+    }
+    return n, err
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request) {
+    s.demand()
+    select {
+    case <-s.ring.waitReady():
+    case <-r.Context().Done():
+        return
+    case <-time.After(firstSegmentWait):
+        w.Header().Set("Retry-After", strconv.Itoa(int(SegmentDuration/time.Second)))
+        http.Error(w, "stream is starting", http.StatusServiceUnavailable)
+        return
+    }
+    playlist := s.ring.Playlist()
+    if token := r.URL.Query().Get("token"); token != "" {
+        q := "?" + url.Values{"token": {token}}.Encode()
+        playlist = bytes.ReplaceAll(playlist, []byte(".ts\n"), []byte(".ts"+q+"\n"))
+    }
+    w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write(playlist)
+}
+
+// demand notes a playlist request and starts the encoder if it is not
+// running.
+func (s *Server) demand() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastRequest = time.Now()
+    if s.running || s.ctx.Err() != nil {
+        return
+    }
+    s.running = true
+    s.wg.Add(1)
+    go s.supervise()
+}
+
+func (s *Server) idle() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return time.Since(s.lastRequest) >= idleTimeout
+}
+
+// stopIfIdle marks the encoder stopped if nobody has asked for the
+// playlist lately. Checking and clearing running under one lock means a
+// request either sees the encoder still running or starts a new one.
+func (s *Server) stopIfIdle() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.ctx.Err() == nil && time.Since(s.lastRequest) < idleTimeout {
+        return false
+    }
+    s.ring.reset()
+    s.running = false
+    return true
+}
+
+// supervise keeps ffmpeg running while there is demand, restarting it
+// with a growing delay when it exits.
+func (s *Server) supervise() {
+    defer s.wg.Done()
+    s.log.Info("starting hls encoder")
+    backoff := minBackoff
+    for {
+        started := time.Now()
+        err := s.runEncoder()
+        if s.stopIfIdle() {
+            if s.ctx.Err() == nil {
+                s.log.Info("no hls viewers, stopped encoder")
+            }
+            return
+        }
+        if time.Since(started) > maxBackoff {
+            backoff = minBackoff
+        }
+        s.log.Warn("hls encoder exited, restarting", "err", err, "delay", backoff)
+        select {
+        case <-s.ctx.Done():
+            s.stopIfIdle()
+            return
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+        if backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+func encoderArgs() []string {
+    secs := strconv.Itoa(int(SegmentDuration / time.Second))
+    return []string{
+        "-hide_banner", "-loglevel", "error",
+        "-use_wallclock_as_timestamps", "1",
+        "-f", "mjpeg", "-i", "pipe:0",
+        "-an", "-fps_mode", "passthrough",
+        "-pix_fmt", "yuv420p",
+        "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency",
+        "-profile:v", "main",
+        // Keyframes exactly on segment boundaries, and nowhere else.
+        "-force_key_frames", "expr:gte(t,n_forced*" + secs + ")",
+        "-sc_threshold", "0",
+        "-f", "mpegts", "pipe:1",
+    }
+}
+
+// runEncoder runs one ffmpeg process until it exits, the server closes,
+// or demand ends.
+func (s *Server) runEncoder() error {
+    ctx, cancel := context.WithCancel(s.ctx)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, s.ffmpeg, encoderArgs()...)
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return fmt.Errorf("hls: starting ffmpeg: %w", err)
+    }
+    go func() {
+        sc := bufio.NewScanner(stderr)
+        for sc.Scan() {
+            s.log.Warn("ffmpeg", "line", sc.Text())
+        }
+    }()
+
+    sub := s.hub.Subscribe(hub.DefaultBuffer)
+    fed := make(chan struct{})
+    go func() {
+        defer close(fed)
+        // Closing stdin lets ffmpeg flush and exit on its own.
+        defer stdin.Close()
+        for f := range sub.Frames() {
+            if s.idle() {
+                f.Release()
+                return
+            }
+            jpeg, err := s.hub.Render(f, protocol.Params{})
+            if err != nil {
+                f.Release()
+                s.log.Warn("encode failed", "seq", f.Seq, "err", err)
+                continue
+            }
+            _, err = stdin.Write(jpeg)
+            f.Release()
+            if err != nil {
+                return
+            }
+            sub.Sent(len(jpeg))
+        }
+    }()
+
+    err = newSegmenter(s.ring).run(stdout)
+    if err != io.EOF {
+        cancel() // output is unusable; do not wait for ffmpeg to notice
+    }
+    s.hub.Unsubscribe(sub)
+    <-fed
+    werr := cmd.Wait()
+    switch {
+    case err != io.EOF:
+        return err
+    case werr != nil && ctx.Err() == nil:
+        return werr
+    }
+    return nil
+}
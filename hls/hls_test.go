@@ -0,0 +1,346 @@
+package hls
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+)
+
+const (
+    testPMTPID   = 0x100
+    testVideoPID = 0x101
+)
+
+// tsPacket builds one MPEG-TS packet on pid, padding payload with 0xFF.
+// A keyframe packet carries an adaptation field setting the random
+// access indicator.
+func tsPacket(pid int, pusi, key bool, payload []byte) []byte {
+    pkt := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+    pkt[0] = tsSync
+    pkt[1] = byte(pid >> 8 & 0x1F)
+    if pusi {
+        pkt[1] |= 0x40
+    }
+    pkt[2] = byte(pid)
+    pkt[3] = 0x10
+    offset := 4
+    if key {
+        pkt[3] = 0x30
+        pkt[4] = 1
+        pkt[5] = 0x40
+        offset = 6
+    }
+    copy(pkt[offset:], payload)
+    return pkt
+}
+
+// tsStream is what ffmpeg would write for keyframes one SegmentDuration
+// apart: a PAT and PMT, then each keyframe's PES packet followed by a
+// couple of continuation packets.
+func tsStream(keyframes int) []byte {
+    var b bytes.Buffer
+    // PAT: one program whose PMT is on testPMTPID.
+    b.Write(tsPacket(pidPAT, true, false, []byte{
+        0, 0x00, 0xB0, 13, 0, 1, 0xC1, 0, 0, 0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF, 0, 0, 0, 0,
+    }))
+    // PMT: one H.264 stream on testVideoPID.
+    b.Write(tsPacket(testPMTPID, true, false, []byte{
+        0, 0x02, 0xB0, 18, 0, 1, 0xC1, 0, 0, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0,
+        streamTypeH264, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0, 0, 0, 0, 0,
+    }))
+    step := int64(SegmentDuration / time.Second * ptsClock)
+    for i := 0; i < keyframes; i++ {
+        pts := int64(i) * step
+        pes := []byte{
+            0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 5,
+            byte(0x21 | pts>>29&0x0E), byte(pts >> 22), byte(pts>>14&0xFE | 1), byte(pts >> 7), byte(pts<<1&0xFE | 1),
+        }
+        b.Write(tsPacket(testVideoPID, true, true, pes))
+        for j := 0; j < 2; j++ {
+            b.Write(tsPacket(testVideoPID, false, false, []byte{byte(i), byte(j)}))
+        }
+    }
+    return b.Bytes()
+}
+
+// fakeFFmpeg writes a script that stands in for ffmpeg: it writes the
+// canned stream to stdout and a line to stderr, then, when linger is
+// set, reads its input until it is killed rather than exiting.
+func fakeFFmpeg(t *testing.T, keyframes int, linger bool) string {
+    t.Helper()
+    dir := t.TempDir()
+    ts := filepath.Join(dir, "out.ts")
+    if err := os.WriteFile(ts, tsStream(keyframes), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    script := fmt.Sprintf("#!/bin/sh\necho 'fake ffmpeg started' >&2\ncat '%s'\n", ts)
+    if linger {
+        script += "exec cat > /dev/null\n"
+    }
+    bin := filepath.Join(dir, "ffmpeg")
+    if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    return bin
+}
+
+func newTestServer(t *testing.T, ffmpeg string, logs io.Writer) *httptest.Server {
+    t.Helper()
+    s := NewServer(hub.New(nil, "test", nil), ffmpeg, slog.New(slog.NewTextHandler(logs, nil)))
+    srv := httptest.NewServer(s)
+    t.Cleanup(func() {
+        srv.Close()
+        s.Close()
+    })
+    return srv
+}
+
+// syncBuffer is a bytes.Buffer safe for a logger and the test to share.
+type syncBuffer struct {
+    mu sync.Mutex
+    b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.b.String()
+}
+
+var segmentLine = regexp.MustCompile(`(?m)^segment(\d+)\.ts$`)
+
+// waitPlaylist fetches the playlist until it lists segment last.
+func waitPlaylist(t *testing.T, srv *httptest.Server, last int) string {
+    t.Helper()
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        resp, err := http.Get(srv.URL + "/hls/playlist.m3u8")
+        if err != nil {
+            t.Fatal(err)
+        }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode == http.StatusOK {
+            if got := resp.Header.Get("Cache-Control"); got != "no-cache" {
+                t.Errorf("playlist Cache-Control = %q, want no-cache", got)
+            }
+            if bytes.Contains(body, []byte(segmentName(uint64(last))+"\n")) {
+                return string(body)
+            }
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("playlist never listed segment %d; last was %d:\n%s", last, resp.StatusCode, body)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func listed(playlist string) []int {
+    var seqs []int
+    for _, m := range segmentLine.FindAllStringSubmatch(playlist, -1) {
+        n, _ := strconv.Atoi(m[1])
+        seqs = append(seqs, n)
+    }
+    return seqs
+}
+
+func TestPlaylistRotationAndEviction(t *testing.T) {
+    // Nine keyframes make eight whole segments; what follows the last is
+    // of unknown length and dropped. The window keeps the newest six.
+    const keyframes = 9
+    srv := newTestServer(t, fakeFFmpeg(t, keyframes, true), io.Discard)
+
+    playlist := waitPlaylist(t, srv, keyframes-2)
+    if want := []int{2, 3, 4, 5, 6, 7}; fmt.Sprint(listed(playlist)) != fmt.Sprint(want) {
+        t.Errorf("playlist lists segments %v, want %v:\n%s", listed(playlist), want, playlist)
+    }
+    for _, line := range []string{"#EXT-X-MEDIA-SEQUENCE:2\n", "#EXT-X-TARGETDURATION:2\n", "#EXTINF:2.000,\n"} {
+        if !strings.Contains(playlist, line) {
+            t.Errorf("playlist lacks %q:\n%s", line, playlist)
+        }
+    }
+    if strings.Contains(playlist, "#EXT-X-DISCONTINUITY") {
+        t.Errorf("one encoder run marked a discontinuity:\n%s", playlist)
+    }
+
+    for _, tc := range []struct {
+        seq  int
+        code int
+    }{
+        {0, http.StatusNotFound}, // evicted
+        {1, http.StatusNotFound},
+        {2, http.StatusOK},
+        {7, http.StatusOK},
+        {8, http.StatusNotFound}, // never finished
+    } {
+        resp, err := http.Get(srv.URL + "/hls/" + segmentName(uint64(tc.seq)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if resp.StatusCode != tc.code {
+            t.Errorf("segment %d: status %d, want %d", tc.seq, resp.StatusCode, tc.code)
+            continue
+        }
+        if tc.code != http.StatusOK {
+            continue
+        }
+        if got := resp.Header.Get("Content-Type"); got != "video/mp2t" {
+            t.Errorf("segment %d: Content-Type %q", tc.seq, got)
+        }
+        if got := resp.Header.Get("Cache-Control"); !strings.HasPrefix(got, "public") {
+            t.Errorf("segment %d: Cache-Control %q, want it cacheable", tc.seq, got)
+        }
+        // Each segment opens with the PAT and PMT, then its keyframe
+        // and the two packets after it.
+        if len(data) != 5*tsPacketSize {
+            t.Errorf("segment %d is %d bytes, want %d", tc.seq, len(data), 5*tsPacketSize)
+            continue
+        }
+        if pid := int(data[1]&0x1F)<<8 | int(data[2]); pid != pidPAT {
+            t.Errorf("segment %d starts on pid %#x, want the PAT", tc.seq, pid)
+        }
+        if _, rai := tsPayload(data[2*tsPacketSize:]); !rai {
+            t.Errorf("segment %d does not continue with a keyframe", tc.seq)
+        }
+        if got := data[3*tsPacketSize+4]; int(got) != tc.seq {
+            t.Errorf("segment %d holds keyframe %d's packets", tc.seq, got)
+        }
+    }
+}
+
+func TestEncoderRestartMarksDiscontinuity(t *testing.T) {
+    var logs syncBuffer
+    // Each run makes two segments and exits; the supervisor restarts it
+    // after minBackoff and numbering carries on.
+    srv := newTestServer(t, fakeFFmpeg(t, 3, false), &logs)
+
+    playlist := waitPlaylist(t, srv, 3)
+    want := "segment0.ts\n#EXTINF:2.000,\nsegment1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\nsegment2.ts\n"
+    if !strings.Contains(playlist, want) {
+        t.Errorf("playlist does not mark the restart:\n%s", playlist)
+    }
+    if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY"); n != 1 {
+        t.Errorf("%d discontinuities, want 1:\n%s", n, playlist)
+    }
+    out := logs.String()
+    if !strings.Contains(out, "hls encoder exited, restarting") {
+        t.Errorf("restart not logged:\n%s", out)
+    }
+    if !strings.Contains(out, "fake ffmpeg started") {
+        t.Errorf("ffmpeg stderr not logged:\n%s", out)
+    }
+}
+
+func TestRingEvictsOldest(t *testing.T) {
+    r := newRing(3)
+    select {
+    case <-r.waitReady():
+        t.Fatal("empty ring ready")
+    default:
+    }
+    for i := 0; i < 5; i++ {
+        r.add([]byte{byte(i)}, SegmentDuration, false)
+    }
+    for seq := uint64(0); seq < 6; seq++ {
+        s := r.get(seq)
+        if kept := seq >= 2 && seq <= 4; kept != (s != nil) {
+            t.Errorf("segment %d kept = %v, want %v", seq, s != nil, kept)
+        } else if kept && s.Data[0] != byte(seq) {
+            t.Errorf("segment %d holds %d", seq, s.Data[0])
+        }
+    }
+    select {
+    case <-r.waitReady():
+    default:
+        t.Fatal("ring with segments not ready")
+    }
+
+    // A reset empties the window but keeps numbering, and the first
+    // segment after it is not marked discontinuous.
+    r.reset()
+    if bytes.Contains(r.Playlist(), []byte("segment")) {
+        t.Errorf("playlist after reset:\n%s", r.Playlist())
+    }
+    r.add([]byte{5}, SegmentDuration, true)
+    if s := r.get(5); s == nil || s.Discontinuity {
+        t.Errorf("first segment after reset = %+v", s)
+    }
+    if !bytes.Contains(r.Playlist(), []byte("#EXT-X-MEDIA-SEQUENCE:5\n")) {
+        t.Errorf("playlist after reset:\n%s", r.Playlist())
+    }
+}
+
+func TestChargeCountsReplies(t *testing.T) {
+    s := NewServer(hub.New(nil, "test", nil), fakeFFmpeg(t, 4, true), slog.New(slog.NewTextHandler(io.Discard, nil)))
+    var (
+        mu      sync.Mutex
+        charged = map[string]int{}
+    )
+    s.Charge = func(r *http.Request) func(n int) error {
+        who := r.URL.Query().Get("token")
+        if who == "" {
+            return nil
+        }
+        return func(n int) error {
+            mu.Lock()
+            defer mu.Unlock()
+            charged[who] += n
+            if who == "spent" {
+                return fmt.Errorf("%s is over budget", who)
+            }
+            return nil
+        }
+    }
+    srv := httptest.NewServer(s)
+    t.Cleanup(func() {
+        srv.Close()
+        s.Close()
+    })
+    waitPlaylist(t, srv, 2)
+
+    get := func(path string) int {
+        t.Helper()
+        resp, err := http.Get(srv.URL + path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return len(body)
+    }
+    want := get("/hls/playlist.m3u8?token=a") + get("/hls/"+segmentName(1)+"?token=a")
+    // A refused charge does not take back what was written.
+    spent := get("/hls/" + segmentName(2) + "?token=spent")
+    mu.Lock()
+    defer mu.Unlock()
+    if charged["a"] != want || want == 0 {
+        t.Errorf("charged %d bytes for replies of %d", charged["a"], want)
+    }
+    if charged["spent"] != spent || spent != 5*tsPacketSize {
+        t.Errorf("over budget: charged %d, sent %d", charged["spent"], spent)
+    }
+    if len(charged) != 2 {
+        t.Errorf("charged %v; requests without a token count nothing", charged)
+    }
+}
@@ -0,0 +1,276 @@
+package hls
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// MPEG-TS is cut into segments here rather than by ffmpeg's hls muxer,
+// which only writes files. ffmpeg forces a keyframe every
+// SegmentDuration and marks it with the random access indicator, so
+// every such packet on the video PID starts a segment. Each segment gets
+// the latest PAT and PMT in front so it can be decoded on its own.
+
+const (
+    tsPacketSize = 188
+    tsSync       = 0x47
+    pidPAT       = 0
+    // streamTypeH264 is the PMT stream_type for H.264 video.
+    streamTypeH264 = 0x1B
+    ptsClock       = 90000
+    ptsWrap        = 1 << 33
+)
+
+var errLostSync = errors.New("hls: lost MPEG-TS sync")
+
+// Segment is one finished media segment.
+type Segment struct {
+    Seq      uint64
+    Duration time.Duration
+    Data     []byte
+    // Discontinuity is set on the first segment from a new ffmpeg
+    // process, whose timestamps do not follow on from the last one's.
+    Discontinuity bool
+}
+
+// ring keeps the newest segments and the playlist describing them. The
+// playlist is rebuilt whenever the window moves and swapped in whole, so
+// a reader never sees it half-written.
+type ring struct {
+    size int
+
+    mu       sync.RWMutex
+    segs     []*Segment
+    next     uint64
+    playlist atomic.Pointer[[]byte]
+    // ready is closed when the first segment after a reset arrives.
+    ready chan struct{}
+}
+
+func newRing(size int) *ring {
+    r := &ring{size: size, ready: make(chan struct{})}
+    r.publish()
+    return r
+}
+
+// add appends a segment, numbering it, and evicts the oldest once there
+// are more than size. A discontinuity is only marked when there is an
+// earlier segment in the window to be discontinuous with.
+func (r *ring) add(data []byte, d time.Duration, discontinuity bool) {
+    r.mu.Lock()
+    discontinuity = discontinuity && len(r.segs) > 0
+    r.segs = append(r.segs, &Segment{Seq: r.next, Duration: d, Data: data, Discontinuity: discontinuity})
+    r.next++
+    if len(r.segs) > r.size {
+        r.segs[0] = nil
+        r.segs = r.segs[1:]
+    }
+    if len(r.segs) == 1 {
+        close(r.ready)
+    }
+    r.publish()
+    r.mu.Unlock()
+}
+
+// reset forgets every segment. Numbering carries on, so a player that
+// still holds an old playlist never fetches a different segment under a
+// name it has seen.
+func (r *ring) reset() {
+    r.mu.Lock()
+    if len(r.segs) > 0 {
+        r.ready = make(chan struct{})
+    }
+    r.segs = nil
+    r.publish()
+    r.mu.Unlock()
+}
+
+// get returns the segment numbered seq if it is still in the window.
+func (r *ring) get(seq uint64) *Segment {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if len(r.segs) == 0 || seq < r.segs[0].Seq || seq > r.segs[len(r.segs)-1].Seq {
+        return nil
+    }
+    return r.segs[seq-r.segs[0].Seq]
+}
+
+// waitReady returns a channel closed once a segment is available.
+func (r *ring) waitReady() <-chan struct{} {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.ready
+}
+
+func (r *ring) Playlist() []byte { return *r.playlist.Load() }
+
+// publish rebuilds the playlist; r.mu must be held.
+func (r *ring) publish() {
+    target := SegmentDuration
+    for _, s := range r.segs {
+        if s.Duration > target {
+            target = s.Duration
+        }
+    }
+    var b bytes.Buffer
+    b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+    fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+    seq := r.next
+    if len(r.segs) > 0 {
+        seq = r.segs[0].Seq
+    }
+    fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", seq)
+    for _, s := range r.segs {
+        if s.Discontinuity {
+            b.WriteString("#EXT-X-DISCONTINUITY\n")
+        }
+        fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", s.Duration.Seconds(), segmentName(s.Seq))
+    }
+    out := b.Bytes()
+    r.playlist.Store(&out)
+}
+
+func segmentName(seq uint64) string {
+    return "segment" + strconv.FormatUint(seq, 10) + ".ts"
+}
+
+// segmenter splits one ffmpeg process's MPEG-TS output into segments.
+type segmenter struct {
+    ring *ring
+
+    pmtPID   int
+    videoPID int
+    pat, pmt []byte
+
+    cur    bytes.Buffer
+    curPTS int64 // PTS of the keyframe that opened cur, -1 before one
+    first  bool
+}
+
+func newSegmenter(r *ring) *segmenter {
+    return &segmenter{ring: r, pmtPID: -1, videoPID: -1, curPTS: -1, first: true}
+}
+
+// run reads packets from ts until it ends. What it has buffered past the
+// last keyframe is dropped, since its length is unknown.
+func (s *segmenter) run(ts io.Reader) error {
+    pkt := make([]byte, tsPacketSize)
+    for {
+        if _, err := io.ReadFull(ts, pkt); err != nil {
+            if err == io.ErrUnexpectedEOF {
+                err = io.EOF
+            }
+            return err
+        }
+        if pkt[0] != tsSync {
+            return errLostSync
+        }
+        s.packet(pkt)
+    }
+}
+
+func (s *segmenter) packet(pkt []byte) {
+    pid := int(pkt[1]&0x1F)<<8 | int(pkt[2])
+    pusi := pkt[1]&0x40 != 0
+    payload, rai := tsPayload(pkt)
+
+    switch {
+    case pid == pidPAT && pusi:
+        s.pat = append(s.pat[:0], pkt...)
+        if p := psiSection(payload); len(p) >= 12 {
+            // The first program's PMT; ffmpeg writes just one.
+            s.pmtPID = int(p[10]&0x1F)<<8 | int(p[11])
+        }
+    case pid == s.pmtPID && pusi:
+        s.pmt = append(s.pmt[:0], pkt...)
+        s.videoPID = pmtVideoPID(psiSection(payload))
+    case pid == s.videoPID && pusi:
+        if pts, ok := pesPTS(payload); ok && rai {
+            s.cut(pts)
+        }
+    }
+    if s.curPTS >= 0 {
+        s.cur.Write(pkt)
+    }
+}
+
+// cut finishes the segment in progress at a keyframe with the given PTS
+// and starts the next one with it.
+func (s *segmenter) cut(pts int64) {
+    if s.curPTS >= 0 && s.cur.Len() > 0 {
+        d := (pts - s.curPTS + ptsWrap) % ptsWrap
+        data := append([]byte(nil), s.cur.Bytes()...)
+        s.ring.add(data, time.Duration(d)*time.Second/ptsClock, s.first)
+        s.first = false
+    }
+    s.cur.Reset()
+    s.cur.Write(s.pat)
+    s.cur.Write(s.pmt)
+    s.curPTS = pts
+}
+
+// tsPayload returns a packet's payload and whether its adaptation field
+// sets the random access indicator.
+func tsPayload(pkt []byte) (payload []byte, rai bool) {
+    afc := pkt[3] >> 4 & 3
+    offset := 4
+    if afc&2 != 0 {
+        n := int(pkt[4])
+        if n > 0 && 5 < len(pkt) {
+            rai = pkt[5]&0x40 != 0
+        }
+        offset += 1 + n
+    }
+    if afc&1 == 0 || offset >= len(pkt) {
+        return nil, rai
+    }
+    return pkt[offset:], rai
+}
+
+// psiSection skips the pointer field in front of a PSI table.
+func psiSection(payload []byte) []byte {
+    if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+        return nil
+    }
+    return payload[1+int(payload[0]):]
+}
+
+// pmtVideoPID finds the H.264 elementary stream in a PMT section, or
+// returns -1.
+func pmtVideoPID(sec []byte) int {
+    if len(sec) < 12 || sec[0] != 0x02 {
+        return -1
+    }
+    end := 3 + (int(sec[1]&0x0F)<<8 | int(sec[2])) - 4 // before the CRC
+    if end > len(sec) {
+        end = len(sec)
+    }
+    i := 12 + (int(sec[10]&0x0F)<<8 | int(sec[11]))
+    for i+5 <= end {
+        typ := sec[i]
+        pid := int(sec[i+1]&0x1F)<<8 | int(sec[i+2])
+        if typ == streamTypeH264 {
+            return pid
+        }
+        i += 5 + (int(sec[i+3]&0x0F)<<8 | int(sec[i+4]))
+    }
+    return -1
+}
+
+// pesPTS reads the PTS from the PES header at the start of payload.
+func pesPTS(p []byte) (int64, bool) {
+    if len(p) < 14 || p[0] != 0 || p[1] != 0 || p[2] != 1 || p[7]&0x80 == 0 {
+        return 0, false
+    }
+    pts := int64(p[9]>>1&7)<<30 |
+        int64(p[10])<<22 | int64(p[11]>>1)<<15 |
+        int64(p[12])<<7 | int64(p[13]>>1)
+    return pts, true
+}
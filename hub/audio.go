@@ -0,0 +1,102 @@
+package hub
+
+import (
+    "context"
+    "log/slog"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+)
+
+// audioBuffer is the per-subscriber audio queue. Chunks are small and
+// frequent, so it is deeper than the frame queue.
+const audioBuffer = 16
+
+// AudioChunk is captured audio stamped with its position in the audio
+// stream, which is numbered separately from video.
+type AudioChunk struct {
+    capture.AudioChunk
+    Seq uint64
+}
+
+// Audio returns the channel audio chunks are delivered on once SetAudio
+// has been called. It is never closed; stop reading when Frames closes.
+func (s *Subscriber) Audio() <-chan *AudioChunk { return s.audio }
+
+// SetAudio turns audio delivery to s on or off.
+func (s *Subscriber) SetAudio(on bool) { s.wantAudio.Store(on) }
+
+// SentAudio records that an audio chunk of n bytes reached the client.
+func (s *Subscriber) SentAudio(n int) {
+    s.bytes.Add(uint64(n))
+    s.m.BytesSent.Add(float64(n))
+}
+
+func (s *Subscriber) sendAudio(a *AudioChunk) {
+    if !s.wantAudio.Load() {
+        return
+    }
+    select {
+    case s.audio <- a:
+        return
+    default:
+    }
+    select {
+    case <-s.audio:
+    default:
+    }
+    select {
+    case s.audio <- a:
+    default:
+    }
+}
+
+// PublishAudio stamps a with the next audio sequence number and delivers
+// it to every subscriber that asked for audio.
+func (h *Hub) PublishAudio(a capture.AudioChunk) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.audioSeq++
+    c := &AudioChunk{AudioChunk: a, Seq: h.audioSeq}
+    for s := range h.subs {
+        s.sendAudio(c)
+    }
+}
+
+// startAudio opens the audio source for the length of a capture run. The
+// returned function stops it. Audio is best effort: if the device cannot
+// be opened or goes away, video carries on without it.
+func (h *Hub) startAudio(ctx context.Context) (stop func()) {
+    if h.Audio == nil {
+        return func() {}
+    }
+    if err := h.Audio.Open(h.AudioDevice); err != nil {
+        slog.Warn("audio device unavailable, streaming video only", "device", h.AudioDevice, "err", err)
+        return func() {}
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for ctx.Err() == nil {
+            a, err := h.Audio.ReadChunk()
+            if err == capture.ErrTimeout {
+                continue
+            }
+            if err != nil {
+                if ctx.Err() == nil {
+                    slog.Warn("audio capture stopped", "device", h.AudioDevice, "err", err)
+                }
+                return
+            }
+            h.PublishAudio(a)
+        }
+    }()
+    return func() {
+        cancel()
+        // Closing unblocks a ReadChunk in progress.
+        h.Audio.Close()
+        wg.Wait()
+    }
+}
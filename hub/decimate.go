@@ -0,0 +1,104 @@
+package hub
+
+import "time"
+
+// Decimator thins a stream to a lower rate by capture timestamps. It
+// keeps a grid of due times one output interval apart and lets through
+// the frame nearest each, so the error never builds up: 60 fps thinned
+// to 24 alternates gaps of two and three frames rather than drifting or
+// bunching, and each frame lands within half a source interval of its
+// due time. Frames lost before it, as a slow client's are, do not shift
+// the grid the way counting frames would.
+//
+// The output interval is one second over a rate set with SetFPS, or a
+// divisor set with SetDivisor times the source's own interval, which it
+// measures between sequence numbers so that gaps left by lost frames do
+// not count. The zero value lets every frame through, as it does stills,
+// which have no sequence number.
+type Decimator struct {
+    fps     int
+    divisor int
+    // next is the due time of the frame to let through next, or start
+    // that of a frame let through before the interval was known.
+    next  time.Time
+    start time.Time
+    // last and lastSeq are the previous frame's timestamp and sequence
+    // number, and period the source's interval between frames, averaged.
+    last    time.Time
+    lastSeq uint64
+    period  time.Duration
+}
+
+// Allow reports whether frame seq, captured at ts, is sent.
+func (d *Decimator) Allow(seq uint64, ts time.Time) bool {
+    if d.fps <= 0 && d.divisor <= 1 || seq == 0 {
+        return true
+    }
+    d.measure(seq, ts)
+    interval := d.interval()
+    if interval == 0 {
+        // A divisor of an interval not measured yet: the grid starts
+        // from this frame once the next one measures it.
+        d.start = ts
+        return true
+    }
+    if d.next.IsZero() && !d.start.IsZero() {
+        d.next, d.start = d.start.Add(interval), time.Time{}
+    }
+    // The first frame, or one after a stall or a jump in the clock,
+    // starts the grid again. So does a frame most of a source interval
+    // late, as the one after a lost frame is, where keeping the grid
+    // would send the frame due next straight after it; the nearest frame
+    // to a due time is never more than half an interval off.
+    if d.next.IsZero() || ts.Sub(d.next) >= d.period*3/4 || d.next.Sub(ts) > 2*interval {
+        d.next = ts.Add(interval)
+        return true
+    }
+    // A frame more than half a source interval early is further from
+    // the due time than the next one will be.
+    if ts.Add(d.period / 2).Before(d.next) {
+        return false
+    }
+    d.next = d.next.Add(interval)
+    return true
+}
+
+// measure takes the source interval from the frame before seq.
+func (d *Decimator) measure(seq uint64, ts time.Time) {
+    if !d.last.IsZero() && seq > d.lastSeq {
+        if dt := ts.Sub(d.last) / time.Duration(seq-d.lastSeq); dt > 0 {
+            if d.period == 0 {
+                d.period = dt
+            } else {
+                d.period += (dt - d.period) / 8
+            }
+        }
+    }
+    d.last, d.lastSeq = ts, seq
+}
+
+func (d *Decimator) interval() time.Duration {
+    if d.fps > 0 {
+        return time.Second / time.Duration(d.fps)
+    }
+    return d.period * time.Duration(d.divisor)
+}
+
+// FPS returns the rate set with SetFPS.
+func (d *Decimator) FPS() int { return d.fps }
+
+// SetFPS thins to fps frames a second, or not at all when it is zero,
+// starting the grid again at the next frame.
+func (d *Decimator) SetFPS(fps int) {
+    *d = Decimator{fps: fps}
+}
+
+// Divisor returns the divisor set with SetDivisor.
+func (d *Decimator) Divisor() int { return d.divisor }
+
+// SetDivisor thins to one frame in every n of the source's, or not at
+// all when n is 1 or less, starting the grid again at the next frame.
+// The source's interval, once measured, is kept.
+func (d *Decimator) SetDivisor(n int) {
+    d.fps, d.divisor, d.next, d.start = 0, n, time.Time{}, time.Time{}
+}
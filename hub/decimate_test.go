@@ -0,0 +1,144 @@
+package hub
+
+import (
+    "fmt"
+    "math/rand"
+    "testing"
+    "time"
+)
+
+// decimate feeds d frames of a src fps source for 10 seconds, the
+// frames where lose returns true going missing before d sees them, and
+// returns the timestamps it lets through.
+func decimate(d *Decimator, src int, jitter time.Duration, lose func(seq uint64) bool) []time.Time {
+    rng := rand.New(rand.NewSource(1))
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    interval := time.Second / time.Duration(src)
+    var out []time.Time
+    for seq := uint64(1); seq <= uint64(10*src); seq++ {
+        if lose != nil && lose(seq) {
+            continue
+        }
+        ts := start.Add(time.Duration(seq) * interval)
+        if jitter > 0 {
+            ts = ts.Add(time.Duration(rng.Int63n(int64(2*jitter))) - jitter)
+        }
+        if d.Allow(seq, ts) {
+            out = append(out, ts)
+        }
+    }
+    return out
+}
+
+// checkGaps fails unless every gap in out is within slack of a want
+// fps interval.
+func checkGaps(t *testing.T, out []time.Time, want int, slack time.Duration) {
+    t.Helper()
+    ideal := time.Second / time.Duration(want)
+    for i := 1; i < len(out); i++ {
+        if gap := out[i].Sub(out[i-1]); gap < ideal-slack || gap > ideal+slack {
+            t.Errorf("gap %d is %v, want %v ± %v", i, gap, ideal, slack)
+        }
+    }
+}
+
+// checkSpacing is checkGaps for a run that also averages want frames a
+// second.
+func checkSpacing(t *testing.T, out []time.Time, want int, slack time.Duration) {
+    t.Helper()
+    checkGaps(t, out, want, slack)
+    if n := len(out); n < 10*want-1 || n > 10*want+1 {
+        t.Errorf("%d frames in 10s, want %d", n, 10*want)
+    }
+}
+
+func TestDecimatorSpacing(t *testing.T) {
+    for _, tc := range []struct{ src, fps int }{
+        {60, 24},
+        {30, 7},
+        {60, 5},
+        {60, 15},
+        {60, 59},
+        {50, 30},
+        {25, 24},
+        {30, 30},
+    } {
+        t.Run(fmt.Sprintf("%d_to_%d", tc.src, tc.fps), func(t *testing.T) {
+            var d Decimator
+            d.SetFPS(tc.fps)
+            interval := time.Second / time.Duration(tc.src)
+            checkSpacing(t, decimate(&d, tc.src, 0, nil), tc.fps, interval)
+        })
+    }
+}
+
+func TestDecimatorSpacingWithJitter(t *testing.T) {
+    // Timestamps a couple of milliseconds either side of the grid, as a
+    // USB card's are.
+    const jitter = 2 * time.Millisecond
+    for _, tc := range []struct{ src, fps int }{{60, 24}, {30, 7}} {
+        var d Decimator
+        d.SetFPS(tc.fps)
+        checkSpacing(t, decimate(&d, tc.src, jitter, nil), tc.fps, time.Second/time.Duration(tc.src)+2*jitter)
+    }
+}
+
+func TestDecimatorSpacingWithLostFrames(t *testing.T) {
+    // Frames the hub dropped for a slow subscriber never reach its
+    // decimator. A lost frame that was due is made up by the next one,
+    // which widens that gap by at most the frame that went missing, and
+    // the grid starts again from it rather than bunching the next frame
+    // up behind it.
+    lose := func(seq uint64) bool { return seq%7 == 0 }
+    for _, tc := range []struct{ src, fps int }{{60, 24}, {30, 7}} {
+        var d Decimator
+        d.SetFPS(tc.fps)
+        out := decimate(&d, tc.src, 0, lose)
+        checkGaps(t, out, tc.fps, 2*time.Second/time.Duration(tc.src))
+        if n := len(out); n < 10*tc.fps*6/7 {
+            t.Errorf("%d to %d fps: %d frames in 10s with a seventh lost", tc.src, tc.fps, n)
+        }
+    }
+}
+
+func TestDecimatorDivisor(t *testing.T) {
+    var d Decimator
+    d.SetDivisor(3)
+    out := decimate(&d, 60, 0, nil)
+    checkSpacing(t, out, 20, time.Microsecond)
+
+    // Changing the divisor keeps the measured source interval, so the
+    // new one applies from the very next frame.
+    d.SetDivisor(2)
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    var allowed []uint64
+    for seq := uint64(601); seq < 611; seq++ {
+        if d.Allow(seq, start.Add(time.Duration(seq)*time.Second/60)) {
+            allowed = append(allowed, seq)
+        }
+    }
+    for i, seq := range allowed {
+        if len(allowed) != 5 || seq != 601+uint64(2*i) {
+            t.Fatalf("after SetDivisor(2) let through %v, want every other frame from 601", allowed)
+        }
+    }
+}
+
+func TestDecimatorPassesThrough(t *testing.T) {
+    var d Decimator
+    if out := decimate(&d, 30, 0, nil); len(out) != 300 {
+        t.Errorf("zero Decimator let %d of 300 frames through", len(out))
+    }
+    // A cap above the source's rate thins nothing.
+    d.SetFPS(60)
+    if out := decimate(&d, 30, 0, nil); len(out) != 300 {
+        t.Errorf("60 fps cap on 30 fps let %d of 300 frames through", len(out))
+    }
+    d.SetFPS(1)
+    d.Allow(1, time.Now())
+    for i := 0; i < 3; i++ {
+        if !d.Allow(0, time.Now()) {
+            t.Error("still held back")
+        }
+    }
+}
@@ -0,0 +1,91 @@
+package hub
+
+import (
+    "context"
+    "log/slog"
+    "path/filepath"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+)
+
+// A USB capture card drops off the bus on a power blip or a knocked
+// cable and comes back a moment or an hour later. The hub does not give
+// up on it: viewers stay connected and are sent the no-signal
+// placeholder, marked DeviceLost, while the device is tried again with a
+// growing delay, and at once whenever something appears under /dev.
+// Opening the configured path again finds a device that came back under
+// another node when that path is a stable one such as /dev/v4l/by-id/….
+const (
+    minReattachDelay = 500 * time.Millisecond
+    maxReattachDelay = 30 * time.Second
+)
+
+// DevicePresent reports whether the device is there, as far as the hub
+// knows. It is true while the device is closed.
+func (h *Hub) DevicePresent() bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return !h.deviceLost
+}
+
+func (h *Hub) setDeviceLost(lost bool) {
+    h.mu.Lock()
+    h.deviceLost = lost
+    h.mu.Unlock()
+    if lost {
+        h.metrics.DevicePresent.Set(0)
+        h.metrics.DeviceLost.Inc()
+        h.setSignal(false, "device lost", 0, 0)
+    } else {
+        h.metrics.DevicePresent.Set(1)
+    }
+}
+
+// reattach closes the lost source and opens it again once the device is
+// back, until ctx is done or, for an on-demand hub, everyone has left;
+// idleSince is the run's idle tracking.
+func (h *Hub) reattach(ctx context.Context, idleSince *time.Time) error {
+    h.src.Close()
+    h.setDeviceLost(true)
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    appeared := capture.WatchDevice(ctx, h.device)
+    delay := minReattachDelay
+    lost := time.Now()
+    for attempt := 1; ; attempt++ {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(delay):
+        case <-appeared:
+            // udev may still be setting the node up; the next event or
+            // the timer tries again if it is not ready.
+        case req := <-h.restart:
+            // Like a closed device, the next open picks the change up.
+            req.done <- nil
+            attempt--
+            continue
+        }
+        if h.OnDemand && h.idle(idleSince) {
+            return errIdle
+        }
+        err := h.src.Open(h.device)
+        if err != nil {
+            slog.Debug("capture device still gone", "device", h.device, "attempt", attempt, "err", err)
+            delay *= 2
+            if delay > maxReattachDelay {
+                delay = maxReattachDelay
+            }
+            continue
+        }
+        node, _ := filepath.EvalSymlinks(h.device)
+        slog.Info("capture device recovered", "device", h.device, "node", node,
+            "after", time.Since(lost).Round(time.Millisecond), "attempts", attempt)
+        h.setDeviceLost(false)
+        if h.OnReattach != nil {
+            h.OnReattach()
+        }
+        return nil
+    }
+}
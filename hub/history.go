@@ -0,0 +1,64 @@
+package hub
+
+// The hub keeps its most recent frames so a viewer that reconnects after
+// a short outage can be sent what it missed. The history is bounded by
+// bytes, since frame sizes vary a lot with the picture, and by age.
+
+// remember adds f to the history and drops the oldest frames until the
+// history fits HistoryBytes and HistoryAge. The caller holds h.mu.
+func (h *Hub) remember(f *Frame) {
+    if h.HistoryBytes <= 0 {
+        return
+    }
+    f.Retain()
+    h.history = append(h.history, f)
+    h.historyBytes += len(f.Data)
+    for len(h.history) > 0 {
+        old := h.history[0]
+        tooOld := h.HistoryAge > 0 && f.Timestamp.Sub(old.Timestamp) > h.HistoryAge
+        if h.historyBytes <= h.HistoryBytes && !tooOld {
+            break
+        }
+        old.Release()
+        h.history[0] = nil
+        h.history = h.history[1:]
+        h.historyBytes -= len(old.Data)
+    }
+}
+
+// forget empties the history. The caller holds h.mu.
+func (h *Hub) forget() {
+    for i, f := range h.history {
+        f.Release()
+        h.history[i] = nil
+    }
+    h.history = h.history[:0]
+    h.historyBytes = 0
+}
+
+// Since returns the frames in the history newer than seq, oldest first,
+// each of which the caller must release. ok is false when frames after
+// seq are no longer held, or seq is from beyond the current stream such
+// as before a server restart; oldest is then the first sequence number
+// that can still be sent.
+func (h *Hub) Since(seq uint64) (frames []*Frame, oldest uint64, ok bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    oldest = h.seq + 1
+    if len(h.history) > 0 {
+        oldest = h.history[0].Seq
+    }
+    if seq+1 < oldest || seq > h.seq {
+        return nil, oldest, false
+    }
+    for i, f := range h.history {
+        if f.Seq > seq {
+            frames = append([]*Frame(nil), h.history[i:]...)
+            for _, f := range frames {
+                f.Retain()
+            }
+            return frames, oldest, true
+        }
+    }
+    return nil, oldest, true
+}
@@ -0,0 +1,685 @@
+// Package hub runs the single capture loop and fans frames out to every
+// connected viewer.
+package hub
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/encode"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+    "github.com/Cdaprod/hdmi-streaming-app/metrics"
+    "github.com/Cdaprod/hdmi-streaming-app/overlay"
+)
+
+// DefaultBuffer is the per-subscriber queue length used when Subscribe is
+// given zero.
+const DefaultBuffer = 4
+
+// ErrStopped is the error subscribers see when the hub shuts down.
+var ErrStopped = errors.New("hub: stopped")
+
+// Frame is a captured frame stamped with its position in the stream. It is
+// shared between subscribers and must not be modified. Every frame handed
+// out by the hub carries a reference to its buffer, which the receiver
+// gives up with Release once it has finished with Data. DeviceLost marks
+// the placeholders published while the device is gone.
+type Frame struct {
+    capture.Frame
+    Seq        uint64
+    DeviceLost bool
+}
+
+// Subscriber receives frames from a Hub.
+type Subscriber struct {
+    ch        chan *Frame
+    audio     chan *AudioChunk
+    wantAudio atomic.Bool
+    // needKey holds back H.264 frames until the next keyframe, for a new
+    // subscriber or one that has lost a frame. Only send touches it.
+    needKey bool
+    // fps is the rate SetFPS asked for, and dec thins frames to it; only
+    // send touches dec.
+    fps     atomic.Int32
+    dec     Decimator
+    dropped atomic.Uint64
+    frames  atomic.Uint64
+    bytes   atomic.Uint64
+    err     error
+    m       *metrics.Metrics
+}
+
+// Frames returns the channel frames are delivered on. It is closed when the
+// subscriber is removed from the hub. Each frame received must be
+// released.
+func (s *Subscriber) Frames() <-chan *Frame { return s.ch }
+
+// Dropped reports how many frames were discarded because the subscriber
+// fell behind.
+func (s *Subscriber) Dropped() uint64 { return s.dropped.Load() }
+
+// Sent records that a frame of n bytes reached the client. Outputs call it
+// after each successful write so delivery is metered in one place.
+func (s *Subscriber) Sent(n int) {
+    s.frames.Add(1)
+    s.bytes.Add(uint64(n))
+    s.m.FramesSent.Inc()
+    s.m.BytesSent.Add(float64(n))
+}
+
+// FramesSent reports how many frames were recorded with Sent.
+func (s *Subscriber) FramesSent() uint64 { return s.frames.Load() }
+
+// BytesSent reports the bytes recorded with Sent.
+func (s *Subscriber) BytesSent() uint64 { return s.bytes.Load() }
+
+func (s *Subscriber) drop() {
+    s.dropped.Add(1)
+    s.m.FramesDropped.Inc()
+}
+
+// SetFPS caps s at fps frames a second, evenly spaced by capture time,
+// from the next frame; zero sends every frame. Frames thinned out are
+// never queued, so they cost nothing and are not counted as dropped.
+// H.264 is sent whole, since the frames after a missing one do not
+// decode.
+func (s *Subscriber) SetFPS(fps int) { s.fps.Store(int32(max(fps, 0))) }
+
+// FPS returns the cap set by SetFPS.
+func (s *Subscriber) FPS() int { return int(s.fps.Load()) }
+
+// Err returns why the hub closed the subscriber, or nil if it was
+// unsubscribed normally. Only valid once Frames is closed.
+func (s *Subscriber) Err() error { return s.err }
+
+// send queues f without blocking. When the queue is full the oldest queued
+// frame is discarded so a slow viewer sees recent video, not a backlog.
+// H.264 frames cannot be decoded without the ones before them, so there
+// the new frame is dropped instead and the subscriber waits for the next
+// keyframe.
+func (s *Subscriber) send(f *Frame) {
+    if f.Format == capture.FormatH264 {
+        s.sendH264(f)
+        return
+    }
+    if fps := s.FPS(); fps != s.dec.FPS() {
+        s.dec.SetFPS(fps)
+    }
+    if !s.dec.Allow(f.Seq, f.Timestamp) {
+        return
+    }
+    f.Retain()
+    select {
+    case s.ch <- f:
+        return
+    default:
+    }
+    select {
+    case old := <-s.ch:
+        old.Release()
+        s.drop()
+    default:
+    }
+    select {
+    case s.ch <- f:
+    default:
+        f.Release()
+        s.drop()
+    }
+}
+
+func (s *Subscriber) sendH264(f *Frame) {
+    if s.needKey && !f.Key {
+        s.drop()
+        return
+    }
+    f.Retain()
+    select {
+    case s.ch <- f:
+        s.needKey = false
+    default:
+        f.Release()
+        s.drop()
+        s.needKey = true
+    }
+}
+
+// close closes the channel and releases whatever is still queued. The
+// subscriber's own goroutine may be receiving at the same time; each
+// frame is taken, and released, by exactly one of them.
+func (s *Subscriber) close() {
+    close(s.ch)
+    for f := range s.ch {
+        f.Release()
+    }
+}
+
+// State describes what the capture device is doing.
+type State string
+
+const (
+    StateIdle     State = "idle"
+    StateStarting State = "starting"
+    StateRunning  State = "running"
+    // StateError means the last capture run failed. On-demand hubs try
+    // again when the next subscriber arrives.
+    StateError State = "error"
+)
+
+// Hub owns a CaptureSource and broadcasts its frames.
+type Hub struct {
+    // Encoder compresses raw frames. Frames the device already delivers
+    // as MJPEG bypass it.
+    // An encode.StreamEncoder is given every frame instead, and its
+    // output is published as it is.
+    Encoder encode.Encoder
+    // Overlay, when set, is drawn into every frame before it is encoded,
+    // so every output shows it. While it is enabled, frames the device
+    // compresses are decoded and encoded again rather than passed on.
+    Overlay *overlay.Overlay
+    // Workers and Queue size the encoder pool; zero picks defaults.
+    Workers int
+    Queue   int
+    // OnDemand keeps the device closed while nobody is subscribed.
+    OnDemand bool
+    // IdleTimeout is how long an on-demand hub keeps the device open
+    // after the last subscriber leaves.
+    IdleTimeout time.Duration
+    // Audio, when set, is opened at AudioDevice alongside the video
+    // device and closed with it.
+    Audio       capture.AudioSource
+    AudioDevice string
+    // FrozenFrames, when positive, takes that many identical frames in a
+    // row to mean the input signal is lost; some capture cards repeat the
+    // last picture rather than stop. A truly still source looks the same,
+    // so it is off by default.
+    FrozenFrames int
+    // HistoryBytes and HistoryAge bound the recent frames kept for
+    // viewers resuming after a reconnect. Zero HistoryBytes keeps none.
+    HistoryBytes int
+    HistoryAge   time.Duration
+    // OnReattach, when set, is called once a device that went away has
+    // been opened again, to restore settings it lost.
+    OnReattach func()
+    // Startup and Offline are JPEG frames for SubscribeViewer to start a
+    // viewer off with while there is no live frame: Offline once the last
+    // capture run has failed, Startup otherwise, as the device opens. A
+    // frame without Data is not sent.
+    Startup capture.Frame
+    Offline capture.Frame
+
+    src     capture.CaptureSource
+    device  string
+    metrics *metrics.Metrics
+    quality atomic.Int32
+
+    wake    chan struct{}
+    restart chan restartRequest
+
+    mu       sync.Mutex
+    subs     map[*Subscriber]struct{}
+    seq      uint64
+    audioSeq uint64
+    last     *Frame
+    err      error
+    runErr   error
+    state    State
+    // signal is whether the device has an input signal, and size the
+    // dimensions of the last real frame. deviceLost is set while the
+    // device has gone away and is being waited for.
+    signal     bool
+    size       [2]int
+    deviceLost bool
+
+    history      []*Frame
+    historyBytes int
+
+    // lastHash and repeats spot frozen frames; only the capture
+    // goroutine uses them.
+    lastHash uint64
+    repeats  int
+
+    fpsStart time.Time
+    fpsCount int
+
+    // tiles holds the newest frames cut up by Tiles, newest first.
+    tilesMu sync.Mutex
+    tiles   [tileCache]*TileSet
+    // renders holds the newest renderings by Render, newest first.
+    rendersMu sync.Mutex
+    renders   [renderCache]*rendering
+}
+
+// New returns a hub that will read from src opened at device and record
+// into m. A nil m gets a private, unregistered set of metrics.
+func New(src capture.CaptureSource, device string, m *metrics.Metrics) *Hub {
+    if m == nil {
+        m = metrics.New(nil).Stream("")
+    }
+    h := &Hub{
+        Encoder: encode.NewJPEGEncoder(),
+        src:     src,
+        device:  device,
+        metrics: m,
+        wake:    make(chan struct{}, 1),
+        restart: make(chan restartRequest),
+        subs:    make(map[*Subscriber]struct{}),
+        state:   StateIdle,
+        signal:  true,
+    }
+    h.quality.Store(imaging.DefaultQuality)
+    m.SignalPresent.Set(1)
+    m.DevicePresent.Set(1)
+    return h
+}
+
+// OutputFormat is the format of the frames the hub publishes: H.264 for a
+// stream encoder, JPEG otherwise.
+func (h *Hub) OutputFormat() capture.PixelFormat {
+    if se, ok := h.Encoder.(encode.StreamEncoder); ok {
+        return se.Format()
+    }
+    return capture.FormatMJPEG
+}
+
+// Quality is the JPEG quality used for frames the hub encodes itself.
+func (h *Hub) Quality() int { return int(h.quality.Load()) }
+
+// SetQuality changes the encode quality; it applies from the next frame.
+func (h *Hub) SetQuality(q int) { h.quality.Store(int32(q)) }
+
+// State reports whether the capture device is idle, starting, running or
+// failed.
+func (h *Hub) State() State {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.state
+}
+
+func (h *Hub) setState(st State) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.state = st
+    if st == StateRunning {
+        h.runErr = nil
+    }
+    if st != StateStarting && st != StateRunning {
+        // Whatever the device showed last is stale once it is closed.
+        if h.last != nil {
+            h.last.Release()
+            h.last = nil
+        }
+        h.forget()
+        h.signal = true
+        h.metrics.SignalPresent.Set(1)
+        h.deviceLost = false
+        h.metrics.DevicePresent.Set(1)
+    }
+}
+
+// setFailed records err as the reason the last capture run ended.
+func (h *Hub) setFailed(err error) {
+    h.setState(StateError)
+    h.mu.Lock()
+    h.runErr = err
+    h.mu.Unlock()
+}
+
+// RunErr returns the error that ended the last capture run, or nil while
+// the device is running or if it last closed cleanly.
+func (h *Hub) RunErr() error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.runErr
+}
+
+// Latest returns the most recent frame while the device is running, or
+// nil if there is none. It works without any subscribers. The caller
+// must release the frame.
+func (h *Hub) Latest() *Frame {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.last != nil {
+        h.last.Retain()
+    }
+    return h.last
+}
+
+// Subscribe registers a new subscriber with a queue of buffer frames.
+func (h *Hub) Subscribe(buffer int) *Subscriber { return h.subscribe(buffer, true) }
+
+// SubscribeContinuing is Subscribe for a subscriber carrying on from
+// frames it already has, such as a recording starting with a
+// prebuffer's: H.264 is sent from the next frame published rather than
+// the next keyframe, which would leave a gap after the frames it had.
+// With nothing to carry on from, it must skip to a keyframe itself.
+func (h *Hub) SubscribeContinuing(buffer int) *Subscriber { return h.subscribe(buffer, false) }
+
+func (h *Hub) subscribe(buffer int, needKey bool) *Subscriber {
+    if buffer <= 0 {
+        buffer = DefaultBuffer
+    }
+    s := &Subscriber{
+        ch:      make(chan *Frame, buffer),
+        audio:   make(chan *AudioChunk, audioBuffer),
+        needKey: needKey,
+        m:       h.metrics,
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.err != nil {
+        s.err = h.err
+        close(s.ch)
+        return s
+    }
+    h.subs[s] = struct{}{}
+    h.metrics.ConnectedClients.Inc()
+    select {
+    case h.wake <- struct{}{}:
+    default:
+    }
+    return s
+}
+
+// SubscribeViewer is Subscribe for someone watching, who would otherwise
+// see nothing until the device delivers: without a live frame to show,
+// the subscriber is sent the Startup or Offline frame at once, as
+// sequence 0, and the live frames follow as they come. Only JPEG
+// streams have them.
+func (h *Hub) SubscribeViewer(buffer int) *Subscriber {
+    s := h.Subscribe(buffer)
+    if h.OutputFormat() != capture.FormatMJPEG {
+        return s
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if _, ok := h.subs[s]; !ok || h.last != nil {
+        return s
+    }
+    still := h.Startup
+    if h.state == StateError {
+        still = h.Offline
+    }
+    if still.Data == nil {
+        return s
+    }
+    still.Timestamp = time.Now()
+    // Queued directly rather than sent: a still is not one of the
+    // stream's frames, and must not start the decimator's grid.
+    select {
+    case s.ch <- &Frame{Frame: still}:
+    default:
+    }
+    return s
+}
+
+// Unsubscribe removes s from the hub and closes its channel. It is safe to
+// call more than once.
+func (h *Hub) Unsubscribe(s *Subscriber) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if _, ok := h.subs[s]; ok {
+        delete(h.subs, s)
+        s.close()
+        h.metrics.ConnectedClients.Dec()
+    }
+}
+
+// Subscribers reports how many subscribers are registered.
+func (h *Hub) Subscribers() int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return len(h.subs)
+}
+
+// Publish stamps f with the next sequence number and delivers it to every
+// subscriber. The hub takes over the caller's reference to f's buffer
+// and keeps it as the latest frame.
+func (h *Hub) Publish(f capture.Frame) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.seq++
+    h.metrics.FramesCaptured.Inc()
+    h.countFPS(f.Timestamp)
+    fr := &Frame{Frame: f, Seq: h.seq, DeviceLost: h.deviceLost}
+    if h.last != nil {
+        h.last.Release()
+    }
+    h.last = fr
+    h.remember(fr)
+    for s := range h.subs {
+        s.send(fr)
+    }
+}
+
+// countFPS updates the current_fps gauge once per second of capture time.
+func (h *Hub) countFPS(ts time.Time) {
+    if h.fpsStart.IsZero() || ts.Before(h.fpsStart) {
+        h.fpsStart, h.fpsCount = ts, 0
+    }
+    h.fpsCount++
+    if elapsed := ts.Sub(h.fpsStart); elapsed >= time.Second {
+        h.metrics.CurrentFPS.Set(float64(h.fpsCount-1) / elapsed.Seconds())
+        h.fpsStart, h.fpsCount = ts, 1
+    }
+}
+
+// Run drives the capture source until ctx is done, publishing frames.
+// With OnDemand set the device is opened only while someone is
+// subscribed and closed again after IdleTimeout without subscribers;
+// otherwise it is opened at once and a failure ends Run. Because only
+// Run opens the device, concurrent subscribers never race to start it.
+//
+// Subscribers are closed when Run returns, and the source is closed last.
+// Callers that must not have the device closed under an active writer
+// should cancel ctx only once writers are finished.
+func (h *Hub) Run(ctx context.Context) error {
+    for {
+        if h.OnDemand && !h.waitForDemand(ctx) {
+            h.fail(ErrStopped)
+            return nil
+        }
+        err := h.run(ctx)
+        switch {
+        case ctx.Err() != nil:
+            h.fail(ErrStopped)
+            return nil
+        case err == errIdle:
+            slog.Info("no subscribers, closing capture device", "device", h.device)
+        case !h.OnDemand:
+            h.setFailed(err)
+            h.fail(err)
+            return err
+        default:
+            // The next subscriber will trigger another attempt.
+            slog.Error("capture stopped", "device", h.device, "err", err)
+            h.setFailed(err)
+            h.closeAll(err)
+        }
+    }
+}
+
+// errIdle ends a capture run that has had no subscribers for IdleTimeout.
+var errIdle = errors.New("hub: idle")
+
+func (h *Hub) waitForDemand(ctx context.Context) bool {
+    for h.Subscribers() == 0 {
+        select {
+        case <-ctx.Done():
+            return false
+        case <-h.wake:
+        }
+    }
+    return true
+}
+
+func (h *Hub) run(ctx context.Context) error {
+    h.setState(StateStarting)
+    defer h.setState(StateIdle)
+    if err := h.src.Open(h.device); err != nil {
+        h.metrics.CaptureErrors.Inc()
+        return err
+    }
+    defer h.src.Close()
+    defer h.startAudio(ctx)()
+    workers := h.Workers
+    se, stream := h.Encoder.(encode.StreamEncoder)
+    if stream {
+        // Its frames must be encoded in order, and it is closed only once
+        // the pipeline has drained.
+        workers = 1
+        defer se.Close()
+    }
+    var stage encode.Encoder = h.Encoder
+    if h.Overlay != nil {
+        stage = overlaid{h.Encoder, h.Overlay}
+    }
+    enc := encode.NewPipeline(stage, workers, h.Queue, h.Quality, h.Publish, h.metrics)
+    defer enc.Close()
+    // Placeholders arrive from a goroutine of their own, and the pipeline
+    // takes one frame at a time.
+    var submitMu sync.Mutex
+    submit := func(f capture.Frame) {
+        submitMu.Lock()
+        defer submitMu.Unlock()
+        if f.Format == capture.FormatMJPEG && !stream && !h.Overlay.Enabled() {
+            h.Publish(f)
+        } else {
+            enc.Submit(f)
+        }
+    }
+    defer h.startPlaceholders(ctx, submit)()
+    h.repeats = 0
+    h.setState(StateRunning)
+
+    var idleSince time.Time
+    for ctx.Err() == nil {
+        if h.OnDemand && h.idle(&idleSince) {
+            return errIdle
+        }
+        select {
+        case req := <-h.restart:
+            if err := h.restartSource(req); err != nil {
+                return err
+            }
+            continue
+        default:
+        }
+        frame, err := h.src.ReadFrame()
+        if h.checkSignal(frame, err) {
+            frame.Release()
+            continue
+        }
+        if err == capture.ErrTimeout || errors.Is(err, capture.ErrNoSignal) {
+            continue
+        }
+        if err != nil {
+            h.metrics.CaptureErrors.Inc()
+        }
+        if capture.IsDeviceLost(err) {
+            slog.Warn("capture device lost", "device", h.device, "err", err)
+            if err = h.reattach(ctx, &idleSince); err == nil {
+                continue
+            }
+        }
+        if err != nil {
+            return err
+        }
+        submit(frame)
+    }
+    return ctx.Err()
+}
+
+// idle reports whether the hub has been without subscribers for
+// IdleTimeout, tracking the start of the idle period in since.
+func (h *Hub) idle(since *time.Time) bool {
+    if h.Subscribers() > 0 {
+        *since = time.Time{}
+        return false
+    }
+    if since.IsZero() {
+        *since = time.Now()
+    }
+    return time.Since(*since) >= h.IdleTimeout
+}
+
+type restartRequest struct {
+    undo func()
+    done chan error
+}
+
+// Restart closes and reopens the source without ending the run, so a
+// mode changed on the source takes effect while subscribers stay
+// connected. If the reopen fails, undo (when not nil) is called to put
+// the previous settings back and the source is opened once more; the
+// error from the first attempt is returned either way. A hub whose
+// device is not open returns nil at once, as its next open picks the
+// change up anyway.
+func (h *Hub) Restart(ctx context.Context, undo func()) error {
+    req := restartRequest{undo: undo, done: make(chan error, 1)}
+    for {
+        if h.State() != StateRunning {
+            return nil
+        }
+        select {
+        case h.restart <- req:
+            return <-req.done
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(100 * time.Millisecond):
+            // Look at the state again in case the run ended.
+        }
+    }
+}
+
+// restartSource serves a Restart request. It returns an error only when
+// the source could not be opened again at all, which ends the run.
+func (h *Hub) restartSource(req restartRequest) error {
+    h.src.Close()
+    err := h.src.Open(h.device)
+    if err != nil {
+        if req.undo == nil {
+            req.done <- err
+            return err
+        }
+        req.undo()
+        if err2 := h.src.Open(h.device); err2 != nil {
+            req.done <- err
+            return err2
+        }
+    }
+    req.done <- err
+    if err == nil {
+        slog.Info("capture device restarted", "device", h.device)
+    }
+    return nil
+}
+
+// fail closes every subscriber with err and refuses new ones.
+func (h *Hub) fail(err error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.err = err
+    h.closeAllLocked(err)
+}
+
+// closeAll closes every current subscriber with err.
+func (h *Hub) closeAll(err error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.closeAllLocked(err)
+}
+
+func (h *Hub) closeAllLocked(err error) {
+    for s := range h.subs {
+        s.err = err
+        delete(h.subs, s)
+        s.close()
+        h.metrics.ConnectedClients.Dec()
+    }
+}
@@ -0,0 +1,390 @@
+package hub
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+)
+
+// jpegFrame is a frame as a device delivering MJPEG would hand it over.
+func jpegFrame(ts time.Time) capture.Frame {
+    return capture.Frame{Data: []byte{0xFF, 0xD8, 0xFF, 0xD9}, Format: capture.FormatMJPEG, Width: 16, Height: 16, Timestamp: ts}
+}
+
+func TestPublishNeverBlocksOnAStuckSubscriber(t *testing.T) {
+    const (
+        readers = 19
+        frames  = 200
+    )
+    h := New(nil, "test", nil)
+    stuck := h.Subscribe(DefaultBuffer)
+    defer h.Unsubscribe(stuck)
+
+    got := make(chan uint64, readers)
+    subs := make([]*Subscriber, readers)
+    for i := range subs {
+        subs[i] = h.Subscribe(DefaultBuffer)
+        go func(s *Subscriber) {
+            for f := range s.Frames() {
+                got <- f.Seq
+                f.Release()
+            }
+        }(subs[i])
+    }
+
+    start := time.Now()
+    for seq := uint64(1); seq <= frames; seq++ {
+        before := time.Now()
+        h.Publish(jpegFrame(start.Add(time.Duration(seq) * time.Millisecond)))
+        if d := time.Since(before); d > 100*time.Millisecond {
+            t.Fatalf("Publish of frame %d took %v", seq, d)
+        }
+        // Every reader gets this frame before the next is published, so
+        // none of them can fall behind and lose one.
+        for i := 0; i < readers; i++ {
+            select {
+            case s := <-got:
+                if s != seq {
+                    t.Fatalf("a reader got frame %d, want %d", s, seq)
+                }
+            case <-time.After(5 * time.Second):
+                t.Fatalf("frame %d reached %d of %d readers", seq, i, readers)
+            }
+        }
+    }
+
+    for _, s := range subs {
+        if n := s.Dropped(); n != 0 {
+            t.Errorf("a reader had %d frames dropped", n)
+        }
+        h.Unsubscribe(s)
+    }
+    if n := stuck.Dropped(); n != frames-DefaultBuffer {
+        t.Errorf("stuck subscriber dropped %d frames, want %d", n, frames-DefaultBuffer)
+    }
+    // What it holds is the newest frames, not the first ones.
+    f := <-stuck.Frames()
+    defer f.Release()
+    if want := uint64(frames - DefaultBuffer + 1); f.Seq != want {
+        t.Errorf("stuck subscriber's oldest frame is %d, want %d", f.Seq, want)
+    }
+}
+
+// closeOrderSource is a synthetic source that records how its Close is
+// ordered against its own reads and the hub's publishing.
+type closeOrderSource struct {
+    *capture.SyntheticSource
+    reading atomic.Bool
+    mu      sync.Mutex
+    // closes counts Close calls; underRead those made during a
+    // ReadFrame; onClose runs at the first.
+    closes, underRead int
+    onClose           func()
+}
+
+func (s *closeOrderSource) ReadFrame() (capture.Frame, error) {
+    s.reading.Store(true)
+    defer s.reading.Store(false)
+    return s.SyntheticSource.ReadFrame()
+}
+
+func (s *closeOrderSource) Close() error {
+    s.mu.Lock()
+    s.closes++
+    if s.reading.Load() {
+        s.underRead++
+    }
+    if s.closes == 1 && s.onClose != nil {
+        s.onClose()
+    }
+    s.mu.Unlock()
+    return s.SyntheticSource.Close()
+}
+
+func TestRunClosesSourceAfterWriters(t *testing.T) {
+    src := &closeOrderSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 200)}
+    h := New(src, "synthetic", nil)
+    // Raw frames go through the encoder pool, whose workers publish
+    // after ReadFrame has returned.
+    h.Workers = 4
+    sub := h.Subscribe(DefaultBuffer)
+    published := func() uint64 {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        return h.seq
+    }
+    var atClose uint64
+    src.onClose = func() { atClose = published() }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- h.Run(ctx) }()
+    deadline := time.After(5 * time.Second)
+    for published() < 10 {
+        select {
+        case <-deadline:
+            t.Fatal("no frames published")
+        case <-time.After(time.Millisecond):
+        }
+    }
+    cancel()
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+
+    for f := range sub.Frames() {
+        f.Release()
+    }
+    if !errors.Is(sub.Err(), ErrStopped) {
+        t.Errorf("subscriber err = %v, want ErrStopped", sub.Err())
+    }
+    src.mu.Lock()
+    defer src.mu.Unlock()
+    if src.closes != 1 {
+        t.Errorf("source closed %d times, want once", src.closes)
+    }
+    if src.underRead != 0 {
+        t.Error("source closed during a ReadFrame")
+    }
+    if n := published(); n != atClose {
+        t.Errorf("%d frames published after the source was closed", n-atClose)
+    }
+}
+
+// countingSource is a synthetic source that counts opens and closes.
+type countingSource struct {
+    *capture.SyntheticSource
+    opens, closes atomic.Int32
+}
+
+func (s *countingSource) Open(device string) error {
+    s.opens.Add(1)
+    return s.SyntheticSource.Open(device)
+}
+
+func (s *countingSource) Close() error {
+    s.closes.Add(1)
+    return s.SyntheticSource.Close()
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestOnDemandFlapping(t *testing.T) {
+    const idle = 100 * time.Millisecond
+    src := &countingSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 50)}
+    h := New(src, "synthetic", nil)
+    h.OnDemand = true
+    h.IdleTimeout = idle
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- h.Run(ctx) }()
+    defer func() {
+        cancel()
+        <-done
+    }()
+
+    time.Sleep(2 * idle)
+    if n := src.opens.Load(); n != 0 {
+        t.Fatalf("device opened %d times with nobody watching", n)
+    }
+
+    // 0 → 1: the device opens and frames flow.
+    s := h.Subscribe(0)
+    if f, ok := <-s.Frames(); !ok {
+        t.Fatal("no frame after subscribing")
+    } else {
+        f.Release()
+    }
+    // 1 → 0 → 1 within the idle timeout keeps the device open.
+    for i := 0; i < 3; i++ {
+        h.Unsubscribe(s)
+        time.Sleep(idle / 4)
+        s = h.Subscribe(0)
+        if f, ok := <-s.Frames(); !ok {
+            t.Fatalf("flap %d: subscriber closed: %v", i, s.Err())
+        } else {
+            f.Release()
+        }
+    }
+    if o, c := src.opens.Load(), src.closes.Load(); o != 1 || c != 0 {
+        t.Errorf("after quick flaps: %d opens, %d closes; want 1, 0", o, c)
+    }
+
+    // 1 → 0 for longer than the timeout closes it.
+    h.Unsubscribe(s)
+    waitFor(t, "idle close", func() bool { return src.closes.Load() == 1 })
+    waitFor(t, "idle state", func() bool { return h.State() == StateIdle })
+    time.Sleep(2 * idle)
+    if n := src.opens.Load(); n != 1 {
+        t.Errorf("device reopened with nobody watching: %d opens", n)
+    }
+
+    // 0 → 1 again reopens it for the new subscriber.
+    s = h.Subscribe(0)
+    defer h.Unsubscribe(s)
+    if f, ok := <-s.Frames(); !ok {
+        t.Fatalf("no frame after resubscribing: %v", s.Err())
+    } else {
+        f.Release()
+    }
+    if o, c := src.opens.Load(), src.closes.Load(); o != 2 || c != 1 {
+        t.Errorf("after resubscribing: %d opens, %d closes; want 2, 1", o, c)
+    }
+}
+
+// signalSource is a counting source whose reads fail as an HDMI bridge's
+// do while lost is set.
+type signalSource struct {
+    countingSource
+    lost atomic.Bool
+}
+
+func (s *signalSource) ReadFrame() (capture.Frame, error) {
+    if s.lost.Load() {
+        time.Sleep(time.Millisecond)
+        return capture.Frame{}, fmt.Errorf("capture: synthetic: %w: link down", capture.ErrNoSignal)
+    }
+    return s.countingSource.ReadFrame()
+}
+
+func TestNoSignalKeepsDeviceOpen(t *testing.T) {
+    src := &signalSource{countingSource: countingSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 50)}}
+    h := New(src, "synthetic", nil)
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() { done <- h.Run(ctx) }()
+    defer func() {
+        cancel()
+        <-done
+    }()
+    sub := h.Subscribe(DefaultBuffer)
+    defer h.Unsubscribe(sub)
+    next := func() *Frame {
+        t.Helper()
+        select {
+        case f, ok := <-sub.Frames():
+            if !ok {
+                t.Fatalf("subscriber closed: %v", sub.Err())
+            }
+            return f
+        case <-time.After(5 * time.Second):
+            t.Fatal("no frame")
+        }
+        return nil
+    }
+    next().Release()
+
+    src.lost.Store(true)
+    waitFor(t, "signal loss", func() bool { return !h.SignalPresent() })
+    h.mu.Lock()
+    lost := h.deviceLost
+    h.mu.Unlock()
+    if lost {
+        t.Error("losing the signal marked the device lost")
+    }
+    if st := h.State(); st != StateRunning {
+        t.Errorf("state %s without a signal, want running", st)
+    }
+
+    src.lost.Store(false)
+    waitFor(t, "signal back", h.SignalPresent)
+    next().Release()
+    if o, c := src.opens.Load(), src.closes.Load(); o != 1 || c != 0 {
+        t.Errorf("%d opens, %d closes; the device should stay open through a lost signal", o, c)
+    }
+}
+
+func TestSubscribeContinuing(t *testing.T) {
+    h := New(nil, "test", nil)
+    start := time.Now()
+    publish := func(key bool) {
+        h.Publish(capture.Frame{Data: []byte{0, 0, 0, 1}, Format: capture.FormatH264, Timestamp: start, Key: key})
+    }
+    publish(true)
+    fresh := h.Subscribe(8)
+    defer h.Unsubscribe(fresh)
+    carrying := h.SubscribeContinuing(8)
+    defer h.Unsubscribe(carrying)
+    publish(false)
+    publish(false)
+    publish(true)
+
+    seqs := func(s *Subscriber) []uint64 {
+        var out []uint64
+        for len(s.Frames()) > 0 {
+            f := <-s.Frames()
+            out = append(out, f.Seq)
+            f.Release()
+        }
+        return out
+    }
+    if got := seqs(fresh); fmt.Sprint(got) != "[4]" {
+        t.Errorf("Subscribe got %v, want the keyframe 4 only", got)
+    }
+    if got := seqs(carrying); fmt.Sprint(got) != "[2 3 4]" {
+        t.Errorf("SubscribeContinuing got %v, want every frame from 2", got)
+    }
+}
+
+// reopenSource opens once and then fails every open while failing is set.
+type reopenSource struct {
+    countingSource
+    failing atomic.Bool
+}
+
+var errReopen = errors.New("mode not supported")
+
+func (s *reopenSource) Open(device string) error {
+    if s.failing.Load() {
+        s.opens.Add(1)
+        return errReopen
+    }
+    return s.countingSource.Open(device)
+}
+
+// A restart whose reopen fails with nothing to undo ends the run with
+// the open error rather than carrying on with the device closed.
+func TestRestartFailureEndsRun(t *testing.T) {
+    src := &reopenSource{countingSource: countingSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 50)}}
+    h := New(src, "synthetic", nil)
+    sub := h.Subscribe(DefaultBuffer)
+    done := make(chan error, 1)
+    go func() { done <- h.Run(context.Background()) }()
+    waitFor(t, "running", func() bool { return h.State() == StateRunning })
+
+    src.failing.Store(true)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := h.Restart(ctx, nil); !errors.Is(err, errReopen) {
+        t.Errorf("Restart = %v, want %v", err, errReopen)
+    }
+    select {
+    case err := <-done:
+        if !errors.Is(err, errReopen) {
+            t.Errorf("Run = %v, want %v", err, errReopen)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("run carried on after the source failed to reopen")
+    }
+    for range sub.Frames() {
+    }
+    if !errors.Is(sub.Err(), errReopen) {
+        t.Errorf("subscriber ended with %v, want %v", sub.Err(), errReopen)
+    }
+}
@@ -0,0 +1,26 @@
+package hub
+
+import (
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/encode"
+    "github.com/Cdaprod/hdmi-streaming-app/overlay"
+)
+
+// overlaid is the encoder stage with the overlay drawn in first. The
+// settings are read per frame, so a change shows on the next one.
+type overlaid struct {
+    enc encode.Encoder
+    o   *overlay.Overlay
+}
+
+func (e overlaid) Encode(f capture.Frame, quality int) (capture.Frame, error) {
+    g, err := e.o.Apply(f)
+    if err != nil {
+        return capture.Frame{}, err
+    }
+    if g.Buf != f.Buf {
+        // A decoded copy; the pipeline releases only the original.
+        defer g.Release()
+    }
+    return e.enc.Encode(g, quality)
+}
@@ -0,0 +1,120 @@
+package hub
+
+import (
+    "errors"
+    "image"
+    "image/draw"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// Magic is the protocol magic for sending f: FrameMagic for a JPEG,
+// H264KeyMagic or H264Magic for H.264.
+func (f *Frame) Magic() [4]byte {
+    switch {
+    case f.Format != capture.FormatH264:
+        return protocol.FrameMagic
+    case f.Key:
+        return protocol.H264KeyMagic
+    default:
+        return protocol.H264Magic
+    }
+}
+
+// renderCache is how many renderings Render keeps. Clients sharing a
+// size, crop and quality are sent the same frames at about the same
+// time, so a few are enough for them to share one encode.
+const renderCache = 8
+
+// ErrNotJPEG is returned by Render for frames from a stream encoder,
+// which can only be sent on as they are.
+var ErrNotJPEG = errors.New("hub: stream is not JPEG")
+
+// rendering is one frame rendered for one set of params. done is closed
+// once data or err is set, so callers asking for it meanwhile wait for
+// the encode under way rather than start another.
+type rendering struct {
+    seq  uint64
+    p    protocol.Params
+    done chan struct{}
+    data []byte
+    err  error
+}
+
+// Render returns f as a JPEG shaped for p: cut to p.Crop, fitted to the
+// frame, then rescaled. MJPEG frames pass through untouched when p asks
+// for no change in crop, size or quality; anything else is decoded,
+// reshaped and recompressed, and the time spent is recorded. The last few
+// renderings are kept, so clients asking for the same frame the same way
+// share the work.
+func (h *Hub) Render(f *Frame, p protocol.Params) ([]byte, error) {
+    if f.Format == capture.FormatH264 {
+        return nil, ErrNotJPEG
+    }
+    if p.Quality == h.Quality() {
+        p.Quality = 0
+    }
+    p.FPS = 0 // paced by the client, not rendered
+    if f.Format == capture.FormatMJPEG && p.Width == 0 && p.Height == 0 && p.Quality == 0 && p.Crop.Empty() {
+        return f.Data, nil
+    }
+    if f.Seq == 0 {
+        // The startup and offline frames share the number, so they are
+        // not kept.
+        return h.render(f, p)
+    }
+    h.rendersMu.Lock()
+    for _, r := range h.renders {
+        if r != nil && r.seq == f.Seq && r.p == p {
+            h.rendersMu.Unlock()
+            <-r.done
+            return r.data, r.err
+        }
+    }
+    r := &rendering{seq: f.Seq, p: p, done: make(chan struct{})}
+    copy(h.renders[1:], h.renders[:renderCache-1])
+    h.renders[0] = r
+    h.rendersMu.Unlock()
+
+    r.data, r.err = h.render(f, p)
+    close(r.done)
+    return r.data, r.err
+}
+
+func (h *Hub) render(f *Frame, p protocol.Params) ([]byte, error) {
+    start := time.Now()
+    defer func() { h.metrics.EncodeDuration.Observe(time.Since(start).Seconds()) }()
+
+    img, err := imaging.Decode(f.Frame)
+    if err != nil {
+        return nil, err
+    }
+    img = crop(img, p.Crop)
+    q := p.Quality
+    if q == 0 {
+        q = h.Quality()
+    }
+    return imaging.EncodeJPEG(imaging.Resize(img, p.Width, p.Height), q)
+}
+
+// crop returns the part of img within r, or all of it when r is empty or
+// misses it altogether, as it can after the source changes size.
+func crop(img image.Image, r protocol.Rect) image.Image {
+    if r.Empty() {
+        return img
+    }
+    b := img.Bounds()
+    rect := image.Rect(r.X, r.Y, r.X+r.W, r.Y+r.H).Add(b.Min).Intersect(b)
+    if rect.Empty() {
+        return img
+    }
+    if s, ok := img.(subImager); ok {
+        return s.SubImage(rect)
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+    draw.Draw(dst, dst.Rect, img, rect.Min, draw.Src)
+    return dst
+}
@@ -0,0 +1,187 @@
+package hub
+
+import (
+    "context"
+    "errors"
+    "hash/fnv"
+    "log/slog"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// When the HDMI source goes away a capture card stops delivering frames,
+// fails with an error, or keeps repeating the last picture. The hub then
+// publishes a generated "no signal" frame once a second, so viewers can
+// tell a dead source from a still one, until real frames come back. The
+// placeholders are ordinary frames in the sequence, so numbering carries
+// straight on when the signal returns.
+
+const (
+    placeholderInterval = time.Second
+    // Without a frame to copy the size from, placeholders are 720p.
+    placeholderWidth  = 1280
+    placeholderHeight = 720
+    // frozenSamples is how many evenly spread 64-byte runs of a frame are
+    // hashed to spot repeats, rather than the whole of every frame.
+    frozenSamples = 64
+)
+
+// SignalPresent reports whether the device has an input signal. It is
+// true while the device is closed, since nothing says otherwise.
+func (h *Hub) SignalPresent() bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.signal
+}
+
+// Size returns the dimensions of the last real frame, zero before the
+// first.
+func (h *Hub) Size() (w, ht int) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.size[0], h.size[1]
+}
+
+// setSignal records whether there is an input signal. A live frame
+// passes its size, which later placeholders copy.
+func (h *Hub) setSignal(present bool, reason string, w, ht int) {
+    h.mu.Lock()
+    changed := h.signal != present
+    h.signal = present
+    if w > 0 && ht > 0 {
+        h.size = [2]int{w, ht}
+    }
+    h.mu.Unlock()
+    if !changed {
+        return
+    }
+    if present {
+        h.metrics.SignalPresent.Set(1)
+        slog.Info("input signal restored", "device", h.device)
+    } else {
+        h.metrics.SignalPresent.Set(0)
+        slog.Warn("input signal lost", "device", h.device, "reason", reason)
+    }
+}
+
+// checkSignal looks at the outcome of a read: a timeout, a no-signal
+// error or a run of identical frames means the signal is gone, and any
+// other frame that it is back. It reports whether f should be dropped
+// as a repeat. Only the capture goroutine calls it.
+func (h *Hub) checkSignal(f capture.Frame, err error) (frozen bool) {
+    switch {
+    case err == capture.ErrTimeout:
+        h.setSignal(false, "no frames", 0, 0)
+    case errors.Is(err, capture.ErrNoSignal):
+        h.setSignal(false, err.Error(), 0, 0)
+    case err != nil:
+    case h.repeated(f):
+        h.setSignal(false, "frozen frames", 0, 0)
+        return true
+    default:
+        h.setSignal(true, "", f.Width, f.Height)
+    }
+    return false
+}
+
+// repeated reports whether f is at least the FrozenFrames'th identical
+// frame in a row.
+func (h *Hub) repeated(f capture.Frame) bool {
+    if h.FrozenFrames <= 0 {
+        return false
+    }
+    sum := sampleHash(f.Data)
+    if sum != h.lastHash {
+        h.lastHash, h.repeats = sum, 1
+        return false
+    }
+    h.repeats++
+    return h.repeats >= h.FrozenFrames
+}
+
+// sampleHash hashes the length of b and runs of bytes spread across it.
+func sampleHash(b []byte) uint64 {
+    hash := fnv.New64a()
+    n := len(b)
+    hash.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+    const run = 64
+    if n <= frozenSamples*run {
+        hash.Write(b)
+        return hash.Sum64()
+    }
+    step := (n - run) / (frozenSamples - 1)
+    for i := 0; i < frozenSamples; i++ {
+        hash.Write(b[i*step : i*step+run])
+    }
+    return hash.Sum64()
+}
+
+// startPlaceholders hands submit a placeholder frame every
+// placeholderInterval while the signal is lost, until the returned stop
+// is called.
+func (h *Hub) startPlaceholders(ctx context.Context, submit func(capture.Frame)) (stop func()) {
+    ctx, cancel := context.WithCancel(ctx)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        tick := time.NewTicker(placeholderInterval)
+        defer tick.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case now := <-tick.C:
+                if h.SignalPresent() {
+                    continue
+                }
+                f, err := h.placeholder(now)
+                if err != nil {
+                    continue
+                }
+                // The signal may have come back while it was drawn.
+                if h.SignalPresent() {
+                    f.Release()
+                    continue
+                }
+                submit(f)
+            }
+        }
+    }()
+    return func() {
+        cancel()
+        <-done
+    }
+}
+
+// placeholder renders a "NO SIGNAL" frame, or "NO DEVICE" while the
+// device is gone, stamped with now, at the size of the last real frame.
+func (h *Hub) placeholder(now time.Time) (capture.Frame, error) {
+    h.mu.Lock()
+    w, ht := h.size[0], h.size[1]
+    title := "NO SIGNAL"
+    if h.deviceLost {
+        title = "NO DEVICE"
+    }
+    h.mu.Unlock()
+    if w <= 0 || ht <= 0 {
+        w, ht = placeholderWidth, placeholderHeight
+    }
+    img := imaging.Placeholder(w, ht, title, now.UTC().Format("2006-01-02 15:04:05 UTC"))
+    data, err := imaging.EncodeJPEG(img, h.Quality())
+    if err != nil {
+        return capture.Frame{}, err
+    }
+    buf := capture.NewFrameBuffer(0)
+    buf.Write(data)
+    return capture.Frame{
+        Data:        buf.Bytes(),
+        Buf:         buf,
+        Format:      capture.FormatMJPEG,
+        Width:       w,
+        Height:      ht,
+        Timestamp:   now,
+        Placeholder: true,
+    }, nil
+}
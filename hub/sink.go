@@ -0,0 +1,43 @@
+package hub
+
+import "context"
+
+// Sink is an output the hub feeds with Feed, such as a process pushing
+// the stream to another server. Start and Stop bracket the frames given
+// to WriteFrame, which are called from a single goroutine.
+type Sink interface {
+    Start(ctx context.Context) error
+    // WriteFrame takes f, which stays owned by the caller. An error ends
+    // the feed.
+    WriteFrame(f *Frame) error
+    Stop() error
+}
+
+// Feed starts s and writes it every frame, or at most fps a second when
+// fps is positive, until ctx is done, the hub stops or WriteFrame fails,
+// then stops s. Like any subscriber, a sink that falls behind misses
+// frames rather than holding up the rest.
+func (h *Hub) Feed(ctx context.Context, s Sink, fps int) error {
+    if err := s.Start(ctx); err != nil {
+        return err
+    }
+    defer s.Stop()
+    sub := h.Subscribe(DefaultBuffer)
+    sub.SetFPS(fps)
+    defer h.Unsubscribe(sub)
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case f, ok := <-sub.Frames():
+            if !ok {
+                return sub.Err()
+            }
+            err := s.WriteFrame(f)
+            f.Release()
+            if err != nil {
+                return err
+            }
+        }
+    }
+}
@@ -0,0 +1,156 @@
+package hub
+
+import (
+    "hash/maphash"
+    "image"
+    "image/draw"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// tileCache is how many frames' tiles Tiles keeps. Delta clients are at
+// most a queue apart, so a few cover them all without holding decoded
+// pictures for long.
+const tileCache = 4
+
+var tileSeed = maphash.MakeSeed()
+
+// TileSet is a frame cut into square tiles, each with a hash of its
+// pixels, so a client can send only the tiles that changed since the
+// last frame it was sent. Tiles on the right and bottom edges may be
+// smaller than Size.
+type TileSet struct {
+    Seq           uint64
+    Width, Height int
+    Size          int
+    Cols, Rows    int
+    // Hashes holds a hash per tile, row by row.
+    Hashes []uint64
+
+    img image.Image
+
+    mu   sync.Mutex
+    jpeg map[[2]int][]byte
+}
+
+// Rect returns the pixels covered by tile i.
+func (t *TileSet) Rect(i int) image.Rectangle {
+    col, row := i%t.Cols, i/t.Cols
+    r := image.Rect(col*t.Size, row*t.Size, (col+1)*t.Size, (row+1)*t.Size)
+    return r.Intersect(image.Rect(0, 0, t.Width, t.Height))
+}
+
+// JPEG returns tile i encoded at quality. Encodings are shared by every
+// client asking for the same tile and quality.
+func (t *TileSet) JPEG(i, quality int) ([]byte, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    key := [2]int{i, quality}
+    if b, ok := t.jpeg[key]; ok {
+        return b, nil
+    }
+    r := t.Rect(i).Add(t.img.Bounds().Min)
+    b, err := imaging.EncodeJPEG(t.img.(subImager).SubImage(r), quality)
+    if err != nil {
+        return nil, err
+    }
+    t.jpeg[key] = b
+    return b, nil
+}
+
+type subImager interface {
+    SubImage(r image.Rectangle) image.Image
+}
+
+// Tiles returns f cut into tiles of size pixels. The last few frames'
+// tiles are kept, so clients sent the same frame share the work of
+// decoding and hashing it.
+func (h *Hub) Tiles(f *Frame, size int) (*TileSet, error) {
+    if f.Format == capture.FormatH264 {
+        return nil, ErrNotJPEG
+    }
+    h.tilesMu.Lock()
+    defer h.tilesMu.Unlock()
+    for _, t := range h.tiles {
+        // Sequence 0 is shared by the startup and offline frames.
+        if t != nil && t.Seq == f.Seq && t.Size == size && f.Seq != 0 {
+            return t, nil
+        }
+    }
+    img, err := imaging.Decode(f.Frame)
+    if err != nil {
+        return nil, err
+    }
+    if _, ok := img.(subImager); !ok {
+        rgba := image.NewRGBA(img.Bounds())
+        draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+        img = rgba
+    }
+    t := newTileSet(f.Seq, img, size)
+    if f.Seq == 0 {
+        return t, nil
+    }
+    copy(h.tiles[1:], h.tiles[:tileCache-1])
+    h.tiles[0] = t
+    return t, nil
+}
+
+func newTileSet(seq uint64, img image.Image, size int) *TileSet {
+    b := img.Bounds()
+    t := &TileSet{
+        Seq:    seq,
+        Width:  b.Dx(),
+        Height: b.Dy(),
+        Size:   size,
+        Cols:   (b.Dx() + size - 1) / size,
+        Rows:   (b.Dy() + size - 1) / size,
+        img:    img,
+        jpeg:   make(map[[2]int][]byte),
+    }
+    t.Hashes = make([]uint64, t.Cols*t.Rows)
+    var mh maphash.Hash
+    for i := range t.Hashes {
+        mh.SetSeed(tileSeed)
+        hashTile(&mh, img, t.Rect(i).Add(b.Min))
+        t.Hashes[i] = mh.Sum64()
+    }
+    return t
+}
+
+// hashTile writes the pixels of r in img to mh, a plane row at a time
+// where the layout allows.
+func hashTile(mh *maphash.Hash, img image.Image, r image.Rectangle) {
+    switch m := img.(type) {
+    case *image.YCbCr:
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            i := m.YOffset(r.Min.X, y)
+            mh.Write(m.Y[i : i+r.Dx()])
+        }
+        // Chroma samples cover more than a pixel; hashing those under
+        // each row and column of the tile catches every change.
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            a, b := m.COffset(r.Min.X, y), m.COffset(r.Max.X-1, y)
+            mh.Write(m.Cb[a : b+1])
+            mh.Write(m.Cr[a : b+1])
+        }
+    case *image.Gray:
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            i := m.PixOffset(r.Min.X, y)
+            mh.Write(m.Pix[i : i+r.Dx()])
+        }
+    case *image.RGBA:
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            i := m.PixOffset(r.Min.X, y)
+            mh.Write(m.Pix[i : i+4*r.Dx()])
+        }
+    default:
+        for y := r.Min.Y; y < r.Max.Y; y++ {
+            for x := r.Min.X; x < r.Max.X; x++ {
+                cr, cg, cb, _ := m.At(x, y).RGBA()
+                mh.Write([]byte{byte(cr >> 8), byte(cg >> 8), byte(cb >> 8)})
+            }
+        }
+    }
+}
@@ -0,0 +1,167 @@
+// Package imaging converts captured frames to images and back to JPEG.
+package imaging
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    "image/color"
+    "image/jpeg"
+    _ "image/png" // for Load
+    "os"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "golang.org/x/image/draw"
+)
+
+// DefaultQuality is used when a JPEG is encoded without an explicit quality.
+const DefaultQuality = 80
+
+// Decode turns a captured frame into an image.
+func Decode(f capture.Frame) (image.Image, error) {
+    switch f.Format {
+    case capture.FormatMJPEG:
+        return jpeg.Decode(bytes.NewReader(f.Data))
+    case capture.FormatYUYV:
+        return decodeYUYV(f.Data, f.Width, f.Height)
+    }
+    return nil, fmt.Errorf("imaging: cannot decode %v", f.Format)
+}
+
+func decodeYUYV(data []byte, w, h int) (image.Image, error) {
+    img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio422)
+    if err := DecodeYUYVInto(img, data); err != nil {
+        return nil, err
+    }
+    return img, nil
+}
+
+// DecodeYUYVInto unpacks packed 4:2:2 (Y0 U Y1 V) into img, which must be
+// a 4:2:2 YCbCr image of the frame's size. No colour conversion is done.
+// It lets callers reuse img between frames.
+func DecodeYUYVInto(img *image.YCbCr, data []byte) error {
+    w, h := img.Rect.Dx(), img.Rect.Dy()
+    if w <= 0 || h <= 0 || len(data) < w*h*2 {
+        return fmt.Errorf("imaging: YUYV buffer of %d bytes too small for %dx%d", len(data), w, h)
+    }
+    if img.SubsampleRatio != image.YCbCrSubsampleRatio422 {
+        return fmt.Errorf("imaging: YUYV needs a 4:2:2 image, got %v", img.SubsampleRatio)
+    }
+    for y := 0; y < h; y++ {
+        row := data[y*w*2:]
+        yo := y * img.YStride
+        co := y * img.CStride
+        for x := 0; x+1 < w; x += 2 {
+            p := row[x*2:]
+            img.Y[yo+x] = p[0]
+            img.Cb[co+x/2] = p[1]
+            img.Y[yo+x+1] = p[2]
+            img.Cr[co+x/2] = p[3]
+        }
+    }
+    return nil
+}
+
+// EncodeYUYVInto packs img as 4:2:2 (Y0 U Y1 V) into dst, which must
+// hold two bytes per pixel of an even-width image. 4:2:2 and 4:2:0 images
+// are copied sample for sample, and opaque RGBA ones converted straight
+// from their pixels; anything else is converted per pixel.
+func EncodeYUYVInto(dst []byte, img image.Image) error {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    if w <= 0 || h <= 0 || w%2 != 0 || len(dst) < w*h*2 {
+        return fmt.Errorf("imaging: YUYV buffer of %d bytes unsuitable for %dx%d", len(dst), w, h)
+    }
+    ycc, ok := img.(*image.YCbCr)
+    if ok && ycc.SubsampleRatio != image.YCbCrSubsampleRatio422 && ycc.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+        ok = false
+    }
+    for y := 0; y < h; y++ {
+        row := dst[y*w*2:]
+        if ok {
+            yo := y * ycc.YStride
+            cy := y
+            if ycc.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+                cy = y / 2
+            }
+            co := cy * ycc.CStride
+            for x := 0; x+1 < w; x += 2 {
+                p := row[x*2:]
+                p[0] = ycc.Y[yo+x]
+                p[1] = ycc.Cb[co+x/2]
+                p[2] = ycc.Y[yo+x+1]
+                p[3] = ycc.Cr[co+x/2]
+            }
+            continue
+        }
+        if rgba, ok := img.(*image.RGBA); ok {
+            pix := rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):]
+            for x := 0; x+1 < w; x += 2 {
+                p, q := pix[x*4:], pix[x*4+4:]
+                y0, cb, cr := color.RGBToYCbCr(p[0], p[1], p[2])
+                y1, _, _ := color.RGBToYCbCr(q[0], q[1], q[2])
+                d := row[x*2:]
+                d[0], d[1], d[2], d[3] = y0, cb, y1, cr
+            }
+            continue
+        }
+        for x := 0; x+1 < w; x += 2 {
+            y0, cb, cr := pixelYCbCr(img, b.Min.X+x, b.Min.Y+y)
+            y1, _, _ := pixelYCbCr(img, b.Min.X+x+1, b.Min.Y+y)
+            p := row[x*2:]
+            p[0], p[1], p[2], p[3] = y0, cb, y1, cr
+        }
+    }
+    return nil
+}
+
+func pixelYCbCr(img image.Image, x, y int) (uint8, uint8, uint8) {
+    c := color.YCbCrModel.Convert(img.At(x, y)).(color.YCbCr)
+    return c.Y, c.Cb, c.Cr
+}
+
+// Resize scales img to w by h. When one dimension is zero it is derived
+// from the other to keep the aspect ratio.
+func Resize(img image.Image, w, h int) image.Image {
+    b := img.Bounds()
+    switch {
+    case w == 0 && h == 0:
+        return img
+    case w == 0:
+        w = b.Dx() * h / b.Dy()
+    case h == 0:
+        h = b.Dy() * w / b.Dx()
+    }
+    if w == b.Dx() && h == b.Dy() {
+        return img
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+    return dst
+}
+
+// Load reads a PNG or JPEG file.
+func Load(path string) (image.Image, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    img, _, err := image.Decode(f)
+    if err != nil {
+        return nil, fmt.Errorf("imaging: %s: %w", path, err)
+    }
+    return img, nil
+}
+
+// EncodeJPEG compresses img. A quality of zero means DefaultQuality.
+func EncodeJPEG(img image.Image, quality int) ([]byte, error) {
+    if quality <= 0 {
+        quality = DefaultQuality
+    }
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package imaging
+
+import (
+    "image"
+    "image/color"
+
+    "golang.org/x/image/draw"
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/basicfont"
+    "golang.org/x/image/math/fixed"
+)
+
+// The placeholder is drawn with the 7x13 bitmap font onto a small canvas
+// and scaled up with nearest-neighbour sampling, which keeps the glyphs
+// sharp at any frame size without shipping a vector font.
+const (
+    placeholderCanvasWidth = 256
+    placeholderBackground  = 0x20
+)
+
+// Placeholder draws a w by h frame saying title, with detail in smaller
+// type underneath, for when there is nothing real to show.
+func Placeholder(w, h int, title, detail string) image.Image {
+    ch := placeholderCanvasWidth * h / w
+    if ch < 40 {
+        ch = 40
+    }
+    canvas := image.NewGray(image.Rect(0, 0, placeholderCanvasWidth, ch))
+    draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.Gray{placeholderBackground}), image.Point{}, draw.Src)
+
+    // The title is drawn at double size on a canvas of its own.
+    face := basicfont.Face7x13
+    big := image.NewGray(image.Rect(0, 0, placeholderCanvasWidth/2, 16))
+    draw.Draw(big, big.Bounds(), image.NewUniform(color.Gray{placeholderBackground}), image.Point{}, draw.Src)
+    drawCentered(big, face, title, 13, color.Gray{0xF0})
+    draw.NearestNeighbor.Scale(canvas, image.Rect(0, ch/2-24, placeholderCanvasWidth, ch/2+8), big, big.Bounds(), draw.Src, nil)
+    drawCentered(canvas, face, detail, ch/2+24, color.Gray{0xA0})
+
+    dst := image.NewGray(image.Rect(0, 0, w, h))
+    draw.NearestNeighbor.Scale(dst, dst.Bounds(), canvas, canvas.Bounds(), draw.Src, nil)
+    return dst
+}
+
+// drawCentered writes s across the middle of img with its baseline at y.
+func drawCentered(img draw.Image, face font.Face, s string, y int, c color.Color) {
+    d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face}
+    x := (fixed.I(img.Bounds().Dx()) - d.MeasureString(s)) / 2
+    d.Dot = fixed.Point26_6{X: x, Y: fixed.I(y)}
+    d.DrawString(s)
+}
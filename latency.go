@@ -0,0 +1,103 @@
+package main
+
+import (
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+const (
+    // sentSlots is how many recent frames' send times are kept for acks
+    // to be matched against; an ack for an older frame is ignored.
+    sentSlots = 64
+    // latencySamples is how many recent acks the percentiles are drawn
+    // from.
+    latencySamples = 128
+    // ackInterval is the least time between acks that are used.
+    ackInterval = 250 * time.Millisecond
+)
+
+// latency measures how long a websocket client's frames take to reach
+// it, from its frame acks. The writer records each frame it sends and the
+// reader matches acks against them, keeping a fixed window of samples, so
+// an ack costs a lookup and two stores.
+type latency struct {
+    mu   sync.Mutex
+    sent [sentSlots]sentFrame
+    // delivery and capture are rings of samples in microseconds, n the
+    // number recorded in all.
+    delivery [latencySamples]int64
+    capture  [latencySamples]int64
+    n        int
+    lastAck  time.Time
+}
+
+// sentFrame is when a frame was captured and sent, in Unix microseconds.
+type sentFrame struct {
+    seq      uint64
+    captured int64
+    sent     int64
+}
+
+// sentAt records that frame seq, captured at captured, was sent at sent.
+func (l *latency) sentAt(seq uint64, captured, sent time.Time) {
+    l.mu.Lock()
+    l.sent[seq%sentSlots] = sentFrame{seq: seq, captured: captured.UnixMicro(), sent: sent.UnixMicro()}
+    l.mu.Unlock()
+}
+
+// ack records that frame seq arrived at recv, in the server's clock, and
+// reports whether it was used: acks come too often, or for frames long
+// gone, are not.
+func (l *latency) ack(seq uint64, recv int64, now time.Time) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if now.Sub(l.lastAck) < ackInterval {
+        return false
+    }
+    f := l.sent[seq%sentSlots]
+    if f.seq != seq || seq == 0 {
+        return false
+    }
+    l.lastAck = now
+    // A clock estimate that is a little off can put the arrival before
+    // the send; that is as good as no delay at all.
+    i := l.n % latencySamples
+    l.delivery[i] = max(recv-f.sent, 0)
+    l.capture[i] = max(recv-f.captured, 0)
+    l.n++
+    return true
+}
+
+// snapshot returns the percentiles of the samples, nil before any.
+func (l *latency) snapshot() *protocol.Latency {
+    l.mu.Lock()
+    n := min(l.n, latencySamples)
+    delivery, capture := l.delivery, l.capture
+    l.mu.Unlock()
+    if n == 0 {
+        return nil
+    }
+    d, c := delivery[:n], capture[:n]
+    sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+    sort.Slice(c, func(i, j int) bool { return c[i] < c[j] })
+    return &protocol.Latency{
+        DeliveryP50: percentileMS(d, 50),
+        DeliveryP95: percentileMS(d, 95),
+        CaptureP50:  percentileMS(c, 50),
+        CaptureP95:  percentileMS(c, 95),
+        Samples:     n,
+    }
+}
+
+// percentileMS returns the p'th percentile of sorted microsecond samples
+// in milliseconds, by the nearest rank.
+func percentileMS(sorted []int64, p int) float64 {
+    i := (len(sorted)*p+99)/100 - 1
+    if i < 0 {
+        i = 0
+    }
+    return float64(sorted[i]) / 1000
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+)
+
+// layoutStream finds the composite stream /api/streams/{name}/layout
+// names, answering 404 for anything else.
+func layoutStream(w http.ResponseWriter, r *http.Request) (*stream.Stream, bool) {
+    name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/streams/"), "/")
+    if action != "layout" {
+        writeError(w, http.StatusNotFound, "not found")
+        return nil, false
+    }
+    st, ok := streams.Get(name)
+    if !ok {
+        writeError(w, http.StatusNotFound, "unknown stream "+name)
+        return nil, false
+    }
+    if st.Composite == nil {
+        writeError(w, http.StatusNotFound, "stream "+name+" is not a composite")
+        return nil, false
+    }
+    return st, true
+}
+
+// layoutGetHandler serves GET /api/streams/{name}/layout.
+func layoutGetHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := layoutStream(w, r)
+    if !ok {
+        return
+    }
+    writeJSON(w, http.StatusOK, st.Composite.Layout())
+}
+
+// layoutPostHandler serves POST /api/streams/{name}/layout. The body
+// holds the settings to change, e.g. {"position": "top-left"}; the rest
+// keep their values. The inset moves from the next frame.
+func layoutPostHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := layoutStream(w, r)
+    if !ok {
+        return
+    }
+    l := st.Composite.Layout()
+    if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+        writeError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+        return
+    }
+    if err := l.Validate("layout"); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    st.Composite.SetLayout(l)
+    writeJSON(w, http.StatusOK, l)
+}
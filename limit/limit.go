@@ -0,0 +1,239 @@
+// Package limit caps how many streaming connections the server holds and
+// how fast a single address may open new ones.
+package limit
+
+import (
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// sweepInterval is how often addresses with nothing left to remember are
+// forgotten.
+const sweepInterval = time.Minute
+
+// capRetry is the Retry-After suggested when a connection cap is hit.
+// Nothing predicts when a viewer will leave, so it is only a hint.
+const capRetry = 10 * time.Second
+
+// Error reports a refused connection attempt.
+type Error struct {
+    Reason     string
+    RetryAfter time.Duration
+}
+
+func (e *Error) Error() string { return "limit: " + e.Reason }
+
+// Limiter admits connections. Zero limits are unlimited, so the zero
+// value admits everything. Limits apply to new connections only; those
+// already admitted are never cut off.
+type Limiter struct {
+    // MaxConns caps connections held at once across all addresses.
+    MaxConns int
+    // MaxPerIP caps connections held at once by one address.
+    MaxPerIP int
+    // PerMinute is the rate of connection attempts one address may make,
+    // with bursts of up to the same number.
+    PerMinute int
+    // Trusted lists the proxies whose X-Forwarded-For is believed.
+    Trusted []*net.IPNet
+
+    mu        sync.Mutex
+    total     int
+    addrs     map[string]*addrState
+    lastSweep time.Time
+}
+
+type addrState struct {
+    conns  int
+    tokens float64
+    filled time.Time // when tokens was last topped up
+}
+
+// New returns a limiter with the given caps and rate, trusting
+// X-Forwarded-For from the proxies in trusted, which are CIDRs or bare
+// addresses.
+func New(maxConns, maxPerIP, perMinute int, trusted []string) (*Limiter, error) {
+    nets, err := ParseTrusted(trusted)
+    if err != nil {
+        return nil, err
+    }
+    return &Limiter{MaxConns: maxConns, MaxPerIP: maxPerIP, PerMinute: perMinute, Trusted: nets}, nil
+}
+
+// ParseTrusted parses CIDRs such as 10.0.0.0/8; a bare address stands
+// for itself alone.
+func ParseTrusted(list []string) ([]*net.IPNet, error) {
+    var out []*net.IPNet
+    for _, s := range list {
+        s = strings.TrimSpace(s)
+        if !strings.Contains(s, "/") {
+            ip := net.ParseIP(s)
+            if ip == nil {
+                return nil, fmt.Errorf("limit: bad trusted proxy %q", s)
+            }
+            bits := 8 * len(ip.To16())
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, n, err := net.ParseCIDR(s)
+        if err != nil {
+            return nil, fmt.Errorf("limit: bad trusted proxy %q", s)
+        }
+        out = append(out, n)
+    }
+    return out, nil
+}
+
+// ClientIP returns the address a request comes from. When the peer is a
+// trusted proxy, X-Forwarded-For is read from the right, skipping
+// further trusted proxies, and the first address that is not one is the
+// client's. Anything further left was written by the client itself and
+// is ignored.
+func (l *Limiter) ClientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !l.trusted(host) {
+        return host
+    }
+    var hops []string
+    for _, h := range r.Header.Values("X-Forwarded-For") {
+        hops = append(hops, strings.Split(h, ",")...)
+    }
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        if net.ParseIP(hop) == nil {
+            break // garbage; trust nothing from here on
+        }
+        host = hop
+        if !l.trusted(hop) {
+            break
+        }
+    }
+    return host
+}
+
+// Origin returns the scheme and host the client addressed. When the
+// peer is a trusted proxy they come from X-Forwarded-Proto and
+// X-Forwarded-Host, where given; otherwise from the request itself.
+func (l *Limiter) Origin(r *http.Request) (scheme, host string) {
+    scheme, host = "http", r.Host
+    if r.TLS != nil {
+        scheme = "https"
+    }
+    peer, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        peer = r.RemoteAddr
+    }
+    if !l.trusted(peer) {
+        return scheme, host
+    }
+    // A chain of proxies appends; the first entry is what the client
+    // used.
+    first := func(h string) string {
+        v, _, _ := strings.Cut(r.Header.Get(h), ",")
+        return strings.TrimSpace(v)
+    }
+    if p := strings.ToLower(first("X-Forwarded-Proto")); p == "http" || p == "https" {
+        scheme = p
+    }
+    if h := first("X-Forwarded-Host"); h != "" {
+        host = h
+    }
+    return scheme, host
+}
+
+func (l *Limiter) trusted(addr string) bool {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    for _, n := range l.Trusted {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Acquire admits a connection from addr, or returns an *Error saying why
+// not. The caller must call release once the connection ends.
+func (l *Limiter) Acquire(addr string) (release func(), err error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    if l.addrs == nil {
+        l.addrs = map[string]*addrState{}
+    }
+    l.sweep(now)
+
+    a := l.addrs[addr]
+    if a == nil {
+        a = &addrState{tokens: float64(l.PerMinute), filled: now}
+        l.addrs[addr] = a
+    }
+    if l.PerMinute > 0 {
+        a.refill(now, l.PerMinute)
+        if a.tokens < 1 {
+            wait := time.Duration((1 - a.tokens) / float64(l.PerMinute) * float64(time.Minute))
+            return nil, &Error{Reason: "too many connection attempts", RetryAfter: wait}
+        }
+        // An attempt costs a token even when a cap then refuses it,
+        // so hammering a full server still trips the rate limit.
+        a.tokens--
+    }
+    if l.MaxPerIP > 0 && a.conns >= l.MaxPerIP {
+        return nil, &Error{Reason: "too many connections from this address", RetryAfter: capRetry}
+    }
+    if l.MaxConns > 0 && l.total >= l.MaxConns {
+        return nil, &Error{Reason: "server is at its connection limit", RetryAfter: capRetry}
+    }
+    a.conns++
+    l.total++
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            l.mu.Lock()
+            defer l.mu.Unlock()
+            a.conns--
+            l.total--
+        })
+    }, nil
+}
+
+func (a *addrState) refill(now time.Time, perMinute int) {
+    a.tokens += now.Sub(a.filled).Minutes() * float64(perMinute)
+    a.tokens = math.Min(a.tokens, float64(perMinute))
+    a.filled = now
+}
+
+// sweep forgets addresses with no connections and a full bucket, which
+// behave exactly as a new entry would.
+func (l *Limiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < sweepInterval {
+        return
+    }
+    l.lastSweep = now
+    for addr, a := range l.addrs {
+        if a.conns > 0 {
+            continue
+        }
+        if l.PerMinute > 0 {
+            a.refill(now, l.PerMinute)
+            if a.tokens < float64(l.PerMinute) {
+                continue
+            }
+        }
+        delete(l.addrs, addr)
+    }
+}
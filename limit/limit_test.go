@@ -0,0 +1,144 @@
+package limit
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+)
+
+func TestClientIP(t *testing.T) {
+    l, err := New(0, 0, 0, []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, tc := range []struct {
+        name   string
+        remote string
+        xff    []string
+        want   string
+    }{
+        {name: "no proxy", remote: "198.51.100.7:5000", want: "198.51.100.7"},
+        {name: "untrusted peer's header ignored", remote: "198.51.100.7:5000", xff: []string{"203.0.113.9"}, want: "198.51.100.7"},
+        {name: "trusted proxy", remote: "10.1.2.3:5000", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+        {name: "trusted bare address", remote: "192.0.2.1:5000", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+        {name: "trusted without header", remote: "10.1.2.3:5000", want: "10.1.2.3"},
+        {name: "chain of trusted proxies", remote: "10.1.2.3:5000", xff: []string{"203.0.113.9, 10.9.9.9, 192.0.2.1"}, want: "203.0.113.9"},
+        {name: "spoofed left entries ignored", remote: "10.1.2.3:5000", xff: []string{"1.1.1.1, 203.0.113.9"}, want: "203.0.113.9"},
+        {name: "several headers", remote: "10.1.2.3:5000", xff: []string{"1.1.1.1", "203.0.113.9"}, want: "203.0.113.9"},
+        {name: "garbage stops the walk", remote: "10.1.2.3:5000", xff: []string{"203.0.113.9, not-an-ip, 10.9.9.9"}, want: "10.9.9.9"},
+        {name: "all trusted", remote: "10.1.2.3:5000", xff: []string{"10.4.4.4"}, want: "10.4.4.4"},
+        {name: "ipv6 proxy", remote: "[2001:db8::1]:5000", xff: []string{"2001:db8::42"}, want: "2001:db8::42"},
+        {name: "ipv6 untrusted", remote: "[2001:db8::2]:5000", xff: []string{"203.0.113.9"}, want: "2001:db8::2"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+            r.RemoteAddr = tc.remote
+            for _, h := range tc.xff {
+                r.Header.Add("X-Forwarded-For", h)
+            }
+            if got := l.ClientIP(r); got != tc.want {
+                t.Errorf("ClientIP = %s, want %s", got, tc.want)
+            }
+        })
+    }
+}
+
+func TestParseTrustedRejectsGarbage(t *testing.T) {
+    for _, s := range []string{"proxy", "10.0.0.0/33", "300.1.1.1"} {
+        if _, err := ParseTrusted([]string{s}); err == nil {
+            t.Errorf("%q accepted", s)
+        }
+    }
+}
+
+func TestAcquireCapsUnderConcurrency(t *testing.T) {
+    for _, tc := range []struct {
+        name            string
+        maxConns, perIP int
+        addrs           int
+        want            int
+    }{
+        {name: "total", maxConns: 7, addrs: 50, want: 7},
+        {name: "per address", perIP: 3, addrs: 4, want: 12},
+        {name: "both", maxConns: 10, perIP: 3, addrs: 5, want: 10},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            l := &Limiter{MaxConns: tc.maxConns, MaxPerIP: tc.perIP}
+            const attempts = 40 // per address
+            var (
+                admitted atomic.Int32
+                perAddr  = make([]atomic.Int32, tc.addrs)
+                mu       sync.Mutex
+                releases []func()
+                wg       sync.WaitGroup
+                start    = make(chan struct{})
+            )
+            for a := 0; a < tc.addrs; a++ {
+                for i := 0; i < attempts; i++ {
+                    wg.Add(1)
+                    go func(a int) {
+                        defer wg.Done()
+                        <-start
+                        release, err := l.Acquire(fmt.Sprintf("203.0.113.%d", a))
+                        if err != nil {
+                            var le *Error
+                            if !errors.As(err, &le) || le.RetryAfter <= 0 {
+                                t.Errorf("refusal %v has no retry hint", err)
+                            }
+                            return
+                        }
+                        admitted.Add(1)
+                        if tc.perIP > 0 && perAddr[a].Add(1) > int32(tc.perIP) {
+                            t.Errorf("address %d holds more than %d", a, tc.perIP)
+                        }
+                        mu.Lock()
+                        releases = append(releases, release)
+                        mu.Unlock()
+                    }(a)
+                }
+            }
+            close(start)
+            wg.Wait()
+            if n := admitted.Load(); n != int32(tc.want) {
+                t.Errorf("admitted %d, want %d", n, tc.want)
+            }
+
+            // Releasing frees the slots, once each.
+            for _, release := range releases {
+                release()
+                release()
+            }
+            for i := 0; i < tc.want; i++ {
+                if _, err := l.Acquire(fmt.Sprintf("203.0.113.%d", i%tc.addrs)); err != nil {
+                    t.Fatalf("after release: %v", err)
+                }
+            }
+            if _, err := l.Acquire("198.51.100.1"); tc.maxConns > 0 && err == nil {
+                t.Error("cap not held after releasing and refilling")
+            }
+        })
+    }
+}
+
+func TestAcquireRate(t *testing.T) {
+    l := &Limiter{PerMinute: 5}
+    for i := 0; i < 5; i++ {
+        release, err := l.Acquire("203.0.113.1")
+        if err != nil {
+            t.Fatalf("attempt %d: %v", i, err)
+        }
+        release()
+    }
+    _, err := l.Acquire("203.0.113.1")
+    var le *Error
+    if !errors.As(err, &le) || le.RetryAfter <= 0 || le.RetryAfter > 12e9 {
+        t.Fatalf("sixth attempt: %v", err)
+    }
+    if _, err := l.Acquire("203.0.113.2"); err != nil {
+        t.Errorf("another address is limited too: %v", err)
+    }
+}
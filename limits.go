@@ -0,0 +1,90 @@
+package main
+
+import (
+    "errors"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/limit"
+    "github.com/Cdaprod/hdmi-streaming-app/quota"
+)
+
+var (
+    limiter = &limit.Limiter{}
+    // meter counts the bytes sent to each token. Without tokens there is
+    // nothing to key it by and it is not used.
+    meter = &quota.Meter{}
+)
+
+// admit applies the connection limits to a viewer before anything is
+// sent. A refused request is answered with 429 and Retry-After and ok is
+// false; otherwise release must be called when the viewer leaves.
+func admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+    ip := limiter.ClientIP(r)
+    release, err := limiter.Acquire(ip)
+    var lerr *limit.Error
+    if errors.As(err, &lerr) {
+        secs := int((lerr.RetryAfter + time.Second - 1) / time.Second)
+        w.Header().Set("Retry-After", strconv.Itoa(secs))
+        http.Error(w, lerr.Error(), http.StatusTooManyRequests)
+        // Debug, since a script hammering the server would flood the log.
+        slog.Debug("connection refused", "remote", ip, "reason", lerr.Reason)
+        return nil, false
+    }
+    return release, true
+}
+
+// admitToken refuses a viewer whose token has used its daily budget with
+// 429 and a Retry-After of when the budget resets.
+func admitToken(w http.ResponseWriter, tok config.Token) bool {
+    if !authn.TokensRequired() {
+        return true
+    }
+    err := meter.Check(tok.ID)
+    var qerr *quota.Error
+    if !errors.As(err, &qerr) {
+        return true
+    }
+    secs := int((qerr.RetryAfter + time.Second - 1) / time.Second)
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+    slog.Debug("connection refused", "token", tok.ID, "reason", "quota exceeded")
+    return false
+}
+
+// charge counts n bytes sent to tok's viewers against its budget.
+func charge(tok config.Token, n int) error {
+    if !authn.TokensRequired() {
+        return nil
+    }
+    return meter.Add(tok.ID, n)
+}
+
+// chargeRequest returns what counts the bytes an output package sends in
+// reply to r against the budget of r's token, or nil without tokens.
+func chargeRequest(r *http.Request) func(n int) error {
+    if !authn.TokensRequired() {
+        return nil
+    }
+    tok, err := authn.Authenticate(r)
+    if err != nil {
+        return nil
+    }
+    return func(n int) error { return charge(tok, n) }
+}
+
+// meterRTSP is the rtsp.Meter for a client's token: PLAY is refused
+// while the token is over budget, and what it is sent is charged.
+func meterRTSP(password string) (func(n int) error, error) {
+    tok, err := authn.Verify(password)
+    if err != nil {
+        return nil, err
+    }
+    if err := meter.Check(tok.ID); err != nil {
+        return nil, err
+    }
+    return func(n int) error { return charge(tok, n) }, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hls"
+    "github.com/Cdaprod/hdmi-streaming-app/rtc"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// HLS, WebRTC and RTSP are served by packages of their own, which count
+// what they send through the hooks set here; the packages' tests show
+// the counting itself.
+func TestQuotaCoversEveryOutput(t *testing.T) {
+    c := config.Default()
+    for _, tok := range roleTokens {
+        c.Tokens = append(c.Tokens, tok)
+    }
+    c.TokenDailyBytes = 1000
+    setupServer(t, c)
+    st := addStream(t, "default", capture.NewSyntheticSource(160, 96, 10), nil)
+    st.HLS = hls.NewServer(st.Hub, "false", slog.Default())
+    st.HLS.Charge = chargeRequest
+    st.RTC = rtc.NewServer(st.Hub, "false", rtc.CodecH264, nil)
+    st.RTC.Charge = chargeRequest
+    mux := http.NewServeMux()
+    routes(mux, prometheus.NewRegistry())
+    srv := httptest.NewServer(mount(mux))
+    defer srv.Close()
+
+    // The operator has used the day's budget; the admin has some left.
+    meter.Add(roleTokens[config.RoleOperator].ID, 1000)
+    for _, tc := range []struct {
+        method, path, role string
+        status             int
+    }{
+        {"GET", "/hls/playlist.m3u8", config.RoleOperator, http.StatusTooManyRequests},
+        {"GET", "/hls/segment9.ts", config.RoleOperator, http.StatusTooManyRequests},
+        {"GET", "/hls/segment9.ts", config.RoleAdmin, http.StatusNotFound},
+        {"POST", "/webrtc/offer", config.RoleOperator, http.StatusTooManyRequests},
+        {"POST", "/webrtc/offer", config.RoleAdmin, http.StatusBadRequest},
+    } {
+        if code, body := call(t, srv, tc.method, tc.path, tc.role, "{}"); code != tc.status {
+            t.Errorf("%s %s as %s: %d %s, want %d", tc.method, tc.path, tc.role, code, body, tc.status)
+        }
+    }
+
+    // The admin's 404 was itself a reply, and counted.
+    base := usage(t, srv)["root"]
+    if base == 0 {
+        t.Error("HLS reply to the admin not charged")
+    }
+
+    rtsp := newRTSPServer()
+    if _, err := rtsp.Meter(roleTokens[config.RoleOperator].Secret); err == nil {
+        t.Error("RTSP PLAY allowed for a token over budget")
+    }
+    chargeRTSP, err := rtsp.Meter(roleTokens[config.RoleAdmin].Secret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := chargeRTSP(300); err != nil {
+        t.Fatal(err)
+    }
+    r := httptest.NewRequest("GET", "/hls/playlist.m3u8?token="+roleTokens[config.RoleAdmin].Secret, nil)
+    if err := chargeRequest(r)(700 - int(base)); err == nil {
+        t.Error("a charge taking the admin to its budget was allowed")
+    }
+
+    // What HLS, WebRTC and RTSP send shows in the token's usage.
+    if used := usage(t, srv); used["root"] != 1000 || used["ops"] != 1000 {
+        t.Errorf("usage %v, want 1000 bytes for root and ops", used)
+    }
+}
+
+// usage returns the bytes each token has used today, from /api/clients.
+func usage(t *testing.T, srv *httptest.Server) map[string]int64 {
+    t.Helper()
+    code, body := call(t, srv, "GET", "/api/clients", config.RoleAdmin, "")
+    var resp clientsResponse
+    if err := json.Unmarshal([]byte(body), &resp); err != nil || code != http.StatusOK {
+        t.Fatalf("/api/clients: %d %v", code, err)
+    }
+    used := map[string]int64{}
+    for _, u := range resp.Tokens {
+        used[u.Token] = u.Bytes
+    }
+    return used
+}
@@ -1,35 +1,436 @@
 package main
 
 import (
+    "context"
+    "flag"
     "fmt"
-    "log"
+    "log/slog"
+    "net"
     "net/http"
-    "github.com/gorilla/websocket"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sync"
+    "syscall"
+
+    "github.com/Cdaprod/hdmi-streaming-app/audit"
+    "github.com/Cdaprod/hdmi-streaming-app/auth"
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/composite"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/discovery"
+    "github.com/Cdaprod/hdmi-streaming-app/encode"
+    "github.com/Cdaprod/hdmi-streaming-app/hls"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/limit"
+    "github.com/Cdaprod/hdmi-streaming-app/metrics"
+    "github.com/Cdaprod/hdmi-streaming-app/motion"
+    "github.com/Cdaprod/hdmi-streaming-app/overlay"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+    "github.com/Cdaprod/hdmi-streaming-app/rollup"
+    "github.com/Cdaprod/hdmi-streaming-app/rtc"
+    "github.com/Cdaprod/hdmi-streaming-app/rtsp"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+    "github.com/Cdaprod/hdmi-streaming-app/web"
+    "github.com/pion/webrtc/v3"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var upgrader = websocket.Upgrader{}
+var cfg config.Config
 
-func streamHandler(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        log.Print("Upgrade:", err)
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "discover" {
+        os.Exit(discoverCommand(os.Args[2:]))
+    }
+    var err error
+    cfg, err = config.Load(os.Args[1:], os.LookupEnv)
+    if err == flag.ErrHelp {
         return
     }
-    defer conn.Close()
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel})))
+    if cfg.SelfTest {
+        os.Exit(selfTest())
+    }
+    slog.Info("effective config", "config", cfg.String())
+
+    authn = auth.New(cfg.Tokens, cfg.AllowedOrigins)
+    // Behind a trusted proxy, same-origin means the host the browser
+    // used, not the one the proxy asked for.
+    authn.Host = func(r *http.Request) string {
+        _, host := limiter.Origin(r)
+        return host
+    }
+    upgrader.CheckOrigin = authn.CheckOrigin
+    if !authn.TokensRequired() {
+        slog.Warn("no access tokens configured; the stream is open to anyone who can reach it")
+    }
+    limiter, err = limit.New(cfg.MaxConnections, cfg.MaxPerIP, cfg.ConnectRate, cfg.TrustedProxies)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    meter.Default = cfg.TokenDailyBytes
+    meter.Budgets = map[string]int64{}
+    for _, t := range cfg.Tokens {
+        if t.DailyBytes > 0 {
+            meter.Budgets[t.ID] = t.DailyBytes
+        }
+    }
+    auditLog, err = audit.Open(cfg.AuditLog)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    defer auditLog.Close()
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // Capture loops get their own context: it is cancelled only after
+    // every writer has stopped, so a device is never closed under one.
+    captureCtx, stopCapture := context.WithCancel(context.Background())
+    var capturing sync.WaitGroup
+    reg := prometheus.NewRegistry()
+    reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+        Name: "frame_buffers_in_use",
+        Help: "Pooled frame buffers held by capture, the hubs and their clients.",
+    }, func() float64 { return float64(capture.BuffersInUse()) }))
+    codec, err := rtc.DetectCodec(cfg.FFmpegPath)
+    if err != nil {
+        slog.Warn("webrtc disabled", "err", err)
+    } else {
+        slog.Info("webrtc enabled", "codec", codec)
+    }
+    if err := startStreams(captureCtx, &capturing, metrics.New(reg), codec); err != nil {
+        slog.Error("stream setup failed", "err", err)
+        os.Exit(1)
+    }
+    startSinks(captureCtx)
+    statsStore, err = rollup.Open(cfg.StatsFile, cfg.StatsRetention)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    defer statsStore.Close()
+    go recordStats(ctx)
+
+    mux := http.NewServeMux()
+    routes(mux, reg)
+
+    // Request contexts derive from ctx, so streaming handlers see the
+    // signal directly.
+    srv := &http.Server{
+        Addr:        cfg.ListenAddr,
+        Handler:     mount(mux),
+        BaseContext: func(net.Listener) context.Context { return ctx },
+    }
+    redirect, err := configureTLS(srv)
+    if err != nil {
+        slog.Error("tls setup failed", "err", err)
+        os.Exit(1)
+    }
+    go func() {
+        if err := listen(srv); err != nil && err != http.ErrServerClosed {
+            slog.Error("server failed", "err", err)
+            os.Exit(1)
+        }
+    }()
+    if redirect != nil {
+        go func() {
+            if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                slog.Error("redirect listener failed", "err", err)
+                os.Exit(1)
+            }
+        }()
+        slog.Info("redirecting plain HTTP to HTTPS", "addr", cfg.RedirectAddr)
+    }
+    var rtspSrv *rtsp.Server
+    if cfg.RTSPAddr != "" {
+        rtspSrv = newRTSPServer()
+        go func() {
+            if err := rtspSrv.ListenAndServe(cfg.RTSPAddr); err != nil {
+                slog.Error("rtsp server failed", "err", err)
+                os.Exit(1)
+            }
+        }()
+        slog.Info("rtsp server started", "addr", cfg.RTSPAddr, "path", "/"+rtsp.DefaultPath)
+    }
+    slog.Info("server started", "addr", cfg.ListenAddr, "tls", cfg.TLS(), "base_path", cfg.BasePath)
+    var adv *discovery.Advertiser
+    if cfg.MDNS {
+        adv = advertise()
+    }
+
+    <-ctx.Done()
+    stop()
+    slog.Info("shutting down", "grace", cfg.ShutdownGrace)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+    defer cancel()
+    if redirect != nil {
+        redirect.Shutdown(shutdownCtx)
+    }
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        slog.Warn("http shutdown incomplete", "err", err)
+    }
+    if rtspSrv != nil {
+        rtspSrv.Close()
+    }
+    if adv != nil {
+        adv.Close()
+    }
+    drain(shutdownCtx, stopCapture, &capturing)
+}
 
-    // Streaming logic goes here, such as capturing frames from the capture card
-    for {
-        message := []byte("Video frame data")
-        err := conn.WriteMessage(websocket.TextMessage, message)
+// routes registers the server's endpoints on mux, with reg's metrics at
+// /metrics.
+func routes(mux *http.ServeMux, reg *prometheus.Registry) {
+    // Each route serves the default stream bare and a named one under
+    // /route/{stream}.
+    for _, route := range []struct {
+        path string
+        h    http.HandlerFunc
+    }{
+        {"/ws", streamHandler},
+        {"/stream.mjpeg", mjpegHandler},
+        {"/snapshot", withCORS(snapshotHandler)},
+        {"/webrtc/offer", api(http.MethodPost, config.RoleOperator, webrtcHandler)},
+    } {
+        mux.HandleFunc(route.path, route.h)
+        mux.HandleFunc(route.path+"/", route.h)
+    }
+    mux.HandleFunc("/ws/replay/", playbackHandler)
+    mux.HandleFunc("/hls/", withCORS(hlsHandler))
+    mux.HandleFunc("/stats", statsHandler)
+    // Health checks come from orchestrators without tokens and reveal
+    // only whether the devices work.
+    mux.HandleFunc("/healthz", healthzHandler)
+    mux.HandleFunc("/readyz", readyzHandler)
+    // API routes name the least token role that may call them. Viewer
+    // tokens may only watch, over /ws, and take snapshots.
+    mux.HandleFunc("/api/streams", api(http.MethodGet, config.RoleOperator, streamsHandler))
+    mux.HandleFunc("/api/streams/", apiMethods(map[string]apiHandler{
+        http.MethodGet:  {config.RoleOperator, layoutGetHandler},
+        http.MethodPost: {config.RoleOperator, layoutPostHandler},
+    }))
+    mux.HandleFunc("/api/recordings", api(http.MethodGet, config.RoleOperator, recordingsHandler))
+    mux.HandleFunc("/api/stats", api(http.MethodGet, config.RoleOperator, statsHistoryHandler))
+    mux.HandleFunc("/api/clients", api(http.MethodGet, config.RoleOperator, clientsHandler))
+    mux.HandleFunc("/api/clients/", api(http.MethodDelete, config.RoleAdmin, clientDeleteHandler))
+    mux.HandleFunc("/api/record/start", api(http.MethodPost, config.RoleOperator, recordStartHandler))
+    mux.HandleFunc("/api/record/stop", api(http.MethodPost, config.RoleOperator, recordStopHandler))
+    mux.HandleFunc("/api/record/status", api(http.MethodGet, config.RoleOperator, recordStatusHandler))
+    mux.HandleFunc("/api/overlay", apiMethods(map[string]apiHandler{
+        http.MethodGet:  {config.RoleOperator, overlayGetHandler},
+        http.MethodPost: {config.RoleOperator, overlayPostHandler},
+    }))
+    mux.HandleFunc("/api/sinks", api(http.MethodGet, config.RoleOperator, sinksHandler))
+    mux.HandleFunc("/api/sinks/", api(http.MethodPost, config.RoleOperator, sinkControlHandler))
+    mux.HandleFunc("/api/device/controls", apiMethods(map[string]apiHandler{
+        http.MethodGet:  {config.RoleAdmin, controlsGetHandler},
+        http.MethodPost: {config.RoleAdmin, controlsPostHandler},
+    }))
+    mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+    // The viewer page holds no secrets; it passes the ?token= it was
+    // opened with on to the websocket.
+    mux.Handle("/", web.Handler())
+}
+
+// drain stops everything that takes frames from the hubs, giving
+// websocket clients until ctx is done to finish, and only then the
+// capture loops, so no device is closed under a writer.
+func drain(ctx context.Context, stopCapture context.CancelFunc, capturing *sync.WaitGroup) {
+    if err := wait(ctx, &wsConns); err != nil {
+        slog.Warn("websocket clients still open", "err", err)
+    }
+    stopSinks()
+    for _, st := range streams.All() {
+        if st.RTC != nil {
+            st.RTC.Close()
+        }
+        if st.HLS != nil {
+            st.HLS.Close()
+        }
+        if _, err := st.Recorder.Stop(); err == nil {
+            slog.Info("stopped recording", "stream", st.Name)
+        }
+    }
+    stopCapture()
+    capturing.Wait()
+}
+
+// captureSource is a device whose mode can be changed, as every source
+// a stream captures from is.
+type captureSource interface {
+    capture.CaptureSource
+    capture.ModeSetter
+}
+
+// newSource returns the source for sc's device: the two streams drawn
+// together for a composite, generated frames for a synthetic device, in
+// the mode it names or else the stream's, and V4L2 for anything else.
+func newSource(sc config.Stream) (captureSource, error) {
+    if sc.Composite != nil {
+        src := composite.New(*sc.Composite, sc.Width, sc.Height)
+        src.Lookup = func(name string) (*hub.Hub, bool) {
+            st, ok := streams.Get(name)
+            if !ok {
+                return nil, false
+            }
+            return st.Hub, true
+        }
+        return src, nil
+    }
+    m, ok, err := capture.ParseSynthetic(sc.Device)
+    switch {
+    case err != nil:
+        return nil, err
+    case !ok:
+        return capture.NewV4L2Source(sc.Width, sc.Height, sc.FPS), nil
+    case m.Width == 0:
+        m.Width, m.Height = sc.Width, sc.Height
+    }
+    if m.FPS == 0 {
+        m.FPS = sc.FPS
+    }
+    return capture.NewSyntheticSource(m.Width, m.Height, m.FPS), nil
+}
+
+// startStreams builds a hub for every configured stream, registers it and
+// starts its capture loop on ctx. An empty codec leaves WebRTC off. The
+// loops start once every stream is registered, so a composite finds the
+// streams it is made of wherever they are listed.
+func startStreams(ctx context.Context, wg *sync.WaitGroup, set *metrics.Set, codec rtc.Codec) error {
+    list := cfg.StreamList()
+    var started []*stream.Stream
+    for _, sc := range list {
+        src, err := newSource(sc)
         if err != nil {
-            log.Println("WriteMessage:", err)
-            break
+            return fmt.Errorf("stream %s: %w", sc.Name, err)
+        }
+        device := sc.Device
+        if c := sc.Composite; c != nil {
+            device = "composite:" + c.Base + "+" + c.Inset
         }
+        m := set.Stream(sc.Name)
+        h := hub.New(src, device, m)
+        h.SetQuality(sc.JPEGQuality)
+        h.Workers = sc.EncodeWorkers
+        if cfg.Encoder == config.EncoderH264 {
+            if enc, err := encode.NewV4L2H264(encode.H264Options{
+                Device:           cfg.H264Device,
+                KeyframeInterval: cfg.KeyframeEvery,
+                Bitrate:          cfg.H264Bitrate,
+            }); err != nil {
+                slog.Warn("hardware H.264 encoder unavailable, sending JPEG", "stream", sc.Name, "device", cfg.H264Device, "err", err)
+            } else {
+                h.Encoder = enc
+            }
+        }
+        h.Overlay = overlay.New(sc.Name, *sc.Overlay)
+        setStills(sc, &h.Startup, &h.Offline)
+        h.OnDemand = cfg.OnDemand
+        h.FrozenFrames = cfg.FrozenFrames
+        h.IdleTimeout = cfg.IdleTimeout
+        if cfg.ReplayWindow > 0 {
+            h.HistoryBytes = cfg.ReplayBytes
+            h.HistoryAge = cfg.ReplayWindow
+        }
+        if sc.AudioDevice != "" {
+            h.Audio = capture.NewALSASource(sc.AudioRate, sc.AudioChannels)
+            h.AudioDevice = sc.AudioDevice
+        }
+        // With several streams each records into its own directory.
+        dir := cfg.RecordDir
+        if len(list) > 1 {
+            dir = filepath.Join(dir, sc.Name)
+        }
+        st := &stream.Stream{
+            Name:     sc.Name,
+            Config:   sc,
+            Hub:      h,
+            Recorder: record.New(h, dir, cfg.RecordSegment),
+            Controls: capture.NewControlSet(sc.Device),
+            Source:   src,
+            Metrics:  m,
+        }
+        st.Composite, _ = src.(*composite.Source)
+        // A card that was unplugged comes back with its defaults.
+        h.OnReattach = func() {
+            if err := st.Controls.Reapply(); err != nil {
+                slog.Warn("device controls not restored", "stream", st.Name, "err", err)
+            }
+        }
+        // WebRTC and HLS transcode the hub's JPEGs.
+        if codec != "" && st.JPEG() {
+            st.RTC = rtc.NewServer(h, cfg.FFmpegPath, codec, iceServers(cfg.ICEServers))
+            st.RTC.Charge = chargeRequest
+        }
+        if codec == rtc.CodecH264 && st.JPEG() {
+            st.HLS = hls.NewServer(h, cfg.FFmpegPath, slog.With("stream", sc.Name))
+            st.HLS.Charge = chargeRequest
+        }
+        if err := streams.Add(st); err != nil {
+            return err
+        }
+        if cfg.RecordPrebuffer > 0 {
+            st.Recorder.Prebuffer = record.NewPrebuffer(h, cfg.RecordPrebuffer, cfg.PrebufferBytes, cfg.RecordFPS)
+            go st.Recorder.Prebuffer.Run(ctx)
+        }
+        if cfg.MotionWebhook != "" {
+            opts := motion.Options{
+                Stream:    sc.Name,
+                Webhook:   cfg.MotionWebhook,
+                Threshold: cfg.MotionThreshold,
+                Frames:    cfg.MotionFrames,
+                Cooldown:  cfg.MotionCooldown,
+                SampleFPS: cfg.MotionFPS,
+            }
+            if cfg.MotionClip {
+                rec := st.Recorder
+                opts.Clip = func() (string, error) { return rec.SaveClip("motion") }
+            }
+            d := motion.New(h, opts)
+            go d.Run(ctx)
+        }
+        started = append(started, st)
+        slog.Info("stream configured", "stream", sc.Name, "device", device, "video", st.Video())
+    }
+    for _, st := range started {
+        wg.Add(1)
+        go func(st *stream.Stream) {
+            defer wg.Done()
+            if err := st.Hub.Run(ctx); err != nil {
+                slog.Error("capture stopped", "stream", st.Name, "err", err)
+            }
+        }(st)
     }
+    return nil
 }
 
-func main() {
-    http.HandleFunc("/ws", streamHandler)
-    fmt.Println("Server started at :8080")
-    log.Fatal(http.ListenAndServe(":8080", nil))
-}
\ No newline at end of file
+func iceServers(list []config.ICEServer) []webrtc.ICEServer {
+    out := make([]webrtc.ICEServer, len(list))
+    for i, s := range list {
+        out[i] = webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential}
+    }
+    return out
+}
+
+// wait blocks until wg is done or ctx expires.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "context"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/auth"
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/limit"
+    "github.com/Cdaprod/hdmi-streaming-app/overlay"
+    "github.com/Cdaprod/hdmi-streaming-app/quota"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+)
+
+// The server keeps its state in package variables, so tests that use it
+// do not run in parallel.
+
+// setupServer resets the server's state for c, with no streams.
+func setupServer(t *testing.T, c config.Config) {
+    t.Helper()
+    // Handlers of the last test may still be finishing with the state
+    // this one is about to replace.
+    wsConns.Wait()
+    t.Cleanup(wsConns.Wait)
+    cfg = c
+    authn = auth.New(c.Tokens, c.AllowedOrigins)
+    upgrader.CheckOrigin = authn.CheckOrigin
+    var err error
+    limiter, err = limit.New(c.MaxConnections, c.MaxPerIP, c.ConnectRate, c.TrustedProxies)
+    if err != nil {
+        t.Fatal(err)
+    }
+    meter = &quota.Meter{Default: c.TokenDailyBytes}
+    streams = stream.NewRegistry()
+    viewers = viewerSet{}
+    sinks = nil
+    auditLog = nil
+}
+
+// addStream registers a stream named name capturing from src, with
+// configure applied to its hub, without starting it.
+func addStream(t *testing.T, name string, src capture.CaptureSource, configure func(*hub.Hub)) *stream.Stream {
+    t.Helper()
+    sc := cfg.StreamList()[0]
+    sc.Name, sc.Device = name, "synthetic:"+name
+    h := hub.New(src, sc.Device, nil)
+    h.Overlay = overlay.New(name, *sc.Overlay)
+    if configure != nil {
+        configure(h)
+    }
+    st := &stream.Stream{Name: name, Config: sc, Hub: h, Recorder: record.New(h, t.TempDir(), time.Minute)}
+    if err := streams.Add(st); err != nil {
+        t.Fatal(err)
+    }
+    return st
+}
+
+// startStream is addStream, with the hub running until the test ends.
+func startStream(t *testing.T, name string, src capture.CaptureSource, configure func(*hub.Hub)) *stream.Stream {
+    t.Helper()
+    st := addStream(t, name, src, configure)
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        st.Hub.Run(ctx)
+    }()
+    t.Cleanup(func() {
+        cancel()
+        <-done
+    })
+    return st
+}
+
+// wsURL is srv's address for a websocket path.
+func wsURL(srv *httptest.Server, path string) string {
+    return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
@@ -0,0 +1,174 @@
+// Package metrics defines the Prometheus instruments for stream health.
+package metrics
+
+import (
+    "github.com/prometheus/client_golang/prometheus"
+    dto "github.com/prometheus/client_model/go"
+)
+
+// StreamLabel distinguishes the instruments of each configured stream.
+const StreamLabel = "stream"
+
+// Metrics is the set of instruments updated by one stream's hub and
+// capture loop.
+type Metrics struct {
+    ConnectedClients prometheus.Gauge
+    FramesCaptured   prometheus.Counter
+    FramesSent       prometheus.Counter
+    FramesDropped    prometheus.Counter
+    // FramesEncodeDropped counts raw frames the encoder had no room for.
+    FramesEncodeDropped prometheus.Counter
+    CaptureErrors       prometheus.Counter
+    BytesSent           prometheus.Counter
+    CurrentFPS          prometheus.Gauge
+    EncodeDuration      prometheus.Observer
+    // SignalPresent is 1 while the device has an input signal.
+    SignalPresent prometheus.Gauge
+    // DevicePresent is 1 unless the device has gone away, and
+    // DeviceLost counts the times it has.
+    DevicePresent prometheus.Gauge
+    DeviceLost    prometheus.Counter
+}
+
+// Set holds the labelled instruments shared by every stream.
+type Set struct {
+    connectedClients    *prometheus.GaugeVec
+    framesCaptured      *prometheus.CounterVec
+    framesSent          *prometheus.CounterVec
+    framesDropped       *prometheus.CounterVec
+    framesEncodeDropped *prometheus.CounterVec
+    captureErrors       *prometheus.CounterVec
+    bytesSent           *prometheus.CounterVec
+    currentFPS          *prometheus.GaugeVec
+    encodeDuration      *prometheus.HistogramVec
+    signalPresent       *prometheus.GaugeVec
+    devicePresent       *prometheus.GaugeVec
+    deviceLost          *prometheus.CounterVec
+}
+
+// New creates the instruments and registers them with reg. A nil reg
+// leaves them unregistered, which is useful when nothing scrapes them.
+func New(reg prometheus.Registerer) *Set {
+    labels := []string{StreamLabel}
+    s := &Set{
+        connectedClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "connected_clients",
+            Help: "Subscribers currently receiving frames.",
+        }, labels),
+        framesCaptured: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "frames_captured_total",
+            Help: "Frames read from the capture device.",
+        }, labels),
+        framesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "frames_sent_total",
+            Help: "Frames written to clients.",
+        }, labels),
+        framesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "frames_dropped_total",
+            Help: "Frames discarded because a subscriber fell behind.",
+        }, labels),
+        framesEncodeDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "frames_encode_dropped_total",
+            Help: "Raw frames discarded because the encoder queue was full.",
+        }, labels),
+        captureErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "capture_errors_total",
+            Help: "Errors returned by the capture device.",
+        }, labels),
+        bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "bytes_sent_total",
+            Help: "Payload bytes written to clients.",
+        }, labels),
+        currentFPS: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "current_fps",
+            Help: "Capture frame rate over the last second.",
+        }, labels),
+        encodeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "encode_duration_seconds",
+            Help:    "Time spent rescaling and compressing a frame.",
+            Buckets: prometheus.ExponentialBuckets(0.001, 2, 10),
+        }, labels),
+        signalPresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "signal_present",
+            Help: "1 while the capture device has an input signal, 0 while it shows the no-signal placeholder.",
+        }, labels),
+        devicePresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "device_present",
+            Help: "0 while the capture device has gone away and is waited for, 1 otherwise.",
+        }, labels),
+        deviceLost: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "device_lost_total",
+            Help: "Times the capture device went away while open.",
+        }, labels),
+    }
+    if reg != nil {
+        reg.MustRegister(
+            s.connectedClients,
+            s.framesCaptured,
+            s.framesSent,
+            s.framesDropped,
+            s.framesEncodeDropped,
+            s.captureErrors,
+            s.bytesSent,
+            s.currentFPS,
+            s.encodeDuration,
+            s.signalPresent,
+            s.devicePresent,
+            s.deviceLost,
+        )
+    }
+    return s
+}
+
+// Stream returns the instruments labelled with the stream's name.
+func (s *Set) Stream(name string) *Metrics {
+    return &Metrics{
+        ConnectedClients:    s.connectedClients.WithLabelValues(name),
+        FramesCaptured:      s.framesCaptured.WithLabelValues(name),
+        FramesSent:          s.framesSent.WithLabelValues(name),
+        FramesDropped:       s.framesDropped.WithLabelValues(name),
+        FramesEncodeDropped: s.framesEncodeDropped.WithLabelValues(name),
+        CaptureErrors:       s.captureErrors.WithLabelValues(name),
+        BytesSent:           s.bytesSent.WithLabelValues(name),
+        CurrentFPS:          s.currentFPS.WithLabelValues(name),
+        EncodeDuration:      s.encodeDuration.WithLabelValues(name),
+        SignalPresent:       s.signalPresent.WithLabelValues(name),
+        DevicePresent:       s.devicePresent.WithLabelValues(name),
+        DeviceLost:          s.deviceLost.WithLabelValues(name),
+    }
+}
+
+// Reading is the current value of a stream's instruments, for keeping a
+// history of them without Prometheus.
+type Reading struct {
+    FPS           float64
+    Clients       int
+    BytesSent     uint64
+    FramesDropped uint64
+    CaptureErrors uint64
+    Signal        bool
+}
+
+// Read returns the current values.
+func (m *Metrics) Read() Reading {
+    return Reading{
+        FPS:           value(m.CurrentFPS),
+        Clients:       int(value(m.ConnectedClients)),
+        BytesSent:     uint64(value(m.BytesSent)),
+        FramesDropped: uint64(value(m.FramesDropped)),
+        CaptureErrors: uint64(value(m.CaptureErrors)),
+        Signal:        value(m.SignalPresent) == 1,
+    }
+}
+
+// value returns a counter's or gauge's current value.
+func value(c prometheus.Metric) float64 {
+    var m dto.Metric
+    if err := c.Write(&m); err != nil {
+        return 0
+    }
+    if m.Counter != nil {
+        return m.Counter.GetValue()
+    }
+    return m.Gauge.GetValue()
+}
@@ -0,0 +1,97 @@
+package metrics_test
+
+import (
+    "bufio"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/metrics"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape fetches reg's exposition and returns each sample's value by its
+// name and labels as written, such as `frames_sent_total{stream="a"}`.
+func scrape(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+    if rec.Code != 200 {
+        t.Fatalf("scrape: status %d", rec.Code)
+    }
+    samples := map[string]float64{}
+    sc := bufio.NewScanner(rec.Body)
+    for sc.Scan() {
+        line := sc.Text()
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        i := strings.LastIndexByte(line, ' ')
+        v, err := strconv.ParseFloat(line[i+1:], 64)
+        if err != nil {
+            t.Fatalf("sample %q: %v", line, err)
+        }
+        samples[line[:i]] = v
+    }
+    return samples
+}
+
+func TestScrapeAfterSyntheticFrames(t *testing.T) {
+    reg := prometheus.NewRegistry()
+    set := metrics.New(reg)
+    src := capture.NewSyntheticSource(160, 96, 1000)
+    if err := src.Open("synthetic"); err != nil {
+        t.Fatal(err)
+    }
+    defer src.Close()
+    h := hub.New(src, "synthetic", set.Stream("cam"))
+    // Another stream's instruments are labelled apart.
+    hub.New(nil, "other", set.Stream("other"))
+
+    reader := h.Subscribe(100)
+    stuck := h.Subscribe(2)
+    const frames = 10
+    var bytes int
+    for i := 0; i < frames; i++ {
+        f, err := src.ReadFrame()
+        if err != nil {
+            t.Fatal(err)
+        }
+        h.Publish(f)
+        got := <-reader.Frames()
+        reader.Sent(len(got.Data))
+        bytes += len(got.Data)
+        got.Release()
+    }
+
+    samples := scrape(t, reg)
+    for name, want := range map[string]float64{
+        `connected_clients{stream="cam"}`:       2,
+        `frames_captured_total{stream="cam"}`:   frames,
+        `frames_sent_total{stream="cam"}`:       frames,
+        `bytes_sent_total{stream="cam"}`:        float64(bytes),
+        `frames_dropped_total{stream="cam"}`:    frames - 2,
+        `capture_errors_total{stream="cam"}`:    0,
+        `frames_captured_total{stream="other"}`: 0,
+        `connected_clients{stream="other"}`:     0,
+    } {
+        got, ok := samples[name]
+        if !ok {
+            t.Errorf("%s missing from the scrape", name)
+            continue
+        }
+        if got != want {
+            t.Errorf("%s = %v, want %v", name, got, want)
+        }
+    }
+
+    h.Unsubscribe(reader)
+    h.Unsubscribe(stuck)
+    if got := scrape(t, reg)[`connected_clients{stream="cam"}`]; got != 0 {
+        t.Errorf("connected_clients after unsubscribing = %v, want 0", got)
+    }
+}
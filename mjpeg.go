@@ -0,0 +1,125 @@
+package main
+
+import (
+    "context"
+    "log/slog"
+    "mime/multipart"
+    "net/http"
+    "net/textproto"
+    "strconv"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+const mjpegBoundary = "frame"
+
+// mjpegHandler serves the stream as multipart/x-mixed-replace so it can be
+// used from an <img> tag or VLC. ?fps= caps the rate for this client.
+func mjpegHandler(w http.ResponseWriter, r *http.Request) {
+    tok, err := authn.Authenticate(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    if !permit(w, tok, config.RoleOperator) {
+        return
+    }
+    st, ok := streamFor(w, r, "/stream.mjpeg")
+    if !ok {
+        return
+    }
+    if !st.JPEG() {
+        http.Error(w, "stream is H.264; use the websocket viewer", http.StatusConflict)
+        return
+    }
+    if !admitToken(w, tok) {
+        return
+    }
+    release, ok := admit(w, r)
+    if !ok {
+        return
+    }
+    defer release()
+    frames := st.Hub
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    fps, ok := parseFPS(r.URL.Query(), cfg.MJPEGFPS)
+    if !ok {
+        http.Error(w, "invalid fps", http.StatusBadRequest)
+        return
+    }
+
+    // Nothing comes back from an MJPEG viewer, so only the session's
+    // maximum duration applies; ending it just ends the response.
+    ctx, cancel := context.WithCancel(r.Context())
+    defer cancel()
+    id := newConnID()
+    sess := newSession(false, func(code int, reason string) {
+        slog.Info("ending session", "conn", id, "stream", st.Name, "remote", r.RemoteAddr, "reason", reason)
+        cancel()
+    })
+    go sess.watch(ctx)
+
+    sub := frames.SubscribeViewer(hub.DefaultBuffer)
+    sub.SetFPS(fps)
+    defer frames.Unsubscribe(sub)
+    defer viewers.add(&viewer{
+        id:        id,
+        kind:      viewerMJPEG,
+        stream:    st.Name,
+        remote:    limiter.ClientIP(r),
+        token:     tok.ID,
+        connected: time.Now(),
+        sub:       sub,
+        session:   sess,
+    })()
+
+    mw := multipart.NewWriter(w)
+    mw.SetBoundary(mjpegBoundary)
+    w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+    w.Header().Set("Cache-Control", "no-cache, no-store")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case f, ok := <-sub.Frames():
+            if !ok {
+                return
+            }
+            data, err := frames.Render(f, protocol.Params{})
+            if err != nil {
+                f.Release()
+                slog.Warn("encode failed", "stream", st.Name, "remote", r.RemoteAddr, "seq", f.Seq, "err", err)
+                continue
+            }
+            part, err := mw.CreatePart(textproto.MIMEHeader{
+                "Content-Type":   {"image/jpeg"},
+                "Content-Length": {strconv.Itoa(len(data))},
+            })
+            if err == nil {
+                _, err = part.Write(data)
+            }
+            f.Release()
+            if err != nil {
+                return
+            }
+            flusher.Flush()
+            sub.Sent(len(data))
+            // There is no close frame to explain with; the response
+            // just ends.
+            if err := charge(tok, len(data)); err != nil {
+                slog.Info("token used its daily byte budget, closing", "stream", st.Name, "remote", r.RemoteAddr, "token", tok.ID)
+                return
+            }
+        }
+    }
+}
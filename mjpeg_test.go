@@ -0,0 +1,60 @@
+package main
+
+import (
+    "bytes"
+    "image/jpeg"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+func TestMJPEGParts(t *testing.T) {
+    setupServer(t, config.Default())
+    startStream(t, "default", capture.NewSyntheticSource(320, 180, 30), nil)
+    srv := httptest.NewServer(http.HandlerFunc(mjpegHandler))
+    defer srv.Close()
+
+    resp, err := http.Get(srv.URL + "/stream.mjpeg")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("status %s", resp.Status)
+    }
+    mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if mediaType != "multipart/x-mixed-replace" || params["boundary"] != mjpegBoundary {
+        t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+    }
+
+    mr := multipart.NewReader(resp.Body, params["boundary"])
+    for i := 0; i < 2; i++ {
+        part, err := mr.NextPart()
+        if err != nil {
+            t.Fatalf("part %d: %v", i, err)
+        }
+        if ct := part.Header.Get("Content-Type"); ct != "image/jpeg" {
+            t.Errorf("part %d: Content-Type = %q, want image/jpeg", i, ct)
+        }
+        data, err := io.ReadAll(part)
+        if err != nil {
+            t.Fatalf("part %d: %v", i, err)
+        }
+        if n, err := strconv.Atoi(part.Header.Get("Content-Length")); err != nil || n != len(data) {
+            t.Errorf("part %d: Content-Length %q for %d bytes", i, part.Header.Get("Content-Length"), len(data))
+        }
+        if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+            t.Errorf("part %d: %v", i, err)
+        }
+    }
+}
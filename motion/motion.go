@@ -0,0 +1,228 @@
+// Package motion watches a stream for changes in the picture and reports
+// them to a webhook.
+//
+// The detector is one more hub subscriber. It looks at a few frames a
+// second, on goroutines of its own, so viewers are never kept waiting
+// for it; frames it has no time for are skipped, not queued.
+package motion
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "image"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+const (
+    // ThumbnailWidth is the width of the JPEG sent with each event.
+    ThumbnailWidth   = 160
+    thumbnailQuality = 70
+    // webhookTimeout bounds each POST.
+    webhookTimeout = 10 * time.Second
+    // eventQueue is how many events may wait for a slow webhook before
+    // new ones are dropped.
+    eventQueue = 16
+    // resubscribeDelay is how long the detector waits before watching a
+    // hub again after it closed the subscription.
+    resubscribeDelay = time.Second
+)
+
+// Event names.
+const (
+    EventStarted = "motion_started"
+    EventEnded   = "motion_ended"
+)
+
+// Options configure a Detector.
+type Options struct {
+    // Stream names the stream in events.
+    Stream string
+    // Webhook is the URL each event is POSTed to as JSON.
+    Webhook string
+    // Threshold is the score, from 0 for an unchanged picture to 1, over
+    // which a frame counts as changed.
+    Threshold float64
+    // Frames is how many sampled frames in a row must be over Threshold
+    // for motion to start.
+    Frames int
+    // Cooldown is how long the picture must stay under Threshold for
+    // motion to end.
+    Cooldown time.Duration
+    // SampleFPS is how many frames a second are scored.
+    SampleFPS int
+    // Clip, when set, saves the frames before a motion_started event,
+    // returning the ID of the recording they went to.
+    Clip func() (string, error)
+}
+
+// Event is the body POSTed to the webhook. Thumbnail is a base64 JPEG of
+// the frame that caused the event, and Clip, on a motion_started event
+// when clips are saved, the ID of the recording of the seconds before.
+type Event struct {
+    Event     string    `json:"event"`
+    Stream    string    `json:"stream"`
+    Timestamp time.Time `json:"timestamp"`
+    Score     float64   `json:"score"`
+    Thumbnail string    `json:"thumbnail"`
+    Clip      string    `json:"clip,omitempty"`
+}
+
+// Detector scores a hub's frames and posts an event when motion starts
+// and when it ends.
+type Detector struct {
+    hub    *hub.Hub
+    opts   Options
+    log    *slog.Logger
+    client *http.Client
+    events chan Event
+}
+
+// New returns a detector for h. It does nothing until Run.
+func New(h *hub.Hub, opts Options) *Detector {
+    return &Detector{
+        hub:    h,
+        opts:   opts,
+        log:    slog.With("stream", opts.Stream),
+        client: &http.Client{Timeout: webhookTimeout},
+        events: make(chan Event, eventQueue),
+    }
+}
+
+// Run watches the hub until ctx is done. As a subscriber it keeps an
+// on-demand device open.
+func (d *Detector) Run(ctx context.Context) {
+    if d.hub.OutputFormat() != capture.FormatMJPEG {
+        d.log.Warn("motion detection needs a JPEG stream, not running")
+        return
+    }
+    go d.notify(ctx)
+    sampled := make(chan *hub.Frame, 1)
+    defer close(sampled)
+    go d.analyse(sampled)
+    for {
+        d.watch(ctx, sampled)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(resubscribeDelay):
+        }
+    }
+}
+
+// watch passes frames from one subscription to the analyser, at most
+// SampleFPS a second and only when it is free for them.
+func (d *Detector) watch(ctx context.Context, sampled chan<- *hub.Frame) {
+    sub := d.hub.Subscribe(hub.DefaultBuffer)
+    defer d.hub.Unsubscribe(sub)
+    interval := time.Second / time.Duration(d.opts.SampleFPS)
+    var last time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case f, ok := <-sub.Frames():
+            if !ok {
+                return
+            }
+            // A placeholder is not a change in the picture.
+            if f.Placeholder || f.Timestamp.Sub(last) < interval {
+                f.Release()
+                continue
+            }
+            select {
+            case sampled <- f:
+                last = f.Timestamp
+            default:
+                f.Release() // still busy with the last one
+            }
+        }
+    }
+}
+
+// analyse scores sampled frames until the channel is closed.
+func (d *Detector) analyse(sampled <-chan *hub.Frame) {
+    s := &scorer{threshold: d.opts.Threshold, frames: d.opts.Frames, cooldown: d.opts.Cooldown}
+    for f := range sampled {
+        img, err := imaging.Decode(f.Frame)
+        ts := f.Timestamp
+        f.Release()
+        if err != nil {
+            d.log.Debug("motion: decode failed", "err", err)
+            continue
+        }
+        score, tr := s.add(img, ts)
+        switch tr {
+        case started:
+            d.log.Info("motion started", "score", score)
+            d.queue(EventStarted, ts, score, img)
+        case ended:
+            d.log.Info("motion ended", "score", score)
+            d.queue(EventEnded, ts, score, img)
+        }
+    }
+}
+
+func (d *Detector) queue(name string, ts time.Time, score float64, img image.Image) {
+    ev := Event{Event: name, Stream: d.opts.Stream, Timestamp: ts.UTC(), Score: score}
+    if thumb, err := imaging.EncodeJPEG(imaging.Resize(img, ThumbnailWidth, 0), thumbnailQuality); err == nil {
+        ev.Thumbnail = base64.StdEncoding.EncodeToString(thumb)
+    }
+    select {
+    case d.events <- ev:
+    default:
+        d.log.Warn("motion webhook backed up, event dropped", "event", name)
+    }
+}
+
+// notify delivers queued events in order, one at a time. The clip for a
+// motion_started event is saved here, off the analyser, so it runs on
+// from the trigger to when the event is sent.
+func (d *Detector) notify(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case ev := <-d.events:
+            if ev.Event == EventStarted && d.opts.Clip != nil {
+                id, err := d.opts.Clip()
+                if err != nil {
+                    d.log.Warn("motion clip not saved", "err", err)
+                }
+                ev.Clip = id
+            }
+            if err := d.post(ctx, ev); err != nil {
+                d.log.Warn("motion webhook failed", "event", ev.Event, "err", err)
+            }
+        }
+    }
+}
+
+func (d *Detector) post(ctx context.Context, ev Event) error {
+    body, err := json.Marshal(ev)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.opts.Webhook, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := d.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("motion: webhook answered %s", resp.Status)
+    }
+    return nil
+}
@@ -0,0 +1,112 @@
+package motion
+
+import (
+    "image"
+    "image/color"
+    "time"
+)
+
+// Frames are compared at this size, in luma only. It is coarse enough to
+// ignore noise and compression artefacts and cheap enough to do for
+// every sampled frame.
+const (
+    GridWidth  = 64
+    GridHeight = 36
+    // baselineWeight is how much each frame moves the baseline towards
+    // itself, so a change that persists becomes the new normal in a few
+    // seconds.
+    baselineWeight = 0.1
+    // cellSamples is how many pixels across and down each cell is
+    // averaged over.
+    cellSamples = 4
+)
+
+// scorer compares each frame with a rolling baseline and turns the
+// scores into started and ended transitions.
+type scorer struct {
+    threshold float64
+    frames    int
+    cooldown  time.Duration
+
+    grid     [GridWidth * GridHeight]uint8
+    baseline []float32
+    over     int
+    active   bool
+    lastOver time.Time
+}
+
+// transition is what a frame changed about the motion state.
+type transition int
+
+const (
+    none transition = iota
+    started
+    ended
+)
+
+// add scores img, captured at ts, against the baseline, folds it into
+// the baseline and reports the score and any transition. Motion starts
+// after frames consecutive scores over the threshold, and ends once no
+// score has been over it for cooldown.
+func (s *scorer) add(img image.Image, ts time.Time) (float64, transition) {
+    downsample(img, &s.grid)
+    if s.baseline == nil {
+        s.baseline = make([]float32, len(s.grid))
+        for i, v := range s.grid {
+            s.baseline[i] = float32(v)
+        }
+        return 0, none
+    }
+    var sum float64
+    for i, v := range s.grid {
+        d := float32(v) - s.baseline[i]
+        if d < 0 {
+            sum -= float64(d)
+        } else {
+            sum += float64(d)
+        }
+        s.baseline[i] += d * baselineWeight
+    }
+    score := sum / float64(len(s.grid)) / 255
+
+    if score > s.threshold {
+        s.over++
+        s.lastOver = ts
+        if !s.active && s.over >= s.frames {
+            s.active = true
+            return score, started
+        }
+        return score, none
+    }
+    s.over = 0
+    if s.active && ts.Sub(s.lastOver) >= s.cooldown {
+        s.active = false
+        return score, ended
+    }
+    return score, none
+}
+
+// downsample averages img's luma over each cell of the grid. JPEGs decode
+// to YCbCr, whose Y plane is read directly; anything else goes through
+// color conversion.
+func downsample(img image.Image, grid *[GridWidth * GridHeight]uint8) {
+    b := img.Bounds()
+    ycc, _ := img.(*image.YCbCr)
+    for gy := 0; gy < GridHeight; gy++ {
+        for gx := 0; gx < GridWidth; gx++ {
+            var sum int
+            for sy := 0; sy < cellSamples; sy++ {
+                y := b.Min.Y + (gy*cellSamples+sy)*b.Dy()/(GridHeight*cellSamples)
+                for sx := 0; sx < cellSamples; sx++ {
+                    x := b.Min.X + (gx*cellSamples+sx)*b.Dx()/(GridWidth*cellSamples)
+                    if ycc != nil {
+                        sum += int(ycc.Y[ycc.YOffset(x, y)])
+                    } else {
+                        sum += int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+                    }
+                }
+            }
+            grid[gy*GridWidth+gx] = uint8(sum / (cellSamples * cellSamples))
+        }
+    }
+}
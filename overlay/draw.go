@@ -0,0 +1,138 @@
+package overlay
+
+import (
+    "image"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/basicfont"
+    "golang.org/x/image/math/fixed"
+)
+
+const (
+    // The built-in font's cell, and the printable ASCII it covers.
+    glyphWidth  = 7
+    glyphHeight = 13
+    glyphAscent = 11
+    firstGlyph  = ' '
+    lastGlyph   = '~'
+    // Text is white and its box black, at video levels.
+    textLuma = 235
+    boxLuma  = 16
+    neutral  = 128
+)
+
+// atlas holds every glyph at one scale as a mask of the pixels it sets,
+// cellW by cellH, row by row.
+type atlas struct {
+    scale        int
+    cellW, cellH int
+    glyphs       [lastGlyph - firstGlyph + 1][]bool
+}
+
+var atlases sync.Map // scale to *atlas
+
+// atlasFor returns the atlas at scale, building it on first use.
+func atlasFor(scale int) *atlas {
+    if a, ok := atlases.Load(scale); ok {
+        return a.(*atlas)
+    }
+    a := &atlas{scale: scale, cellW: glyphWidth * scale, cellH: glyphHeight * scale}
+    src := image.NewAlpha(image.Rect(0, 0, glyphWidth, glyphHeight))
+    for r := rune(firstGlyph); r <= lastGlyph; r++ {
+        for i := range src.Pix {
+            src.Pix[i] = 0
+        }
+        d := &font.Drawer{Dst: src, Src: image.Opaque, Face: basicfont.Face7x13, Dot: fixed.P(0, glyphAscent)}
+        d.DrawString(string(r))
+        mask := make([]bool, a.cellW*a.cellH)
+        for y := 0; y < a.cellH; y++ {
+            for x := 0; x < a.cellW; x++ {
+                mask[y*a.cellW+x] = src.AlphaAt(x/scale, y/scale).A >= 0x80
+            }
+        }
+        a.glyphs[r-firstGlyph] = mask
+    }
+    v, _ := atlases.LoadOrStore(scale, a)
+    return v.(*atlas)
+}
+
+// drawYUYV draws lines into a w by h YUYV frame in the corner s names,
+// on a box that keeps them readable over any picture. Whatever does not
+// fit in the frame is cut off.
+func drawYUYV(data []byte, w, h int, lines []string, s *config.Overlay) {
+    if len(lines) == 0 {
+        return
+    }
+    scale := (s.FontSize + glyphHeight/2) / glyphHeight
+    if scale < 1 {
+        scale = 1
+    }
+    a := atlasFor(scale)
+    pad, margin := 2*scale, 4*scale
+    cols := 0
+    for _, l := range lines {
+        if len(l) > cols {
+            cols = len(l)
+        }
+    }
+    boxW := cols*a.cellW + 2*pad
+    boxH := len(lines)*a.cellH + 2*pad
+    x0, y0 := margin, margin
+    if s.Position == config.TopRight || s.Position == config.BottomRight {
+        x0 = w - margin - boxW
+    }
+    if s.Position == config.BottomLeft || s.Position == config.BottomRight {
+        y0 = h - margin - boxH
+    }
+    // Pixels pair up over shared chroma, so the box starts on a pair.
+    x0 &^= 1
+    box := image.Rect(x0, y0, x0+boxW, y0+boxH).Intersect(image.Rect(0, 0, w, h))
+    if box.Empty() {
+        return
+    }
+    textA := int(s.Opacity*256 + 0.5)
+    boxA := textA / 2
+    stride := w * 2
+
+    for y := box.Min.Y; y < box.Max.Y; y++ {
+        row := data[y*stride : (y+1)*stride]
+        for x := box.Min.X; x < box.Max.X; x++ {
+            row[2*x] = blend(row[2*x], boxLuma, boxA)
+            row[2*x+1] = blend(row[2*x+1], neutral, boxA) // U or V
+        }
+    }
+    for i, line := range lines {
+        ty := y0 + pad + i*a.cellH
+        for j := 0; j < len(line); j++ {
+            c := line[j]
+            if c < firstGlyph || c > lastGlyph || c == ' ' {
+                continue
+            }
+            mask := a.glyphs[c-firstGlyph]
+            tx := x0 + pad + j*a.cellW
+            for gy := 0; gy < a.cellH; gy++ {
+                y := ty + gy
+                if y < box.Min.Y || y >= box.Max.Y {
+                    continue
+                }
+                row := data[y*stride : (y+1)*stride]
+                m := mask[gy*a.cellW : (gy+1)*a.cellW]
+                for gx, on := range m {
+                    x := tx + gx
+                    if !on || x < box.Min.X || x >= box.Max.X {
+                        continue
+                    }
+                    row[2*x] = blend(row[2*x], textLuma, textA)
+                    row[2*x+1] = blend(row[2*x+1], neutral, textA)
+                }
+            }
+        }
+    }
+}
+
+// blend moves v towards to by a 256ths.
+func blend(v, to byte, a int) byte {
+    return byte((int(v)*(256-a) + int(to)*a) >> 8)
+}
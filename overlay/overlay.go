@@ -0,0 +1,94 @@
+// Package overlay burns a timestamp, a stream name and a watermark into
+// frames.
+//
+// Text is drawn straight into YUYV, which raw captures arrive in and
+// every encoder accepts; frames the device compressed are decoded into
+// it first. Glyphs come from an atlas of the built-in 7x13 font rendered
+// once per size, so drawing costs a few byte blends per pixel of text
+// and nothing per pixel of the rest of the frame.
+package overlay
+
+import (
+    "fmt"
+    "sync/atomic"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// TimestampLayout is how the capture time is written: local wall-clock
+// time to the millisecond, for reading latency off a screen.
+const TimestampLayout = "2006-01-02 15:04:05.000 MST"
+
+// Overlay draws one stream's text. Its settings may be changed at any
+// time and apply from the next frame.
+type Overlay struct {
+    name     string
+    settings atomic.Pointer[config.Overlay]
+}
+
+// New returns an overlay for the stream called name.
+func New(name string, s config.Overlay) *Overlay {
+    o := &Overlay{name: name}
+    o.Set(s)
+    return o
+}
+
+// Settings returns the settings in use.
+func (o *Overlay) Settings() config.Overlay { return *o.settings.Load() }
+
+// Set replaces the settings. The caller validates them.
+func (o *Overlay) Set(s config.Overlay) { o.settings.Store(&s) }
+
+// Enabled reports whether the overlay draws anything. A nil overlay
+// does not.
+func (o *Overlay) Enabled() bool {
+    return o != nil && o.settings.Load().Enabled()
+}
+
+// Apply returns f with the overlay drawn in. A YUYV frame is drawn on in
+// place and returned as it is; a JPEG one is decoded into a new YUYV
+// frame with a buffer of its own, which the caller releases as well as
+// f. H.264 frames, and any frame while nothing is enabled, are returned
+// untouched.
+func (o *Overlay) Apply(f capture.Frame) (capture.Frame, error) {
+    s := o.settings.Load()
+    if !s.Enabled() || f.Format == capture.FormatH264 {
+        return f, nil
+    }
+    if f.Format == capture.FormatMJPEG {
+        img, err := imaging.Decode(f)
+        if err != nil {
+            return capture.Frame{}, err
+        }
+        b := img.Bounds()
+        buf := capture.NewFrameBuffer(b.Dx() * b.Dy() * 2)
+        if err := imaging.EncodeYUYVInto(buf.Bytes(), img); err != nil {
+            buf.Release()
+            return capture.Frame{}, err
+        }
+        f.Data, f.Buf, f.Format = buf.Bytes(), buf, capture.FormatYUYV
+        f.Width, f.Height = b.Dx(), b.Dy()
+    }
+    if len(f.Data) < f.Width*f.Height*2 {
+        return capture.Frame{}, fmt.Errorf("overlay: YUYV frame of %d bytes too small for %dx%d", len(f.Data), f.Width, f.Height)
+    }
+    drawYUYV(f.Data, f.Width, f.Height, o.lines(s, f), s)
+    return f, nil
+}
+
+// lines returns the text to draw on f, top line first.
+func (o *Overlay) lines(s *config.Overlay, f capture.Frame) []string {
+    var lines []string
+    if s.Watermark != "" {
+        lines = append(lines, s.Watermark)
+    }
+    if s.StreamName {
+        lines = append(lines, o.name)
+    }
+    if s.Timestamp {
+        lines = append(lines, f.Timestamp.Format(TimestampLayout))
+    }
+    return lines
+}
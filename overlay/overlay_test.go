@@ -0,0 +1,143 @@
+package overlay
+
+import (
+    "bytes"
+    "flag"
+    "image"
+    "image/png"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// gradient is a w by h YUYV frame whose luma rises left to right and
+// top to bottom, so blending shows up over both light and dark.
+func gradient(w, h int) capture.Frame {
+    data := make([]byte, w*h*2)
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            data[(y*w+x)*2] = byte(16 + (x*150/w + y*69/h))
+            data[(y*w+x)*2+1] = 128
+        }
+    }
+    return capture.Frame{
+        Data:      data,
+        Format:    capture.FormatYUYV,
+        Width:     w,
+        Height:    h,
+        Timestamp: time.Date(2024, 5, 17, 13, 4, 5, 678_000_000, time.UTC),
+    }
+}
+
+func TestApplyGolden(t *testing.T) {
+    for _, tc := range []struct {
+        name string
+        s    config.Overlay
+    }{
+        {"timestamp-top-left", config.Overlay{Timestamp: true, Position: config.TopLeft, FontSize: 13, Opacity: 1}},
+        {"all-bottom-right", config.Overlay{Timestamp: true, StreamName: true, Watermark: "CAM 1", Position: config.BottomRight, FontSize: 13, Opacity: 0.8}},
+        {"watermark-large-top-right", config.Overlay{Watermark: "LIVE", Position: config.TopRight, FontSize: 26, Opacity: 0.5}},
+        // Text wider than the frame is cut off at its edge.
+        {"clipped-bottom-left", config.Overlay{Watermark: "a watermark far too long to fit", Position: config.BottomLeft, FontSize: 13, Opacity: 1}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            f, err := New("studio", tc.s).Apply(gradient(192, 80))
+            if err != nil {
+                t.Fatal(err)
+            }
+            img, err := imaging.Decode(f)
+            if err != nil {
+                t.Fatal(err)
+            }
+            golden := filepath.Join("testdata", tc.name+".png")
+            if *update {
+                var b bytes.Buffer
+                if err := png.Encode(&b, img); err != nil {
+                    t.Fatal(err)
+                }
+                if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            file, err := os.Open(golden)
+            if err != nil {
+                t.Fatalf("%v; run go test -update to create it", err)
+            }
+            defer file.Close()
+            want, err := png.Decode(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if diff := countDiff(img, want); diff > 0 {
+                t.Errorf("%d pixels differ from %s", diff, golden)
+            }
+        })
+    }
+}
+
+// countDiff counts the pixels where got and want differ by more than a
+// rounding step in any channel.
+func countDiff(got, want image.Image) int {
+    if got.Bounds() != want.Bounds() {
+        return got.Bounds().Dx() * got.Bounds().Dy()
+    }
+    n := 0
+    b := got.Bounds()
+    for y := b.Min.Y; y < b.Max.Y; y++ {
+        for x := b.Min.X; x < b.Max.X; x++ {
+            r1, g1, b1, _ := got.At(x, y).RGBA()
+            r2, g2, b2, _ := want.At(x, y).RGBA()
+            if far(r1, r2) || far(g1, g2) || far(b1, b2) {
+                n++
+            }
+        }
+    }
+    return n
+}
+
+func far(a, b uint32) bool {
+    if a > b {
+        a, b = b, a
+    }
+    return b-a > 0x101
+}
+
+func TestApplyLeavesFramesAloneWhenDisabled(t *testing.T) {
+    f := gradient(64, 32)
+    orig := append([]byte(nil), f.Data...)
+    out, err := New("studio", config.Overlay{Position: config.TopLeft, FontSize: 13, Opacity: 1}).Apply(f)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(out.Data, orig) {
+        t.Error("overlay with nothing enabled changed the frame")
+    }
+}
+
+func TestApplyDecodesJPEG(t *testing.T) {
+    img, err := imaging.Decode(gradient(64, 32))
+    if err != nil {
+        t.Fatal(err)
+    }
+    jpeg, err := imaging.EncodeJPEG(img, 90)
+    if err != nil {
+        t.Fatal(err)
+    }
+    in := capture.Frame{Data: jpeg, Format: capture.FormatMJPEG, Width: 64, Height: 32}
+    out, err := New("studio", config.Overlay{Watermark: "x", Position: config.TopLeft, FontSize: 13, Opacity: 1}).Apply(in)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer out.Release()
+    if out.Format != capture.FormatYUYV || out.Width != 64 || out.Height != 32 || len(out.Data) != 64*32*2 || out.Buf == nil {
+        t.Errorf("JPEG came out as %s %dx%d, %d bytes", out.Format, out.Width, out.Height, len(out.Data))
+    }
+}
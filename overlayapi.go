@@ -0,0 +1,39 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+// The overlay endpoints act on the default stream unless ?stream= names
+// another.
+
+// overlayGetHandler serves GET /api/overlay.
+func overlayGetHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    writeJSON(w, http.StatusOK, st.Hub.Overlay.Settings())
+}
+
+// overlayPostHandler serves POST /api/overlay. The body holds the
+// settings to change, e.g. {"timestamp": true}; the rest keep their
+// values. The change shows from the next frame.
+func overlayPostHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    s := st.Hub.Overlay.Settings()
+    if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+        writeError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+        return
+    }
+    if err := s.Validate("overlay"); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    st.Hub.Overlay.Set(s)
+    writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+    "net/url"
+    "strconv"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// parseFPS reads the frame rate cap an output's URL asks for with ?fps=,
+// def when it asks for none. The hub thins the frames to it.
+func parseFPS(q url.Values, def int) (int, bool) {
+    v := q.Get("fps")
+    if v == "" {
+        return def, true
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 1 || n > protocol.MaxFPS {
+        return 0, false
+    }
+    return n, true
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+    "github.com/gorilla/websocket"
+)
+
+// replayer plays a recording to one websocket viewer. It borrows the
+// live client's connection handling; the playback position and rate
+// belong to the writer goroutine alone.
+type replayer struct {
+    *client
+    player *record.Player
+    // ctl carries seek, speed, pause and resume to the writer.
+    ctl chan protocol.Control
+
+    frames atomic.Uint64
+    bytes  atomic.Uint64
+}
+
+func (p *replayer) FramesSent() uint64 { return p.frames.Load() }
+func (p *replayer) BytesSent() uint64  { return p.bytes.Load() }
+func (p *replayer) Dropped() uint64    { return 0 }
+
+// playbackHandler serves /ws/replay/{id}: a recording listed by
+// /api/recordings, sent over the live binary protocol at the pace it was
+// captured. The viewer may seek, change speed or pause; at the end it is
+// sent eof and the connection stays open for another seek.
+func playbackHandler(w http.ResponseWriter, r *http.Request) {
+    tok, err := authn.Check(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    if !permit(w, tok, config.RoleOperator) {
+        return
+    }
+    st, player, err := openRecording(strings.TrimPrefix(r.URL.Path, "/ws/replay/"))
+    if errors.Is(err, record.ErrNoRecording) {
+        http.Error(w, "unknown recording", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer player.Close()
+    if !admitToken(w, tok) {
+        return
+    }
+    release, ok := admit(w, r)
+    if !ok {
+        return
+    }
+    defer release()
+
+    wsConns.Add(1)
+    defer wsConns.Done()
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        slog.Warn("websocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+        return
+    }
+    defer conn.Close()
+
+    id := newConnID()
+    rec := player.Recording()
+    p := &replayer{
+        client: &client{
+            id:      id,
+            stream:  st,
+            log:     slog.With("conn", id, "stream", st.Name, "recording", rec.ID),
+            conn:    conn,
+            token:   tok,
+            version: protocol.Negotiated(conn.Subprotocol()),
+        },
+        player: player,
+        ctl:    make(chan protocol.Control, 8),
+    }
+    p.session = newSession(true, p.endSession)
+    defer viewers.add(&viewer{
+        id:        id,
+        kind:      viewerReplay,
+        stream:    st.Name,
+        remote:    limiter.ClientIP(r),
+        token:     tok.ID,
+        connected: time.Now(),
+        sub:       p,
+        session:   p.session,
+    })()
+    start := time.Now()
+    p.log.Info("replay started", "remote", r.RemoteAddr)
+    defer func() {
+        p.log.Info("replay ended",
+            "remote", r.RemoteAddr,
+            "duration", time.Since(start).Round(time.Millisecond),
+            "frames_sent", p.FramesSent(),
+            "bytes_sent", p.BytesSent())
+    }()
+
+    hello := protocol.NewHello(id, p.version)
+    hello.Video = rec.Video
+    hello.Session = sessionLimits()
+    if err := p.writeJSON(hello); err != nil {
+        return
+    }
+    ctx, cancel := context.WithCancel(r.Context())
+    defer cancel()
+    go p.session.watch(ctx)
+    go func() {
+        err := p.readLoop(ctx)
+        cancel()
+        if isTimeout(err) {
+            reaped.Add(1)
+            p.log.Info("client missed pongs, closing")
+        }
+    }()
+    p.writeLoop(ctx, r.Context())
+}
+
+// openRecording finds the stream whose recorder holds id and opens it.
+func openRecording(id string) (*stream.Stream, *record.Player, error) {
+    for _, st := range streams.All() {
+        p, err := st.Recorder.Open(id)
+        if errors.Is(err, record.ErrNoRecording) {
+            continue
+        }
+        return st, p, err
+    }
+    return nil, nil, record.ErrNoRecording
+}
+
+// writeLoop sends frames, each when as much time has passed since the
+// first one sent as passed between their captures, divided by the rate.
+// A seek, a change of rate or a resume starts the count again from the
+// next frame. It returns when ctx is done, announcing 1001 Going Away if
+// that is because the server is shutting down.
+func (p *replayer) writeLoop(ctx, server context.Context) {
+    ping := time.NewTicker(cfg.PingInterval)
+    defer ping.Stop()
+    rate := 1.0
+    var (
+        paused, eof bool
+        next        *protocol.FrameHeader
+        payload     []byte
+        // The next frame is due when the wall clock has moved on from
+        // baseWall as far as the capture clock has from baseTS, scaled.
+        based    bool
+        baseWall time.Time
+        baseTS   int64
+    )
+    for {
+        if next == nil && !paused && !eof {
+            h, data, err := p.player.Next()
+            switch {
+            case errors.Is(err, io.EOF):
+                eof = true
+                if err := p.writeJSON(protocol.NewEOF()); err != nil {
+                    return
+                }
+            case err != nil:
+                p.log.Error("replay read failed", "err", err)
+                p.close(websocket.CloseInternalServerErr, err.Error())
+                return
+            default:
+                next, payload = &h, data
+            }
+        }
+        var due <-chan time.Time
+        if next != nil && !paused {
+            if !based {
+                based, baseWall, baseTS = true, time.Now(), next.Timestamp
+            }
+            elapsed := time.Duration(next.Timestamp-baseTS) * time.Microsecond
+            due = time.After(time.Duration(float64(elapsed)/rate) - time.Since(baseWall))
+        }
+        select {
+        case <-ping.C:
+            if err := p.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+                return
+            }
+        case <-ctx.Done():
+            if server.Err() != nil {
+                p.close(websocket.CloseGoingAway, "server shutting down")
+            }
+            return
+        case <-due:
+            err := p.writeRecorded(*next, payload)
+            next, payload = nil, nil
+            if err != nil {
+                p.writeFailed(err)
+                return
+            }
+        case msg := <-p.ctl:
+            switch msg.Type {
+            case protocol.TypeSeek:
+                p.player.Seek(time.Duration(*msg.ToMS) * time.Millisecond)
+                next, payload, eof = nil, nil, false
+            case protocol.TypeSpeed:
+                rate = msg.Rate
+            case protocol.TypePause:
+                paused = true
+            case protocol.TypeResume:
+                paused = false
+            }
+            based = false
+        }
+    }
+}
+
+// readLoop passes the viewer's control messages to the writer until the
+// connection fails or ctx is done, with the live reader's pong deadline.
+// Messages that only make sense live are answered with an error.
+func (p *replayer) readLoop(ctx context.Context) error {
+    p.handlePongs()
+    for {
+        typ, data, err := p.conn.ReadMessage()
+        if err != nil {
+            return err
+        }
+        p.heard(true)
+        if typ != websocket.TextMessage {
+            continue
+        }
+        msg, err := protocol.ParseControl(data)
+        switch {
+        case err != nil:
+        case msg.Type == protocol.TypeHeartbeat:
+            continue
+        case msg.Type == protocol.TypeResume && msg.FromSeq != nil:
+            err = errors.New("resume with from_seq is not supported during replay")
+        case msg.Type != protocol.TypeSeek && msg.Type != protocol.TypeSpeed &&
+            msg.Type != protocol.TypePause && msg.Type != protocol.TypeResume:
+            err = errors.New(msg.Type + " is not supported during replay")
+        }
+        if err != nil {
+            if err := p.writeJSON(protocol.NewError(err.Error())); err != nil {
+                return err
+            }
+            continue
+        }
+        select {
+        case p.ctl <- msg:
+        case <-ctx.Done():
+            return nil
+        }
+    }
+}
+
+// writeRecorded sends a frame under the header it was recorded with, in
+// the viewer's protocol version.
+func (p *replayer) writeRecorded(h protocol.FrameHeader, payload []byte) error {
+    if len(payload) > protocol.MaxPayload || !p.version.HasMagic(h.Magic) {
+        return nil
+    }
+    n, err := p.writeBinary(h, payload)
+    if err != nil {
+        return err
+    }
+    p.frames.Add(1)
+    p.bytes.Add(uint64(n))
+    return charge(p.token, n)
+}
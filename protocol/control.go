@@ -0,0 +1,354 @@
+package protocol
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+)
+
+// Control messages travel as JSON text messages in both directions on the
+// same websocket as the binary frames.
+const (
+    TypeSetParams = "set_params"
+    TypePause     = "pause"
+    TypeResume    = "resume"
+    TypeError     = "error"
+    TypeStatus    = "status"
+    TypeHello     = "hello"
+    TypeAudioOff  = "audio_off"
+    TypeAudioOn   = "audio_on"
+    TypeDeltaOff  = "delta_off"
+    TypeDeltaOn   = "delta_on"
+    // TypeHeartbeat does nothing but show the viewer is being watched,
+    // for servers with require_activity.
+    TypeHeartbeat = "heartbeat"
+    // TypeTimeSync asks for the server's clock, and TypeFrameAck reports
+    // when a frame arrived, for measuring latency.
+    TypeTimeSync = "time_sync"
+    TypeFrameAck = "frame_ack"
+    TypeStats    = "stats"
+    // TypeSignal reports the capture device losing or regaining its
+    // input signal.
+    TypeSignal = "signal"
+    // TypeDevice reports the capture device going away and coming back.
+    TypeDevice = "device"
+    // TypeResumeFailed answers a resume with FromSeq whose frames are no
+    // longer held.
+    TypeResumeFailed = "resume_failed"
+    // TypeSeek and TypeSpeed move and pace playback of a recording, and
+    // TypeEOF says playback has reached its end. They are only used on
+    // /ws/replay connections.
+    TypeSeek  = "seek"
+    TypeSpeed = "speed"
+    TypeEOF   = "eof"
+)
+
+// Close codes, from the range RFC 6455 leaves to applications, for a
+// session the server ended on purpose. A viewer can offer to resume
+// rather than reconnect on its own.
+const (
+    // CloseSessionExpired: the session lasted session_max_duration.
+    CloseSessionExpired = 4000
+    // CloseIdle: nothing was heard from the viewer for
+    // session_idle_timeout.
+    CloseIdle = 4001
+    // CloseTerminated: an administrator ended the session.
+    CloseTerminated = 4002
+)
+
+// MaxRate bounds the playback rate a speed message may ask for.
+const MaxRate = 16
+
+// Params adjusts the stream a single client receives. Zero fields leave
+// the source value untouched. Crop is applied before the size, and is set
+// by set_crop rather than set_params.
+type Params struct {
+    Width   int  `json:"width,omitempty"`
+    Height  int  `json:"height,omitempty"`
+    FPS     int  `json:"fps,omitempty"`
+    Quality int  `json:"quality,omitempty"`
+    Crop    Rect `json:"-"`
+}
+
+// Limits accepted by Params.Validate.
+const (
+    MinDimension = 16
+    MaxWidth     = 7680
+    MaxHeight    = 4320
+    MaxFPS       = 120
+)
+
+// Validate reports the first field that is out of range.
+func (p Params) Validate() error {
+    if p.Width != 0 && (p.Width < MinDimension || p.Width > MaxWidth) {
+        return fmt.Errorf("width %d out of range [%d, %d]", p.Width, MinDimension, MaxWidth)
+    }
+    if p.Height != 0 && (p.Height < MinDimension || p.Height > MaxHeight) {
+        return fmt.Errorf("height %d out of range [%d, %d]", p.Height, MinDimension, MaxHeight)
+    }
+    if p.FPS < 0 || p.FPS > MaxFPS {
+        return fmt.Errorf("fps %d out of range [1, %d]", p.FPS, MaxFPS)
+    }
+    if p.Quality < 0 || p.Quality > 100 {
+        return fmt.Errorf("quality %d out of range [1, 100]", p.Quality)
+    }
+    return nil
+}
+
+// Control is a message sent by the client. Resume undoes pause. Sent
+// straight after the hello on a new connection with FromSeq, it also asks
+// for the frames after that sequence number to be replayed before live
+// ones. Seek moves playback to ToMS milliseconds into the recording, and
+// speed plays it at Rate times the capture pace. Set crop carries its
+// region as Rect.
+//
+// Time sync and frame acks measure latency; their times are microseconds
+// since the Unix epoch, like frame timestamps. A time sync carries the
+// client's clock as ClientTS and is answered with a TimeSync, from which
+// the client estimates how far its clock is from the server's, NTP-style.
+// A frame ack says a frame with sequence number Seq arrived at RecvTS,
+// the client's clock corrected by that estimate. The server uses at most
+// a few acks a second and ignores the rest, so a client may ack as often
+// as it likes, but every few hundred milliseconds is plenty.
+type Control struct {
+    Type     string  `json:"type"`
+    FromSeq  *uint64 `json:"from_seq,omitempty"`
+    ToMS     *int64  `json:"to_ms,omitempty"`
+    Rate     float64 `json:"rate,omitempty"`
+    ClientTS int64   `json:"client_ts,omitempty"`
+    Seq      uint64  `json:"seq,omitempty"`
+    RecvTS   int64   `json:"recv_ts,omitempty"`
+    Params
+    Rect
+}
+
+// ErrorReply tells the client a control message was rejected.
+type ErrorReply struct {
+    Type   string `json:"type"`
+    Reason string `json:"reason"`
+}
+
+// NewError returns an ErrorReply with Type set.
+func NewError(reason string) ErrorReply {
+    return ErrorReply{Type: TypeError, Reason: reason}
+}
+
+// ParseControl decodes and validates a client control message.
+func ParseControl(data []byte) (Control, error) {
+    var c Control
+    if err := json.Unmarshal(data, &c); err != nil {
+        return c, fmt.Errorf("malformed control message: %v", err)
+    }
+    switch c.Type {
+    case TypeSetParams:
+        if err := c.Params.Validate(); err != nil {
+            return c, err
+        }
+    case TypeSetCrop:
+        if err := c.Rect.Validate(); err != nil {
+            return c, err
+        }
+    case TypeSeek:
+        if c.ToMS == nil || *c.ToMS < 0 {
+            return c, errors.New("seek needs a non-negative to_ms")
+        }
+    case TypeSpeed:
+        if !(c.Rate > 0 && c.Rate <= MaxRate) {
+            return c, fmt.Errorf("rate %g out of range (0, %d]", c.Rate, MaxRate)
+        }
+    case TypeTimeSync:
+        if c.ClientTS <= 0 {
+            return c, errors.New("time_sync needs a positive client_ts")
+        }
+    case TypeFrameAck:
+        if c.Seq == 0 || c.RecvTS <= 0 {
+            return c, errors.New("frame_ack needs a seq and a positive recv_ts")
+        }
+    case TypePause, TypeResume, TypeAudioOff, TypeAudioOn, TypeDeltaOff, TypeDeltaOn, TypeHeartbeat:
+    case "":
+        return c, errors.New("control message has no type")
+    default:
+        return c, fmt.Errorf("unknown control message type %q", c.Type)
+    }
+    return c, nil
+}
+
+// Status tells the client what the capture pipeline is doing, e.g.
+// "starting" while the device warms up.
+type Status struct {
+    Type  string `json:"type"`
+    State string `json:"state"`
+}
+
+// NewStatus returns a Status with Type set.
+func NewStatus(state string) Status {
+    return Status{Type: TypeStatus, State: state}
+}
+
+// Signal is sent when the capture device loses its input, and again when
+// the input returns. While Present is false the video frames are a
+// generated "no signal" picture, about one a second.
+type Signal struct {
+    Type    string `json:"type"`
+    Present bool   `json:"present"`
+}
+
+// NewSignal returns a Signal with Type set.
+func NewSignal(present bool) Signal {
+    return Signal{Type: TypeSignal, Present: present}
+}
+
+// Device is sent when the capture device goes away, such as a USB card
+// unplugged, and again when it is back. Meanwhile the video frames are a
+// generated "no device" picture while the server waits for it; the
+// connection stays open.
+type Device struct {
+    Type    string `json:"type"`
+    Present bool   `json:"present"`
+}
+
+// NewDevice returns a Device with Type set.
+func NewDevice(present bool) Device {
+    return Device{Type: TypeDevice, Present: present}
+}
+
+// TimeSync answers a time sync: ClientTS as the client sent it, and the
+// server's clock when the request arrived and when the answer left.
+type TimeSync struct {
+    Type         string `json:"type"`
+    ClientTS     int64  `json:"client_ts"`
+    ServerRecvTS int64  `json:"server_recv_ts"`
+    ServerSendTS int64  `json:"server_send_ts"`
+}
+
+// NewTimeSync returns a TimeSync with Type set. ServerSendTS is left for
+// the writer to fill in at the last moment.
+func NewTimeSync(clientTS, recvTS int64) TimeSync {
+    return TimeSync{Type: TypeTimeSync, ClientTS: clientTS, ServerRecvTS: recvTS}
+}
+
+// Latency summarises a client's recent frame acks, in milliseconds.
+// Delivery is from the server sending a frame to the client receiving
+// it; Capture is from the frame being captured, which adds the time spent
+// encoding and queued. Samples is how many acks they are drawn from.
+type Latency struct {
+    DeliveryP50 float64 `json:"delivery_p50_ms"`
+    DeliveryP95 float64 `json:"delivery_p95_ms"`
+    CaptureP50  float64 `json:"capture_p50_ms"`
+    CaptureP95  float64 `json:"capture_p95_ms"`
+    Samples     int     `json:"samples"`
+}
+
+// EOF is sent when playback of a recording runs out of frames. The
+// connection stays open for a seek.
+type EOF struct {
+    Type string `json:"type"`
+}
+
+// NewEOF returns an EOF with Type set.
+func NewEOF() EOF {
+    return EOF{Type: TypeEOF}
+}
+
+// Hello is the first message on every connection. ConnID matches the
+// "conn" attribute of the server's log lines for this connection, and
+// Version is the protocol spoken on it (see version.go). Video
+// says how frames are encoded, VideoJPEG or VideoH264. Audio is set when
+// the server captures audio; the client then receives audio chunks until
+// it sends audio_off. Delta is set when the client may send delta_on to
+// be sent only the changed tiles of each frame. Session gives the
+// server's limits on the connection, when it has any.
+type Hello struct {
+    Type    string         `json:"type"`
+    ConnID  string         `json:"conn_id"`
+    Version Version        `json:"version"`
+    Video   string         `json:"video"`
+    Audio   *AudioFormat   `json:"audio,omitempty"`
+    Delta   *DeltaFormat   `json:"delta,omitempty"`
+    Session *SessionLimits `json:"session,omitempty"`
+}
+
+// Video encodings announced by Hello. H.264 streams ignore set_params
+// and the adaptive quality levels, since every frame must be delivered
+// for the ones after it to decode.
+const (
+    VideoJPEG = "jpeg"
+    VideoH264 = "h264"
+)
+
+// AudioFormat describes the PCM in audio chunks.
+type AudioFormat struct {
+    Encoding string `json:"encoding"` // always "s16le"
+    Rate     int    `json:"rate"`
+    Channels int    `json:"channels"`
+}
+
+// DeltaFormat describes delta mode: the side of a tile in pixels, and how
+// often a whole frame is sent regardless, in milliseconds.
+type DeltaFormat struct {
+    TileSize   int   `json:"tile_size"`
+    KeyframeMS int64 `json:"keyframe_ms"`
+}
+
+// SessionLimits describes when the server ends a connection: MaxMS after
+// it opened, or IdleMS after the viewer was last heard from. With
+// RequireActivity only control messages, such as heartbeats, count; pongs
+// do not.
+type SessionLimits struct {
+    MaxMS           int64 `json:"max_ms,omitempty"`
+    IdleMS          int64 `json:"idle_ms,omitempty"`
+    RequireActivity bool  `json:"require_activity,omitempty"`
+}
+
+// NewHello returns a Hello with Type set, announcing JPEG video.
+func NewHello(connID string, v Version) Hello {
+    return Hello{Type: TypeHello, ConnID: connID, Version: v, Video: VideoJPEG}
+}
+
+// Stats is sent every couple of seconds with the quality the client is
+// actually receiving. Level 0 is the stream as requested; higher levels
+// mean the server has lowered Quality or sends only one frame in every
+// FPSDivisor because the client was falling behind. DropRate is the
+// share of frames dropped for the client recently, and DropPercent the
+// same as a percentage, the unit the server's slow-client threshold is
+// set in. SlowFor is how many seconds the client has been over that
+// threshold when the server disconnects slow clients; a client can lower
+// its own frame rate or size before it is closed with 1008 "too slow".
+// DeltaSaving, in delta mode, is the share of bytes the tiles saved over
+// sending whole frames. Latency is set once the client has sent frame
+// acks.
+type Stats struct {
+    Type        string   `json:"type"`
+    Level       int      `json:"level"`
+    Quality     int      `json:"quality"`
+    FPSDivisor  int      `json:"fps_divisor"`
+    DropRate    float64  `json:"drop_rate"`
+    DropPercent float64  `json:"drop_percent"`
+    SlowFor     float64  `json:"slow_for,omitempty"`
+    DeltaSaving *float64 `json:"delta_saving,omitempty"`
+    Latency     *Latency `json:"latency,omitempty"`
+}
+
+// NewStats returns a Stats with Type set.
+func NewStats(level, quality, fpsDivisor int, dropRate float64) Stats {
+    return Stats{
+        Type:        TypeStats,
+        Level:       level,
+        Quality:     quality,
+        FPSDivisor:  fpsDivisor,
+        DropRate:    dropRate,
+        DropPercent: dropRate * 100,
+    }
+}
+
+// ResumeFailed tells a resuming client that frames were missed: the
+// first one still held is OldestSeq, and live frames follow.
+type ResumeFailed struct {
+    Type      string `json:"type"`
+    OldestSeq uint64 `json:"oldest_seq"`
+}
+
+// NewResumeFailed returns a ResumeFailed with Type set.
+func NewResumeFailed(oldest uint64) ResumeFailed {
+    return ResumeFailed{Type: TypeResumeFailed, OldestSeq: oldest}
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import "fmt"
+
+// TypeSetCrop asks for a client's frames to be cut to a region of the
+// source picture, and TypeCrop answers it with the region in effect.
+const (
+    TypeSetCrop = "set_crop"
+    TypeCrop    = "crop"
+)
+
+// Rect is a region of the source picture in source pixels, X and Y its
+// top left corner. The zero Rect is the whole picture.
+type Rect struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+    W int `json:"w"`
+    H int `json:"h"`
+}
+
+// Empty reports whether r is the zero Rect, meaning no crop.
+func (r Rect) Empty() bool {
+    return r == Rect{}
+}
+
+// Validate reports what is wrong with r as a crop, before it is compared
+// with the source.
+func (r Rect) Validate() error {
+    if r.Empty() {
+        return nil
+    }
+    if r.X < 0 || r.Y < 0 {
+        return fmt.Errorf("crop origin %d,%d is negative", r.X, r.Y)
+    }
+    if r.W < MinDimension || r.W > MaxWidth {
+        return fmt.Errorf("crop width %d out of range [%d, %d]", r.W, MinDimension, MaxWidth)
+    }
+    if r.H < MinDimension || r.H > MaxHeight {
+        return fmt.Errorf("crop height %d out of range [%d, %d]", r.H, MinDimension, MaxHeight)
+    }
+    return nil
+}
+
+// Clamp fits r within a w by h source. It fails when too little of r is
+// left, and otherwise returns what is, with a reason when that is not r.
+func (r Rect) Clamp(w, h int) (Rect, string, error) {
+    if r.Empty() {
+        return r, "", nil
+    }
+    c := r
+    c.W = min(r.X+r.W, w) - r.X
+    c.H = min(r.Y+r.H, h) - r.Y
+    if c.W < MinDimension || c.H < MinDimension {
+        return r, "", fmt.Errorf("crop %dx%d at %d,%d lies outside the %dx%d source", r.W, r.H, r.X, r.Y, w, h)
+    }
+    if c == r {
+        return r, "", nil
+    }
+    return c, fmt.Sprintf("crop clamped to the %dx%d source", w, h), nil
+}
+
+// Crop answers set_crop, and says when the crop was adjusted to fit the
+// source: Clamped is set and Reason says why.
+type Crop struct {
+    Type string `json:"type"`
+    Rect
+    Clamped bool   `json:"clamped,omitempty"`
+    Reason  string `json:"reason,omitempty"`
+}
+
+// NewCrop returns a Crop with Type set.
+func NewCrop(r Rect, reason string) Crop {
+    return Crop{Type: TypeCrop, Rect: r, Clamped: reason != "", Reason: reason}
+}
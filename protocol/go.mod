@@ -0,0 +1,3 @@
+module github.com/Cdaprod/hdmi-streaming-app/protocol
+
+go 1.21
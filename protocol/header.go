@@ -0,0 +1,141 @@
+// Package protocol defines the binary messages the server sends over the
+// websocket so that Go and browser clients can parse them.
+package protocol
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+// Every binary websocket message is a fixed header followed by the
+// payload. All integers are big-endian. This is the V1 header, which
+// recordings use too; V2 adds a field (see version.go).
+//
+//	offset  size  field
+//	0       4     magic
+//	4       8     sequence number
+//	12      8     capture timestamp, microseconds since the Unix epoch
+//	20      4     payload length
+//
+// The magic says what the payload is: FrameMagic for a JPEG video frame,
+// H264Magic or H264KeyMagic for H.264, TileMagic for the changed parts
+// of a JPEG frame, AudioMagic for a chunk of PCM audio. Video and audio
+// count sequence numbers separately but share the timestamp clock, so a
+// client can line them up.
+const HeaderSize = 24
+
+// MaxPayload bounds the payload length a decoder will accept.
+const MaxPayload = 16 << 20
+
+// FrameMagic marks a video frame message.
+var FrameMagic = [4]byte{'H', 'D', 'M', 'V'}
+
+// H264Magic marks an H.264 access unit in Annex-B form, and H264KeyMagic
+// one that starts with a keyframe, carrying its SPS and PPS, that a
+// decoder can begin from. A connection sends one or the other family of
+// video magics, as announced by Hello.Video.
+var (
+    H264Magic    = [4]byte{'H', 'D', 'M', 'H'}
+    H264KeyMagic = [4]byte{'H', 'D', 'M', 'K'}
+)
+
+// AudioMagic marks an audio chunk: interleaved signed 16-bit
+// little-endian PCM in the format announced by Hello.Audio.
+var AudioMagic = [4]byte{'H', 'D', 'M', 'A'}
+
+// TileMagic marks the tiles of a frame that changed, sent in delta mode
+// (see tiles.go).
+var TileMagic = [4]byte{'H', 'D', 'M', 'T'}
+
+var (
+    ErrShortHeader     = errors.New("protocol: message shorter than frame header")
+    ErrBadMagic        = errors.New("protocol: bad frame magic")
+    ErrPayloadTooLarge = errors.New("protocol: payload exceeds maximum size")
+    ErrPayloadLength   = errors.New("protocol: payload length does not match header")
+)
+
+// FrameHeader precedes each frame on the wire.
+type FrameHeader struct {
+    Magic     [4]byte
+    Seq       uint64
+    Timestamp int64 // microseconds since the Unix epoch
+    // SendTS is when the server sent the message, in the same unit. It
+    // is only carried by V2.
+    SendTS int64
+    Length uint32
+}
+
+// EncodeFrameHeader writes h into the first HeaderSize bytes of buf, in
+// the V1 layout. A zero Magic is written as FrameMagic.
+func EncodeFrameHeader(buf []byte, h FrameHeader) error {
+    if len(buf) < HeaderSize {
+        return ErrShortHeader
+    }
+    if h.Length > MaxPayload {
+        return ErrPayloadTooLarge
+    }
+    if h.Magic == ([4]byte{}) {
+        h.Magic = FrameMagic
+    }
+    copy(buf[0:4], h.Magic[:])
+    binary.BigEndian.PutUint64(buf[4:12], h.Seq)
+    binary.BigEndian.PutUint64(buf[12:20], uint64(h.Timestamp))
+    binary.BigEndian.PutUint32(buf[20:24], h.Length)
+    return nil
+}
+
+// DecodeFrameHeader parses the V1 layout header at the start of buf.
+func DecodeFrameHeader(buf []byte) (FrameHeader, error) {
+    var h FrameHeader
+    if len(buf) < HeaderSize {
+        return h, ErrShortHeader
+    }
+    copy(h.Magic[:], buf[0:4])
+    if !knownMagic(h.Magic) {
+        return h, ErrBadMagic
+    }
+    h.Seq = binary.BigEndian.Uint64(buf[4:12])
+    h.Timestamp = int64(binary.BigEndian.Uint64(buf[12:20]))
+    h.Length = binary.BigEndian.Uint32(buf[20:24])
+    if h.Length > MaxPayload {
+        return h, ErrPayloadTooLarge
+    }
+    return h, nil
+}
+
+func knownMagic(m [4]byte) bool {
+    switch m {
+    case FrameMagic, H264Magic, H264KeyMagic, AudioMagic, TileMagic:
+        return true
+    }
+    return false
+}
+
+// DecodeFrame splits a complete V1 websocket message into its header and
+// payload, rejecting messages whose payload is truncated or padded.
+func DecodeFrame(msg []byte) (FrameHeader, []byte, error) {
+    h, err := DecodeFrameHeader(msg)
+    if err != nil {
+        return h, nil, err
+    }
+    payload := msg[HeaderSize:]
+    if len(payload) != int(h.Length) {
+        return h, nil, ErrPayloadLength
+    }
+    return h, payload, nil
+}
+
+// EncodeFrame returns a V1 video message holding the header for seq and
+// ts followed by payload.
+func EncodeFrame(seq uint64, ts int64, payload []byte) ([]byte, error) {
+    return encodeMessage(FrameMagic, seq, ts, payload)
+}
+
+// EncodeAudio is EncodeFrame for an audio chunk.
+func EncodeAudio(seq uint64, ts int64, payload []byte) ([]byte, error) {
+    return encodeMessage(AudioMagic, seq, ts, payload)
+}
+
+func encodeMessage(magic [4]byte, seq uint64, ts int64, payload []byte) ([]byte, error) {
+    return V1.Encode(FrameHeader{Magic: magic, Seq: seq, Timestamp: ts}, payload)
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+    for _, tc := range []struct {
+        name    string
+        seq     uint64
+        ts      int64
+        payload []byte
+    }{
+        {"empty", 1, 0, nil},
+        {"small", 42, 1_700_000_000_000_000, []byte("jpeg bytes")},
+        {"max seq", ^uint64(0), -1, bytes.Repeat([]byte{0xFF}, 1000)},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            msg, err := EncodeFrame(tc.seq, tc.ts, tc.payload)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(msg) != HeaderSize+len(tc.payload) {
+                t.Fatalf("message is %d bytes, want %d", len(msg), HeaderSize+len(tc.payload))
+            }
+            h, payload, err := DecodeFrame(msg)
+            if err != nil {
+                t.Fatal(err)
+            }
+            want := FrameHeader{Magic: FrameMagic, Seq: tc.seq, Timestamp: tc.ts, Length: uint32(len(tc.payload))}
+            if h != want {
+                t.Errorf("header = %+v, want %+v", h, want)
+            }
+            if !bytes.Equal(payload, tc.payload) {
+                t.Errorf("payload = %q, want %q", payload, tc.payload)
+            }
+        })
+    }
+}
+
+func TestEncodeFrameHeaderDefaultsMagic(t *testing.T) {
+    buf := make([]byte, HeaderSize)
+    if err := EncodeFrameHeader(buf, FrameHeader{Seq: 7}); err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(buf[:4], FrameMagic[:]) {
+        t.Errorf("magic = %q, want %q", buf[:4], FrameMagic[:])
+    }
+}
+
+func TestDecodeFrameHeaderPartial(t *testing.T) {
+    msg, err := EncodeFrame(1, 2, []byte("payload"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for n := 0; n < HeaderSize; n++ {
+        if _, err := DecodeFrameHeader(msg[:n]); !errors.Is(err, ErrShortHeader) {
+            t.Errorf("%d bytes: err = %v, want ErrShortHeader", n, err)
+        }
+        if _, _, err := DecodeFrame(msg[:n]); !errors.Is(err, ErrShortHeader) {
+            t.Errorf("DecodeFrame of %d bytes: err = %v, want ErrShortHeader", n, err)
+        }
+    }
+    if err := EncodeFrameHeader(make([]byte, HeaderSize-1), FrameHeader{}); !errors.Is(err, ErrShortHeader) {
+        t.Errorf("encoding into a short buffer: err = %v, want ErrShortHeader", err)
+    }
+}
+
+func TestDecodeFrameLengthMismatch(t *testing.T) {
+    msg, err := EncodeFrame(1, 2, []byte("payload"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := DecodeFrame(msg[:len(msg)-1]); !errors.Is(err, ErrPayloadLength) {
+        t.Errorf("truncated: err = %v, want ErrPayloadLength", err)
+    }
+    if _, _, err := DecodeFrame(append(msg, 0)); !errors.Is(err, ErrPayloadLength) {
+        t.Errorf("padded: err = %v, want ErrPayloadLength", err)
+    }
+}
+
+func TestDecodeFrameHeaderBadMagic(t *testing.T) {
+    msg, err := EncodeFrame(1, 2, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    copy(msg, "NOPE")
+    if _, err := DecodeFrameHeader(msg); !errors.Is(err, ErrBadMagic) {
+        t.Errorf("err = %v, want ErrBadMagic", err)
+    }
+}
+
+func TestMaxPayloadRejected(t *testing.T) {
+    buf := make([]byte, HeaderSize)
+    if err := EncodeFrameHeader(buf, FrameHeader{Length: MaxPayload + 1}); !errors.Is(err, ErrPayloadTooLarge) {
+        t.Errorf("encode: err = %v, want ErrPayloadTooLarge", err)
+    }
+    if err := EncodeFrameHeader(buf, FrameHeader{Length: MaxPayload}); err != nil {
+        t.Errorf("encode at MaxPayload: %v", err)
+    }
+
+    // A header claiming more than MaxPayload is refused before any
+    // payload is looked at.
+    copy(buf, FrameMagic[:])
+    binary.BigEndian.PutUint32(buf[20:24], MaxPayload+1)
+    if _, err := DecodeFrameHeader(buf); !errors.Is(err, ErrPayloadTooLarge) {
+        t.Errorf("decode: err = %v, want ErrPayloadTooLarge", err)
+    }
+    if _, _, err := DecodeFrame(buf); !errors.Is(err, ErrPayloadTooLarge) {
+        t.Errorf("DecodeFrame: err = %v, want ErrPayloadTooLarge", err)
+    }
+    if _, err := EncodeFrame(1, 2, make([]byte, MaxPayload+1)); !errors.Is(err, ErrPayloadTooLarge) {
+        t.Errorf("EncodeFrame: err = %v, want ErrPayloadTooLarge", err)
+    }
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+// In delta mode a client that sent delta_on is sent a whole JPEG frame
+// as a keyframe and after it, under TileMagic, only the square tiles of
+// each frame that differ from what the client is showing. Tiles are
+// drawn in order on top of the picture so far; a keyframe replaces it.
+// A tile message's payload is:
+//
+//	offset  size  field
+//	0       2     frame width
+//	2       2     frame height
+//	4       2     tile size, the side of every tile in pixels
+//	6       2     tile count
+//
+// followed, for each tile, by
+//
+//	0       2     column
+//	2       2     row
+//	4       4     JPEG length
+//	8       n     JPEG of the tile
+//
+// The tile at column c, row r covers the pixels from (c, r) times the
+// tile size; those on the right and bottom edges may be cut short by the
+// frame.
+const (
+    tilesHeaderSize = 8
+    tileHeaderSize  = 8
+)
+
+// DeltaTileSize is the side of the tiles the server divides frames into.
+const DeltaTileSize = 64
+
+var ErrBadTiles = errors.New("protocol: malformed tile message")
+
+// Tile is one changed tile of a frame.
+type Tile struct {
+    Col, Row int
+    JPEG     []byte
+}
+
+// Tiles is the payload of a tile message.
+type Tiles struct {
+    Width, Height int
+    TileSize      int
+    Tiles         []Tile
+}
+
+// EncodeTiles returns the payload of a tile message, to be sent under a
+// V2 header with TileMagic.
+func EncodeTiles(t Tiles) ([]byte, error) {
+    n := tilesHeaderSize
+    for _, tile := range t.Tiles {
+        n += tileHeaderSize + len(tile.JPEG)
+    }
+    payload := make([]byte, n)
+    binary.BigEndian.PutUint16(payload[0:2], uint16(t.Width))
+    binary.BigEndian.PutUint16(payload[2:4], uint16(t.Height))
+    binary.BigEndian.PutUint16(payload[4:6], uint16(t.TileSize))
+    binary.BigEndian.PutUint16(payload[6:8], uint16(len(t.Tiles)))
+    off := tilesHeaderSize
+    for _, tile := range t.Tiles {
+        binary.BigEndian.PutUint16(payload[off:], uint16(tile.Col))
+        binary.BigEndian.PutUint16(payload[off+2:], uint16(tile.Row))
+        binary.BigEndian.PutUint32(payload[off+4:], uint32(len(tile.JPEG)))
+        off += tileHeaderSize + copy(payload[off+tileHeaderSize:], tile.JPEG)
+    }
+    if len(payload) > MaxPayload {
+        return nil, ErrPayloadTooLarge
+    }
+    return payload, nil
+}
+
+// DecodeTiles parses the payload of a tile message. The tiles' JPEG data
+// points into payload.
+func DecodeTiles(payload []byte) (Tiles, error) {
+    var t Tiles
+    if len(payload) < tilesHeaderSize {
+        return t, ErrBadTiles
+    }
+    t.Width = int(binary.BigEndian.Uint16(payload[0:2]))
+    t.Height = int(binary.BigEndian.Uint16(payload[2:4]))
+    t.TileSize = int(binary.BigEndian.Uint16(payload[4:6]))
+    count := int(binary.BigEndian.Uint16(payload[6:8]))
+    if t.TileSize == 0 {
+        return t, ErrBadTiles
+    }
+    off := tilesHeaderSize
+    for i := 0; i < count; i++ {
+        if len(payload)-off < tileHeaderSize {
+            return t, ErrBadTiles
+        }
+        tile := Tile{
+            Col: int(binary.BigEndian.Uint16(payload[off:])),
+            Row: int(binary.BigEndian.Uint16(payload[off+2:])),
+        }
+        n := int(binary.BigEndian.Uint32(payload[off+4:]))
+        off += tileHeaderSize
+        if n > len(payload)-off || tile.Col*t.TileSize >= t.Width || tile.Row*t.TileSize >= t.Height {
+            return t, ErrBadTiles
+        }
+        tile.JPEG = payload[off : off+n]
+        off += n
+        t.Tiles = append(t.Tiles, tile)
+    }
+    if off != len(payload) {
+        return t, ErrBadTiles
+    }
+    return t, nil
+}
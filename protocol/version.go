@@ -0,0 +1,177 @@
+package protocol
+
+import (
+    "encoding/binary"
+    "fmt"
+    "strings"
+)
+
+// The websocket protocol is versioned, and a client picks a version by
+// offering its subprotocols, such as "hdmi-stream.v2", in the
+// Sec-WebSocket-Protocol header. The server settles on the highest one
+// both sides speak, and says which in the hello. A client offering none
+// it knows is spoken to in V1, as clients were before versions existed.
+//
+// V1 is the original protocol: the HeaderSize header, video and audio,
+// and the control messages that came with them. V2 adds a send time to
+// the header, making it HeaderSizeV2 long,
+//
+//	offset  size  field
+//	0       4     magic
+//	4       8     sequence number
+//	12      8     capture timestamp, microseconds since the Unix epoch
+//	20      8     send timestamp, microseconds since the Unix epoch
+//	28      4     payload length
+//
+// and the messages listed in v2Only: delta tiles, device reports, time
+// sync and frame acks, and crops. A V1 client is never sent them and is
+// answered with an error if it sends them.
+type Version int
+
+const (
+    V1 Version = 1
+    V2 Version = 2
+)
+
+// HeaderSizeV2 is the size of a V2 header.
+const HeaderSizeV2 = 32
+
+// subprotocolPrefix is followed by the version number in a subprotocol.
+const subprotocolPrefix = "hdmi-stream.v"
+
+// Subprotocols are the server's subprotocols, most preferred first, as
+// websocket.Upgrader takes them.
+var Subprotocols = []string{V2.Subprotocol(), V1.Subprotocol()}
+
+// v2Only holds the control message types and binary magics new in V2.
+var (
+    v2Only = map[string]bool{
+        TypeDeltaOn:  true,
+        TypeDeltaOff: true,
+        TypeDevice:   true,
+        TypeTimeSync: true,
+        TypeFrameAck: true,
+        TypeSetCrop:  true,
+        TypeCrop:     true,
+    }
+    v2OnlyMagic = map[[4]byte]bool{TileMagic: true}
+)
+
+// Subprotocol returns v's subprotocol name.
+func (v Version) Subprotocol() string {
+    return fmt.Sprintf("%s%d", subprotocolPrefix, int(v))
+}
+
+func (v Version) String() string { return v.Subprotocol() }
+
+// Negotiated returns the version of the subprotocol an upgrade settled
+// on, V1 when it settled on none.
+func Negotiated(subprotocol string) Version {
+    if n, ok := strings.CutPrefix(subprotocol, subprotocolPrefix); ok && n == "2" {
+        return V2
+    }
+    return V1
+}
+
+// Has reports whether control message type typ, in either direction,
+// exists in v.
+func (v Version) Has(typ string) bool {
+    return v >= V2 || !v2Only[typ]
+}
+
+// HasMagic reports whether binary messages marked magic exist in v.
+func (v Version) HasMagic(magic [4]byte) bool {
+    return v >= V2 || !v2OnlyMagic[magic]
+}
+
+// HeaderSize returns the size of v's header.
+func (v Version) HeaderSize() int {
+    if v >= V2 {
+        return HeaderSizeV2
+    }
+    return HeaderSize
+}
+
+// EncodeHeader writes h into the first v.HeaderSize() bytes of buf. V1
+// has no send time, and leaves out h.SendTS.
+func (v Version) EncodeHeader(buf []byte, h FrameHeader) error {
+    if v < V2 {
+        return EncodeFrameHeader(buf, h)
+    }
+    if len(buf) < HeaderSizeV2 {
+        return ErrShortHeader
+    }
+    if h.Length > MaxPayload {
+        return ErrPayloadTooLarge
+    }
+    if h.Magic == ([4]byte{}) {
+        h.Magic = FrameMagic
+    }
+    copy(buf[0:4], h.Magic[:])
+    binary.BigEndian.PutUint64(buf[4:12], h.Seq)
+    binary.BigEndian.PutUint64(buf[12:20], uint64(h.Timestamp))
+    binary.BigEndian.PutUint64(buf[20:28], uint64(h.SendTS))
+    binary.BigEndian.PutUint32(buf[28:32], h.Length)
+    return nil
+}
+
+// DecodeHeader parses the v header at the start of buf, rejecting
+// magics v does not have.
+func (v Version) DecodeHeader(buf []byte) (FrameHeader, error) {
+    if v < V2 {
+        h, err := DecodeFrameHeader(buf)
+        if err == nil && !v.HasMagic(h.Magic) {
+            err = ErrBadMagic
+        }
+        return h, err
+    }
+    var h FrameHeader
+    if len(buf) < HeaderSizeV2 {
+        return h, ErrShortHeader
+    }
+    copy(h.Magic[:], buf[0:4])
+    if !knownMagic(h.Magic) {
+        return h, ErrBadMagic
+    }
+    h.Seq = binary.BigEndian.Uint64(buf[4:12])
+    h.Timestamp = int64(binary.BigEndian.Uint64(buf[12:20]))
+    h.SendTS = int64(binary.BigEndian.Uint64(buf[20:28]))
+    h.Length = binary.BigEndian.Uint32(buf[28:32])
+    if h.Length > MaxPayload {
+        return h, ErrPayloadTooLarge
+    }
+    return h, nil
+}
+
+// Decode splits a complete v message into its header and payload, as
+// DecodeFrame does for V1.
+func (v Version) Decode(msg []byte) (FrameHeader, []byte, error) {
+    h, err := v.DecodeHeader(msg)
+    if err != nil {
+        return h, nil, err
+    }
+    payload := msg[v.HeaderSize():]
+    if len(payload) != int(h.Length) {
+        return h, nil, ErrPayloadLength
+    }
+    return h, payload, nil
+}
+
+// Encode returns a complete v message of h followed by payload, with
+// h.Length set to match.
+func (v Version) Encode(h FrameHeader, payload []byte) ([]byte, error) {
+    if len(payload) > MaxPayload {
+        return nil, ErrPayloadTooLarge
+    }
+    if !v.HasMagic(h.Magic) {
+        return nil, fmt.Errorf("protocol: %s has no %q messages", v, h.Magic[:])
+    }
+    n := v.HeaderSize()
+    msg := make([]byte, n+len(payload))
+    h.Length = uint32(len(payload))
+    if err := v.EncodeHeader(msg, h); err != nil {
+        return nil, err
+    }
+    copy(msg[n:], payload)
+    return msg, nil
+}
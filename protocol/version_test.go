@@ -0,0 +1,155 @@
+package protocol
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "testing"
+)
+
+func TestNegotiated(t *testing.T) {
+    for _, tc := range []struct {
+        subprotocol string
+        want        Version
+    }{
+        {"hdmi-stream.v2", V2},
+        {"hdmi-stream.v1", V1},
+        // No subprotocol is how clients spoke before versions existed.
+        {"", V1},
+        {"hdmi-stream.v3", V1},
+        {"hdmi-stream.v20", V1},
+        {"other.v2", V1},
+    } {
+        if got := Negotiated(tc.subprotocol); got != tc.want {
+            t.Errorf("Negotiated(%q) = %v, want %v", tc.subprotocol, got, tc.want)
+        }
+    }
+    if len(Subprotocols) != 2 || Subprotocols[0] != "hdmi-stream.v2" || Subprotocols[1] != "hdmi-stream.v1" {
+        t.Errorf("Subprotocols = %q, want v2 before v1", Subprotocols)
+    }
+    for _, v := range []Version{V1, V2} {
+        if Negotiated(v.Subprotocol()) != v {
+            t.Errorf("%v does not negotiate to itself", v)
+        }
+    }
+}
+
+func TestVersionHas(t *testing.T) {
+    v1Types := []string{
+        TypeHello, TypeError, TypeSignal, TypeSetParams, TypePause, TypeResume,
+        TypeAudioOff, TypeAudioOn, TypeHeartbeat, TypeSeek, TypeSpeed,
+    }
+    for _, typ := range v1Types {
+        if !V1.Has(typ) || !V2.Has(typ) {
+            t.Errorf("%s missing from V1 or V2", typ)
+        }
+    }
+    v2Types := []string{TypeDeltaOn, TypeDeltaOff, TypeDevice, TypeTimeSync, TypeFrameAck, TypeSetCrop, TypeCrop}
+    for _, typ := range v2Types {
+        if V1.Has(typ) {
+            t.Errorf("V1 has %s", typ)
+        }
+        if !V2.Has(typ) {
+            t.Errorf("V2 lacks %s", typ)
+        }
+    }
+    if len(v2Only) != len(v2Types) {
+        t.Errorf("v2Only has %d types, the test knows %d", len(v2Only), len(v2Types))
+    }
+
+    for _, magic := range [][4]byte{FrameMagic, H264Magic, H264KeyMagic, AudioMagic} {
+        if !V1.HasMagic(magic) || !V2.HasMagic(magic) {
+            t.Errorf("%q missing from V1 or V2", magic[:])
+        }
+    }
+    if V1.HasMagic(TileMagic) || !V2.HasMagic(TileMagic) {
+        t.Error("tiles should be in V2 only")
+    }
+}
+
+func TestVersionHeaderLayout(t *testing.T) {
+    h := FrameHeader{Magic: FrameMagic, Seq: 0x0102030405060708, Timestamp: 1_700_000_000_000_001, SendTS: 1_700_000_000_000_002, Length: 3}
+
+    v1, err := V1.Encode(h, []byte("abc"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    old, err := EncodeFrame(h.Seq, h.Timestamp, []byte("abc"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(v1, old) || V1.HeaderSize() != HeaderSize {
+        t.Errorf("V1 message % x differs from the original protocol's % x", v1, old)
+    }
+
+    v2, err := V2.Encode(h, []byte("abc"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(v2) != HeaderSizeV2+3 || V2.HeaderSize() != HeaderSizeV2 {
+        t.Fatalf("V2 message is %d bytes", len(v2))
+    }
+    if !bytes.Equal(v2[0:4], FrameMagic[:]) ||
+        binary.BigEndian.Uint64(v2[4:12]) != h.Seq ||
+        int64(binary.BigEndian.Uint64(v2[12:20])) != h.Timestamp ||
+        int64(binary.BigEndian.Uint64(v2[20:28])) != h.SendTS ||
+        binary.BigEndian.Uint32(v2[28:32]) != 3 ||
+        string(v2[32:]) != "abc" {
+        t.Errorf("V2 message laid out as % x", v2)
+    }
+
+    for _, tc := range []struct {
+        v      Version
+        msg    []byte
+        sendTS int64
+    }{{V1, v1, 0}, {V2, v2, h.SendTS}} {
+        got, payload, err := tc.v.Decode(tc.msg)
+        if err != nil {
+            t.Fatalf("%v: %v", tc.v, err)
+        }
+        want := h
+        want.SendTS = tc.sendTS
+        if got != want || string(payload) != "abc" {
+            t.Errorf("%v decoded %+v %q, want %+v", tc.v, got, payload, want)
+        }
+    }
+
+    // Read in the other version, neither parses.
+    if _, _, err := V1.Decode(v2); !errors.Is(err, ErrPayloadLength) {
+        t.Errorf("V2 message read as V1: err = %v, want ErrPayloadLength", err)
+    }
+    if _, _, err := V2.Decode(v1); !errors.Is(err, ErrShortHeader) && !errors.Is(err, ErrPayloadLength) {
+        t.Errorf("V1 message read as V2: err = %v", err)
+    }
+    if _, err := V2.DecodeHeader(v2[:HeaderSizeV2-1]); !errors.Is(err, ErrShortHeader) {
+        t.Errorf("short V2 header: err = %v, want ErrShortHeader", err)
+    }
+}
+
+func TestV1HasNoTiles(t *testing.T) {
+    h := FrameHeader{Magic: TileMagic, Seq: 9, Timestamp: 1}
+    if _, err := V1.Encode(h, []byte("tiles")); err == nil {
+        t.Error("V1 encoded a tile message")
+    }
+    msg, err := V2.Encode(h, []byte("tiles"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := V2.Decode(msg); err != nil {
+        t.Errorf("V2 tile message: %v", err)
+    }
+    // The same bytes under a V1-sized header are still not a V1 message.
+    v1 := make([]byte, HeaderSize)
+    copy(v1, TileMagic[:])
+    if _, err := V1.DecodeHeader(v1); !errors.Is(err, ErrBadMagic) {
+        t.Errorf("V1 header with tile magic: err = %v, want ErrBadMagic", err)
+    }
+}
+
+func TestHelloCarriesVersion(t *testing.T) {
+    for _, v := range []Version{V1, V2} {
+        if h := NewHello("c", v); h.Version != v || h.Type != TypeHello {
+            t.Errorf("NewHello(%v) = %+v", v, h)
+        }
+    }
+}
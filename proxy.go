@@ -0,0 +1,94 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "github.com/Cdaprod/hdmi-streaming-app/auth"
+)
+
+// mount serves h under cfg.BasePath. A proxy may pass the prefix on or
+// strip it, so paths are served either way; the bare prefix redirects to
+// itself with a slash so the viewer's relative URLs resolve under it.
+func mount(h http.Handler) http.Handler {
+    base := cfg.BasePath
+    if base == "" {
+        return h
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch p := r.URL.Path; {
+        case p == base:
+            u := *r.URL
+            u.Path = base + "/"
+            http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+            return
+        case strings.HasPrefix(p, base+"/"):
+            r2 := new(http.Request)
+            *r2 = *r
+            r2.URL = new(url.URL)
+            *r2.URL = *r.URL
+            r2.URL.Path = strings.TrimPrefix(p, base)
+            r2.URL.RawPath = ""
+            r = r2
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// externalURL returns the URL a client would use for path on this
+// server: the scheme and host it addressed, through a trusted proxy if
+// need be, and the base path. websocket gives ws or wss.
+func externalURL(r *http.Request, path string, websocket bool) string {
+    scheme, host := limiter.Origin(r)
+    if websocket {
+        scheme = map[string]string{"http": "ws", "https": "wss"}[scheme]
+    }
+    return scheme + "://" + host + cfg.BasePath + path
+}
+
+// withCORS answers preflight requests from the cors_origins and marks
+// h's responses readable by their scripts. Without cors_origins it
+// returns h as it is. The token check still applies to the request that
+// follows a preflight.
+func withCORS(h http.HandlerFunc) http.HandlerFunc {
+    if len(cfg.CORSOrigins) == 0 {
+        return h
+    }
+    anyOrigin := false
+    for _, o := range cfg.CORSOrigins {
+        anyOrigin = anyOrigin || o == "*"
+    }
+    methods := strings.Join(cfg.CORSMethods, ", ")
+    headers := strings.Join(cfg.CORSHeaders, ", ")
+    maxAge := strconv.Itoa(int(cfg.CORSMaxAge.Seconds()))
+    return func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        if origin == "" {
+            h(w, r)
+            return
+        }
+        w.Header().Add("Vary", "Origin")
+        u, err := url.Parse(origin)
+        allowed := err == nil && u.Host != "" && (anyOrigin || auth.OriginAllowed(cfg.CORSOrigins, u))
+        preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+        if preflight {
+            if !allowed {
+                http.Error(w, "origin not allowed", http.StatusForbidden)
+                return
+            }
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Allow-Methods", methods)
+            w.Header().Set("Access-Control-Allow-Headers", headers)
+            w.Header().Set("Access-Control-Max-Age", maxAge)
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        if allowed {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+            w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+        }
+        h(w, r)
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+func TestCORS(t *testing.T) {
+    c := config.Default()
+    c.CORSOrigins = []string{"https://app.example", "*.partner.example"}
+    setupServer(t, c)
+    called := false
+    h := withCORS(func(w http.ResponseWriter, r *http.Request) {
+        called = true
+        w.WriteHeader(http.StatusTeapot)
+    })
+
+    for _, tc := range []struct {
+        name, method, origin, requestMethod string
+        code                                int
+        allowOrigin                         string
+        reachesHandler                      bool
+    }{
+        {"preflight", http.MethodOptions, "https://app.example", "POST", http.StatusNoContent, "https://app.example", false},
+        {"preflight from a subdomain", http.MethodOptions, "https://cam.partner.example", "GET", http.StatusNoContent, "https://cam.partner.example", false},
+        {"preflight from the bare wildcard domain", http.MethodOptions, "https://partner.example", "GET", http.StatusForbidden, "", false},
+        {"preflight from elsewhere", http.MethodOptions, "https://evil.example", "GET", http.StatusForbidden, "", false},
+        {"preflight with a bad origin", http.MethodOptions, "null", "GET", http.StatusForbidden, "", false},
+        // OPTIONS without Access-Control-Request-Method is not a
+        // preflight and goes to the handler.
+        {"plain options", http.MethodOptions, "https://app.example", "", http.StatusTeapot, "https://app.example", true},
+        {"request from an allowed origin", http.MethodGet, "https://app.example", "", http.StatusTeapot, "https://app.example", true},
+        {"request from elsewhere", http.MethodGet, "https://evil.example", "", http.StatusTeapot, "", true},
+        {"same-origin request", http.MethodGet, "", "", http.StatusTeapot, "", true},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            called = false
+            r := httptest.NewRequest(tc.method, "/api/streams", nil)
+            if tc.origin != "" {
+                r.Header.Set("Origin", tc.origin)
+            }
+            if tc.requestMethod != "" {
+                r.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+            }
+            w := httptest.NewRecorder()
+            h(w, r)
+            if w.Code != tc.code {
+                t.Errorf("status %d, want %d", w.Code, tc.code)
+            }
+            if called != tc.reachesHandler {
+                t.Errorf("handler called = %v, want %v", called, tc.reachesHandler)
+            }
+            if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+                t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tc.allowOrigin)
+            }
+            if tc.origin != "" && w.Header().Get("Vary") != "Origin" {
+                t.Errorf("Vary = %q, want Origin", w.Header().Get("Vary"))
+            }
+            if w.Code == http.StatusNoContent {
+                for k, want := range map[string]string{
+                    "Access-Control-Allow-Methods": "GET, POST, DELETE",
+                    "Access-Control-Allow-Headers": "Authorization, Content-Type",
+                    "Access-Control-Max-Age":       "600",
+                } {
+                    if got := w.Header().Get(k); got != want {
+                        t.Errorf("%s = %q, want %q", k, got, want)
+                    }
+                }
+            } else if tc.allowOrigin != "" && w.Header().Get("Access-Control-Expose-Headers") != "Retry-After" {
+                t.Error("Retry-After not exposed to the page")
+            }
+        })
+    }
+
+    // Any origin, with cors_origins *.
+    c.CORSOrigins = []string{"*"}
+    setupServer(t, c)
+    r := httptest.NewRequest(http.MethodOptions, "/snapshot", nil)
+    r.Header.Set("Origin", "http://anything.example:8080")
+    r.Header.Set("Access-Control-Request-Method", "GET")
+    w := httptest.NewRecorder()
+    withCORS(func(http.ResponseWriter, *http.Request) {})(w, r)
+    if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "http://anything.example:8080" {
+        t.Errorf("wildcard preflight: %d, %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+    }
+}
+
+func TestCORSOffWithoutOrigins(t *testing.T) {
+    setupServer(t, config.Default())
+    r := httptest.NewRequest(http.MethodOptions, "/api/streams", nil)
+    r.Header.Set("Origin", "https://app.example")
+    r.Header.Set("Access-Control-Request-Method", "GET")
+    w := httptest.NewRecorder()
+    withCORS(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusMethodNotAllowed) })(w, r)
+    if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Errorf("preflight without cors_origins: %d, %v", w.Code, w.Header())
+    }
+}
+
+func TestMount(t *testing.T) {
+    c := config.Default()
+    c.BasePath = "/hdmi"
+    setupServer(t, c)
+    mux := http.NewServeMux()
+    var got string
+    route := func(name string) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            got = name + " " + r.URL.Path + "?" + r.URL.RawQuery
+        }
+    }
+    mux.Handle("/api/streams", route("streams"))
+    mux.Handle("/ws", route("ws"))
+    mux.Handle("/", route("index"))
+    h := mount(mux)
+
+    for _, tc := range []struct {
+        path string
+        want string
+    }{
+        // A proxy that passes the prefix on.
+        {"/hdmi/api/streams", "streams /api/streams?"},
+        {"/hdmi/ws?token=t", "ws /ws?token=t"},
+        {"/hdmi/", "index /?"},
+        // One that strips it.
+        {"/api/streams", "streams /api/streams?"},
+        {"/ws?token=t", "ws /ws?token=t"},
+        // A path that only starts with the same letters keeps them.
+        {"/hdmicam/ws", "index /hdmicam/ws?"},
+    } {
+        got = ""
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+        if got != tc.want {
+            t.Errorf("%s reached %q, want %q", tc.path, got, tc.want)
+        }
+    }
+
+    // The bare prefix redirects so relative URLs resolve under it, and
+    // keeps its query.
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/hdmi?token=t", nil))
+    if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/hdmi/?token=t" {
+        t.Errorf("bare prefix: %d to %q, want a redirect to /hdmi/?token=t", w.Code, w.Header().Get("Location"))
+    }
+
+    // Links the server hands out carry the prefix.
+    r := httptest.NewRequest(http.MethodGet, "http://cam.local/hdmi/api/streams", nil)
+    if u := externalURL(r, "/ws", true); u != "ws://cam.local/hdmi/ws" {
+        t.Errorf("externalURL = %q", u)
+    }
+}
@@ -0,0 +1,126 @@
+// Package quota meters the bytes sent to each access token and cuts a
+// token off once it has used its daily budget.
+//
+// Usage is kept per token, not per connection, so reconnecting does not
+// start the count again. It is held in memory only and starts from
+// nothing when the server restarts.
+package quota
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Error reports a token that has used its budget for the day.
+type Error struct {
+    Token string
+    // Resets is when the next day's budget becomes available, and
+    // RetryAfter how long that is from now.
+    Resets     time.Time
+    RetryAfter time.Duration
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("quota exceeded for token %q", e.Token) }
+
+// Meter counts bytes per token over calendar days in the clock's
+// location. A token with no budget is counted but never cut off.
+type Meter struct {
+    // Default is the daily budget in bytes of tokens without one of
+    // their own; 0 is unlimited.
+    Default int64
+    // Budgets overrides Default per token ID.
+    Budgets map[string]int64
+    // Now is the clock, time.Now when nil. Tests move it forward.
+    Now func() time.Time
+
+    mu   sync.Mutex
+    used map[string]*usage
+}
+
+type usage struct {
+    bytes int64
+    day   time.Time // midnight starting the day bytes was counted in
+}
+
+// Usage is one token's consumption for the current day.
+type Usage struct {
+    Token string `json:"token"`
+    Bytes int64  `json:"bytes"`
+    // Budget is 0 when the token is unlimited.
+    Budget int64     `json:"budget"`
+    Resets time.Time `json:"resets"`
+}
+
+// Budget returns the daily budget of a token, 0 meaning unlimited.
+func (m *Meter) Budget(token string) int64 {
+    if b, ok := m.Budgets[token]; ok {
+        return b
+    }
+    return m.Default
+}
+
+// Check returns an *Error if token has nothing left of today's budget.
+func (m *Meter) Check(token string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.over(token, 0)
+}
+
+// Add counts n bytes sent to token and reports, as Check does, whether
+// that used up the budget. The bytes are counted either way, since they
+// have already gone out.
+func (m *Meter) Add(token string, n int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.over(token, n)
+}
+
+// over adds n to token's usage and returns an *Error if that uses up its
+// budget. The caller holds m.mu.
+func (m *Meter) over(token string, n int) error {
+    u, now, day := m.current(token)
+    u.bytes += int64(n)
+    if b := m.Budget(token); b > 0 && u.bytes >= b {
+        resets := day.AddDate(0, 0, 1)
+        return &Error{Token: token, Resets: resets, RetryAfter: resets.Sub(now)}
+    }
+    return nil
+}
+
+// Snapshot returns every token's usage for the current day, by token.
+func (m *Meter) Snapshot() []Usage {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := make([]Usage, 0, len(m.used))
+    for token := range m.used {
+        u, _, day := m.current(token)
+        out = append(out, Usage{Token: token, Bytes: u.bytes, Budget: m.Budget(token), Resets: day.AddDate(0, 0, 1)})
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Token < out[j].Token })
+    return out
+}
+
+// current returns token's usage, emptied if it was counted on an earlier
+// day, the time, and the midnight starting today. The caller holds m.mu.
+func (m *Meter) current(token string) (*usage, time.Time, time.Time) {
+    now := time.Now()
+    if m.Now != nil {
+        now = m.Now()
+    }
+    y, mo, d := now.Date()
+    day := time.Date(y, mo, d, 0, 0, 0, 0, now.Location())
+    if m.used == nil {
+        m.used = make(map[string]*usage)
+    }
+    u := m.used[token]
+    if u == nil {
+        u = &usage{day: day}
+        m.used[token] = u
+    }
+    if !u.day.Equal(day) {
+        u.bytes, u.day = 0, day
+    }
+    return u, now, day
+}
@@ -0,0 +1,94 @@
+package quota
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+// clock is a Meter.Now that tests move forward by hand.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func TestMeterCutsOffAndResetsAtMidnight(t *testing.T) {
+    loc := time.FixedZone("test", 2*60*60)
+    c := &clock{time.Date(2024, 3, 9, 22, 0, 0, 0, loc)}
+    m := &Meter{Default: 1000, Budgets: map[string]int64{"big": 5000, "free": 0}, Now: c.now}
+
+    if err := m.Add("a", 600); err != nil {
+        t.Fatalf("under budget: %v", err)
+    }
+    c.t = c.t.Add(30 * time.Minute)
+    err := m.Add("a", 400)
+    var qerr *Error
+    if !errors.As(err, &qerr) {
+        t.Fatalf("at budget: err = %v, want *Error", err)
+    }
+    midnight := time.Date(2024, 3, 10, 0, 0, 0, 0, loc)
+    if !qerr.Resets.Equal(midnight) || qerr.RetryAfter != 90*time.Minute || qerr.Token != "a" {
+        t.Errorf("error = %+v, want a reset at %v in 90m", qerr, midnight)
+    }
+    if err := m.Check("a"); !errors.As(err, &qerr) {
+        t.Errorf("Check after the budget ran out: %v", err)
+    }
+    // Other tokens have budgets of their own.
+    if err := m.Add("big", 4999); err != nil {
+        t.Errorf("token with a larger budget: %v", err)
+    }
+    if err := m.Add("free", 1<<40); err != nil {
+        t.Errorf("unlimited token: %v", err)
+    }
+
+    // Still cut off a second before midnight, and back a second after.
+    c.t = midnight.Add(-time.Second)
+    if !errors.As(m.Check("a"), &qerr) {
+        t.Error("budget came back before midnight")
+    } else if qerr.RetryAfter != time.Second {
+        t.Errorf("RetryAfter = %v a second before midnight", qerr.RetryAfter)
+    }
+    c.t = midnight.Add(time.Second)
+    if err := m.Check("a"); err != nil {
+        t.Errorf("next day: %v", err)
+    }
+    if err := m.Add("big", 1); err != nil {
+        t.Errorf("yesterday's usage counted today: %v", err)
+    }
+
+    got := map[string]Usage{}
+    for _, u := range m.Snapshot() {
+        got[u.Token] = u
+    }
+    want := map[string]Usage{
+        "a":    {Token: "a", Bytes: 0, Budget: 1000},
+        "big":  {Token: "big", Bytes: 1, Budget: 5000},
+        "free": {Token: "free", Bytes: 0, Budget: 0},
+    }
+    for token, w := range want {
+        u := got[token]
+        if u.Bytes != w.Bytes || u.Budget != w.Budget || !u.Resets.Equal(midnight.AddDate(0, 0, 1)) {
+            t.Errorf("%s: usage %+v, want %+v resetting at %v", token, u, w, midnight.AddDate(0, 0, 1))
+        }
+    }
+}
+
+func TestMeterCountsBytesThatOvershoot(t *testing.T) {
+    c := &clock{time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+    m := &Meter{Default: 100, Now: c.now}
+    // A frame that crosses the budget has already gone out, so it
+    // counts in full.
+    if err := m.Add("a", 250); err == nil {
+        t.Fatal("no error crossing the budget")
+    }
+    if u := m.Snapshot(); len(u) != 1 || u[0].Bytes != 250 {
+        t.Errorf("usage %+v, want 250 bytes", u)
+    }
+    c.t = c.t.Add(6 * time.Hour)
+    if err := m.Check("a"); err == nil {
+        t.Error("budget came back within the day")
+    }
+    c.t = c.t.Add(12 * time.Hour)
+    if err := m.Add("a", 99); err != nil {
+        t.Errorf("next day: %v", err)
+    }
+}
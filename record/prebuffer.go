@@ -0,0 +1,216 @@
+package record
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+)
+
+// resubscribeDelay is how long a prebuffer waits before watching a hub
+// again after it closed the subscription.
+const resubscribeDelay = time.Second
+
+// Prebuffer keeps a stream's last few seconds of frames, so a recording
+// can start from before it was asked for. It is bounded by a window of
+// capture time and, strictly, by bytes: when the window's worth of frames
+// would take more than the cap, as at a high bitrate, the oldest are
+// dropped and it holds less. An H.264 prebuffer always starts at a
+// keyframe, the last one at or before the window's start, so it holds up
+// to a keyframe interval more than the window. As a hub subscriber it
+// keeps an on-demand device open, which is why the configuration allows
+// one only without on_demand.
+type Prebuffer struct {
+    hub      *hub.Hub
+    window   time.Duration
+    maxBytes int
+    fps      int
+
+    mu  sync.Mutex
+    sub *hub.Subscriber
+    // frames are held oldest first, taking bytes between them; trimmed
+    // is set when the byte cap rather than the window last dropped one.
+    frames  []*hub.Frame
+    bytes   int
+    trimmed bool
+}
+
+// PrebufferStatus describes what a prebuffer holds: the frames of
+// DurationMS of capture time, around the WindowMS it is configured to
+// keep, in Bytes out of its MaxBytes. For H.264 DurationMS runs past
+// WindowMS back to a keyframe. Trimmed says the byte cap is what keeps
+// it short of the window.
+type PrebufferStatus struct {
+    WindowMS   int64 `json:"window_ms"`
+    DurationMS int64 `json:"duration_ms"`
+    Frames     int   `json:"frames"`
+    Bytes      int   `json:"bytes"`
+    MaxBytes   int   `json:"max_bytes"`
+    Trimmed    bool  `json:"trimmed"`
+}
+
+// NewPrebuffer returns a prebuffer of h's frames for window, holding no
+// more than maxBytes of them, at most fps a second or every frame when
+// fps is zero. It holds nothing until Run.
+func NewPrebuffer(h *hub.Hub, window time.Duration, maxBytes, fps int) *Prebuffer {
+    return &Prebuffer{hub: h, window: window, maxBytes: maxBytes, fps: fps}
+}
+
+// Run keeps the prebuffer filled until ctx is done.
+func (p *Prebuffer) Run(ctx context.Context) {
+    defer p.clear()
+    for {
+        p.watch(ctx)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(resubscribeDelay):
+        }
+    }
+}
+
+// watch holds the frames of one subscription until it closes.
+func (p *Prebuffer) watch(ctx context.Context) {
+    sub := p.hub.Subscribe(subscriberBuffer)
+    sub.SetFPS(p.fps)
+    p.mu.Lock()
+    p.sub = sub
+    p.mu.Unlock()
+    defer func() {
+        p.mu.Lock()
+        p.sub = nil
+        p.mu.Unlock()
+        p.hub.Unsubscribe(sub)
+    }()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case f, ok := <-sub.Frames():
+            if !ok {
+                return
+            }
+            p.mu.Lock()
+            p.add(f)
+            p.mu.Unlock()
+        }
+    }
+}
+
+// add takes f as the newest frame and drops the oldest until the rest
+// fit the window and the byte cap. The caller holds p.mu.
+func (p *Prebuffer) add(f *hub.Frame) {
+    p.frames = append(p.frames, f)
+    p.bytes += len(f.Data)
+    if n := p.expired(f.Timestamp.Add(-p.window)); n > 0 {
+        p.trimmed = false
+        for ; n > 0; n-- {
+            p.drop()
+        }
+    }
+    for len(p.frames) > 0 {
+        old := p.frames[0]
+        tooBig := p.bytes > p.maxBytes
+        // A recording cannot start on an H.264 frame that is not a
+        // keyframe, so those go with the frames before them.
+        orphan := old.Format == capture.FormatH264 && !old.Key
+        if !tooBig && !orphan {
+            break
+        }
+        if tooBig {
+            p.trimmed = true
+        }
+        p.drop()
+    }
+}
+
+// expired returns how many of the oldest frames were captured before
+// the window, which starts at start. An H.264 prebuffer keeps the frames
+// from the last keyframe at or before start, or it would hold up to a
+// keyframe interval less than the window, and nothing at all when the
+// window is the shorter. The caller holds p.mu.
+func (p *Prebuffer) expired(start time.Time) int {
+    n := 0
+    for i, f := range p.frames {
+        if f.Format != capture.FormatH264 {
+            if !f.Timestamp.Before(start) {
+                break
+            }
+            n = i + 1
+            continue
+        }
+        if f.Timestamp.After(start) {
+            break
+        }
+        if f.Key {
+            n = i
+        }
+    }
+    return n
+}
+
+// drop releases the oldest frame. The caller holds p.mu.
+func (p *Prebuffer) drop() {
+    old := p.frames[0]
+    p.frames[0] = nil
+    p.frames = p.frames[1:]
+    p.bytes -= len(old.Data)
+    old.Release()
+}
+
+// clear drops every frame.
+func (p *Prebuffer) clear() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    for len(p.frames) > 0 {
+        p.drop()
+    }
+    p.trimmed = false
+}
+
+// Frames returns the frames held, oldest first, each of which the caller
+// must release. Frames already sent to the prebuffer but not yet taken
+// in are included, so a subscription made before the call misses
+// nothing between the last of them and its own first frame.
+func (p *Prebuffer) Frames() []*hub.Frame {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.sub != nil {
+        for drained := false; !drained; {
+            select {
+            case f, ok := <-p.sub.Frames():
+                if !ok {
+                    drained = true
+                    break
+                }
+                p.add(f)
+            default:
+                drained = true
+            }
+        }
+    }
+    frames := append([]*hub.Frame(nil), p.frames...)
+    for _, f := range frames {
+        f.Retain()
+    }
+    return frames
+}
+
+// Status reports what the prebuffer holds.
+func (p *Prebuffer) Status() PrebufferStatus {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    st := PrebufferStatus{
+        WindowMS: p.window.Milliseconds(),
+        Frames:   len(p.frames),
+        Bytes:    p.bytes,
+        MaxBytes: p.maxBytes,
+        Trimmed:  p.trimmed,
+    }
+    if n := len(p.frames); n > 0 {
+        st.DurationMS = p.frames[n-1].Timestamp.Sub(p.frames[0].Timestamp).Milliseconds()
+    }
+    return st
+}
@@ -0,0 +1,173 @@
+package record
+
+import (
+    "context"
+    "encoding/binary"
+    "io"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// gopEncoder stands in for an H.264 encoder, turning each frame into a
+// few bytes and making every gop'th one a keyframe.
+type gopEncoder struct {
+    gop int
+    n   int
+}
+
+func (e *gopEncoder) Encode(f capture.Frame, quality int) (capture.Frame, error) {
+    out := capture.Frame{
+        Data:      binary.BigEndian.AppendUint64(nil, uint64(e.n)),
+        Format:    capture.FormatH264,
+        Width:     f.Width,
+        Height:    f.Height,
+        Timestamp: f.Timestamp,
+        Key:       e.n%e.gop == 0,
+    }
+    e.n++
+    return out, nil
+}
+
+func (e *gopEncoder) Format() capture.PixelFormat { return capture.FormatH264 }
+
+func (e *gopEncoder) Close() error {
+    e.n = 0
+    return nil
+}
+
+// fill adds n frames of size bytes, 100ms apart, to p; with gop set they
+// are H.264 with a keyframe every gop frames, otherwise JPEG.
+func fill(p *Prebuffer, n, size, gop int) {
+    start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    for i := 0; i < n; i++ {
+        f := &hub.Frame{Frame: capture.Frame{Data: make([]byte, size), Format: capture.FormatMJPEG, Timestamp: start.Add(time.Duration(i) * 100 * time.Millisecond)}, Seq: uint64(i + 1)}
+        if gop > 0 {
+            f.Format = capture.FormatH264
+            f.Key = i%gop == 0
+        }
+        p.add(f)
+    }
+}
+
+func TestPrebufferWindow(t *testing.T) {
+    for _, tc := range []struct {
+        name     string
+        gop      int
+        min, max int64
+    }{
+        {"jpeg", 0, 1000, 1000},
+        // A keyframe every 1.5s: the window reaches back to the last one
+        // at or before its start.
+        {"h264", 15, 1000, 2400},
+        // Keyframes 5s apart, a window shorter than the interval.
+        {"h264_long_gop", 50, 1000, 5900},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            p := NewPrebuffer(nil, time.Second, 1<<20, 0)
+            for n := 11; n <= 120; n++ {
+                p.clear()
+                fill(p, n, 100, tc.gop)
+                st := p.Status()
+                if st.DurationMS < tc.min || st.DurationMS > tc.max {
+                    t.Fatalf("after %d frames holds %dms, want %d to %d", n, st.DurationMS, tc.min, tc.max)
+                }
+                if first := p.frames[0]; tc.gop > 0 && !first.Key {
+                    t.Fatalf("after %d frames starts at non-keyframe %d", n, first.Seq)
+                }
+                if st.Trimmed || st.WindowMS != 1000 || st.Bytes != 100*st.Frames {
+                    t.Fatalf("after %d frames: %+v", n, st)
+                }
+            }
+        })
+    }
+}
+
+func TestPrebufferByteCap(t *testing.T) {
+    for _, gop := range []int{0, 15} {
+        p := NewPrebuffer(nil, 10*time.Second, 1000, 0)
+        fill(p, 60, 100, gop)
+        st := p.Status()
+        if st.Bytes > st.MaxBytes || !st.Trimmed {
+            t.Errorf("gop %d: %+v, want trimmed to the cap", gop, st)
+        }
+        if gop > 0 && len(p.frames) > 0 && !p.frames[0].Key {
+            t.Errorf("gop %d: starts at non-keyframe %d", gop, p.frames[0].Seq)
+        }
+    }
+}
+
+// A recording started with the prebuffer of an H.264 stream, partway
+// between keyframes, runs from before the window's start through the
+// live frames without a frame missing where one hands over to the other.
+func TestRecordingContinuesFromPrebuffer(t *testing.T) {
+    const (
+        fps    = 30
+        window = 400 * time.Millisecond
+    )
+    h := hub.New(capture.NewSyntheticSource(160, 96, fps), "synthetic", nil)
+    // A keyframe each second, more than the window.
+    h.Encoder = &gopEncoder{gop: fps}
+    ctx, cancel := context.WithCancel(context.Background())
+    done := make(chan struct{}, 2)
+    pre := NewPrebuffer(h, window, 16<<20, 0)
+    go func() { h.Run(ctx); done <- struct{}{} }()
+    go func() { pre.Run(ctx); done <- struct{}{} }()
+    defer func() {
+        cancel()
+        <-done
+        <-done
+    }()
+
+    // Long enough for the oldest keyframe to have left the window.
+    time.Sleep(1700 * time.Millisecond)
+    r := New(h, t.TempDir(), time.Minute)
+    r.Prebuffer = pre
+    started := time.Now()
+    id, err := r.Start(Options{IncludePrebuffer: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(time.Second)
+    if _, err := r.Stop(); err != nil {
+        t.Fatal(err)
+    }
+
+    p, err := r.Open(id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer p.Close()
+    var frames []protocol.FrameHeader
+    for {
+        hdr, _, err := p.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        frames = append(frames, hdr)
+    }
+    if len(frames) < fps {
+        t.Fatalf("%d frames recorded", len(frames))
+    }
+    if frames[0].Magic != protocol.H264KeyMagic {
+        t.Errorf("recording starts with %q, not a keyframe", frames[0].Magic[:])
+    }
+    if first := time.UnixMicro(frames[0].Timestamp); started.Sub(first) < window {
+        t.Errorf("recording starts %v before Start, want at least the %v window", started.Sub(first), window)
+    }
+    for i := 1; i < len(frames); i++ {
+        prev, f := frames[i-1], frames[i]
+        // The hub numbers every frame it publishes, so each one is here
+        // and none is twice. A busy machine can stretch the time between
+        // them but not reorder it.
+        if f.Seq != prev.Seq+1 || f.Timestamp <= prev.Timestamp {
+            t.Fatalf("frame %d (at %d) follows %d (at %d)", f.Seq, f.Timestamp, prev.Seq, prev.Timestamp)
+        }
+    }
+}
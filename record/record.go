@@ -0,0 +1,407 @@
+// Package record writes frames from the hub to disk and plays the
+// recordings back.
+//
+// Recordings are split into segment files so a crash loses at most the
+// segment being written. Each file is a sequence of frames, each one the
+// same header the websocket uses (see protocol.EncodeFrameHeader)
+// followed by the JPEG data, or H.264 with the H.264 magics, so the
+// original capture timestamps survive.
+package record
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// Ext is the file extension of recording segments.
+const Ext = ".hdmv"
+
+// subscriberBuffer is deeper than a viewer's queue: the disk can stall
+// briefly and we would rather catch up than drop frames.
+const subscriberBuffer = 64
+
+var (
+    ErrRecording    = errors.New("record: already recording")
+    ErrNotRecording = errors.New("record: not recording")
+    ErrPrefix       = errors.New("record: filename_prefix may only contain letters, digits, '-' and '_'")
+    ErrNoPrebuffer  = errors.New("record: the stream keeps no prebuffer")
+)
+
+var validPrefix = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Options tune a single recording.
+type Options struct {
+    // Duration stops the recording automatically; zero records until Stop.
+    Duration time.Duration
+    // FilenamePrefix starts every segment file name. Defaults to "rec".
+    FilenamePrefix string
+    // FPS caps the frames recorded a second; zero records every frame.
+    FPS int
+    // IncludePrebuffer starts the recording with the prebuffer's frames,
+    // from before Start, at the prebuffer's own rate.
+    IncludePrebuffer bool
+}
+
+// File is a segment written by a recording.
+type File struct {
+    Name string `json:"name"`
+    Size int64  `json:"size"`
+}
+
+// Status describes the current or most recent recording.
+type Status struct {
+    Recording bool      `json:"recording"`
+    ID        string    `json:"id,omitempty"`
+    Started   time.Time `json:"started,omitempty"`
+    Files     []File    `json:"files,omitempty"`
+    Error     string    `json:"error,omitempty"`
+    // Prebuffer is what the recorder's prebuffer holds, when it has one.
+    Prebuffer *PrebufferStatus `json:"prebuffer,omitempty"`
+}
+
+// Recorder runs at most one recording at a time.
+type Recorder struct {
+    // Prebuffer, when set, keeps the frames a recording may start with.
+    // The recorder does not run it.
+    Prebuffer *Prebuffer
+
+    hub     *hub.Hub
+    dir     string
+    segment time.Duration
+
+    mu      sync.Mutex
+    current *session
+    last    Status
+
+    // indexMu guards index, the frames of each segment file by path.
+    indexMu sync.Mutex
+    index   map[string]*segIndex
+}
+
+// New returns a recorder writing segments of the given length under dir.
+func New(h *hub.Hub, dir string, segment time.Duration) *Recorder {
+    return &Recorder{hub: h, dir: dir, segment: segment}
+}
+
+// Start begins a recording and returns its ID.
+func (r *Recorder) Start(opts Options) (string, error) {
+    if opts.FilenamePrefix == "" {
+        opts.FilenamePrefix = "rec"
+    }
+    if !validPrefix.MatchString(opts.FilenamePrefix) {
+        return "", ErrPrefix
+    }
+    if opts.Duration < 0 {
+        return "", fmt.Errorf("record: negative duration %v", opts.Duration)
+    }
+    if opts.FPS < 0 {
+        return "", fmt.Errorf("record: negative fps %d", opts.FPS)
+    }
+    if opts.IncludePrebuffer && r.Prebuffer == nil {
+        return "", ErrNoPrebuffer
+    }
+    if err := os.MkdirAll(r.dir, 0o755); err != nil {
+        return "", fmt.Errorf("record: %w", err)
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.current != nil {
+        return "", ErrRecording
+    }
+    s := &session{
+        rec:     r,
+        id:      newID(),
+        opts:    opts,
+        started: time.Now(),
+        stop:    make(chan struct{}),
+        done:    make(chan struct{}),
+    }
+    // The live frames carry straight on from the prebuffer rather than
+    // waiting for an H.264 keyframe; write skips to one if the prebuffer
+    // turns out empty.
+    if opts.IncludePrebuffer {
+        s.sub = r.hub.SubscribeContinuing(subscriberBuffer)
+    } else {
+        s.sub = r.hub.Subscribe(subscriberBuffer)
+    }
+    s.sub.SetFPS(opts.FPS)
+    // Taken after subscribing, the prebuffer runs up to where the
+    // subscription starts, give or take frames both have.
+    if opts.IncludePrebuffer {
+        s.pre = r.Prebuffer.Frames()
+    }
+    r.current = s
+    r.last = Status{}
+    go s.run()
+    return s.id, nil
+}
+
+// Stop ends the recording and returns the files it wrote.
+func (r *Recorder) Stop() (Status, error) {
+    r.mu.Lock()
+    s := r.current
+    r.mu.Unlock()
+    if s == nil {
+        return Status{}, ErrNotRecording
+    }
+    s.halt()
+    <-s.done
+    return r.Status(), nil
+}
+
+// SaveClip writes the prebuffer's frames to a recording of their own,
+// its files named with prefix, and returns its ID. It may be called
+// while a recording runs.
+func (r *Recorder) SaveClip(prefix string) (string, error) {
+    if r.Prebuffer == nil {
+        return "", ErrNoPrebuffer
+    }
+    if !validPrefix.MatchString(prefix) {
+        return "", ErrPrefix
+    }
+    if err := os.MkdirAll(r.dir, 0o755); err != nil {
+        return "", fmt.Errorf("record: %w", err)
+    }
+    s := &session{rec: r, id: newID(), opts: Options{FilenamePrefix: prefix}, pre: r.Prebuffer.Frames()}
+    if len(s.pre) == 0 {
+        return "", errors.New("record: the prebuffer is empty")
+    }
+    hdr := make([]byte, protocol.HeaderSize)
+    var err error
+    for len(s.pre) > 0 && err == nil {
+        f := s.pre[0]
+        s.pre = s.pre[1:]
+        err = s.write(hdr, f)
+    }
+    for _, f := range s.pre {
+        f.Release()
+    }
+    if cerr := s.closeSegment(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return "", fmt.Errorf("record: %w", err)
+    }
+    return s.id, nil
+}
+
+// Status reports the running recording, or the last one with any error
+// that ended it.
+func (r *Recorder) Status() Status {
+    r.mu.Lock()
+    st := r.last
+    if r.current != nil {
+        st = r.current.status(true)
+    }
+    r.mu.Unlock()
+    if r.Prebuffer != nil {
+        pst := r.Prebuffer.Status()
+        st.Prebuffer = &pst
+    }
+    return st
+}
+
+// finish records the outcome of s once it has stopped.
+func (r *Recorder) finish(s *session, err error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.current = nil
+    r.last = s.status(false)
+    if err != nil {
+        r.last.Error = err.Error()
+    }
+}
+
+type session struct {
+    rec     *Recorder
+    id      string
+    opts    Options
+    started time.Time
+    sub     *hub.Subscriber
+    // pre are the prebuffer frames to write before the live ones.
+    pre  []*hub.Frame
+    stop chan struct{}
+    once sync.Once
+    done chan struct{}
+
+    mu    sync.Mutex
+    files []File
+
+    f      *os.File
+    w      *bufio.Writer
+    opened time.Time
+}
+
+func (s *session) halt() { s.once.Do(func() { close(s.stop) }) }
+
+func (s *session) status(recording bool) Status {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return Status{
+        Recording: recording,
+        ID:        s.id,
+        Started:   s.started,
+        Files:     append([]File(nil), s.files...),
+    }
+}
+
+func (s *session) run() {
+    defer close(s.done)
+    err := s.record()
+    s.rec.hub.Unsubscribe(s.sub)
+    for _, f := range s.pre {
+        f.Release()
+    }
+    if cerr := s.closeSegment(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        slog.Error("recording stopped", "id", s.id, "err", err)
+    }
+    s.rec.finish(s, err)
+}
+
+func (s *session) record() error {
+    var timeout <-chan time.Time
+    if s.opts.Duration > 0 {
+        t := time.NewTimer(s.opts.Duration)
+        defer t.Stop()
+        timeout = t.C
+    }
+    flush := time.NewTicker(time.Second)
+    defer flush.Stop()
+    hdr := make([]byte, protocol.HeaderSize)
+    // The prebuffer goes first, and the live frames it already had are
+    // skipped.
+    var last uint64
+    for len(s.pre) > 0 {
+        f := s.pre[0]
+        s.pre = s.pre[1:]
+        last = f.Seq
+        if err := s.write(hdr, f); err != nil {
+            return err
+        }
+    }
+    for {
+        select {
+        case <-s.stop:
+            return nil
+        case <-timeout:
+            return nil
+        case <-flush.C:
+            if s.w != nil {
+                if err := s.w.Flush(); err != nil {
+                    return err
+                }
+            }
+        case f, ok := <-s.sub.Frames():
+            if !ok {
+                if err := s.sub.Err(); err != nil {
+                    return err
+                }
+                return errors.New("record: stream ended")
+            }
+            if f.Seq <= last {
+                f.Release()
+                continue
+            }
+            if err := s.write(hdr, f); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// write adds f to the current segment, starting the next one first when
+// it is due, and releases f. hdr is scratch space for the header.
+func (s *session) write(hdr []byte, f *hub.Frame) error {
+    defer f.Release()
+    // An H.264 segment has to start at a keyframe to play on its own, so
+    // rotation waits for one.
+    due := s.f == nil || time.Since(s.opened) >= s.rec.segment
+    if due && (f.Format != capture.FormatH264 || f.Key) {
+        if err := s.rotate(); err != nil {
+            return err
+        }
+    }
+    if s.f == nil {
+        return nil
+    }
+    h := protocol.FrameHeader{Magic: f.Magic(), Seq: f.Seq, Timestamp: f.Timestamp.UnixMicro(), Length: uint32(len(f.Data))}
+    if err := protocol.EncodeFrameHeader(hdr, h); err != nil {
+        return nil
+    }
+    n := len(hdr) + len(f.Data)
+    _, err := s.w.Write(hdr)
+    if err == nil {
+        _, err = s.w.Write(f.Data)
+    }
+    if err != nil {
+        return err
+    }
+    s.grow(int64(n))
+    return nil
+}
+
+// rotate closes the current segment and starts the next one.
+func (s *session) rotate() error {
+    if err := s.closeSegment(); err != nil {
+        return err
+    }
+    s.mu.Lock()
+    n := len(s.files)
+    s.mu.Unlock()
+    name := fmt.Sprintf("%s-%s-%03d%s", s.opts.FilenamePrefix, s.id, n, Ext)
+    f, err := os.OpenFile(filepath.Join(s.rec.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+    if err != nil {
+        return err
+    }
+    s.f = f
+    s.w = bufio.NewWriterSize(f, 1<<20)
+    s.opened = time.Now()
+    s.mu.Lock()
+    s.files = append(s.files, File{Name: name})
+    s.mu.Unlock()
+    return nil
+}
+
+func (s *session) closeSegment() error {
+    if s.f == nil {
+        return nil
+    }
+    err := s.w.Flush()
+    if serr := s.f.Sync(); err == nil {
+        err = serr
+    }
+    if cerr := s.f.Close(); err == nil {
+        err = cerr
+    }
+    s.f, s.w = nil, nil
+    return err
+}
+
+func (s *session) grow(n int64) {
+    s.mu.Lock()
+    s.files[len(s.files)-1].Size += n
+    s.mu.Unlock()
+}
+
+func newID() string {
+    b := make([]byte, 3)
+    rand.Read(b)
+    return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,326 @@
+package record
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// ErrNoRecording is returned by Open for an ID with no frames on disk.
+var ErrNoRecording = errors.New("record: no such recording")
+
+// segmentName matches the files rotate writes: prefix, recording ID and
+// segment number.
+var segmentName = regexp.MustCompile(`^[A-Za-z0-9_-]+-(\d{8}T\d{6}Z-[0-9a-f]{6})-(\d+)` + regexp.QuoteMeta(Ext) + `$`)
+
+// Recording is a recording found on disk. Start and End are the capture
+// times of its first and last frames.
+type Recording struct {
+    ID         string    `json:"id"`
+    Start      time.Time `json:"start"`
+    End        time.Time `json:"end"`
+    DurationMS int64     `json:"duration_ms"`
+    // Video is protocol.VideoJPEG or protocol.VideoH264.
+    Video    string    `json:"video"`
+    Segments []Segment `json:"segments"`
+}
+
+// Segment is one file of a recording.
+type Segment struct {
+    Name   string    `json:"name"`
+    Size   int64     `json:"size"`
+    Start  time.Time `json:"start"`
+    End    time.Time `json:"end"`
+    Frames int       `json:"frames"`
+    // TornBytes is the tail that does not make up a whole frame, as a
+    // crash leaves behind. Playback skips it.
+    TornBytes int64 `json:"torn_bytes,omitempty"`
+}
+
+// segIndex locates every frame of a segment file as it was when
+// scanned.
+type segIndex struct {
+    size   int64
+    mod    time.Time
+    frames []frameRef
+    torn   int64
+}
+
+// frameRef is a frame's header and where its payload starts.
+type frameRef struct {
+    off int64
+    hdr protocol.FrameHeader
+}
+
+func (f frameRef) key() bool { return f.hdr.Magic != protocol.H264Magic }
+
+// recording is a Recording with the index of each of its segments.
+type recording struct {
+    Recording
+    paths []string
+    index []*segIndex
+}
+
+// Recordings lists the recordings under the recorder's directory, oldest
+// first, including one still being written.
+func (r *Recorder) Recordings() ([]Recording, error) {
+    recs, err := r.scan()
+    if err != nil {
+        return nil, err
+    }
+    out := make([]Recording, len(recs))
+    for i, rec := range recs {
+        out[i] = rec.Recording
+    }
+    return out, nil
+}
+
+// Open returns a player for the recording with the given ID, positioned
+// at its first frame. Frames written after Open are not seen.
+func (r *Recorder) Open(id string) (*Player, error) {
+    recs, err := r.scan()
+    if err != nil {
+        return nil, err
+    }
+    for _, rec := range recs {
+        if rec.ID == id {
+            return &Player{rec: rec}, nil
+        }
+    }
+    return nil, ErrNoRecording
+}
+
+// scan indexes the segment files and groups them into recordings,
+// leaving out segments without a whole frame. Files unchanged since the
+// last scan are not read again.
+func (r *Recorder) scan() ([]recording, error) {
+    entries, err := os.ReadDir(r.dir)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("record: %w", err)
+    }
+    type file struct {
+        name string
+        n    int
+    }
+    byID := map[string][]file{}
+    for _, e := range entries {
+        m := segmentName.FindStringSubmatch(e.Name())
+        if m == nil || !e.Type().IsRegular() {
+            continue
+        }
+        n, _ := strconv.Atoi(m[2])
+        byID[m[1]] = append(byID[m[1]], file{e.Name(), n})
+    }
+    active := r.activeSegment()
+
+    r.indexMu.Lock()
+    defer r.indexMu.Unlock()
+    if r.index == nil {
+        r.index = make(map[string]*segIndex)
+    }
+    seen := map[string]bool{}
+    var recs []recording
+    for id, files := range byID {
+        sort.Slice(files, func(i, j int) bool { return files[i].n < files[j].n })
+        rec := recording{Recording: Recording{ID: id, Segments: []Segment{}}}
+        for _, f := range files {
+            path := filepath.Join(r.dir, f.name)
+            seen[path] = true
+            idx, err := r.indexSegment(path, f.name == active)
+            if err != nil {
+                slog.Warn("recording segment unreadable", "file", path, "err", err)
+                continue
+            }
+            if len(idx.frames) == 0 {
+                continue
+            }
+            first, last := idx.frames[0].hdr, idx.frames[len(idx.frames)-1].hdr
+            seg := Segment{
+                Name:      f.name,
+                Size:      idx.size,
+                Start:     time.UnixMicro(first.Timestamp).UTC(),
+                End:       time.UnixMicro(last.Timestamp).UTC(),
+                Frames:    len(idx.frames),
+                TornBytes: idx.torn,
+            }
+            if len(rec.Segments) == 0 {
+                rec.Start = seg.Start
+                rec.Video = protocol.VideoJPEG
+                if first.Magic != protocol.FrameMagic {
+                    rec.Video = protocol.VideoH264
+                }
+            }
+            rec.End = seg.End
+            rec.Segments = append(rec.Segments, seg)
+            rec.paths = append(rec.paths, path)
+            rec.index = append(rec.index, idx)
+        }
+        if len(rec.Segments) == 0 {
+            continue
+        }
+        rec.DurationMS = rec.End.Sub(rec.Start).Milliseconds()
+        recs = append(recs, rec)
+    }
+    for path := range r.index {
+        if !seen[path] {
+            delete(r.index, path)
+        }
+    }
+    sort.Slice(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+    return recs, nil
+}
+
+// indexSegment returns the index of the file at path, reading it again
+// only if its size or modification time changed. The caller holds
+// r.indexMu. A torn tail is logged unless the file is still being
+// written, where it is just data not yet flushed.
+func (r *Recorder) indexSegment(path string, writing bool) (*segIndex, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    fi, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if idx := r.index[path]; idx != nil && idx.size == fi.Size() && idx.mod.Equal(fi.ModTime()) {
+        return idx, nil
+    }
+    idx := &segIndex{size: fi.Size(), mod: fi.ModTime()}
+    buf := make([]byte, protocol.HeaderSize)
+    var off int64
+    for off < idx.size {
+        if _, err := f.ReadAt(buf, off); err != nil {
+            if err != io.EOF {
+                return nil, err
+            }
+            break
+        }
+        h, err := protocol.DecodeFrameHeader(buf)
+        if err != nil {
+            break
+        }
+        end := off + protocol.HeaderSize + int64(h.Length)
+        if end > idx.size {
+            break
+        }
+        idx.frames = append(idx.frames, frameRef{off: off + protocol.HeaderSize, hdr: h})
+        off = end
+    }
+    if off < idx.size && !writing {
+        idx.torn = idx.size - off
+        slog.Warn("recording segment has a torn tail, skipping it", "file", path, "frames", len(idx.frames), "torn_bytes", idx.torn)
+    }
+    r.index[path] = idx
+    return idx, nil
+}
+
+// activeSegment names the segment being written, if any.
+func (r *Recorder) activeSegment() string {
+    r.mu.Lock()
+    s := r.current
+    r.mu.Unlock()
+    if s == nil {
+        return ""
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.files) == 0 {
+        return ""
+    }
+    return s.files[len(s.files)-1].Name
+}
+
+// Player reads a recording's frames in order, passing from one segment
+// to the next as if they were one file. It is not safe for concurrent
+// use.
+type Player struct {
+    rec recording
+    // seg and frame locate the next frame; f is seg's file once opened.
+    seg, frame int
+    f          *os.File
+}
+
+// Recording describes what is being played.
+func (p *Player) Recording() Recording { return p.rec.Recording }
+
+// Next returns the next frame's header and payload, or io.EOF after the
+// last one.
+func (p *Player) Next() (protocol.FrameHeader, []byte, error) {
+    for p.seg < len(p.rec.index) && p.frame >= len(p.rec.index[p.seg].frames) {
+        p.setSegment(p.seg + 1)
+        p.frame = 0
+    }
+    if p.seg >= len(p.rec.index) {
+        return protocol.FrameHeader{}, nil, io.EOF
+    }
+    if p.f == nil {
+        f, err := os.Open(p.rec.paths[p.seg])
+        if err != nil {
+            return protocol.FrameHeader{}, nil, fmt.Errorf("record: %w", err)
+        }
+        p.f = f
+    }
+    ref := p.rec.index[p.seg].frames[p.frame]
+    data := make([]byte, ref.hdr.Length)
+    if _, err := p.f.ReadAt(data, ref.off); err != nil {
+        return protocol.FrameHeader{}, nil, fmt.Errorf("record: %s: %w", p.rec.Segments[p.seg].Name, err)
+    }
+    p.frame++
+    return ref.hdr, data, nil
+}
+
+// Seek moves to the first frame captured at least offset after the
+// recording's start, or for H.264 to the keyframe before it so the
+// picture can be decoded. Seeking past the end leaves nothing to read.
+func (p *Player) Seek(offset time.Duration) {
+    target := p.rec.Start.Add(offset).UnixMicro()
+    seg, frame := len(p.rec.index), 0
+    for i, idx := range p.rec.index {
+        j := sort.Search(len(idx.frames), func(j int) bool { return idx.frames[j].hdr.Timestamp >= target })
+        if j < len(idx.frames) {
+            seg, frame = i, j
+            break
+        }
+    }
+    // Every segment starts at a keyframe, so the search stays within one.
+    if seg < len(p.rec.index) {
+        for frame > 0 && !p.rec.index[seg].frames[frame].key() {
+            frame--
+        }
+    }
+    p.setSegment(seg)
+    p.frame = frame
+}
+
+// setSegment moves to segment i, closing the file of the one left.
+func (p *Player) setSegment(i int) {
+    if i != p.seg && p.f != nil {
+        p.f.Close()
+        p.f = nil
+    }
+    p.seg = i
+}
+
+// Close releases the open segment file.
+func (p *Player) Close() error {
+    if p.f == nil {
+        return nil
+    }
+    err := p.f.Close()
+    p.f = nil
+    return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+)
+
+type recordStartRequest struct {
+    Duration         string `json:"duration"`
+    FilenamePrefix   string `json:"filename_prefix"`
+    FPS              int    `json:"fps"`
+    IncludePrebuffer bool   `json:"include_prebuffer"`
+}
+
+type recordStartResponse struct {
+    ID string `json:"id"`
+}
+
+// The recording endpoints act on the default stream unless ?stream=
+// names another.
+
+// recordStartHandler serves POST /api/record/start. The body is optional;
+// duration is a Go duration string such as "90s", and fps caps the
+// frame rate, record_fps when it is zero. include_prebuffer starts the
+// recording with the frames from before the request, at their original
+// timestamps.
+func recordStartHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    var req recordStartRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        writeError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+        return
+    }
+    if req.FPS < 0 || req.FPS > protocol.MaxFPS {
+        writeError(w, http.StatusBadRequest, "invalid fps")
+        return
+    }
+    opts := record.Options{FilenamePrefix: req.FilenamePrefix, FPS: req.FPS, IncludePrebuffer: req.IncludePrebuffer}
+    if opts.FPS == 0 {
+        opts.FPS = cfg.RecordFPS
+    }
+    if req.Duration != "" {
+        d, err := time.ParseDuration(req.Duration)
+        if err != nil || d <= 0 {
+            writeError(w, http.StatusBadRequest, "invalid duration "+req.Duration)
+            return
+        }
+        opts.Duration = d
+    }
+    id, err := st.Recorder.Start(opts)
+    switch {
+    case errors.Is(err, record.ErrRecording):
+        writeError(w, http.StatusConflict, err.Error())
+    case errors.Is(err, record.ErrPrefix):
+        writeError(w, http.StatusBadRequest, err.Error())
+    case errors.Is(err, record.ErrNoPrebuffer):
+        writeError(w, http.StatusBadRequest, err.Error()+"; set record_prebuffer")
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, err.Error())
+    default:
+        writeJSON(w, http.StatusOK, recordStartResponse{ID: id})
+    }
+}
+
+// recordStopHandler serves POST /api/record/stop.
+func recordStopHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    status, err := st.Recorder.Stop()
+    if errors.Is(err, record.ErrNotRecording) {
+        writeError(w, http.StatusConflict, err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, status)
+}
+
+// recordStatusHandler serves GET /api/record/status, with what the
+// prebuffer holds when there is one.
+func recordStatusHandler(w http.ResponseWriter, r *http.Request) {
+    st, ok := streamParam(w, r)
+    if !ok {
+        return
+    }
+    writeJSON(w, http.StatusOK, st.Recorder.Status())
+}
+
+// recordingInfo is a recording on disk and the stream that made it.
+type recordingInfo struct {
+    Stream string `json:"stream"`
+    record.Recording
+    ReplayURL string `json:"replay_url"`
+}
+
+type recordingsResponse struct {
+    Recordings []recordingInfo `json:"recordings"`
+}
+
+// recordingsHandler serves GET /api/recordings: every stream's
+// recordings with their segments, oldest first within a stream, and the
+// websocket URL each plays back at.
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+    resp := recordingsResponse{Recordings: []recordingInfo{}}
+    for _, st := range streams.All() {
+        recs, err := st.Recorder.Recordings()
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        for _, rec := range recs {
+            resp.Recordings = append(resp.Recordings, recordingInfo{
+                Stream:    st.Name,
+                Recording: rec,
+                ReplayURL: externalURL(r, "/ws/replay/"+rec.ID, true),
+            })
+        }
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
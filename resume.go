@@ -0,0 +1,110 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+const (
+    // resumeGrace is how long a new connection holds live frames back in
+    // case its first message is a resume. Sending live frames first would
+    // put the replayed ones after them.
+    resumeGrace = 200 * time.Millisecond
+    // replaySpeedup is how much faster than they were captured replayed
+    // frames are sent.
+    replaySpeedup = 4
+)
+
+// awaitResume holds the writer until the client has said something or
+// resumeGrace has passed, and returns the sequence number to replay from
+// when what it said was a resume. Without a history there is nothing to
+// resume and no reason to wait.
+func (c *client) awaitResume(ctx context.Context) (uint64, bool) {
+    if c.stream.Hub.HistoryBytes <= 0 {
+        return 0, false
+    }
+    t := time.NewTimer(resumeGrace)
+    defer t.Stop()
+    select {
+    case <-c.spoke:
+        // The resume is queued before spoke is closed, so it goes ahead
+        // of the live frames that arrived meanwhile.
+        select {
+        case from := <-c.resume:
+            return from, true
+        default:
+        }
+    case <-t.C:
+    case <-ctx.Done():
+    }
+    return 0, false
+}
+
+// replay sends the held frames after from, faster than real time, then
+// keeps asking for what arrived meanwhile until it has caught up with the
+// live stream. It runs on the writer goroutine, so it delays no one else.
+// Frames the hub drops for the client during the replay are sent from
+// the history instead and do not count against its adaptive level.
+func (c *client) replay(ctx context.Context, sub *hub.Subscriber, from uint64) error {
+    h := c.stream.Hub
+    frames, oldest, ok := h.Since(from)
+    if !ok {
+        c.log.Debug("resume failed", "from_seq", from, "oldest_seq", oldest)
+        return c.writeJSON(protocol.NewResumeFailed(oldest))
+    }
+    dropped := sub.Dropped()
+    c.replaying.Store(true)
+    defer func() {
+        c.excused.Add(sub.Dropped() - dropped)
+        c.replaying.Store(false)
+    }()
+
+    sent := 0
+    for len(frames) > 0 {
+        n, err := c.replayFrames(ctx, sub, frames)
+        sent += n
+        if err != nil || ctx.Err() != nil {
+            return err
+        }
+        if frames, _, ok = h.Since(c.lastSeq); !ok {
+            break
+        }
+    }
+    c.log.Debug("resumed", "from_seq", from, "replayed", sent)
+    return nil
+}
+
+// replayFrames sends one batch from the history, spaced out by their
+// capture times, and releases the batch.
+func (c *client) replayFrames(ctx context.Context, sub *hub.Subscriber, frames []*hub.Frame) (int, error) {
+    defer func() {
+        for _, f := range frames {
+            f.Release()
+        }
+    }()
+    sent := 0
+    var prev *hub.Frame
+    for _, f := range frames {
+        if f.Seq <= c.lastSeq {
+            continue
+        }
+        if prev != nil {
+            select {
+            case <-ctx.Done():
+                return sent, nil
+            case <-time.After(f.Timestamp.Sub(prev.Timestamp) / replaySpeedup):
+            }
+        }
+        prev = f
+        c.delivered.Add(1)
+        c.lastSeq = f.Seq
+        if err := c.writeFrame(sub, f); err != nil {
+            return sent, err
+        }
+        sent++
+    }
+    return sent, nil
+}
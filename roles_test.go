@@ -0,0 +1,207 @@
+package main
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/audit"
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// roleTokens are a token of each role, by role.
+var roleTokens = map[string]config.Token{
+    config.RoleViewer:   {ID: "kiosk", Secret: "viewer-secret"},
+    config.RoleOperator: {ID: "ops", Secret: "operator-secret", Role: config.RoleOperator},
+    config.RoleAdmin:    {ID: "root", Secret: "admin-secret", Role: config.RoleAdmin},
+}
+
+// setupRoles starts the server's real routes with a token of each role
+// and the audit log in a temporary file, whose path it returns.
+func setupRoles(t *testing.T) (*httptest.Server, string) {
+    t.Helper()
+    c := config.Default()
+    for _, tok := range roleTokens {
+        c.Tokens = append(c.Tokens, tok)
+    }
+    setupServer(t, c)
+    addStream(t, "default", capture.NewSyntheticSource(160, 96, 10), nil)
+    path := filepath.Join(t.TempDir(), "audit.log")
+    var err error
+    if auditLog, err = audit.Open(path); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { auditLog.Close() })
+    mux := http.NewServeMux()
+    routes(mux, prometheus.NewRegistry())
+    srv := httptest.NewServer(mount(mux))
+    t.Cleanup(srv.Close)
+    return srv, path
+}
+
+// call makes a request as the token of role, or with none when role is
+// empty, and returns the status and body.
+func call(t *testing.T, srv *httptest.Server, method, path, role, body string) (int, string) {
+    t.Helper()
+    req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if role != "" {
+        req.Header.Set("Authorization", "Bearer "+roleTokens[role].Secret)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    b, _ := io.ReadAll(resp.Body)
+    return resp.StatusCode, string(b)
+}
+
+func TestRoleBoundaries(t *testing.T) {
+    srv, _ := setupRoles(t)
+    roles := []string{config.RoleViewer, config.RoleOperator, config.RoleAdmin}
+    rank := map[string]int{config.RoleViewer: 0, config.RoleOperator: 1, config.RoleAdmin: 2}
+
+    // Streaming endpoints name a stream that does not exist, so a caller
+    // who gets past the role check is answered 404 at once rather than
+    // being sent video.
+    for _, tc := range []struct {
+        method, path, body string
+        role               string
+    }{
+        {"GET", "/ws/nosuch", "", config.RoleViewer},
+        {"GET", "/snapshot/nosuch", "", config.RoleViewer},
+        {"GET", "/stream.mjpeg/nosuch", "", config.RoleOperator},
+        {"GET", "/hls/nosuch/playlist.m3u8", "", config.RoleOperator},
+        {"GET", "/ws/replay/nosuch", "", config.RoleOperator},
+        {"POST", "/webrtc/offer/nosuch", "{}", config.RoleOperator},
+        {"GET", "/api/streams", "", config.RoleOperator},
+        {"GET", "/api/streams/nosuch/layout", "", config.RoleOperator},
+        {"POST", "/api/streams/nosuch/layout", "{}", config.RoleOperator},
+        {"GET", "/api/recordings", "", config.RoleOperator},
+        {"GET", "/api/stats", "", config.RoleOperator},
+        {"GET", "/api/clients", "", config.RoleOperator},
+        {"POST", "/api/record/start?stream=nosuch", "{}", config.RoleOperator},
+        {"POST", "/api/record/stop?stream=nosuch", "", config.RoleOperator},
+        {"GET", "/api/record/status?stream=nosuch", "", config.RoleOperator},
+        {"GET", "/api/overlay?stream=nosuch", "", config.RoleOperator},
+        {"GET", "/api/sinks", "", config.RoleOperator},
+        {"POST", "/api/sinks/nosuch/start", "", config.RoleOperator},
+        {"DELETE", "/api/clients/nosuch", "", config.RoleAdmin},
+        {"GET", "/api/device/controls?stream=nosuch", "", config.RoleAdmin},
+        {"POST", "/api/device/controls?stream=nosuch", "{}", config.RoleAdmin},
+    } {
+        t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+            if code, _ := call(t, srv, tc.method, tc.path, "", tc.body); code != http.StatusForbidden {
+                t.Errorf("without a token: %d, want 403", code)
+            }
+            for _, role := range roles {
+                code, body := call(t, srv, tc.method, tc.path, role, tc.body)
+                if rank[role] < rank[tc.role] {
+                    if code != http.StatusForbidden || !strings.Contains(body, "requires the "+tc.role+" role") {
+                        t.Errorf("%s: %d %q, want 403 naming the %s role", role, code, strings.TrimSpace(body), tc.role)
+                    }
+                } else if code == http.StatusForbidden {
+                    t.Errorf("%s: refused: %s", role, strings.TrimSpace(body))
+                }
+            }
+        })
+    }
+
+    // Health checks and the viewer page need no token at all.
+    for _, path := range []string{"/healthz", "/"} {
+        if code, _ := call(t, srv, "GET", path, "", ""); code != http.StatusOK {
+            t.Errorf("%s without a token: %d", path, code)
+        }
+    }
+}
+
+func TestAuditLog(t *testing.T) {
+    srv, path := setupRoles(t)
+    start := time.Now().UTC().Add(-time.Second)
+
+    type req struct {
+        method, path, role, body string
+        status                   int
+    }
+    audited := []req{
+        // Refused calls are recorded as well, with the token that tried.
+        {"POST", "/api/record/stop", config.RoleViewer, "", http.StatusForbidden},
+        {"POST", "/api/record/stop", config.RoleOperator, "", http.StatusConflict},
+        {"POST", "/api/overlay", config.RoleOperator, `{"watermark":"LIVE"}`, http.StatusOK},
+        {"DELETE", "/api/clients/gone", config.RoleOperator, "", http.StatusForbidden},
+        {"DELETE", "/api/clients/gone", config.RoleAdmin, "", http.StatusNotFound},
+        {"POST", "/api/device/controls", "", `{"brightness":1}`, http.StatusForbidden},
+        // A body is only read for a caller allowed the call, so one too
+        // big to digest is refused for the role before its size.
+        {"POST", "/api/overlay", "", strings.Repeat("x", maxAPIBody+1), http.StatusForbidden},
+        {"POST", "/api/overlay", config.RoleOperator, strings.Repeat("x", maxAPIBody+1), http.StatusRequestEntityTooLarge},
+    }
+    for _, c := range audited {
+        if code, body := call(t, srv, c.method, c.path, c.role, c.body); code != c.status {
+            t.Fatalf("%s %s as %q: %d %s, want %d", c.method, c.path, c.role, code, body, c.status)
+        }
+    }
+    // Reads change nothing and are not recorded.
+    for _, p := range []string{"/api/streams", "/api/overlay", "/api/clients"} {
+        call(t, srv, "GET", p, config.RoleAdmin, "")
+    }
+    auditLog.Close()
+
+    f, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if fi, _ := f.Stat(); fi.Mode().Perm() != 0o600 {
+        t.Errorf("audit log mode %v, want 0600", fi.Mode().Perm())
+    }
+    var entries []audit.Entry
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        var e audit.Entry
+        if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+            t.Fatalf("line %q: %v", sc.Text(), err)
+        }
+        entries = append(entries, e)
+    }
+    if len(entries) != len(audited) {
+        t.Fatalf("%d audit entries, want %d", len(entries), len(audited))
+    }
+    for i, e := range entries {
+        c := audited[i]
+        want := audit.Entry{
+            Time:   e.Time,
+            Remote: "127.0.0.1",
+            Method: c.method,
+            Route:  c.path,
+            Status: c.status,
+        }
+        if c.role != "" {
+            want.Token, want.Role = roleTokens[c.role].ID, c.role
+        }
+        if c.body != "" && c.status != http.StatusForbidden && len(c.body) <= maxAPIBody {
+            sum := sha256.Sum256([]byte(c.body))
+            want.BodySHA256 = hex.EncodeToString(sum[:])
+        }
+        if e != want {
+            t.Errorf("entry %d = %+v, want %+v", i, e, want)
+        }
+        if e.Time.Before(start) || e.Time.After(time.Now().UTC()) || e.Time.Location() != time.UTC {
+            t.Errorf("entry %d time %v", i, e.Time)
+        }
+    }
+}
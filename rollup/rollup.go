@@ -0,0 +1,345 @@
+// Package rollup keeps a history of each stream's health in per-minute
+// rollups, for servers nobody scrapes with Prometheus.
+//
+// Samples are folded into the minute they fall in as they arrive, in
+// memory. Finished minutes are appended to a file of JSON lines in
+// batches by Flush, and Prune drops those older than the retention,
+// rewriting the file without them. Sampling never touches the disk, so
+// a slow disk holds up nothing but the next flush.
+package rollup
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Resolutions a query can be rolled up to.
+const (
+    Minute = "minute"
+    Hour   = "hour"
+)
+
+// ErrResolution is returned by Query for a resolution other than Minute
+// or Hour.
+var ErrResolution = errors.New("rollup: resolution must be minute or hour")
+
+// Sample is one stream's readings at a moment. The counters are totals
+// that only grow, so a rollup counts the difference between samples; one
+// that falls, as when the server restarts, counts from zero again.
+type Sample struct {
+    Time          time.Time
+    Stream        string
+    FPS           float64
+    Clients       int
+    BytesSent     uint64
+    FramesDropped uint64
+    CaptureErrors uint64
+    Signal        bool
+}
+
+// Point is a stream's rollup over the minute or hour starting at Time.
+// FPS, Clients and NoSignal, the share of samples without an input
+// signal, are averages over its Samples; the counts are totals.
+type Point struct {
+    Time          time.Time `json:"time"`
+    Stream        string    `json:"stream"`
+    Samples       int       `json:"samples"`
+    FPS           float64   `json:"fps"`
+    Clients       float64   `json:"clients"`
+    MaxClients    int       `json:"max_clients"`
+    BytesSent     uint64    `json:"bytes_sent"`
+    FramesDropped uint64    `json:"frames_dropped"`
+    CaptureErrors uint64    `json:"capture_errors"`
+    SignalChanges int       `json:"signal_changes"`
+    NoSignal      float64   `json:"no_signal"`
+}
+
+// Store holds the rollups of every stream. A nil Store records nothing.
+type Store struct {
+    // Retention is how long points are kept; 0 keeps them forever.
+    Retention time.Duration
+    // Now is the clock, time.Now when nil. Tests move it forward.
+    Now func() time.Time
+
+    path string
+    mu   sync.Mutex
+    f    *os.File
+    // points are the finished minutes, oldest first; the first written
+    // of them are in the file.
+    points  []Point
+    written int
+    // cur is each stream's minute in progress, and last its previous
+    // sample.
+    cur  map[string]*Point
+    last map[string]Sample
+}
+
+// Open loads the rollups kept at path and opens it for appending more,
+// creating it if need be. An empty path returns a nil Store. A line cut
+// short by a crash is skipped.
+func Open(path string, retention time.Duration) (*Store, error) {
+    if path == "" {
+        return nil, nil
+    }
+    s := &Store{
+        Retention: retention,
+        path:      path,
+        cur:       make(map[string]*Point),
+        last:      make(map[string]Sample),
+    }
+    f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+    if err != nil {
+        return nil, err
+    }
+    sc := bufio.NewScanner(f)
+    for sc.Scan() {
+        var p Point
+        if json.Unmarshal(sc.Bytes(), &p) == nil {
+            s.points = append(s.points, p)
+        }
+    }
+    if err := sc.Err(); err != nil {
+        f.Close()
+        return nil, err
+    }
+    sort.SliceStable(s.points, func(i, j int) bool { return s.points[i].Time.Before(s.points[j].Time) })
+    s.written = len(s.points)
+    s.f = f
+    return s, nil
+}
+
+func (s *Store) now() time.Time {
+    if s.Now != nil {
+        return s.Now()
+    }
+    return time.Now()
+}
+
+// Record folds sm into its stream's minute.
+func (s *Store) Record(sm Sample) {
+    if s == nil {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    minute := sm.Time.Truncate(time.Minute)
+    p := s.cur[sm.Stream]
+    if p != nil && !p.Time.Equal(minute) {
+        s.finish(p)
+        p = nil
+    }
+    if p == nil {
+        p = &Point{Time: minute, Stream: sm.Stream}
+        s.cur[sm.Stream] = p
+    }
+    prev, seen := s.last[sm.Stream]
+    s.last[sm.Stream] = sm
+    p.Samples++
+    p.FPS += sm.FPS
+    p.Clients += float64(sm.Clients)
+    p.MaxClients = max(p.MaxClients, sm.Clients)
+    p.BytesSent += grown(prev.BytesSent, sm.BytesSent)
+    p.FramesDropped += grown(prev.FramesDropped, sm.FramesDropped)
+    p.CaptureErrors += grown(prev.CaptureErrors, sm.CaptureErrors)
+    if seen && prev.Signal != sm.Signal {
+        p.SignalChanges++
+    }
+    if !sm.Signal {
+        p.NoSignal++
+    }
+}
+
+// grown is how much a total went up from prev to cur.
+func grown(prev, cur uint64) uint64 {
+    if cur < prev {
+        return cur
+    }
+    return cur - prev
+}
+
+// finish turns the sums in p into averages and adds it to the finished
+// points. The caller holds s.mu.
+func (s *Store) finish(p *Point) {
+    n := float64(p.Samples)
+    p.FPS /= n
+    p.Clients /= n
+    p.NoSignal /= n
+    s.points = append(s.points, *p)
+    delete(s.cur, p.Stream)
+}
+
+// Flush finishes the minutes that are over and appends every finished
+// point not yet in the file, in one write.
+func (s *Store) Flush() error {
+    if s == nil {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    minute := s.now().Truncate(time.Minute)
+    for _, p := range s.cur {
+        if p.Time.Before(minute) {
+            s.finish(p)
+        }
+    }
+    return s.write()
+}
+
+// write appends the points not yet in the file. The caller holds s.mu.
+func (s *Store) write() error {
+    if s.written == len(s.points) {
+        return nil
+    }
+    var buf []byte
+    for _, p := range s.points[s.written:] {
+        line, err := json.Marshal(p)
+        if err != nil {
+            return err
+        }
+        buf = append(append(buf, line...), '\n')
+    }
+    if _, err := s.f.Write(buf); err != nil {
+        return err
+    }
+    s.written = len(s.points)
+    return nil
+}
+
+// Prune drops the points older than the retention and compacts the file,
+// replacing it with one holding only those left.
+func (s *Store) Prune() error {
+    if s == nil || s.Retention <= 0 {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    cutoff := s.now().Add(-s.Retention)
+    n := sort.Search(len(s.points), func(i int) bool { return !s.points[i].Time.Before(cutoff) })
+    if n == 0 {
+        return nil
+    }
+    keep := append([]Point(nil), s.points[n:]...)
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(tmp)
+    enc := json.NewEncoder(w)
+    for _, p := range keep {
+        enc.Encode(p)
+    }
+    err = w.Flush()
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), s.path)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    f, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    s.f.Close()
+    s.f = f
+    s.points = keep
+    s.written = len(keep)
+    return nil
+}
+
+// Query returns the finished points from from up to to, of stream or of
+// every stream when it is empty, by time and then stream. Hour rolls the
+// minutes up into the hours they fall in.
+func (s *Store) Query(from, to time.Time, resolution, stream string) ([]Point, error) {
+    if resolution != Minute && resolution != Hour {
+        return nil, ErrResolution
+    }
+    out := []Point{}
+    if s == nil {
+        return out, nil
+    }
+    s.mu.Lock()
+    for _, p := range s.points {
+        if !p.Time.Before(from) && p.Time.Before(to) && (stream == "" || p.Stream == stream) {
+            out = append(out, p)
+        }
+    }
+    s.mu.Unlock()
+    if resolution == Hour {
+        out = hours(out)
+    }
+    sort.SliceStable(out, func(i, j int) bool {
+        if !out[i].Time.Equal(out[j].Time) {
+            return out[i].Time.Before(out[j].Time)
+        }
+        return out[i].Stream < out[j].Stream
+    })
+    return out, nil
+}
+
+// hours merges minutes into hours, weighting the averages by samples.
+func hours(minutes []Point) []Point {
+    type key struct {
+        hour   time.Time
+        stream string
+    }
+    var order []key
+    merged := make(map[key]*Point)
+    for _, m := range minutes {
+        k := key{m.Time.Truncate(time.Hour), m.Stream}
+        h := merged[k]
+        if h == nil {
+            h = &Point{Time: k.hour, Stream: m.Stream}
+            merged[k] = h
+            order = append(order, k)
+        }
+        n := float64(m.Samples)
+        h.FPS += m.FPS * n
+        h.Clients += m.Clients * n
+        h.NoSignal += m.NoSignal * n
+        h.Samples += m.Samples
+        h.MaxClients = max(h.MaxClients, m.MaxClients)
+        h.BytesSent += m.BytesSent
+        h.FramesDropped += m.FramesDropped
+        h.CaptureErrors += m.CaptureErrors
+        h.SignalChanges += m.SignalChanges
+    }
+    out := make([]Point, 0, len(order))
+    for _, k := range order {
+        h := merged[k]
+        if n := float64(h.Samples); n > 0 {
+            h.FPS /= n
+            h.Clients /= n
+            h.NoSignal /= n
+        }
+        out = append(out, *h)
+    }
+    return out
+}
+
+// Close writes what has been recorded, including the minutes still in
+// progress, and closes the file.
+func (s *Store) Close() error {
+    if s == nil {
+        return nil
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    for _, p := range s.cur {
+        s.finish(p)
+    }
+    err := s.write()
+    if cerr := s.f.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
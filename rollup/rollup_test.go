@@ -0,0 +1,203 @@
+package rollup
+
+import (
+    "math"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// clock is a Store.Now that tests move forward by hand.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+const (
+    sampleEvery = 10 * time.Second
+    perMinute   = int(time.Minute / sampleEvery)
+    perHour     = int(time.Hour / sampleEvery)
+)
+
+// run48h feeds s two days of samples for streams a and b, flushing every
+// minute and pruning every hour as the server does. Stream a loses its
+// signal for ten minutes in hour 30, and its counters start over from a
+// restart at hour 40.
+func run48h(t *testing.T, s *Store, c *clock, start time.Time) {
+    t.Helper()
+    var bytes uint64
+    for i := 0; i <= 48*perHour; i++ {
+        c.t = start.Add(time.Duration(i) * sampleEvery)
+        if i > 0 {
+            bytes += 1000
+        }
+        if i == 40*perHour {
+            bytes = 1000 // a restarted server counts from zero
+        }
+        signal := i < 30*perHour || i >= 30*perHour+10*perMinute
+        s.Record(Sample{Time: c.t, Stream: "a", FPS: 30, Clients: 2, BytesSent: bytes, Signal: signal})
+        s.Record(Sample{Time: c.t, Stream: "b", FPS: 15, Clients: i % 3, Signal: true})
+        if i%perMinute == 0 {
+            if err := s.Flush(); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if i%perHour == 0 {
+            if err := s.Prune(); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+}
+
+func TestRollup48hWithPruning(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    end := start.Add(48 * time.Hour)
+    path := filepath.Join(t.TempDir(), "stats.log")
+    c := &clock{}
+    s, err := Open(path, 24*time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Now = c.now
+    run48h(t, s, c, start)
+
+    // The last prune, at the end, kept the day before it; the minute in
+    // progress is not finished yet.
+    minutes, err := s.Query(time.Time{}, end.Add(time.Hour), Minute, "a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := 24 * 60; len(minutes) != want {
+        t.Fatalf("%d minutes kept, want %d", len(minutes), want)
+    }
+    if first := minutes[0].Time; !first.Equal(end.Add(-24 * time.Hour)) {
+        t.Errorf("oldest minute kept is %v, want %v", first, end.Add(-24*time.Hour))
+    }
+    for _, m := range minutes {
+        if m.Samples != perMinute || m.BytesSent != uint64(perMinute)*1000 || m.FPS != 30 || m.MaxClients != 2 {
+            t.Fatalf("minute %+v, want %d samples of 1000 bytes at 30 fps", m, perMinute)
+        }
+    }
+
+    hours, err := s.Query(end.Add(-24*time.Hour), end, Hour, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(hours) != 2*24 {
+        t.Fatalf("%d hourly points, want 48", len(hours))
+    }
+    for _, h := range hours {
+        hour := int(h.Time.Sub(start) / time.Hour)
+        if h.Samples != perHour {
+            t.Errorf("%s hour %d: %d samples, want %d", h.Stream, hour, h.Samples, perHour)
+        }
+        switch h.Stream {
+        case "a":
+            // The restart did not lose or double count anything.
+            if h.BytesSent != uint64(perHour)*1000 || h.FPS != 30 || h.Clients != 2 {
+                t.Errorf("a hour %d: %+v", hour, h)
+            }
+            want, changes := 0.0, 0
+            if hour == 30 {
+                want, changes = 1.0/6, 2
+            }
+            if math.Abs(h.NoSignal-want) > 1e-9 || h.SignalChanges != changes {
+                t.Errorf("a hour %d: no signal %v with %d changes, want %v with %d", hour, h.NoSignal, h.SignalChanges, want, changes)
+            }
+        case "b":
+            if h.FPS != 15 || h.Clients != 1 || h.MaxClients != 2 || h.BytesSent != 0 {
+                t.Errorf("b hour %d: %+v", hour, h)
+            }
+        }
+    }
+
+    // What is on disk is what was kept, plus the minute Close finishes.
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    s, err = Open(path, 24*time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    reloaded, err := s.Query(time.Time{}, end.Add(time.Hour), Minute, "a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(reloaded) != len(minutes)+1 {
+        t.Fatalf("reopened store holds %d minutes of a, want %d", len(reloaded), len(minutes)+1)
+    }
+    for i, m := range minutes {
+        if reloaded[i] != m {
+            t.Fatalf("minute %d reloaded as %+v, was %+v", i, reloaded[i], m)
+        }
+    }
+    if last := reloaded[len(reloaded)-1]; !last.Time.Equal(end) || last.Samples != 1 {
+        t.Errorf("minute in progress written as %+v", last)
+    }
+}
+
+func TestPruneKeepsEverythingWithoutRetention(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    c := &clock{}
+    s, err := Open(filepath.Join(t.TempDir(), "stats.log"), 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    s.Now = c.now
+    run48h(t, s, c, start)
+    hours, err := s.Query(time.Time{}, start.Add(49*time.Hour), Hour, "b")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(hours) != 48 || !hours[0].Time.Equal(start) {
+        t.Errorf("%d hours from %v, want all 48 from %v", len(hours), hours[0].Time, start)
+    }
+}
+
+func TestQueryRejectsResolution(t *testing.T) {
+    var s *Store
+    if _, err := s.Query(time.Time{}, time.Now(), "day", ""); err != ErrResolution {
+        t.Errorf("err = %v, want ErrResolution", err)
+    }
+}
+
+func TestOpenSkipsTornLine(t *testing.T) {
+    start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+    path := filepath.Join(t.TempDir(), "stats.log")
+    c := &clock{t: start}
+    s, err := Open(path, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Now = c.now
+    for i := 0; i < 3*perMinute; i++ {
+        c.t = start.Add(time.Duration(i) * sampleEvery)
+        s.Record(Sample{Time: c.t, Stream: "a", FPS: 30, Signal: true})
+    }
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    // A crash in the middle of a write leaves half a line behind.
+    f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.WriteString(`{"time":"2024-03-01T00:03:00Z","stream":"a","sam`)
+    f.Close()
+
+    s, err = Open(path, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    points, err := s.Query(time.Time{}, start.Add(time.Hour), Minute, "a")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(points) != 3 {
+        t.Errorf("reopened with %d minutes, want the 3 written whole", len(points))
+    }
+}
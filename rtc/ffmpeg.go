@@ -0,0 +1,243 @@
+package rtc
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os/exec"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+    "github.com/pion/webrtc/v3/pkg/media/h264reader"
+    "github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// Codec is a video codec the server can send.
+type Codec string
+
+const (
+    CodecH264 Codec = "h264"
+    CodecVP8  Codec = "vp8"
+)
+
+// ErrNoEncoder means ffmpeg is missing or has neither libx264 nor libvpx.
+var ErrNoEncoder = errors.New("rtc: ffmpeg with libx264 or libvpx is required for WebRTC")
+
+// keyframeInterval is in frames. Browsers cannot start decoding until one
+// arrives, so it also bounds how long a new viewer waits for a picture.
+const keyframeInterval = 60
+
+func (c Codec) capability() webrtc.RTPCodecCapability {
+    if c == CodecH264 {
+        return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}
+    }
+    return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}
+}
+
+// DetectCodec asks ffmpeg which encoders it was built with and picks
+// H.264 when it can, falling back to VP8.
+func DetectCodec(ffmpeg string) (Codec, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    out, err := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-encoders").Output()
+    if err != nil {
+        return "", fmt.Errorf("%w: %v", ErrNoEncoder, err)
+    }
+    switch {
+    case bytes.Contains(out, []byte(" libx264 ")):
+        return CodecH264, nil
+    case bytes.Contains(out, []byte(" libvpx ")):
+        return CodecVP8, nil
+    }
+    return "", ErrNoEncoder
+}
+
+// encoder turns a stream of JPEGs into codec samples with an ffmpeg
+// child process. Samples are delivered to out from a separate goroutine
+// in the order their JPEGs went in.
+type encoder struct {
+    cmd   *exec.Cmd
+    stdin io.WriteCloser
+    log   *slog.Logger
+
+    // stamps carries input capture times to the reader, which turns them
+    // into sample durations. ffmpeg is run without B-frames or lookahead
+    // so output frames match input frames one for one.
+    stamps chan time.Time
+    done   chan struct{}
+
+    closeOnce sync.Once
+}
+
+func encoderArgs(codec Codec, width, height int) []string {
+    args := []string{
+        "-hide_banner", "-loglevel", "error",
+        "-fflags", "nobuffer", "-flags", "low_delay",
+        "-use_wallclock_as_timestamps", "1",
+        "-f", "mjpeg", "-i", "pipe:0",
+        "-an", "-fps_mode", "passthrough",
+        "-pix_fmt", "yuv420p",
+        "-g", strconv.Itoa(keyframeInterval),
+    }
+    if width != 0 || height != 0 {
+        // -2 keeps the aspect ratio and the even size 4:2:0 needs.
+        w, h := "-2", "-2"
+        if width != 0 {
+            w = strconv.Itoa(width &^ 1)
+        }
+        if height != 0 {
+            h = strconv.Itoa(height &^ 1)
+        }
+        args = append(args, "-vf", "scale="+w+":"+h)
+    }
+    if codec == CodecH264 {
+        return append(args,
+            "-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+            "-profile:v", "baseline", "-x264-params", "sliced-threads=0",
+            "-f", "h264", "pipe:1")
+    }
+    return append(args,
+        "-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8",
+        "-lag-in-frames", "0", "-error-resilient", "1", "-b:v", "2M",
+        "-f", "ivf", "pipe:1")
+}
+
+func startEncoder(ffmpeg string, codec Codec, width, height int, log *slog.Logger, out func(media.Sample)) (*encoder, error) {
+    cmd := exec.Command(ffmpeg, encoderArgs(codec, width, height)...)
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := cmd.Start(); err != nil {
+        return nil, fmt.Errorf("rtc: starting ffmpeg: %w", err)
+    }
+    e := &encoder{
+        cmd:    cmd,
+        stdin:  stdin,
+        log:    log,
+        stamps: make(chan time.Time, 2*keyframeInterval),
+        done:   make(chan struct{}),
+    }
+    go func() {
+        s := bufio.NewScanner(stderr)
+        for s.Scan() {
+            log.Debug("ffmpeg", "line", s.Text())
+        }
+    }()
+    go func() {
+        defer close(e.done)
+        var err error
+        if codec == CodecH264 {
+            err = e.readH264(stdout, out)
+        } else {
+            err = e.readIVF(stdout, out)
+        }
+        if err != nil && !errors.Is(err, io.EOF) {
+            log.Warn("encoder output failed", "err", err)
+        }
+        io.Copy(io.Discard, stdout)
+        cmd.Wait()
+    }()
+    return e, nil
+}
+
+// Encode queues one JPEG. It blocks while ffmpeg is busy, which is what
+// lets the hub drop frames for a viewer whose encoder cannot keep up.
+func (e *encoder) Encode(jpeg []byte, ts time.Time) error {
+    select {
+    case e.stamps <- ts:
+    default:
+    }
+    _, err := e.stdin.Write(jpeg)
+    return err
+}
+
+// Close ends the input and waits for ffmpeg to exit.
+func (e *encoder) Close() {
+    e.closeOnce.Do(func() {
+        e.stdin.Close()
+        select {
+        case <-e.done:
+        case <-time.After(2 * time.Second):
+            e.cmd.Process.Kill()
+            <-e.done
+        }
+    })
+}
+
+// duration returns how long the previous frame was on screen, taking the
+// next input timestamp off the queue.
+func (e *encoder) duration(prev *time.Time) time.Duration {
+    var ts time.Time
+    select {
+    case ts = <-e.stamps:
+    default:
+        ts = time.Now()
+    }
+    d := time.Second / 30
+    if !prev.IsZero() && ts.After(*prev) {
+        d = ts.Sub(*prev)
+    }
+    *prev = ts
+    return d
+}
+
+// readH264 groups NAL units into access units. With sliced threads off
+// x264 writes one slice per picture, so a slice ends the access unit and
+// it can go out without waiting for the next one to begin.
+func (e *encoder) readH264(r io.Reader, out func(media.Sample)) error {
+    h, err := h264reader.NewReader(r)
+    if err != nil {
+        return err
+    }
+    var (
+        au   []byte
+        prev time.Time
+    )
+    for {
+        nal, err := h.NextNAL()
+        if err != nil {
+            return err
+        }
+        if nal.UnitType == h264reader.NalUnitTypeAUD {
+            continue
+        }
+        au = append(au, 0, 0, 0, 1)
+        au = append(au, nal.Data...)
+        switch nal.UnitType {
+        case h264reader.NalUnitTypeCodedSliceIdr, h264reader.NalUnitTypeCodedSliceNonIdr:
+            out(media.Sample{Data: au, Duration: e.duration(&prev)})
+            au = nil
+        }
+    }
+}
+
+func (e *encoder) readIVF(r io.Reader, out func(media.Sample)) error {
+    ivf, _, err := ivfreader.NewWith(r)
+    if err != nil {
+        return err
+    }
+    var prev time.Time
+    for {
+        frame, _, err := ivf.ParseNextFrame()
+        if err != nil {
+            return err
+        }
+        out(media.Sample{Data: frame, Duration: e.duration(&prev)})
+    }
+}
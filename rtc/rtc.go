@@ -0,0 +1,415 @@
+// Package rtc serves the hub to browsers over WebRTC.
+//
+// Each peer connection gets its own hub subscription and its own ffmpeg
+// encoder, so viewers can ask for different sizes and a slow one only
+// drops its own frames. Signalling is a single HTTP exchange: the client
+// posts an offer and receives an answer with every ICE candidate already
+// gathered. Posting a new offer with the same session ID renegotiates the
+// existing connection.
+package rtc
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+)
+
+// connectTimeout closes sessions whose ICE never completes, so a client
+// that posts an offer and vanishes does not hold the device open.
+const connectTimeout = 30 * time.Second
+
+// gatherTimeout bounds how long an answer waits for ICE candidates; a
+// STUN server that does not reply must not hang the request.
+const gatherTimeout = 10 * time.Second
+
+var ErrUnknownSession = errors.New("rtc: unknown session")
+
+// Server answers WebRTC offers with video from a hub.
+type Server struct {
+    // Charge, when set, returns what counts the bytes sent to the session
+    // an offer opens, or nil to count nothing. The session ends at the
+    // first charge it refuses.
+    Charge func(r *http.Request) func(n int) error
+
+    hub    *hub.Hub
+    ffmpeg string
+    codec  Codec
+    config webrtc.Configuration
+
+    mu       sync.Mutex
+    sessions map[string]*session
+}
+
+// NewServer returns a server that sends h to peers encoded as codec,
+// which DetectCodec should have found ffmpeg able to produce. iceServers
+// are offered for NAT traversal.
+func NewServer(h *hub.Hub, ffmpeg string, codec Codec, iceServers []webrtc.ICEServer) *Server {
+    return &Server{
+        hub:      h,
+        ffmpeg:   ffmpeg,
+        codec:    codec,
+        config:   webrtc.Configuration{ICEServers: iceServers},
+        sessions: map[string]*session{},
+    }
+}
+
+// Codec reports the codec sent to every peer.
+func (s *Server) Codec() Codec { return s.codec }
+
+// Sessions reports how many peer connections are open.
+func (s *Server) Sessions() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.sessions)
+}
+
+// Close ends every session.
+func (s *Server) Close() {
+    s.mu.Lock()
+    all := make([]*session, 0, len(s.sessions))
+    for _, sess := range s.sessions {
+        all = append(all, sess)
+    }
+    s.mu.Unlock()
+    for _, sess := range all {
+        sess.close()
+    }
+}
+
+// Offer is the body of POST /webrtc/offer. Width and Height scale the
+// video as they do in a websocket set_params message. SessionID is empty
+// for a new connection and set to the answer's ID to renegotiate.
+type Offer struct {
+    Type      string `json:"type"`
+    SDP       string `json:"sdp"`
+    SessionID string `json:"session_id,omitempty"`
+    Width     int    `json:"width,omitempty"`
+    Height    int    `json:"height,omitempty"`
+}
+
+// Answer is the reply to an Offer.
+type Answer struct {
+    Type      string `json:"type"`
+    SDP       string `json:"sdp"`
+    SessionID string `json:"session_id"`
+    Codec     Codec  `json:"codec"`
+}
+
+// ServeHTTP handles POST /webrtc/offer. Authentication is left to the
+// caller.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    var o Offer
+    if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+        writeError(w, http.StatusBadRequest, "malformed offer: "+err.Error())
+        return
+    }
+    if o.Type != webrtc.SDPTypeOffer.String() || o.SDP == "" {
+        writeError(w, http.StatusBadRequest, `type must be "offer" with a non-empty sdp`)
+        return
+    }
+    if err := (protocol.Params{Width: o.Width, Height: o.Height}).Validate(); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    var (
+        sess *session
+        err  error
+    )
+    if o.SessionID == "" {
+        var charge func(n int) error
+        if s.Charge != nil {
+            charge = s.Charge(r)
+        }
+        sess, err = s.newSession(r.RemoteAddr, charge)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+    } else {
+        s.mu.Lock()
+        sess = s.sessions[o.SessionID]
+        s.mu.Unlock()
+        if sess == nil {
+            writeError(w, http.StatusNotFound, ErrUnknownSession.Error())
+            return
+        }
+    }
+
+    answer, err := sess.negotiate(o)
+    if err != nil {
+        if o.SessionID == "" {
+            sess.close()
+        }
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    writeJSON(w, http.StatusOK, Answer{
+        Type:      answer.Type.String(),
+        SDP:       answer.SDP,
+        SessionID: sess.id,
+        Codec:     s.codec,
+    })
+}
+
+// session is one peer connection.
+type session struct {
+    id    string
+    srv   *Server
+    log   *slog.Logger
+    pc    *webrtc.PeerConnection
+    track *webrtc.TrackLocalStaticSample
+    // charge counts what is sent, if anything does.
+    charge func(n int) error
+
+    mu        sync.Mutex
+    width     int
+    height    int
+    enc       *encoder
+    sub       *hub.Subscriber
+    started   time.Time
+    closed    bool
+    closeOnce sync.Once
+}
+
+func (s *Server) newSession(remote string, charge func(n int) error) (*session, error) {
+    pc, err := webrtc.NewPeerConnection(s.config)
+    if err != nil {
+        return nil, err
+    }
+    track, err := webrtc.NewTrackLocalStaticSample(s.codec.capability(), "video", "hdmi")
+    if err != nil {
+        pc.Close()
+        return nil, err
+    }
+    sender, err := pc.AddTrack(track)
+    if err != nil {
+        pc.Close()
+        return nil, err
+    }
+    id := newSessionID()
+    sess := &session{
+        id:      id,
+        srv:     s,
+        log:     slog.With("conn", id, "transport", "webrtc"),
+        pc:      pc,
+        track:   track,
+        charge:  charge,
+        started: time.Now(),
+    }
+
+    // RTCP has to be read for pion to act on NACKs and receiver reports.
+    go func() {
+        buf := make([]byte, 1500)
+        for {
+            if _, _, err := sender.Read(buf); err != nil {
+                return
+            }
+        }
+    }()
+    pc.OnConnectionStateChange(func(st webrtc.PeerConnectionState) {
+        sess.log.Debug("peer connection state", "state", st.String())
+        switch st {
+        case webrtc.PeerConnectionStateConnected:
+            sess.start()
+        case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+            sess.close()
+        }
+    })
+    time.AfterFunc(connectTimeout, func() {
+        if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+            sess.close()
+        }
+    })
+
+    s.mu.Lock()
+    s.sessions[id] = sess
+    s.mu.Unlock()
+    sess.log.Info("client connected", "remote", remote, "codec", s.codec)
+    return sess, nil
+}
+
+// negotiate applies an offer and returns the answer once ICE gathering is
+// done. A change of size restarts the encoder on the running session.
+func (sess *session) negotiate(o Offer) (*webrtc.SessionDescription, error) {
+    if err := sess.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: o.SDP}); err != nil {
+        return nil, fmt.Errorf("rtc: bad offer: %w", err)
+    }
+    answer, err := sess.pc.CreateAnswer(nil)
+    if err != nil {
+        return nil, fmt.Errorf("rtc: creating answer: %w", err)
+    }
+    gathered := webrtc.GatheringCompletePromise(sess.pc)
+    if err := sess.pc.SetLocalDescription(answer); err != nil {
+        return nil, fmt.Errorf("rtc: setting answer: %w", err)
+    }
+    select {
+    case <-gathered:
+    case <-time.After(gatherTimeout):
+        sess.log.Warn("ice gathering timed out; answering with the candidates found so far")
+    }
+
+    sess.mu.Lock()
+    resized := o.Width != sess.width || o.Height != sess.height
+    sess.width, sess.height = o.Width, o.Height
+    running := sess.enc != nil
+    sess.mu.Unlock()
+    if resized && running {
+        sess.log.Info("renegotiated size", "width", o.Width, "height", o.Height)
+        if err := sess.restartEncoder(); err != nil {
+            return nil, err
+        }
+    }
+    return sess.pc.LocalDescription(), nil
+}
+
+// start subscribes to the hub once the peer is connected.
+func (sess *session) start() {
+    sess.mu.Lock()
+    if sess.closed || sess.sub != nil {
+        sess.mu.Unlock()
+        return
+    }
+    sess.sub = sess.srv.hub.Subscribe(hub.DefaultBuffer)
+    sess.mu.Unlock()
+    if err := sess.restartEncoder(); err != nil {
+        sess.log.Warn("starting encoder failed", "err", err)
+        sess.close()
+        return
+    }
+    go sess.feed(sess.sub)
+}
+
+// restartEncoder replaces the running ffmpeg with one for the current
+// size. The new process starts with a keyframe, so the browser switches
+// resolution without waiting.
+func (sess *session) restartEncoder() error {
+    sess.mu.Lock()
+    if sess.closed {
+        sess.mu.Unlock()
+        return nil
+    }
+    old := sess.enc
+    w, h, sub := sess.width, sess.height, sess.sub
+    sess.mu.Unlock()
+
+    enc, err := startEncoder(sess.srv.ffmpeg, sess.srv.codec, w, h, sess.log, func(sample media.Sample) {
+        sess.write(sub, sample)
+    })
+    if err != nil {
+        return err
+    }
+    sess.mu.Lock()
+    sess.enc = enc
+    sess.mu.Unlock()
+    if old != nil {
+        old.Close()
+    }
+    return nil
+}
+
+// write sends sample to the peer and counts it against sub and charge,
+// ending the session once charge refuses.
+func (sess *session) write(sub *hub.Subscriber, sample media.Sample) {
+    if err := sess.track.WriteSample(sample); err != nil {
+        sess.log.Debug("write failed", "err", err)
+        return
+    }
+    sub.Sent(len(sample.Data))
+    if sess.charge == nil {
+        return
+    }
+    if err := sess.charge(len(sample.Data)); err != nil {
+        sess.log.Info("daily byte budget used, closing", "err", err)
+        // Closing waits for the encoder, which is what called write.
+        go sess.close()
+    }
+}
+
+// feed passes hub frames to the encoder until the subscription ends.
+func (sess *session) feed(sub *hub.Subscriber) {
+    for f := range sub.Frames() {
+        jpeg, err := sess.srv.hub.Render(f, protocol.Params{})
+        if err != nil {
+            f.Release()
+            sess.log.Warn("encode failed", "seq", f.Seq, "err", err)
+            continue
+        }
+        sess.mu.Lock()
+        enc := sess.enc
+        sess.mu.Unlock()
+        if enc == nil {
+            f.Release()
+            return
+        }
+        err = enc.Encode(jpeg, f.Timestamp)
+        f.Release()
+        if err != nil {
+            // Usually a restart closed this encoder under us; the next
+            // frame goes to its replacement.
+            sess.log.Debug("encoder write failed", "err", err)
+        }
+    }
+    if err := sub.Err(); err != nil {
+        sess.log.Warn("stream ended", "err", err)
+    }
+    sess.close()
+}
+
+func (sess *session) close() {
+    sess.closeOnce.Do(func() {
+        sess.mu.Lock()
+        sess.closed = true
+        sub, enc := sess.sub, sess.enc
+        sess.enc = nil
+        sess.mu.Unlock()
+
+        srv := sess.srv
+        srv.mu.Lock()
+        delete(srv.sessions, sess.id)
+        srv.mu.Unlock()
+
+        if sub != nil {
+            srv.hub.Unsubscribe(sub)
+        }
+        if enc != nil {
+            enc.Close()
+        }
+        sess.pc.Close()
+
+        attrs := []any{"duration", time.Since(sess.started).Round(time.Millisecond)}
+        if sub != nil {
+            attrs = append(attrs, "frames_sent", sub.FramesSent(), "bytes_sent", sub.BytesSent(), "frames_dropped", sub.Dropped())
+        }
+        sess.log.Info("client disconnected", attrs...)
+    })
+}
+
+func newSessionID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+    writeJSON(w, code, struct {
+        Error string `json:"error"`
+    }{msg})
+}
@@ -0,0 +1,109 @@
+package rtc
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media"
+)
+
+// offer returns a receive-only video offer from a peer of the test's own,
+// with its candidates gathered.
+func offer(t *testing.T) Offer {
+    t.Helper()
+    pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { pc.Close() })
+    if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+        t.Fatal(err)
+    }
+    sdp, err := pc.CreateOffer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    gathered := webrtc.GatheringCompletePromise(pc)
+    if err := pc.SetLocalDescription(sdp); err != nil {
+        t.Fatal(err)
+    }
+    <-gathered
+    return Offer{Type: "offer", SDP: pc.LocalDescription().SDP}
+}
+
+func TestChargeEndsSession(t *testing.T) {
+    h := hub.New(nil, "test", nil)
+    s := NewServer(h, "ffmpeg", CodecH264, nil)
+    defer s.Close()
+    var (
+        mu      sync.Mutex
+        charged int
+    )
+    s.Charge = func(r *http.Request) func(n int) error {
+        if r.URL.Query().Get("token") != "metered" {
+            return nil
+        }
+        return func(n int) error {
+            mu.Lock()
+            defer mu.Unlock()
+            charged += n
+            if charged >= 250 {
+                return errors.New("over budget")
+            }
+            return nil
+        }
+    }
+    srv := httptest.NewServer(s)
+    defer srv.Close()
+
+    body, _ := json.Marshal(offer(t))
+    resp, err := http.Post(srv.URL+"/webrtc/offer?token=metered", "application/json", bytes.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var answer Answer
+    err = json.NewDecoder(resp.Body).Decode(&answer)
+    resp.Body.Close()
+    if err != nil || resp.StatusCode != http.StatusOK {
+        t.Fatalf("answer: %d %v", resp.StatusCode, err)
+    }
+    s.mu.Lock()
+    sess := s.sessions[answer.SessionID]
+    s.mu.Unlock()
+    if sess == nil {
+        t.Fatal("no session for the answer")
+    }
+
+    // Samples as the encoder hands them over: two fit the budget, the
+    // third takes it over and ends the session.
+    sub := h.Subscribe(hub.DefaultBuffer)
+    defer h.Unsubscribe(sub)
+    sample := media.Sample{Data: make([]byte, 100), Duration: time.Second / 30}
+    for i := 0; i < 2; i++ {
+        sess.write(sub, sample)
+    }
+    if s.Sessions() != 1 {
+        t.Fatal("session ended within its budget")
+    }
+    sess.write(sub, sample)
+    deadline := time.Now().Add(5 * time.Second)
+    for s.Sessions() != 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("session still open over its budget")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    if charged != 300 || sub.BytesSent() != 300 {
+        t.Errorf("charged %d, sent %d; want 300 of both", charged, sub.BytesSent())
+    }
+}
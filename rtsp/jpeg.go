@@ -0,0 +1,172 @@
+package rtsp
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+)
+
+// RFC 2435 carries baseline JPEG without its headers: the receiver
+// rebuilds them from the image type, size and quantisation tables sent in
+// each frame, and assumes the standard Huffman tables. Capture cards and
+// image/jpeg both produce such JPEGs.
+
+var errUnsupportedJPEG = errors.New("rtsp: JPEG cannot be sent as RFC 2435")
+
+// jpegFrame is what RFC 2435 needs from a JPEG.
+type jpegFrame struct {
+    typ      byte // 0 for 4:2:2, 1 for 4:2:0; +64 with restart markers
+    width    int
+    height   int
+    tables   []byte // 8-bit quantisation tables, 64 bytes each, zigzag order
+    restart  uint16 // restart interval in MCUs, 0 for none
+    scanData []byte // entropy-coded data between SOS and EOI
+}
+
+// parseJPEG pulls the fields RFC 2435 needs out of a baseline JPEG.
+func parseJPEG(data []byte) (*jpegFrame, error) {
+    if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+        return nil, fmt.Errorf("%w: missing SOI", errUnsupportedJPEG)
+    }
+    f := &jpegFrame{}
+    var (
+        tables [4][]byte
+        tq     []byte
+        sof    bool
+    )
+    i := 2
+    for i+4 <= len(data) {
+        if data[i] != 0xFF {
+            return nil, fmt.Errorf("%w: bad marker at %d", errUnsupportedJPEG, i)
+        }
+        marker := data[i+1]
+        if marker == 0xFF {
+            i++
+            continue
+        }
+        length := int(binary.BigEndian.Uint16(data[i+2:]))
+        seg := data[i+4:]
+        if length < 2 || len(seg) < length-2 {
+            return nil, fmt.Errorf("%w: truncated segment", errUnsupportedJPEG)
+        }
+        seg = seg[:length-2]
+        switch marker {
+        case 0xDB: // DQT
+            for len(seg) >= 65 {
+                if seg[0]>>4 != 0 {
+                    return nil, fmt.Errorf("%w: 16-bit quantisation table", errUnsupportedJPEG)
+                }
+                tables[seg[0]&3] = seg[1:65]
+                seg = seg[65:]
+            }
+        case 0xC0: // baseline SOF
+            if len(seg) < 6+3*3 || seg[5] != 3 {
+                return nil, fmt.Errorf("%w: need three components", errUnsupportedJPEG)
+            }
+            f.height = int(binary.BigEndian.Uint16(seg[1:]))
+            f.width = int(binary.BigEndian.Uint16(seg[3:]))
+            switch seg[7] { // luma sampling factors
+            case 0x21:
+                f.typ = 0
+            case 0x22:
+                f.typ = 1
+            default:
+                return nil, fmt.Errorf("%w: sampling %#x", errUnsupportedJPEG, seg[7])
+            }
+            // Chroma must not be subsampled beyond what the type implies.
+            if seg[10] != 0x11 || seg[13] != 0x11 {
+                return nil, fmt.Errorf("%w: chroma sampling", errUnsupportedJPEG)
+            }
+            tq = []byte{seg[8], seg[11], seg[14]}
+            sof = true
+        case 0xC1, 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+            return nil, fmt.Errorf("%w: not baseline", errUnsupportedJPEG)
+        case 0xDD: // DRI
+            if len(seg) >= 2 {
+                f.restart = binary.BigEndian.Uint16(seg)
+            }
+        case 0xDA: // SOS
+            if !sof {
+                return nil, fmt.Errorf("%w: scan before frame header", errUnsupportedJPEG)
+            }
+            scan := data[i+2+length:]
+            if n := len(scan); n >= 2 && scan[n-2] == 0xFF && scan[n-1] == 0xD9 {
+                scan = scan[:n-2]
+            }
+            f.scanData = scan
+            // Luma uses the first component's table, chroma the second's.
+            luma, chroma := tables[tq[0]&3], tables[tq[1]&3]
+            if luma == nil || chroma == nil {
+                return nil, fmt.Errorf("%w: missing quantisation tables", errUnsupportedJPEG)
+            }
+            f.tables = append(append([]byte{}, luma...), chroma...)
+            if f.restart != 0 {
+                f.typ += 64
+            }
+            if f.width > 2040 || f.height > 2040 || f.width%8 != 0 || f.height%8 != 0 {
+                return nil, fmt.Errorf("%w: %dx%d is not a multiple of 8 up to 2040", errUnsupportedJPEG, f.width, f.height)
+            }
+            return f, nil
+        }
+        i += 2 + length
+    }
+    return nil, fmt.Errorf("%w: no scan", errUnsupportedJPEG)
+}
+
+const (
+    rtpHeaderSize = 12
+    // maxPacket keeps RTP packets under a typical MTU so the same
+    // packets could go over UDP.
+    maxPacket   = 1400
+    payloadJPEG = 26
+    clockRate   = 90000
+)
+
+// packetizer splits JPEG frames into RTP packets for one session.
+type packetizer struct {
+    ssrc uint32
+    seq  uint16
+}
+
+// packets returns the RTP packets carrying f with the given 90kHz
+// timestamp. The marker bit is set on the last one.
+func (p *packetizer) packets(f *jpegFrame, ts uint32) [][]byte {
+    var out [][]byte
+    for offset := 0; offset == 0 || offset < len(f.scanData); {
+        hdr := make([]byte, 0, maxPacket)
+        hdr = append(hdr, make([]byte, rtpHeaderSize)...)
+        hdr = append(hdr, 0, byte(offset>>16), byte(offset>>8), byte(offset),
+            f.typ, 255, byte(f.width/8), byte(f.height/8))
+        if f.restart != 0 {
+            // Packets are not cut on restart intervals, which RFC 2435
+            // signals with F and L set and a count of 0x3FFF.
+            hdr = append(hdr, byte(f.restart>>8), byte(f.restart), 0xFF, 0xFF)
+        }
+        if offset == 0 {
+            // Q of 255 means the tables follow in the first packet.
+            hdr = append(hdr, 0, 0, byte(len(f.tables)>>8), byte(len(f.tables)))
+            hdr = append(hdr, f.tables...)
+        }
+        n := maxPacket - len(hdr)
+        if n > len(f.scanData)-offset {
+            n = len(f.scanData) - offset
+        }
+        pkt := append(hdr, f.scanData[offset:offset+n]...)
+        offset += n
+
+        pkt[0] = 0x80
+        pkt[1] = payloadJPEG
+        if offset >= len(f.scanData) {
+            pkt[1] |= 0x80
+        }
+        binary.BigEndian.PutUint16(pkt[2:], p.seq)
+        binary.BigEndian.PutUint32(pkt[4:], ts)
+        binary.BigEndian.PutUint32(pkt[8:], p.ssrc)
+        p.seq++
+        out = append(out, pkt)
+        if n == 0 {
+            break // an empty scan still gets its one packet
+        }
+    }
+    return out
+}
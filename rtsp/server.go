@@ -0,0 +1,506 @@
+// Package rtsp serves hub streams to RTSP clients such as NVRs and VLC.
+//
+// Video goes out as RFC 2435 JPEG over RTP, interleaved on the RTSP TCP
+// connection, so frames from an MJPEG capture card are sent as they are.
+// A session subscribes to the hub on PLAY and unsubscribes on TEARDOWN or
+// when the connection drops, which is what drives on-demand capture and
+// the client metrics.
+package rtsp
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/textproto"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// DefaultPath is the URL path of the default stream.
+const DefaultPath = "hdmi"
+
+// trackControl is the one media track's control URL suffix.
+const trackControl = "trackID=0"
+
+// writeWait bounds each write so a stalled client cannot hold a hub
+// subscription forever.
+const writeWait = 10 * time.Second
+
+// sessionTimeout is advertised to clients, which send keepalives (or
+// RTCP) at least this often.
+const sessionTimeout = 60 * time.Second
+
+// Lookup returns the hub serving a stream name; "" is the default one.
+type Lookup func(name string) (*hub.Hub, bool)
+
+// Authenticate checks the password from a request URL or Basic
+// credentials, or a ?token= in the URL. A nil Authenticate lets everyone
+// in.
+type Authenticate func(user, password string) bool
+
+// Meter returns what counts the bytes sent to a session played with
+// password, or an error to refuse PLAY when its budget is spent. The
+// session ends at the first count it refuses.
+type Meter func(password string) (charge func(n int) error, err error)
+
+// Server accepts RTSP connections. A nil Meter counts nothing.
+type Server struct {
+    Lookup Lookup
+    Auth   Authenticate
+    Meter  Meter
+
+    mu    sync.Mutex
+    ln    net.Listener
+    conns map[*conn]struct{}
+}
+
+// Serve accepts connections on ln until Close.
+func (s *Server) Serve(ln net.Listener) error {
+    s.mu.Lock()
+    s.ln = ln
+    s.conns = map[*conn]struct{}{}
+    s.mu.Unlock()
+    for {
+        nc, err := ln.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return nil
+            }
+            return err
+        }
+        c := &conn{srv: s, nc: nc, log: slog.With("remote", nc.RemoteAddr().String(), "transport", "rtsp")}
+        s.mu.Lock()
+        s.conns[c] = struct{}{}
+        s.mu.Unlock()
+        go c.serve()
+    }
+}
+
+// ListenAndServe listens on addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    return s.Serve(ln)
+}
+
+// Close stops accepting and ends every session.
+func (s *Server) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var err error
+    if s.ln != nil {
+        err = s.ln.Close()
+    }
+    for c := range s.conns {
+        c.nc.Close()
+    }
+    return err
+}
+
+// Sessions reports how many clients are playing.
+func (s *Server) Sessions() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n := 0
+    for c := range s.conns {
+        if c.playing() {
+            n++
+        }
+    }
+    return n
+}
+
+// conn is one RTSP connection, carrying at most one session.
+type conn struct {
+    srv *Server
+    nc  net.Conn
+    log *slog.Logger
+
+    writeMu sync.Mutex
+    // password is the one the last request authenticated with. Only the
+    // read loop touches it.
+    password string
+
+    mu      sync.Mutex
+    session string
+    channel byte
+    hub     *hub.Hub
+    sub     *hub.Subscriber
+    done    chan struct{}
+}
+
+type request struct {
+    method string
+    url    *url.URL
+    header textproto.MIMEHeader
+}
+
+func (c *conn) serve() {
+    defer func() {
+        // Closing first unblocks a write in progress so stop is prompt.
+        c.nc.Close()
+        c.stop()
+        c.srv.mu.Lock()
+        delete(c.srv.conns, c)
+        c.srv.mu.Unlock()
+    }()
+    r := bufio.NewReader(c.nc)
+    tp := textproto.NewReader(r)
+    for {
+        // Clients that send RTCP do so interleaved on this connection.
+        c.nc.SetReadDeadline(time.Now().Add(2 * sessionTimeout))
+        if b, err := r.Peek(1); err == nil && b[0] == '$' {
+            var hdr [4]byte
+            if _, err := io.ReadFull(r, hdr[:]); err != nil {
+                return
+            }
+            if _, err := r.Discard(int(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+                return
+            }
+            continue
+        }
+        req, err := readRequest(tp)
+        if err != nil {
+            if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+                c.log.Debug("rtsp read failed", "err", err)
+            }
+            return
+        }
+        if !c.handle(req) {
+            return
+        }
+    }
+}
+
+func readRequest(tp *textproto.Reader) (*request, error) {
+    line, err := tp.ReadLine()
+    if err != nil {
+        return nil, err
+    }
+    parts := strings.Fields(line)
+    if len(parts) != 3 || parts[2] != "RTSP/1.0" {
+        return nil, fmt.Errorf("rtsp: malformed request line %q", line)
+    }
+    u, err := url.Parse(parts[1])
+    if err != nil {
+        return nil, fmt.Errorf("rtsp: bad url: %w", err)
+    }
+    header, err := tp.ReadMIMEHeader()
+    if err != nil {
+        return nil, err
+    }
+    // Requests we handle carry no body, but one must still be consumed.
+    if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+        if _, err := io.CopyN(io.Discard, tp.R, int64(n)); err != nil {
+            return nil, err
+        }
+    }
+    return &request{method: parts[0], url: u, header: header}, nil
+}
+
+// handle answers one request and reports whether to keep the connection.
+func (c *conn) handle(req *request) bool {
+    cseq := req.header.Get("CSeq")
+    h := textproto.MIMEHeader{}
+    if req.method != "OPTIONS" && !c.authorized(req) {
+        h.Set("WWW-Authenticate", `Basic realm="hdmi-streaming-app"`)
+        return c.reply(401, "Unauthorized", cseq, h, "")
+    }
+    switch req.method {
+    case "OPTIONS":
+        h.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER")
+        return c.reply(200, "OK", cseq, h, "")
+    case "DESCRIBE":
+        if _, ok := c.lookup(req.url); !ok {
+            return c.reply(404, "Stream Not Found", cseq, h, "")
+        }
+        base := *req.url
+        base.User = nil
+        h.Set("Content-Base", strings.TrimSuffix(base.String(), "/")+"/")
+        h.Set("Content-Type", "application/sdp")
+        return c.reply(200, "OK", cseq, h, c.sdp())
+    case "SETUP":
+        return c.setup(req, cseq, h)
+    case "PLAY":
+        if !c.checkSession(req) {
+            return c.reply(454, "Session Not Found", cseq, h, "")
+        }
+        h.Set("Session", c.session)
+        h.Set("Range", "npt=0.000-")
+        var charge func(n int) error
+        if c.srv.Meter != nil && !c.playing() {
+            var err error
+            if charge, err = c.srv.Meter(c.password); err != nil {
+                c.log.Debug("play refused", "err", err)
+                return c.reply(453, "Not Enough Bandwidth", cseq, h, "")
+            }
+        }
+        if !c.reply(200, "OK", cseq, h, "") {
+            return false
+        }
+        c.play(charge)
+        return true
+    case "TEARDOWN":
+        h.Set("Session", req.header.Get("Session"))
+        c.reply(200, "OK", cseq, h, "")
+        return false
+    case "GET_PARAMETER":
+        if s := req.header.Get("Session"); s != "" {
+            h.Set("Session", s)
+        }
+        return c.reply(200, "OK", cseq, h, "")
+    }
+    return c.reply(501, "Not Implemented", cseq, h, "")
+}
+
+func (c *conn) authorized(req *request) bool {
+    if c.srv.Auth == nil {
+        return true
+    }
+    if t := req.url.Query().Get("token"); t != "" && c.srv.Auth("", t) {
+        c.password = t
+        return true
+    }
+    if req.url.User != nil {
+        pw, _ := req.url.User.Password()
+        if c.srv.Auth(req.url.User.Username(), pw) {
+            c.password = pw
+            return true
+        }
+    }
+    user, pw, ok := basicAuth(req.header.Get("Authorization"))
+    if ok && c.srv.Auth(user, pw) {
+        c.password = pw
+        return true
+    }
+    return false
+}
+
+func basicAuth(h string) (user, password string, ok bool) {
+    if len(h) < 6 || !strings.EqualFold(h[:6], "basic ") {
+        return "", "", false
+    }
+    b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(h[6:]))
+    if err != nil {
+        return "", "", false
+    }
+    return strings.Cut(string(b), ":")
+}
+
+// lookup finds the hub for a request URL: /hdmi is the default stream
+// and /{name} a named one, either with the track suffix.
+func (c *conn) lookup(u *url.URL) (*hub.Hub, bool) {
+    name := strings.Trim(u.Path, "/")
+    name = strings.TrimSuffix(strings.TrimSuffix(name, trackControl), "/")
+    if name == DefaultPath {
+        name = ""
+    }
+    return c.srv.Lookup(name)
+}
+
+func (c *conn) sdp() string {
+    host, _, _ := net.SplitHostPort(c.nc.LocalAddr().String())
+    family := "IP4"
+    if strings.Contains(host, ":") {
+        family = "IP6"
+    }
+    return strings.Join([]string{
+        "v=0",
+        fmt.Sprintf("o=- %d 1 IN %s %s", time.Now().Unix(), family, host),
+        "s=hdmi-streaming-app",
+        "c=IN " + family + " " + host,
+        "t=0 0",
+        fmt.Sprintf("m=video 0 RTP/AVP %d", payloadJPEG),
+        fmt.Sprintf("a=rtpmap:%d JPEG/%d", payloadJPEG, clockRate),
+        "a=control:" + trackControl,
+        "",
+    }, "\r\n")
+}
+
+func (c *conn) setup(req *request, cseq string, h textproto.MIMEHeader) bool {
+    hb, ok := c.lookup(req.url)
+    if !ok {
+        return c.reply(404, "Stream Not Found", cseq, h, "")
+    }
+    transport := req.header.Get("Transport")
+    if !strings.Contains(transport, "RTP/AVP/TCP") {
+        // Only interleaved TCP is offered; clients retry with it.
+        return c.reply(461, "Unsupported Transport", cseq, h, "")
+    }
+    var channel byte
+    for _, p := range strings.Split(transport, ";") {
+        if v, ok := strings.CutPrefix(p, "interleaved="); ok {
+            first, _, _ := strings.Cut(v, "-")
+            n, err := strconv.Atoi(first)
+            if err != nil || n < 0 || n > 254 {
+                return c.reply(400, "Bad Request", cseq, h, "")
+            }
+            channel = byte(n)
+        }
+    }
+    c.mu.Lock()
+    if c.session == "" {
+        c.session = newSessionID()
+    }
+    c.channel = channel
+    c.hub = hb
+    session := c.session
+    c.mu.Unlock()
+    h.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1))
+    h.Set("Session", fmt.Sprintf("%s;timeout=%d", session, int(sessionTimeout/time.Second)))
+    return c.reply(200, "OK", cseq, h, "")
+}
+
+func (c *conn) checkSession(req *request) bool {
+    id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.session != "" && strings.TrimSpace(id) == c.session
+}
+
+func (c *conn) playing() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.sub != nil
+}
+
+// play subscribes to the hub and starts sending frames, counting them
+// with charge if it is set.
+func (c *conn) play(charge func(n int) error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.sub != nil {
+        return
+    }
+    c.sub = c.hub.Subscribe(hub.DefaultBuffer)
+    c.done = make(chan struct{})
+    c.log.Info("client connected", "session", c.session)
+    go c.send(c.hub, c.sub, c.channel, c.done, charge)
+}
+
+// stop ends playback and releases the hub subscription.
+func (c *conn) stop() {
+    c.mu.Lock()
+    hb, sub, done := c.hub, c.sub, c.done
+    c.sub = nil
+    c.mu.Unlock()
+    if sub == nil {
+        return
+    }
+    hb.Unsubscribe(sub)
+    <-done
+    c.log.Info("client disconnected",
+        "session", c.session,
+        "frames_sent", sub.FramesSent(),
+        "bytes_sent", sub.BytesSent(),
+        "frames_dropped", sub.Dropped())
+}
+
+func (c *conn) send(hb *hub.Hub, sub *hub.Subscriber, channel byte, done chan struct{}, charge func(n int) error) {
+    defer close(done)
+    var b [4]byte
+    rand.Read(b[:])
+    p := &packetizer{ssrc: binary.BigEndian.Uint32(b[:])}
+    var (
+        first  time.Time
+        warned bool
+    )
+    for f := range sub.Frames() {
+        // f is released before it is done with; anything logged about
+        // it is kept aside first.
+        seq := f.Seq
+        data, err := hb.Render(f, protocol.Params{})
+        if err == nil {
+            var jf *jpegFrame
+            if jf, err = parseJPEG(data); err == nil {
+                if first.IsZero() {
+                    first = f.Timestamp
+                }
+                ts := uint32(f.Timestamp.Sub(first) * clockRate / time.Second)
+                // The packets are copies, so the frame can go back now.
+                pkts := p.packets(jf, ts)
+                f.Release()
+                n, err := c.writePackets(channel, pkts)
+                if err != nil {
+                    // The read loop sees the same failure and tears down.
+                    c.nc.Close()
+                    return
+                }
+                sub.Sent(n)
+                if charge != nil {
+                    if err := charge(n); err != nil {
+                        c.log.Info("daily byte budget used, closing", "session", c.session, "err", err)
+                        c.nc.Close()
+                        return
+                    }
+                }
+                continue
+            }
+        }
+        f.Release()
+        if !warned {
+            c.log.Warn("cannot send frame", "seq", seq, "err", err)
+            warned = true
+        }
+    }
+}
+
+func (c *conn) writePackets(channel byte, pkts [][]byte) (int, error) {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.nc.SetWriteDeadline(time.Now().Add(writeWait))
+    n := 0
+    for _, pkt := range pkts {
+        hdr := [4]byte{'$', channel}
+        binary.BigEndian.PutUint16(hdr[2:], uint16(len(pkt)))
+        if _, err := c.nc.Write(append(hdr[:], pkt...)); err != nil {
+            return n, err
+        }
+        n += len(pkt)
+    }
+    return n, nil
+}
+
+func (c *conn) reply(code int, reason, cseq string, h textproto.MIMEHeader, body string) bool {
+    var b strings.Builder
+    fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", code, reason)
+    if cseq != "" {
+        fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+    }
+    for k, vs := range h {
+        for _, v := range vs {
+            fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+        }
+    }
+    if body != "" {
+        fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+    }
+    b.WriteString("\r\n")
+    b.WriteString(body)
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.nc.SetWriteDeadline(time.Now().Add(writeWait))
+    _, err := io.WriteString(c.nc, b.String())
+    return err == nil
+}
+
+func newSessionID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
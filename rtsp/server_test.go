@@ -0,0 +1,381 @@
+package rtsp
+
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/encode"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+)
+
+// testJPEG is a synthetic frame encoded as the hub would.
+func testJPEG(t *testing.T, width, height int) capture.Frame {
+    t.Helper()
+    src := capture.NewSyntheticSource(width, height, 1000)
+    if err := src.Open("synthetic"); err != nil {
+        t.Fatal(err)
+    }
+    defer src.Close()
+    raw, err := src.ReadFrame()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer raw.Release()
+    f, err := encode.NewJPEGEncoder().Encode(raw, 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Data = append([]byte(nil), f.Data...)
+    f.Buf.Release()
+    f.Buf = nil
+    return f
+}
+
+// rtspClient speaks just enough RTSP over a TCP connection to play.
+type rtspClient struct {
+    t    *testing.T
+    nc   net.Conn
+    r    *bufio.Reader
+    cseq int
+}
+
+type response struct {
+    code   int
+    header textproto.MIMEHeader
+    body   string
+}
+
+func dialRTSP(t *testing.T, addr string) *rtspClient {
+    t.Helper()
+    nc, err := net.Dial("tcp", addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { nc.Close() })
+    nc.SetDeadline(time.Now().Add(10 * time.Second))
+    return &rtspClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+}
+
+func (c *rtspClient) do(method, url string, header ...string) response {
+    c.t.Helper()
+    c.cseq++
+    req := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+    for _, h := range header {
+        req += h + "\r\n"
+    }
+    if _, err := io.WriteString(c.nc, req+"\r\n"); err != nil {
+        c.t.Fatal(err)
+    }
+    tp := textproto.NewReader(c.r)
+    line, err := tp.ReadLine()
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    parts := strings.SplitN(line, " ", 3)
+    if len(parts) < 2 || parts[0] != "RTSP/1.0" {
+        c.t.Fatalf("status line %q", line)
+    }
+    code, _ := strconv.Atoi(parts[1])
+    h, err := tp.ReadMIMEHeader()
+    if err != nil {
+        c.t.Fatal(err)
+    }
+    if got := h.Get("CSeq"); got != strconv.Itoa(c.cseq) {
+        c.t.Errorf("%s: CSeq %q, want %d", method, got, c.cseq)
+    }
+    body := make([]byte, 0)
+    if n, _ := strconv.Atoi(h.Get("Content-Length")); n > 0 {
+        body = make([]byte, n)
+        if _, err := io.ReadFull(c.r, body); err != nil {
+            c.t.Fatal(err)
+        }
+    }
+    return response{code: code, header: h, body: string(body)}
+}
+
+// rtpPacket is an interleaved RTP packet as received.
+type rtpPacket struct {
+    channel byte
+    pt      byte
+    marker  bool
+    seq     uint16
+    ts      uint32
+    ssrc    uint32
+    payload []byte
+}
+
+func (c *rtspClient) readPacket() rtpPacket {
+    c.t.Helper()
+    var hdr [4]byte
+    if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+        c.t.Fatal(err)
+    }
+    if hdr[0] != '$' {
+        c.t.Fatalf("interleaved packet starts with %q", hdr[0])
+    }
+    pkt := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+    if _, err := io.ReadFull(c.r, pkt); err != nil {
+        c.t.Fatal(err)
+    }
+    if len(pkt) < rtpHeaderSize || pkt[0]>>6 != 2 {
+        c.t.Fatalf("not an RTP packet: % x", pkt[:min(len(pkt), 12)])
+    }
+    return rtpPacket{
+        channel: hdr[1],
+        pt:      pkt[1] & 0x7F,
+        marker:  pkt[1]&0x80 != 0,
+        seq:     binary.BigEndian.Uint16(pkt[2:]),
+        ts:      binary.BigEndian.Uint32(pkt[4:]),
+        ssrc:    binary.BigEndian.Uint32(pkt[8:]),
+        payload: pkt[rtpHeaderSize:],
+    }
+}
+
+// serve runs a server for h, as the default stream, until the test ends.
+func serve(t *testing.T, h *hub.Hub, auth Authenticate) string {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := &Server{
+        Lookup: func(name string) (*hub.Hub, bool) { return h, name == "" },
+        Auth:   auth,
+    }
+    go srv.Serve(ln)
+    t.Cleanup(func() { srv.Close() })
+    return ln.Addr().String()
+}
+
+func TestDescribeSetupPlay(t *testing.T) {
+    h := hub.New(nil, "test", nil)
+    addr := serve(t, h, nil)
+    c := dialRTSP(t, addr)
+    url := "rtsp://" + addr + "/" + DefaultPath
+
+    if r := c.do("OPTIONS", url); r.code != 200 || !strings.Contains(r.header.Get("Public"), "DESCRIBE") {
+        t.Fatalf("OPTIONS: %d %v", r.code, r.header)
+    }
+    r := c.do("DESCRIBE", url, "Accept: application/sdp")
+    if r.code != 200 {
+        t.Fatalf("DESCRIBE: %d", r.code)
+    }
+    if ct := r.header.Get("Content-Type"); ct != "application/sdp" {
+        t.Errorf("DESCRIBE Content-Type %q", ct)
+    }
+    if base := r.header.Get("Content-Base"); base != url+"/" {
+        t.Errorf("Content-Base %q, want %q", base, url+"/")
+    }
+    for _, line := range []string{"v=0", "c=IN IP4 127.0.0.1", "m=video 0 RTP/AVP 26", "a=rtpmap:26 JPEG/90000", "a=control:trackID=0"} {
+        if !strings.Contains(r.body, line+"\r\n") {
+            t.Errorf("SDP lacks %q:\n%s", line, r.body)
+        }
+    }
+    if r := c.do("DESCRIBE", "rtsp://"+addr+"/nosuch"); r.code != 404 {
+        t.Errorf("DESCRIBE of an unknown stream: %d, want 404", r.code)
+    }
+
+    if r := c.do("SETUP", url+"/trackID=0", "Transport: RTP/AVP;unicast;client_port=5000-5001"); r.code != 461 {
+        t.Errorf("SETUP over UDP: %d, want 461", r.code)
+    }
+    r = c.do("SETUP", url+"/trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3")
+    if r.code != 200 {
+        t.Fatalf("SETUP: %d", r.code)
+    }
+    if tr := r.header.Get("Transport"); !strings.Contains(tr, "interleaved=2-3") {
+        t.Errorf("SETUP Transport %q", tr)
+    }
+    session, _, _ := strings.Cut(r.header.Get("Session"), ";")
+    if session == "" {
+        t.Fatal("SETUP without a session")
+    }
+    if r := c.do("PLAY", url, "Session: wrong"); r.code != 454 {
+        t.Errorf("PLAY with the wrong session: %d, want 454", r.code)
+    }
+    if r := c.do("PLAY", url, "Session: "+session); r.code != 200 {
+        t.Fatalf("PLAY: %d", r.code)
+    }
+
+    // Frames published once playback subscribes arrive interleaved on
+    // the channel SETUP chose. The first does not parse as RFC 2435 and
+    // is skipped.
+    good := testJPEG(t, 160, 96)
+    bad := capture.Frame{Data: []byte{0xFF, 0xD8, 0xFF, 0xD9}, Format: capture.FormatMJPEG, Width: 16, Height: 16}
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        for h.Subscribers() == 0 {
+            time.Sleep(time.Millisecond)
+        }
+        start := time.Now()
+        bad.Timestamp = start
+        h.Publish(bad)
+        for i := 1; ; i++ {
+            select {
+            case <-stop:
+                return
+            case <-time.After(10 * time.Millisecond):
+            }
+            f := good
+            f.Timestamp = start.Add(time.Duration(i) * 40 * time.Millisecond)
+            h.Publish(f)
+        }
+    }()
+
+    var (
+        frames   []uint32
+        last     rtpPacket
+        received int
+    )
+    for len(frames) < 3 {
+        p := c.readPacket()
+        if p.channel != 2 || p.pt != payloadJPEG {
+            t.Fatalf("packet on channel %d with payload type %d", p.channel, p.pt)
+        }
+        if received > 0 {
+            if p.seq != last.seq+1 {
+                t.Errorf("RTP seq %d after %d", p.seq, last.seq)
+            }
+            if p.ssrc != last.ssrc {
+                t.Errorf("SSRC changed from %x to %x", last.ssrc, p.ssrc)
+            }
+        }
+        // The RFC 2435 header carries the picture size in 8-pixel units.
+        if len(p.payload) < 8 || p.payload[6] != 160/8 || p.payload[7] != 96/8 {
+            t.Fatalf("JPEG header % x", p.payload[:min(len(p.payload), 8)])
+        }
+        if p.marker {
+            frames = append(frames, p.ts)
+        }
+        last = p
+        received++
+    }
+    for i := 1; i < len(frames); i++ {
+        if d := frames[i] - frames[i-1]; d != 40*clockRate/1000 {
+            t.Errorf("frame %d is %d ticks after the last, want %d", i, d, 40*clockRate/1000)
+        }
+    }
+}
+
+func TestAuthRequired(t *testing.T) {
+    h := hub.New(nil, "test", nil)
+    addr := serve(t, h, func(_, password string) bool { return password == "s3cret" })
+    c := dialRTSP(t, addr)
+    url := "rtsp://" + addr + "/" + DefaultPath
+    if r := c.do("OPTIONS", url); r.code != 200 {
+        t.Errorf("OPTIONS needs no credentials, got %d", r.code)
+    }
+    r := c.do("DESCRIBE", url)
+    if r.code != 401 || !strings.HasPrefix(r.header.Get("WWW-Authenticate"), "Basic") {
+        t.Errorf("DESCRIBE without credentials: %d %v", r.code, r.header)
+    }
+    for _, try := range []struct {
+        url    string
+        header []string
+    }{
+        {url: url + "?token=s3cret"},
+        {url: "rtsp://nvr:s3cret@" + addr + "/" + DefaultPath},
+        {url: url, header: []string{"Authorization: Basic bnZyOnMzY3JldA=="}}, // nvr:s3cret
+    } {
+        if r := c.do("DESCRIBE", try.url, try.header...); r.code != 200 {
+            t.Errorf("DESCRIBE %s %v: %d", try.url, try.header, r.code)
+        }
+    }
+}
+
+func TestMeterEndsSession(t *testing.T) {
+    h := hub.New(nil, "test", nil)
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var charged atomic.Int64
+    srv := &Server{
+        Lookup: func(name string) (*hub.Hub, bool) { return h, name == "" },
+        Auth:   func(_, password string) bool { return password == "s3cret" || password == "spent" },
+        Meter: func(password string) (func(int) error, error) {
+            if password == "spent" {
+                return nil, errors.New("over budget")
+            }
+            return func(n int) error {
+                if charged.Add(int64(n)) >= 20000 {
+                    return errors.New("over budget")
+                }
+                return nil
+            }, nil
+        },
+    }
+    go srv.Serve(ln)
+    t.Cleanup(func() { srv.Close() })
+    addr := ln.Addr().String()
+
+    play := func(token string) (*rtspClient, int) {
+        c := dialRTSP(t, addr)
+        url := "rtsp://" + addr + "/" + DefaultPath
+        r := c.do("SETUP", url+"/trackID=0?token="+token, "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+        if r.code != 200 {
+            t.Fatalf("SETUP: %d", r.code)
+        }
+        session, _, _ := strings.Cut(r.header.Get("Session"), ";")
+        return c, c.do("PLAY", url+"?token="+token, "Session: "+session).code
+    }
+    if _, code := play("spent"); code != 453 {
+        t.Errorf("PLAY over budget: %d, want 453", code)
+    }
+    if h.Subscribers() != 0 {
+        t.Error("a refused PLAY subscribed")
+    }
+
+    c, code := play("s3cret")
+    if code != 200 {
+        t.Fatalf("PLAY: %d", code)
+    }
+    f := testJPEG(t, 160, 96)
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        for i := 0; ; i++ {
+            select {
+            case <-stop:
+                return
+            case <-time.After(10 * time.Millisecond):
+            }
+            f.Timestamp = time.Now()
+            h.Publish(f)
+        }
+    }()
+    // The connection is closed once the frames sent reach the budget.
+    got := 0
+    for {
+        var hdr [4]byte
+        if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+            break
+        }
+        n, err := io.CopyN(io.Discard, c.r, int64(binary.BigEndian.Uint16(hdr[2:])))
+        got += int(n)
+        if err != nil {
+            break
+        }
+    }
+    if n := charged.Load(); n < 20000 || int64(got) != n {
+        t.Errorf("charged %d bytes, received %d, before the session ended", n, got)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for h.Subscribers() != 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("session over budget still subscribed")
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    sdk "github.com/Cdaprod/hdmi-streaming-app/client"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// The tests here run the client package, imported as sdk since this
+// package has a client of its own, against the server's real routes.
+
+// connTracker is a listener that can cut every connection it accepted,
+// as a network outage would.
+type connTracker struct {
+    net.Listener
+    mu    sync.Mutex
+    conns []net.Conn
+}
+
+func (l *connTracker) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    if err == nil {
+        l.mu.Lock()
+        l.conns = append(l.conns, conn)
+        l.mu.Unlock()
+    }
+    return conn, err
+}
+
+func (l *connTracker) cut() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, conn := range l.conns {
+        conn.Close()
+    }
+    l.conns = nil
+}
+
+// sdkServer serves the real routes, with a token of each role, for a
+// running 30 fps synthetic stream with configure applied to its hub.
+func sdkServer(t *testing.T, configure func(*hub.Hub)) (*httptest.Server, *connTracker) {
+    t.Helper()
+    c := config.Default()
+    for _, tok := range roleTokens {
+        c.Tokens = append(c.Tokens, tok)
+    }
+    setupServer(t, c)
+    startStream(t, "default", capture.NewSyntheticSource(320, 180, 30), configure)
+    mux := http.NewServeMux()
+    routes(mux, prometheus.NewRegistry())
+    srv := httptest.NewUnstartedServer(mount(mux))
+    l := &connTracker{Listener: srv.Listener}
+    srv.Listener = l
+    srv.Start()
+    t.Cleanup(srv.Close)
+    return srv, l
+}
+
+func dialSDK(t *testing.T, srv *httptest.Server, opts ...sdk.Option) *sdk.Stream {
+    t.Helper()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    opts = append([]sdk.Option{sdk.WithToken(roleTokens[config.RoleViewer].Secret)}, opts...)
+    s, err := sdk.Dial(ctx, wsURL(srv, "/ws"), opts...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { s.Close() })
+    return s
+}
+
+// nextFrames returns the next n live frames from s.
+func nextFrames(t *testing.T, s *sdk.Stream, n int) []sdk.Frame {
+    t.Helper()
+    var frames []sdk.Frame
+    timeout := time.After(10 * time.Second)
+    for len(frames) < n {
+        select {
+        case f, ok := <-s.Frames():
+            if !ok {
+                t.Fatalf("stream ended after %d frames: %v", len(frames), s.Err())
+            }
+            if !f.Still() {
+                frames = append(frames, f)
+            }
+        case <-timeout:
+            t.Fatalf("%d of %d frames", len(frames), n)
+        }
+    }
+    return frames
+}
+
+func TestSDKWatchesStream(t *testing.T) {
+    srv, _ := sdkServer(t, nil)
+    s := dialSDK(t, srv, sdk.WithFPS(10))
+    if h := s.Hello(); h.Version != protocol.V2 || h.Video != protocol.VideoJPEG {
+        t.Errorf("hello %+v", h)
+    }
+
+    var prev uint32
+    for i, f := range nextFrames(t, s, 10) {
+        img, err := f.Image()
+        if err != nil {
+            t.Fatal(err)
+        }
+        n, ok := capture.ReadSyntheticCounter(img)
+        if !ok {
+            t.Fatalf("frame %d has no counter", f.Seq)
+        }
+        // Ten of thirty frames a second, evenly: two skipped each time,
+        // after the first that came before the cap took effect.
+        if i > 1 && (n <= prev+1 || n > prev+5) {
+            t.Errorf("frame %d has counter %d after %d", f.Seq, n, prev)
+        }
+        if !f.Keyframe || f.H264 || f.Timestamp.IsZero() {
+            t.Errorf("frame %+v", f)
+        }
+        prev = n
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    img, err := s.Snapshot(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 180 {
+        t.Errorf("snapshot is %v", b)
+    }
+
+    if err := s.Close(); err != nil {
+        t.Fatal(err)
+    }
+    for range s.Frames() {
+    }
+    if err := s.Err(); err != nil {
+        t.Errorf("Err after Close = %v", err)
+    }
+}
+
+func TestSDKRefusedToken(t *testing.T) {
+    srv, _ := sdkServer(t, nil)
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _, err := sdk.Dial(ctx, wsURL(srv, "/ws"), sdk.WithToken("wrong"))
+    var he *sdk.HTTPError
+    if !errors.As(err, &he) || he.StatusCode != http.StatusForbidden {
+        t.Errorf("err = %v, want a 403 HTTPError", err)
+    }
+}
+
+func TestSDKResumesAfterOutage(t *testing.T) {
+    srv, l := sdkServer(t, func(h *hub.Hub) {
+        h.HistoryBytes = 16 << 20
+        h.HistoryAge = 10 * time.Second
+    })
+    s := dialSDK(t, srv)
+    before := nextFrames(t, s, 10)
+    l.cut()
+
+    // The client reconnects after its first backoff, half a second in
+    // which the server captured another fifteen frames or so, and picks
+    // up from the last frame it had.
+    after := nextFrames(t, s, 30)
+    want := before[len(before)-1].Seq + 1
+    for _, f := range after[:15] {
+        if f.Seq != want {
+            t.Fatalf("after the outage got seq %d, want %d", f.Seq, want)
+        }
+        want++
+    }
+    if s.Err() != nil {
+        t.Errorf("Err = %v while reconnected", s.Err())
+    }
+}
+
+func TestSDKStaysEndedWhenTerminated(t *testing.T) {
+    srv, _ := sdkServer(t, nil)
+    s := dialSDK(t, srv)
+    nextFrames(t, s, 3)
+    if code, body := call(t, srv, http.MethodDelete, "/api/clients/"+s.Hello().ConnID, config.RoleAdmin, ""); code/100 != 2 {
+        t.Fatalf("terminating the session: %d %s", code, body)
+    }
+    timeout := time.After(5 * time.Second)
+    for open := true; open; {
+        select {
+        case _, open = <-s.Frames():
+        case <-timeout:
+            t.Fatal("stream still open after its session was terminated")
+        }
+    }
+    if s.Err() == nil {
+        t.Error("terminated stream reports no error")
+    }
+    // Past the first reconnect's backoff, nothing has come back.
+    time.Sleep(time.Second)
+    viewers.mu.Lock()
+    n := len(viewers.m)
+    viewers.mu.Unlock()
+    if n != 0 {
+        t.Errorf("%d viewers after termination; the client came back", n)
+    }
+}
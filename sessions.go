@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// session tracks a viewer connection against session_max_duration and
+// session_idle_timeout, and ends it when either runs out or an
+// administrator deletes it.
+type session struct {
+    start time.Time
+    max   time.Duration
+    idle  time.Duration
+    // last is when the viewer was last heard from, in Unix nanoseconds.
+    last atomic.Int64
+    end  func(code int, reason string)
+    once sync.Once
+}
+
+// newSession starts a session ended by end. Viewers that cannot be heard
+// from, such as MJPEG ones, pass idle false and only have a maximum
+// duration.
+func newSession(idle bool, end func(code int, reason string)) *session {
+    s := &session{start: time.Now(), max: cfg.SessionMax, end: end}
+    if idle {
+        s.idle = cfg.SessionIdle
+    }
+    s.touch()
+    return s
+}
+
+// touch records that the viewer is still there.
+func (s *session) touch() {
+    s.last.Store(time.Now().UnixNano())
+}
+
+// remaining reports how long is left before each limit at now, nil for a
+// limit that does not apply.
+func (s *session) remaining(now time.Time) (max, idle *time.Duration) {
+    if s.max > 0 {
+        d := s.max - now.Sub(s.start)
+        max = &d
+    }
+    if s.idle > 0 {
+        d := s.idle - now.Sub(time.Unix(0, s.last.Load()))
+        idle = &d
+    }
+    return max, idle
+}
+
+// watch ends the session once a limit runs out, unless ctx is done
+// first.
+func (s *session) watch(ctx context.Context) {
+    if s.max == 0 && s.idle == 0 {
+        return
+    }
+    tick := time.NewTicker(time.Second)
+    defer tick.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-tick.C:
+            max, idle := s.remaining(now)
+            switch {
+            case max != nil && *max <= 0:
+                s.terminate(protocol.CloseSessionExpired, "session expired")
+                return
+            case idle != nil && *idle <= 0:
+                s.terminate(protocol.CloseIdle, "idle")
+                return
+            }
+        }
+    }
+}
+
+// terminate ends the session with code and reason, once.
+func (s *session) terminate(code int, reason string) {
+    s.once.Do(func() { s.end(code, reason) })
+}
+
+// sessionLimits is what the hello tells a websocket viewer about its
+// session, nil when there are no limits.
+func sessionLimits() *protocol.SessionLimits {
+    if cfg.SessionMax == 0 && cfg.SessionIdle == 0 {
+        return nil
+    }
+    return &protocol.SessionLimits{
+        MaxMS:           cfg.SessionMax.Milliseconds(),
+        IdleMS:          cfg.SessionIdle.Milliseconds(),
+        RequireActivity: cfg.RequireActivity,
+    }
+}
+
+// endSession closes a websocket client's connection with code, which
+// ends its handler.
+func (c *client) endSession(code int, reason string) {
+    c.log.Info("ending session", "reason", reason)
+    c.close(code, reason)
+    c.conn.Close()
+}
+
+// clientDeleteHandler serves DELETE /api/clients/{id}, ending the
+// session at once. It answers with the session as it was.
+func clientDeleteHandler(w http.ResponseWriter, r *http.Request) {
+    id := strings.TrimPrefix(r.URL.Path, "/api/clients/")
+    viewers.mu.Lock()
+    v, ok := viewers.m[id]
+    viewers.mu.Unlock()
+    if !ok {
+        writeError(w, http.StatusNotFound, "unknown client "+id)
+        return
+    }
+    info := v.info(time.Now())
+    v.session.terminate(protocol.CloseTerminated, "terminated")
+    writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+)
+
+// watchedSource is a synthetic source whose Close reports whether a
+// writer was still running.
+type watchedSource struct {
+    *capture.SyntheticSource
+    writing *atomic.Bool
+    closed  chan bool
+}
+
+func (s *watchedSource) Close() error {
+    select {
+    case s.closed <- s.writing.Load():
+    default:
+    }
+    return s.SyntheticSource.Close()
+}
+
+func TestDrainClosesCaptureAfterWriters(t *testing.T) {
+    setupServer(t, config.Default())
+    var writing atomic.Bool
+    src := &watchedSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 30), writing: &writing, closed: make(chan bool, 1)}
+    h := hub.New(src, "synthetic", nil)
+    if err := streams.Add(&stream.Stream{Name: "default", Hub: h, Recorder: record.New(h, t.TempDir(), time.Minute)}); err != nil {
+        t.Fatal(err)
+    }
+    captureCtx, stopCapture := context.WithCancel(context.Background())
+    defer stopCapture()
+    var capturing sync.WaitGroup
+    capturing.Add(1)
+    go func() {
+        defer capturing.Done()
+        h.Run(captureCtx)
+    }()
+
+    // A websocket handler that is told to stop but takes a while to
+    // finish its last write.
+    writerCtx, stopWriter := context.WithCancel(context.Background())
+    started := make(chan struct{})
+    writing.Store(true)
+    wsConns.Add(1)
+    go func() {
+        defer wsConns.Done()
+        sub := h.Subscribe(0)
+        defer h.Unsubscribe(sub)
+        close(started)
+        for {
+            select {
+            case <-writerCtx.Done():
+                time.Sleep(100 * time.Millisecond)
+                writing.Store(false)
+                return
+            case f, ok := <-sub.Frames():
+                if !ok {
+                    t.Error("capture stopped under the writer")
+                    writing.Store(false)
+                    return
+                }
+                f.Release()
+            }
+        }
+    }()
+    <-started
+
+    stopWriter()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    drain(ctx, stopCapture, &capturing)
+    select {
+    case wasWriting := <-src.closed:
+        if wasWriting {
+            t.Error("capture source closed while a writer was running")
+        }
+    default:
+        t.Error("capture source not closed")
+    }
+}
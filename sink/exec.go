@@ -0,0 +1,336 @@
+// Package sink pushes a stream to programs outside the server.
+//
+// An Exec runs a configured command, typically ffmpeg sending to an RTMP
+// server, and writes it the hub's frames on standard input. The command
+// is restarted with a growing delay when it exits, and given up on after
+// too many failures in a row; what it prints on standard error is
+// logged.
+package sink
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "os/exec"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+const (
+    minBackoff = time.Second
+    maxBackoff = 30 * time.Second
+    // A command that ran this long before exiting is not counted as
+    // failing repeatedly; its restarts start over.
+    stableAfter = time.Minute
+    // stopWait is how long a command has to exit after being
+    // interrupted before it is killed.
+    stopWait = 5 * time.Second
+    // stderrLines is how much of the command's output Status keeps.
+    stderrLines = 10
+)
+
+// ErrRunning is returned by Start for a sink already running, and
+// ErrFailed by WriteFrame once the command has been given up on.
+var (
+    ErrRunning = errors.New("sink: already running")
+    ErrFailed  = errors.New("sink: command keeps failing, gave up")
+)
+
+// States reported by Status.
+const (
+    StateStopped    = "stopped"
+    StateStarting   = "starting"
+    StateRunning    = "running"
+    StateRestarting = "restarting"
+    StateFailed     = "failed"
+)
+
+// Status describes a sink. Only the program of the command is given:
+// its arguments usually carry a stream key.
+type Status struct {
+    Name          string    `json:"name"`
+    Stream        string    `json:"stream"`
+    Program       string    `json:"program"`
+    Input         string    `json:"input"`
+    State         string    `json:"state"`
+    PID           int       `json:"pid,omitempty"`
+    Since         time.Time `json:"since,omitempty"`
+    Restarts      int       `json:"restarts"`
+    MaxRestarts   int       `json:"max_restarts"`
+    LastError     string    `json:"last_error,omitempty"`
+    Stderr        []string  `json:"stderr,omitempty"`
+    FramesWritten uint64    `json:"frames_written"`
+    BytesWritten  uint64    `json:"bytes_written"`
+}
+
+// Exec is a sink that runs a command and writes frames to its standard
+// input, either as published or, for input raw, as YUYV decoded from
+// JPEG.
+type Exec struct {
+    cfg config.Sink
+    log *slog.Logger
+
+    mu       sync.Mutex
+    state    string
+    pid      int
+    since    time.Time
+    restarts int
+    lastErr  string
+    stderr   []string
+    stdin    io.WriteCloser
+    cancel   context.CancelFunc
+    done     chan struct{}
+
+    frames atomic.Uint64
+    bytes  atomic.Uint64
+    // yuyv is WriteFrame's conversion buffer.
+    yuyv []byte
+}
+
+// NewExec returns a stopped sink for c, whose Stream is the name of the
+// stream it will be fed.
+func NewExec(c config.Sink, log *slog.Logger) *Exec {
+    if c.Input == "" {
+        c.Input = config.SinkEncoded
+    }
+    if c.MaxRestarts == 0 {
+        c.MaxRestarts = config.DefaultSinkRestarts
+    }
+    return &Exec{cfg: c, log: log.With("sink", c.Name), state: StateStopped}
+}
+
+// Name returns the sink's configured name.
+func (e *Exec) Name() string { return e.cfg.Name }
+
+// Raw reports whether the sink wants frames decoded to YUYV.
+func (e *Exec) Raw() bool { return e.cfg.Input == config.SinkRaw }
+
+// Start launches the command and keeps it running until Stop or ctx is
+// done.
+func (e *Exec) Start(ctx context.Context) error {
+    if _, err := exec.LookPath(e.cfg.Command[0]); err != nil {
+        return fmt.Errorf("sink %s: %w", e.cfg.Name, err)
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.done != nil {
+        return ErrRunning
+    }
+    ctx, e.cancel = context.WithCancel(ctx)
+    e.done = make(chan struct{})
+    e.state, e.restarts, e.lastErr, e.stderr = StateStarting, 0, "", nil
+    go e.supervise(ctx, e.done)
+    return nil
+}
+
+// Stop closes the command's input, so it can finish what it is sending,
+// and waits for it to exit; one that takes too long is killed.
+func (e *Exec) Stop() error {
+    e.mu.Lock()
+    done, cancel := e.done, e.cancel
+    if e.stdin != nil {
+        e.stdin.Close()
+    }
+    e.mu.Unlock()
+    if done == nil {
+        return nil
+    }
+    cancel()
+    <-done
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    e.done, e.cancel = nil, nil
+    if e.state != StateFailed {
+        e.state = StateStopped
+    }
+    return nil
+}
+
+// WriteFrame writes f to the command. Frames arriving while it is being
+// restarted are dropped. The write has no deadline: it blocks until the
+// command reads it, and meanwhile the hub drops the frames that back up
+// in the sink's queue.
+func (e *Exec) WriteFrame(f *hub.Frame) error {
+    e.mu.Lock()
+    w, state := e.stdin, e.state
+    e.mu.Unlock()
+    if state == StateFailed {
+        return ErrFailed
+    }
+    if w == nil {
+        return nil
+    }
+    data, err := e.input(f)
+    if err != nil {
+        e.log.Warn("frame not converted", "seq", f.Seq, "err", err)
+        return nil
+    }
+    // A failed write means the command has exited, which the supervisor
+    // deals with.
+    if _, err := w.Write(data); err == nil {
+        e.frames.Add(1)
+        e.bytes.Add(uint64(len(data)))
+    }
+    return nil
+}
+
+// input returns what is written for f.
+func (e *Exec) input(f *hub.Frame) ([]byte, error) {
+    if !e.Raw() || f.Format == capture.FormatYUYV {
+        return f.Data, nil
+    }
+    if f.Format == capture.FormatH264 {
+        return nil, errors.New("raw input needs a JPEG stream")
+    }
+    img, err := imaging.Decode(f.Frame)
+    if err != nil {
+        return nil, err
+    }
+    b := img.Bounds()
+    if n := b.Dx() * b.Dy() * 2; cap(e.yuyv) < n {
+        e.yuyv = make([]byte, n)
+    } else {
+        e.yuyv = e.yuyv[:n]
+    }
+    if err := imaging.EncodeYUYVInto(e.yuyv, img); err != nil {
+        return nil, err
+    }
+    return e.yuyv, nil
+}
+
+// Status reports what the sink is doing.
+func (e *Exec) Status() Status {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return Status{
+        Name:          e.cfg.Name,
+        Stream:        e.cfg.Stream,
+        Program:       e.cfg.Command[0],
+        Input:         e.cfg.Input,
+        State:         e.state,
+        PID:           e.pid,
+        Since:         e.since,
+        Restarts:      e.restarts,
+        MaxRestarts:   e.cfg.MaxRestarts,
+        LastError:     e.lastErr,
+        Stderr:        append([]string(nil), e.stderr...),
+        FramesWritten: e.frames.Load(),
+        BytesWritten:  e.bytes.Load(),
+    }
+}
+
+// supervise runs the command until ctx is done, restarting it with a
+// growing delay, and closes done when it gives up or is stopped.
+func (e *Exec) supervise(ctx context.Context, done chan struct{}) {
+    defer close(done)
+    e.log.Info("starting sink", "program", e.cfg.Command[0])
+    backoff := minBackoff
+    for {
+        started := time.Now()
+        err := e.run(ctx)
+        if ctx.Err() != nil {
+            e.log.Info("sink stopped")
+            return
+        }
+        if err == nil {
+            err = errors.New("exited")
+        }
+        e.mu.Lock()
+        if time.Since(started) >= stableAfter {
+            e.restarts, backoff = 0, minBackoff
+        }
+        e.lastErr = err.Error()
+        if e.restarts >= e.cfg.MaxRestarts {
+            e.state = StateFailed
+            e.mu.Unlock()
+            e.log.Error("sink command keeps failing, giving up", "err", err, "restarts", e.cfg.MaxRestarts)
+            return
+        }
+        e.restarts++
+        e.state = StateRestarting
+        e.mu.Unlock()
+        e.log.Warn("sink command exited, restarting", "err", err, "delay", backoff)
+        select {
+        case <-ctx.Done():
+            e.log.Info("sink stopped")
+            return
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+        if backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// run runs the command once until it exits or ctx is done.
+func (e *Exec) run(ctx context.Context) error {
+    cmd := exec.CommandContext(ctx, e.cfg.Command[0], e.cfg.Command[1:]...)
+    // Interrupted, ffmpeg finishes the container it is writing.
+    cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+    cmd.WaitDelay = stopWait
+    cmd.Stderr = &lineLogger{e: e}
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+    e.mu.Lock()
+    e.state, e.pid, e.since, e.stdin = StateRunning, cmd.Process.Pid, time.Now(), stdin
+    e.mu.Unlock()
+    err = cmd.Wait()
+    e.mu.Lock()
+    e.pid, e.since, e.stdin = 0, time.Time{}, nil
+    e.mu.Unlock()
+    return err
+}
+
+// lineLogger logs the command's standard error a line at a time and
+// keeps the last few lines for Status.
+type lineLogger struct {
+    e       *Exec
+    partial []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+    l.partial = append(l.partial, p...)
+    for {
+        i := bytes.IndexByte(l.partial, '\n')
+        if i < 0 {
+            break
+        }
+        l.line(string(bytes.TrimRight(l.partial[:i], "\r")))
+        l.partial = l.partial[i+1:]
+    }
+    // A line this long is not going to end; log what there is of it.
+    if len(l.partial) > 4096 {
+        l.line(string(l.partial))
+        l.partial = l.partial[:0]
+    }
+    return len(p), nil
+}
+
+func (l *lineLogger) line(s string) {
+    if s == "" {
+        return
+    }
+    l.e.log.Info("sink output", "line", s)
+    l.e.mu.Lock()
+    l.e.stderr = append(l.e.stderr, s)
+    if len(l.e.stderr) > stderrLines {
+        l.e.stderr = l.e.stderr[len(l.e.stderr)-stderrLines:]
+    }
+    l.e.mu.Unlock()
+}
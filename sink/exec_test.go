@@ -0,0 +1,166 @@
+package sink
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+)
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+func newTestExec(t *testing.T, c config.Sink) (*Exec, *logBuffer) {
+    t.Helper()
+    logs := &logBuffer{}
+    e := NewExec(c, slog.New(slog.NewTextHandler(logs, nil)))
+    t.Cleanup(func() { e.Stop() })
+    return e, logs
+}
+
+// waitState polls e until it reports state.
+func waitState(t *testing.T, e *Exec, state string, timeout time.Duration) {
+    t.Helper()
+    deadline := time.Now().Add(timeout)
+    for e.Status().State != state {
+        if time.Now().After(deadline) {
+            t.Fatalf("sink is %s, never became %s", e.Status().State, state)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestExecWritesFrames(t *testing.T) {
+    e, _ := newTestExec(t, config.Sink{Name: "null", Stream: "default", Command: []string{"sh", "-c", "cat > /dev/null"}})
+    if err := e.Start(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if err := e.Start(context.Background()); !errors.Is(err, ErrRunning) {
+        t.Errorf("second Start: err = %v, want ErrRunning", err)
+    }
+    waitState(t, e, StateRunning, 5*time.Second)
+    if st := e.Status(); st.PID == 0 || st.Since.IsZero() || st.Program != "sh" {
+        t.Errorf("running status %+v", st)
+    }
+    const frames, size = 20, 64 << 10
+    for i := 1; i <= frames; i++ {
+        f := &hub.Frame{Frame: capture.Frame{Data: make([]byte, size), Format: capture.FormatMJPEG}, Seq: uint64(i)}
+        if err := e.WriteFrame(f); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if st := e.Status(); st.FramesWritten != frames || st.BytesWritten != frames*size {
+        t.Errorf("wrote %d frames of %d bytes, want %d of %d", st.FramesWritten, st.BytesWritten, frames, frames*size)
+    }
+
+    if err := e.Stop(); err != nil {
+        t.Fatal(err)
+    }
+    if st := e.Status(); st.State != StateStopped || st.PID != 0 {
+        t.Errorf("after Stop: %+v", st)
+    }
+}
+
+func TestExecRestartsWithBackoffThenFails(t *testing.T) {
+    // The command notes each start and crashes, printing more lines
+    // than Status keeps.
+    dir := t.TempDir()
+    runs := filepath.Join(dir, "runs")
+    script := filepath.Join(dir, "crash")
+    body := fmt.Sprintf("#!/bin/sh\necho run >> '%s'\nfor i in 1 2 3 4 5 6 7 8 9 10 11 12; do echo \"line $i\" >&2; done\nexit 3\n", runs)
+    if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    const restarts = 2
+    e, logs := newTestExec(t, config.Sink{Name: "crash", Stream: "default", Command: []string{script}, MaxRestarts: restarts})
+    if err := e.Start(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+
+    // Time each start as the test sees it.
+    var starts []time.Time
+    deadline := time.Now().Add(10 * time.Second)
+    for len(starts) < restarts+1 {
+        if time.Now().After(deadline) {
+            t.Fatalf("command started %d times, want %d", len(starts), restarts+1)
+        }
+        data, _ := os.ReadFile(runs)
+        for n := bytes.Count(data, []byte("\n")); len(starts) < n; {
+            starts = append(starts, time.Now())
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    waitState(t, e, StateFailed, 5*time.Second)
+
+    // Each restart waits twice as long as the one before.
+    for i, want := range []time.Duration{minBackoff, 2 * minBackoff} {
+        if gap := starts[i+1].Sub(starts[i]); gap < want-50*time.Millisecond || gap > want+time.Second {
+            t.Errorf("restart %d came %v after the last start, want about %v", i+1, gap, want)
+        }
+    }
+    time.Sleep(minBackoff + minBackoff/2)
+    if data, _ := os.ReadFile(runs); bytes.Count(data, []byte("\n")) != restarts+1 {
+        t.Errorf("command ran again after the sink gave up: %q", data)
+    }
+
+    st := e.Status()
+    if st.Restarts != restarts || st.MaxRestarts != restarts || st.LastError != "exit status 3" {
+        t.Errorf("failed status %+v", st)
+    }
+    want := []string{"line 3", "line 4", "line 5", "line 6", "line 7", "line 8", "line 9", "line 10", "line 11", "line 12"}
+    if strings.Join(st.Stderr, ",") != strings.Join(want, ",") {
+        t.Errorf("stderr kept %q, want the last %d lines %q", st.Stderr, stderrLines, want)
+    }
+    if err := e.WriteFrame(&hub.Frame{Seq: 1}); !errors.Is(err, ErrFailed) {
+        t.Errorf("WriteFrame on a failed sink: err = %v, want ErrFailed", err)
+    }
+    out := logs.String()
+    for _, line := range []string{
+        `msg="sink output" sink=crash line="line 1"`,
+        `msg="sink command exited, restarting" sink=crash err="exit status 3" delay=1s`,
+        `msg="sink command exited, restarting" sink=crash err="exit status 3" delay=2s`,
+        `msg="sink command keeps failing, giving up" sink=crash err="exit status 3" restarts=2`,
+    } {
+        if !strings.Contains(out, line) {
+            t.Errorf("log lacks %s:\n%s", line, out)
+        }
+    }
+
+    // A failed sink stays failed across Stop, and can be started again.
+    e.Stop()
+    if st := e.Status(); st.State != StateFailed {
+        t.Errorf("after Stop: state %s, want failed", st.State)
+    }
+    if err := e.Start(context.Background()); err != nil {
+        t.Fatalf("restarting a failed sink: %v", err)
+    }
+    if st := e.Status(); st.Restarts != 0 || st.LastError != "" {
+        t.Errorf("restarted sink kept its failures: %+v", st)
+    }
+}
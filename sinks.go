@@ -0,0 +1,169 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net/http"
+    "strings"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/sink"
+)
+
+// sinks are the configured sinks in order.
+var sinks []*sinkRunner
+
+// sinkRunner feeds one sink from its stream's hub while started.
+type sinkRunner struct {
+    exec *sink.Exec
+    hub  *hub.Hub
+    fps  int
+    ctx  context.Context
+
+    mu     sync.Mutex
+    cancel context.CancelFunc
+    done   chan struct{}
+}
+
+var errSinkStopped = errors.New("sink: not running")
+
+// startSinks builds the configured sinks and starts those set to
+// autostart. They stop when ctx is done.
+func startSinks(ctx context.Context) {
+    for _, sc := range cfg.Sinks {
+        st := streams.Default()
+        if sc.Stream != "" {
+            st, _ = streams.Get(sc.Stream)
+        }
+        sc.Stream = st.Name
+        r := &sinkRunner{exec: sink.NewExec(sc, slog.With("stream", st.Name)), hub: st.Hub, fps: sc.FPS, ctx: ctx}
+        sinks = append(sinks, r)
+        if r.exec.Raw() && !st.JPEG() {
+            slog.Warn("sink wants raw input from an H.264 stream, its frames will be dropped", "sink", sc.Name, "stream", st.Name)
+        }
+        if sc.AutoStart {
+            if err := r.start(); err != nil {
+                slog.Error("sink not started", "sink", sc.Name, "err", err)
+            }
+        }
+    }
+}
+
+// findSink returns the sink called name.
+func findSink(name string) (*sinkRunner, bool) {
+    for _, r := range sinks {
+        if r.exec.Name() == name {
+            return r, true
+        }
+    }
+    return nil, false
+}
+
+// start feeds the sink until stop, or until its command is given up on.
+func (r *sinkRunner) start() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.done != nil {
+        select {
+        case <-r.done:
+        default:
+            return sink.ErrRunning
+        }
+    }
+    ctx, cancel := context.WithCancel(r.ctx)
+    // Feed only returns Start's error once it has given up, so check it
+    // here where the caller can be told.
+    started := make(chan error, 1)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        err := r.hub.Feed(ctx, startNotifier{r.exec, started}, r.fps)
+        if err != nil && !errors.Is(err, sink.ErrFailed) {
+            slog.Warn("sink feed ended", "sink", r.exec.Name(), "err", err)
+        }
+    }()
+    if err := <-started; err != nil {
+        cancel()
+        <-done
+        return err
+    }
+    r.cancel, r.done = cancel, done
+    return nil
+}
+
+// stop ends the feed and waits for the command to exit. A sink given up
+// on is already over; stopping it just forgets that it was started.
+func (r *sinkRunner) stop() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.done == nil {
+        return errSinkStopped
+    }
+    r.cancel()
+    <-r.done
+    r.cancel, r.done = nil, nil
+    return nil
+}
+
+// startNotifier reports the result of its sink's Start.
+type startNotifier struct {
+    *sink.Exec
+    started chan<- error
+}
+
+func (n startNotifier) Start(ctx context.Context) error {
+    err := n.Exec.Start(ctx)
+    n.started <- err
+    return err
+}
+
+// stopSinks stops every running sink, for shutdown.
+func stopSinks() {
+    for _, r := range sinks {
+        r.stop()
+    }
+}
+
+type sinksResponse struct {
+    Sinks []sink.Status `json:"sinks"`
+}
+
+// sinksHandler serves GET /api/sinks.
+func sinksHandler(w http.ResponseWriter, r *http.Request) {
+    resp := sinksResponse{Sinks: []sink.Status{}}
+    for _, s := range sinks {
+        resp.Sinks = append(resp.Sinks, s.exec.Status())
+    }
+    writeJSON(w, http.StatusOK, resp)
+}
+
+// sinkControlHandler serves POST /api/sinks/{name}/start and
+// /api/sinks/{name}/stop, answering with the sink's status.
+func sinkControlHandler(w http.ResponseWriter, r *http.Request) {
+    name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/sinks/"), "/")
+    s, ok := findSink(name)
+    if !ok {
+        writeError(w, http.StatusNotFound, "unknown sink "+name)
+        return
+    }
+    var err error
+    switch action {
+    case "start":
+        err = s.start()
+    case "stop":
+        err = s.stop()
+    default:
+        writeError(w, http.StatusNotFound, "unknown sink action "+action)
+        return
+    }
+    switch {
+    case errors.Is(err, sink.ErrRunning), errors.Is(err, errSinkStopped):
+        writeError(w, http.StatusConflict, err.Error())
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, err.Error())
+    default:
+        writeJSON(w, http.StatusOK, s.exec.Status())
+    }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "sync/atomic"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// slowKicked counts clients closed by slow_client_policy disconnect.
+var slowKicked atomic.Uint64
+
+// slowWatch tracks how long a client has dropped more than
+// slow_client_drop_percent of its frames. It keeps a window of its own,
+// since the adapter starts its window over whenever the level changes.
+// It holds no locks; only the pacing goroutine uses it.
+type slowWatch struct {
+    dropWindow
+    // threshold is the drop rate, 0 to 1, above which the client is slow.
+    threshold float64
+    timeout   time.Duration
+    since     time.Time
+}
+
+func newSlowWatch() slowWatch {
+    return slowWatch{threshold: float64(cfg.SlowPercent) / 100, timeout: cfg.SlowTimeout}
+}
+
+// observe samples the client's counters at now and returns how long it
+// has been slow without a break, and whether that has reached the
+// timeout. One sample at or under the threshold starts the clock over.
+func (w *slowWatch) observe(now time.Time, dropped, delivered uint64) (slow time.Duration, expired bool) {
+    w.add(adaptSample{now, dropped, delivered})
+    if w.dropRate() <= w.threshold {
+        w.since = time.Time{}
+        return 0, false
+    }
+    if w.since.IsZero() {
+        w.since = now
+    }
+    slow = now.Sub(w.since)
+    return slow, slow >= w.timeout
+}
+
+// kick closes a client that has stayed slow, with 1008 Policy Violation.
+// The handler then returns and frees the client's connection slot.
+func (c *client) kick(rate float64) {
+    slowKicked.Add(1)
+    c.log.Info("client too slow, closing",
+        "drop_percent", int(rate*100),
+        "threshold_percent", cfg.SlowPercent,
+        "for", cfg.SlowTimeout)
+    c.close(websocket.ClosePolicyViolation, "too slow")
+    c.conn.Close()
+}
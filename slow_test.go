@@ -0,0 +1,69 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+// slowClient feeds w a sample every adaptTick, in which step says how the
+// counters moved, until ticks have passed or w says the timeout is up. It
+// returns the tick at which that happened, or -1.
+func slowClient(w *slowWatch, start time.Time, ticks int, step func(tick int) (dropped, delivered uint64)) int {
+    var dropped, delivered uint64
+    for i := 0; i < ticks; i++ {
+        d, n := step(i)
+        dropped += d
+        delivered += n
+        if _, expired := w.observe(start.Add(time.Duration(i)*adaptTick), dropped, delivered); expired {
+            return i
+        }
+    }
+    return -1
+}
+
+// slowTick drops three frames in four, well over a 50% threshold.
+func slowTick(int) (uint64, uint64) { return 6, 2 }
+
+func TestSlowWatchExpiresAfterTimeout(t *testing.T) {
+    const timeout = 10 * time.Second
+    w := slowWatch{threshold: 0.5, timeout: timeout}
+    got := slowClient(&w, time.Now(), 100, slowTick)
+    // The first sample has nothing to compare with; the clock starts at
+    // the second.
+    if want := 1 + int(timeout/adaptTick); got != want {
+        t.Errorf("expired at tick %d, want %d", got, want)
+    }
+}
+
+func TestSlowWatchRecoveryJustBeforeDeadline(t *testing.T) {
+    const timeout = 10 * time.Second
+    deadline := 1 + int(timeout/adaptTick)
+    recovered := deadline - 1
+    start := time.Now()
+    w := slowWatch{threshold: 0.5, timeout: timeout}
+
+    // One tick short of being kicked the client catches up, delivering
+    // a burst that brings the window under the threshold.
+    got := slowClient(&w, start, deadline+1, func(i int) (uint64, uint64) {
+        if i == recovered {
+            return 0, 60
+        }
+        return slowTick(i)
+    })
+    if got >= 0 {
+        t.Fatalf("client that recovered at tick %d was kicked at tick %d", recovered, got)
+    }
+
+    // Slow again, it gets a whole new timeout from when the burst leaves
+    // the window, not from its first slow sample.
+    w = slowWatch{threshold: 0.5, timeout: timeout}
+    got = slowClient(&w, start, 200, func(i int) (uint64, uint64) {
+        if i == recovered {
+            return 0, 60
+        }
+        return slowTick(i)
+    })
+    if min := recovered + int(timeout/adaptTick); got < min {
+        t.Errorf("kicked at tick %d, before a full timeout after recovering at %d", got, recovered)
+    }
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// snapshotWait is how long /snapshot waits for an idle device to produce
+// its first frame.
+const snapshotWait = 3 * time.Second
+
+// snapshotHandler serves GET /snapshot/{stream}: the latest frame as a JPEG,
+// optionally cut to ?x=&y=&w=&h=, as set_crop would, and rescaled with
+// ?width=.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+    if _, err := authn.Authenticate(r); err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    st, ok := streamFor(w, r, "/snapshot")
+    if !ok {
+        return
+    }
+    if !st.JPEG() {
+        http.Error(w, "stream is H.264; use the websocket viewer", http.StatusConflict)
+        return
+    }
+    frames := st.Hub
+    var p protocol.Params
+    if v := r.URL.Query().Get("width"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil {
+            http.Error(w, "invalid width", http.StatusBadRequest)
+            return
+        }
+        p.Width = n
+    }
+    if err := p.Validate(); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    crop, err := parseCrop(r.URL.Query())
+    if err == nil {
+        p.Crop, _, err = fitCrop(frames, crop)
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    f := frames.Latest()
+    if f == nil {
+        f = awaitFrame(r, frames, snapshotWait)
+    }
+    if f == nil {
+        w.Header().Set("Retry-After", strconv.Itoa(int(snapshotWait/time.Second)))
+        http.Error(w, "no frame available yet", http.StatusServiceUnavailable)
+        return
+    }
+    defer f.Release()
+    data, err := frames.Render(f, p)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "image/jpeg")
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    w.Header().Set("Last-Modified", f.Timestamp.UTC().Format(http.TimeFormat))
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write(data)
+}
+
+// awaitFrame subscribes for the first frame, which also wakes an
+// on-demand device, and gives up after timeout. The caller releases the
+// frame.
+func awaitFrame(r *http.Request, frames *hub.Hub, timeout time.Duration) *hub.Frame {
+    sub := frames.Subscribe(1)
+    defer frames.Unsubscribe(sub)
+    t := time.NewTimer(timeout)
+    defer t.Stop()
+    select {
+    case f, ok := <-sub.Frames():
+        if ok {
+            return f
+        }
+    case <-t.C:
+    case <-r.Context().Done():
+    }
+    return nil
+}
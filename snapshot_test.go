@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "image/jpeg"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+func TestSnapshotColdStart(t *testing.T) {
+    setupServer(t, config.Default())
+    // Registered but never run, the hub has no frame to give.
+    addStream(t, "default", capture.NewSyntheticSource(320, 180, 30), nil)
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    rec := httptest.NewRecorder()
+    snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/snapshot", nil).WithContext(ctx))
+    if rec.Code != http.StatusServiceUnavailable {
+        t.Fatalf("status %d, want 503", rec.Code)
+    }
+    if got := rec.Header().Get("Retry-After"); got != "3" {
+        t.Errorf("Retry-After = %q, want 3", got)
+    }
+}
+
+func TestSnapshotWidth(t *testing.T) {
+    setupServer(t, config.Default())
+    startStream(t, "default", capture.NewSyntheticSource(320, 180, 30), nil)
+
+    for _, tc := range []struct {
+        query         string
+        code          int
+        width, height int
+    }{
+        {"", http.StatusOK, 320, 180},
+        {"?width=160", http.StatusOK, 160, 90},
+        {"?width=64", http.StatusOK, 64, 36},
+        {"?width=wide", http.StatusBadRequest, 0, 0},
+        {"?width=-5", http.StatusBadRequest, 0, 0},
+    } {
+        t.Run(tc.query, func(t *testing.T) {
+            rec := httptest.NewRecorder()
+            snapshotHandler(rec, httptest.NewRequest(http.MethodGet, "/snapshot"+tc.query, nil))
+            if rec.Code != tc.code {
+                t.Fatalf("status %d, want %d: %s", rec.Code, tc.code, rec.Body)
+            }
+            if tc.code != http.StatusOK {
+                return
+            }
+            if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+                t.Errorf("Content-Type = %q", ct)
+            }
+            img, err := jpeg.Decode(rec.Body)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if b := img.Bounds(); b.Dx() != tc.width || b.Dy() != tc.height {
+                t.Errorf("snapshot is %dx%d, want %dx%d", b.Dx(), b.Dy(), tc.width, tc.height)
+            }
+        })
+    }
+}
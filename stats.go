@@ -0,0 +1,26 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+type statsResponse struct {
+    State             string `json:"state"`
+    Clients           int    `json:"clients"`
+    ReapedConnections uint64 `json:"reaped_connections"`
+    SlowDisconnects   uint64 `json:"slow_disconnects"`
+}
+
+// statsHandler reports statistics for the default stream as JSON; see
+// /api/streams for the others.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+    frames := streams.Default().Hub
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(statsResponse{
+        State:             string(frames.State()),
+        Clients:           frames.Subscribers(),
+        ReapedConnections: reaped.Load(),
+        SlowDisconnects:   slowKicked.Load(),
+    })
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "image"
+    "log/slog"
+    "os"
+    "strings"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/imaging"
+)
+
+// Generated stills are drawn at the stream's size, or this one.
+const (
+    stillWidth  = 1280
+    stillHeight = 720
+)
+
+// setStills gives the stream's hub its startup and offline frames.
+func setStills(sc config.Stream, startup, offline *capture.Frame) {
+    host, err := os.Hostname()
+    if err != nil {
+        host = "hdmi-streaming-app"
+    }
+    *startup = still(sc, "startup_image", sc.StartupImage, strings.ToUpper(host), "connecting to source...")
+    *offline = still(sc, "offline_image", sc.OfflineImage, "STREAM OFFLINE", sc.Name)
+}
+
+// still returns the image at path as a JPEG frame for sc, scaled to its
+// size if it has one. Without a path, or when the image cannot be read,
+// which is logged naming key, it draws title and detail instead. It
+// returns an empty frame only if even that fails to encode.
+func still(sc config.Stream, key, path, title, detail string) capture.Frame {
+    w, h := sc.Width, sc.Height
+    if path != "" {
+        img, err := imaging.Load(path)
+        if err == nil {
+            return stillFrame(sc, key, imaging.Resize(img, w, h))
+        }
+        slog.Error("image not loaded, using a generated one", "stream", sc.Name, "setting", key, "path", path, "err", err)
+    }
+    if w <= 0 || h <= 0 {
+        w, h = stillWidth, stillHeight
+    }
+    return stillFrame(sc, key, imaging.Placeholder(w, h, title, detail))
+}
+
+// stillFrame encodes img as sc's JPEGs are, logging a failure naming key.
+func stillFrame(sc config.Stream, key string, img image.Image) capture.Frame {
+    data, err := imaging.EncodeJPEG(img, sc.JPEGQuality)
+    if err != nil {
+        slog.Error("image not encoded", "stream", sc.Name, "setting", key, "err", err)
+        return capture.Frame{}
+    }
+    b := img.Bounds()
+    return capture.Frame{Data: data, Format: capture.FormatMJPEG, Width: b.Dx(), Height: b.Dy()}
+}
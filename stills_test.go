@@ -0,0 +1,116 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "image/png"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/gorilla/websocket"
+)
+
+// warmingSource is a synthetic source whose device takes a while to
+// open, as a capture card does.
+type warmingSource struct {
+    *capture.SyntheticSource
+    warmup time.Duration
+}
+
+func (s *warmingSource) Open(device string) error {
+    time.Sleep(s.warmup)
+    return s.SyntheticSource.Open(device)
+}
+
+func TestStartupStillOnColdStream(t *testing.T) {
+    // A branding image in a colour the synthetic source never fills a
+    // frame with.
+    img := image.NewRGBA(image.Rect(0, 0, 64, 36))
+    for i := 0; i < len(img.Pix); i += 4 {
+        copy(img.Pix[i:], []byte{200, 20, 160, 255})
+    }
+    var b bytes.Buffer
+    if err := png.Encode(&b, img); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "brand.png")
+    if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+        t.Fatal(err)
+    }
+
+    setupServer(t, config.Default())
+    startStream(t, "default", &warmingSource{capture.NewSyntheticSource(320, 180, 30), time.Second}, func(h *hub.Hub) {
+        sc := cfg.StreamList()[0]
+        sc.StartupImage = path
+        setStills(sc, &h.Startup, &h.Offline)
+    })
+    srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+    defer srv.Close()
+
+    // A frame rate cap must not cost the viewer the still, nor the still
+    // the first live frame.
+    start := time.Now()
+    conn := dialWS(t, srv, "/ws?fps=5")
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var still, live *protocol.FrameHeader
+    for live == nil {
+        typ, data, err := conn.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if typ != websocket.BinaryMessage {
+            continue
+        }
+        h, payload, err := protocol.DecodeFrame(data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if h.Seq != 0 {
+            live = &h
+            break
+        }
+        if still != nil {
+            t.Fatal("two stills")
+        }
+        still = &h
+        if d := time.Since(start); d > 100*time.Millisecond {
+            t.Errorf("startup still arrived after %v, want it within 100ms", d)
+        }
+        got, err := jpeg.Decode(bytes.NewReader(payload))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if bounds := got.Bounds(); bounds.Dx() != 64 || bounds.Dy() != 36 {
+            t.Errorf("still is %v, want the 64x36 branding image", bounds)
+        }
+        r, g, bl, _ := got.At(32, 18).RGBA()
+        if !near(color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8), 255}, color.RGBA{200, 20, 160, 255}) {
+            t.Errorf("still is coloured %v, not the branding image", got.At(32, 18))
+        }
+    }
+    if still == nil {
+        t.Fatal("live frame arrived without a startup still before it")
+    }
+    if time.Since(start) < 900*time.Millisecond {
+        t.Errorf("live frame after %v, before the device could have opened", time.Since(start))
+    }
+    if live.Seq != 1 {
+        t.Errorf("first live frame is seq %d, want 1", live.Seq)
+    }
+}
+
+// near reports whether a and b differ by no more than JPEG rounding.
+func near(a, b color.RGBA) bool {
+    d := func(x, y uint8) bool { return int(x)-int(y) < 8 && int(y)-int(x) < 8 }
+    return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B)
+}
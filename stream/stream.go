@@ -0,0 +1,134 @@
+// Package stream keeps the set of named capture pipelines the server
+// offers, one per configured device.
+package stream
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/composite"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hls"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/metrics"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/record"
+    "github.com/Cdaprod/hdmi-streaming-app/rtc"
+)
+
+var ErrDuplicate = errors.New("stream: duplicate name")
+
+// Stream is one capture device and everything that serves it.
+type Stream struct {
+    Name     string
+    Config   config.Stream
+    Hub      *hub.Hub
+    Recorder *record.Recorder
+    // RTC is nil when WebRTC is unavailable.
+    RTC *rtc.Server
+    // HLS is nil when ffmpeg cannot encode H.264.
+    HLS *hls.Server
+    // Controls adjusts the device's image controls, and Source changes
+    // the mode it is opened with.
+    Controls *capture.ControlSet
+    Source   capture.ModeSetter
+    // Composite is the source of a picture-in-picture stream, nil for a
+    // capture device.
+    Composite *composite.Source
+    // Metrics are the hub's instruments, read for the stats history.
+    Metrics *metrics.Metrics
+}
+
+// Info is the summary of a stream returned by GET /api/streams. Width
+// and Height are those of the latest frame, zero while the device is
+// closed. Video is what websocket viewers are sent, "jpeg" or "h264".
+type Info struct {
+    Name    string    `json:"name"`
+    Device  string    `json:"device"`
+    State   hub.State `json:"state"`
+    Clients int       `json:"clients"`
+    Width   int       `json:"width"`
+    Height  int       `json:"height"`
+    Video   string    `json:"video"`
+}
+
+// JPEG reports whether the hub publishes JPEG frames, which everything
+// but the websocket needs. Otherwise it publishes H.264.
+func (s *Stream) JPEG() bool {
+    return s.Hub.OutputFormat() == capture.FormatMJPEG
+}
+
+// Video is the encoding announced to websocket viewers.
+func (s *Stream) Video() string {
+    if s.JPEG() {
+        return protocol.VideoJPEG
+    }
+    return protocol.VideoH264
+}
+
+// Info reports the stream's current state.
+func (s *Stream) Info() Info {
+    info := Info{
+        Name:    s.Name,
+        Device:  s.Config.Device,
+        State:   s.Hub.State(),
+        Clients: s.Hub.Subscribers(),
+        Video:   s.Video(),
+    }
+    if f := s.Hub.Latest(); f != nil {
+        info.Width, info.Height = f.Width, f.Height
+        f.Release()
+    }
+    return info
+}
+
+// Registry looks streams up by name. The first stream added is the
+// default, served on the unnamed routes.
+type Registry struct {
+    mu     sync.RWMutex
+    list   []*Stream
+    byName map[string]*Stream
+}
+
+func NewRegistry() *Registry {
+    return &Registry{byName: map[string]*Stream{}}
+}
+
+// Add registers s under its name.
+func (r *Registry) Add(s *Stream) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.byName[s.Name]; ok {
+        return fmt.Errorf("%w %q", ErrDuplicate, s.Name)
+    }
+    r.byName[s.Name] = s
+    r.list = append(r.list, s)
+    return nil
+}
+
+// Get returns the stream called name.
+func (r *Registry) Get(name string) (*Stream, bool) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    s, ok := r.byName[name]
+    return s, ok
+}
+
+// Default returns the first stream, or nil if there are none.
+func (r *Registry) Default() *Stream {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if len(r.list) == 0 {
+        return nil
+    }
+    return r.list[0]
+}
+
+// All returns the streams in the order they were added.
+func (r *Registry) All() []*Stream {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return append([]*Stream(nil), r.list...)
+}
@@ -0,0 +1,77 @@
+package testclient
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Report is what Check found in a run of frames.
+type Report struct {
+    Frames int
+    // Missing is how many counter values were skipped between frames:
+    // frames the server dropped for a slow client, or the source missed.
+    Missing int
+    // OutOfOrder counts frames whose sequence number or counter went
+    // backwards, and Duplicates those repeating the previous counter.
+    OutOfOrder int
+    Duplicates int
+    // NoCounter counts frames without a readable counter, which Check
+    // leaves out of the others.
+    NoCounter int
+    // MaxGap is the most counter values skipped at once.
+    MaxGap int
+}
+
+// Check inspects frames in the order they arrived. Sequence numbers must
+// only grow, and counters should too, each by one when nothing is lost.
+// Stills, with sequence number 0, are not stream frames and are skipped.
+func Check(frames []Frame) Report {
+    var r Report
+    var prev *Frame
+    for i := range frames {
+        f := &frames[i]
+        if f.Header.Seq == 0 {
+            continue
+        }
+        r.Frames++
+        if !f.HasCounter {
+            r.NoCounter++
+            continue
+        }
+        if prev != nil {
+            switch {
+            case f.Header.Seq <= prev.Header.Seq || f.Counter < prev.Counter:
+                r.OutOfOrder++
+            case f.Counter == prev.Counter:
+                r.Duplicates++
+            default:
+                gap := int(f.Counter - prev.Counter - 1)
+                r.Missing += gap
+                r.MaxGap = max(r.MaxGap, gap)
+            }
+        }
+        prev = f
+    }
+    return r
+}
+
+// Err returns an error describing the problems that mean the stream is
+// broken rather than lossy: frames out of order, repeated, or without a
+// counter. Missing frames are allowed; compare Missing or MaxGap against
+// what the run can tolerate.
+func (r Report) Err() error {
+    var problems []string
+    if r.OutOfOrder > 0 {
+        problems = append(problems, fmt.Sprintf("%d out of order", r.OutOfOrder))
+    }
+    if r.Duplicates > 0 {
+        problems = append(problems, fmt.Sprintf("%d duplicated", r.Duplicates))
+    }
+    if r.NoCounter > 0 {
+        problems = append(problems, fmt.Sprintf("%d without a counter", r.NoCounter))
+    }
+    if len(problems) == 0 {
+        return nil
+    }
+    return fmt.Errorf("testclient: of %d frames, %s", r.Frames, strings.Join(problems, ", "))
+}
@@ -0,0 +1,163 @@
+// Package testclient is a websocket viewer for exercising the server
+// from Go: integration tests, soak runs, protocol checks. It speaks the
+// versioned protocol, and reads back the frame counter a synthetic
+// capture source draws into each frame, so a run's frames can be checked
+// for drops, reordering and repeats from what actually arrived.
+package testclient
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image/jpeg"
+    "time"
+
+    "github.com/gorilla/websocket"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+)
+
+// Client is one websocket connection to a stream.
+type Client struct {
+    Conn *websocket.Conn
+    // Version is the protocol version the server settled on, and Hello
+    // the hello it opened with.
+    Version protocol.Version
+    Hello   protocol.Hello
+    // Controls are the text messages received since the hello, in order.
+    Controls []json.RawMessage
+}
+
+// Frame is a video frame as received.
+type Frame struct {
+    Header   protocol.FrameHeader
+    Payload  []byte
+    Received time.Time
+    // Counter is the synthetic source's number for the frame, read from
+    // its barcode; HasCounter is false for a frame without one.
+    Counter    uint32
+    HasCounter bool
+}
+
+// Dial connects to a /ws URL such as ws://host:8080/ws/default,
+// offering subprotocols, or every version this package speaks when none
+// are given, and reads the hello.
+func Dial(ctx context.Context, url string, subprotocols ...string) (*Client, error) {
+    if len(subprotocols) == 0 {
+        subprotocols = protocol.Subprotocols
+    }
+    return DialWith(ctx, &websocket.Dialer{Subprotocols: subprotocols, HandshakeTimeout: 10 * time.Second}, url)
+}
+
+// DialWith is Dial connecting through d, for a client that needs its
+// own network settings, and offers d.Subprotocols as they are.
+func DialWith(ctx context.Context, d *websocket.Dialer, url string) (*Client, error) {
+    conn, _, err := d.DialContext(ctx, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    c := &Client{Conn: conn, Version: protocol.Negotiated(conn.Subprotocol())}
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetReadDeadline(deadline)
+        defer conn.SetReadDeadline(time.Time{})
+    }
+    typ, msg, err := conn.ReadMessage()
+    if err == nil && typ != websocket.TextMessage {
+        err = errors.New("testclient: first message is not the hello")
+    }
+    if err == nil {
+        err = json.Unmarshal(msg, &c.Hello)
+    }
+    if err == nil && c.Hello.Type != protocol.TypeHello {
+        err = fmt.Errorf("testclient: first message is %q, not the hello", c.Hello.Type)
+    }
+    if err == nil && c.Hello.Version != c.Version {
+        err = fmt.Errorf("testclient: hello says %s but %s was negotiated", c.Hello.Version, c.Version)
+    }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return c, nil
+}
+
+// Send writes a control message.
+func (c *Client) Send(msg protocol.Control) error {
+    return c.Conn.WriteJSON(msg)
+}
+
+// ReadFrame returns the next video frame, keeping the text messages that
+// come before it in Controls and skipping audio and delta tiles. A binary
+// message the negotiated version does not allow is an error, as is a
+// text message whose type it lacks.
+func (c *Client) ReadFrame() (Frame, error) {
+    for {
+        typ, msg, err := c.Conn.ReadMessage()
+        if err != nil {
+            return Frame{}, err
+        }
+        received := time.Now()
+        if typ == websocket.TextMessage {
+            var m struct {
+                Type string `json:"type"`
+            }
+            if err := json.Unmarshal(msg, &m); err != nil {
+                return Frame{}, fmt.Errorf("testclient: bad control message: %w", err)
+            }
+            if !c.Version.Has(m.Type) {
+                return Frame{}, fmt.Errorf("testclient: %s server sent %q", c.Version, m.Type)
+            }
+            c.Controls = append(c.Controls, msg)
+            continue
+        }
+        h, payload, err := c.Version.Decode(msg)
+        if err != nil {
+            return Frame{}, err
+        }
+        switch h.Magic {
+        case protocol.FrameMagic, protocol.H264Magic, protocol.H264KeyMagic:
+        default:
+            continue
+        }
+        f := Frame{Header: h, Payload: payload, Received: received}
+        if h.Magic == protocol.FrameMagic {
+            img, err := jpeg.Decode(bytes.NewReader(payload))
+            if err != nil {
+                return Frame{}, fmt.Errorf("testclient: frame %d: %w", h.Seq, err)
+            }
+            f.Counter, f.HasCounter = capture.ReadSyntheticCounter(img)
+        }
+        return f, nil
+    }
+}
+
+// ReadFrames reads frames until it has n or ctx is done, returning those
+// it read. A timeout is not an error; the caller checks how many came.
+// Reading is cut off by a deadline, so a connection whose ctx ran out
+// cannot be read again.
+func (c *Client) ReadFrames(ctx context.Context, n int) ([]Frame, error) {
+    stop := context.AfterFunc(ctx, func() { c.Conn.SetReadDeadline(time.Now()) })
+    defer stop()
+    var frames []Frame
+    for len(frames) < n {
+        f, err := c.ReadFrame()
+        if err != nil {
+            if ctx.Err() != nil {
+                return frames, nil
+            }
+            return frames, err
+        }
+        frames = append(frames, f)
+    }
+    return frames, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+    c.Conn.WriteControl(websocket.CloseMessage,
+        websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+    return c.Conn.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+
+    "golang.org/x/crypto/acme/autocert"
+)
+
+// configureTLS prepares srv for TLS according to cfg and returns the
+// plain-HTTP redirect server to run alongside it, or nil when TLS is off
+// or no redirect address is configured.
+func configureTLS(srv *http.Server) (*http.Server, error) {
+    if !cfg.TLS() {
+        return nil, nil
+    }
+    var redirect http.Handler = http.HandlerFunc(redirectHandler)
+    if cfg.TLSAutocert {
+        m := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(cfg.AutocertHosts...),
+            Cache:      autocert.DirCache(cfg.AutocertCache),
+        }
+        srv.TLSConfig = m.TLSConfig()
+        // The ACME HTTP-01 challenge arrives on the plain listener.
+        redirect = m.HTTPHandler(redirect)
+    } else {
+        // Load now so a bad pair fails startup instead of the listener.
+        cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+        if err != nil {
+            return nil, fmt.Errorf("tls: %w", err)
+        }
+        srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+    }
+    if cfg.RedirectAddr == "" {
+        return nil, nil
+    }
+    return &http.Server{Addr: cfg.RedirectAddr, Handler: redirect}, nil
+}
+
+// listen serves srv, with TLS if configureTLS set it up.
+func listen(srv *http.Server) error {
+    if srv.TLSConfig != nil {
+        return srv.ListenAndServeTLS("", "")
+    }
+    return srv.ListenAndServe()
+}
+
+// redirectHandler answers every plain-HTTP request with a 301 to the same
+// URL on the TLS listener.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+    host := r.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    // An IPv6 host without a port keeps its brackets.
+    host = strings.Trim(host, "[]")
+    if strings.Contains(host, ":") {
+        host = "[" + host + "]"
+    }
+    if _, port, err := net.SplitHostPort(cfg.ListenAddr); err == nil && port != "443" && port != "" {
+        host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+    }
+    http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+)
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "localhost"},
+        DNSNames:     []string{"localhost"},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return certFile, keyFile
+}
+
+func TestRedirectHandler(t *testing.T) {
+    for _, tc := range []struct {
+        listen, host, target, want string
+    }{
+        {":443", "cam.local", "/ws?token=x", "https://cam.local/ws?token=x"},
+        {":443", "cam.local:80", "/", "https://cam.local/"},
+        {":8443", "cam.local:8080", "/snapshot", "https://cam.local:8443/snapshot"},
+        {":8443", "[::1]:80", "/", "https://[::1]:8443/"},
+        {":443", "[::1]", "/hls/index.m3u8", "https://[::1]/hls/index.m3u8"},
+    } {
+        cfg = config.Default()
+        cfg.ListenAddr = tc.listen
+        r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+        r.Host = tc.host
+        rec := httptest.NewRecorder()
+        redirectHandler(rec, r)
+        if rec.Code != http.StatusMovedPermanently {
+            t.Errorf("%s%s: status %d, want 301", tc.host, tc.target, rec.Code)
+        }
+        if got := rec.Header().Get("Location"); got != tc.want {
+            t.Errorf("%s%s on %s: Location %q, want %q", tc.host, tc.target, tc.listen, got, tc.want)
+        }
+    }
+}
+
+func TestConfigureTLSRedirectListener(t *testing.T) {
+    certFile, keyFile := writeCert(t, t.TempDir())
+    cfg = config.Default()
+    cfg.ListenAddr = ":8443"
+    cfg.TLSCert, cfg.TLSKey = certFile, keyFile
+    cfg.RedirectAddr = "127.0.0.1:0"
+
+    srv := &http.Server{}
+    redirect, err := configureTLS(srv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if srv.TLSConfig == nil || len(srv.TLSConfig.Certificates) != 1 {
+        t.Fatal("certificate not loaded into the server")
+    }
+    if redirect == nil || redirect.Addr != cfg.RedirectAddr {
+        t.Fatalf("redirect server %+v, want one on %s", redirect, cfg.RedirectAddr)
+    }
+    plain := httptest.NewServer(redirect.Handler)
+    defer plain.Close()
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+    req, _ := http.NewRequest(http.MethodGet, plain.URL+"/ws/default?fps=5", nil)
+    req.Host = "cam.local"
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://cam.local:8443/ws/default?fps=5" {
+        t.Errorf("plain request got %s to %q", resp.Status, resp.Header.Get("Location"))
+    }
+
+    cfg.RedirectAddr = ""
+    if redirect, err := configureTLS(&http.Server{}); err != nil || redirect != nil {
+        t.Errorf("no redirect_addr: redirect %v, err %v", redirect, err)
+    }
+}
+
+func TestConfigureTLSBadKey(t *testing.T) {
+    dir := t.TempDir()
+    certFile, _ := writeCert(t, dir)
+    // A key that does not belong to the certificate.
+    _, otherKey := writeCert(t, t.TempDir())
+    cfg = config.Default()
+    cfg.TLSCert = certFile
+    for _, key := range []string{otherKey, filepath.Join(dir, "missing.pem"), dir} {
+        cfg.TLSKey = key
+        if _, err := configureTLS(&http.Server{}); err == nil {
+            t.Errorf("key %s accepted", key)
+        }
+    }
+}
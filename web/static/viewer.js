@@ -0,0 +1,459 @@
+// Viewer for the server's websocket stream. The wire format is described
+// in protocol/header.go and protocol/version.go: a big-endian header
+// (magic, sequence, timestamp, in v2 the send time, then length)
+// followed by a JPEG frame, an H.264 access unit, the changed tiles of a
+// JPEG frame (protocol/tiles.go) or a chunk of PCM audio. H.264 is
+// decoded with WebCodecs. Text messages are the JSON control messages of
+// protocol/control.go.
+(function () {
+    "use strict";
+
+    // Subprotocols offered, most preferred first, and the header size of
+    // each; a server that picks none speaks v1.
+    const SUBPROTOCOLS = ["hdmi-stream.v2", "hdmi-stream.v1"];
+    const HEADER_SIZES = { "hdmi-stream.v2": 32, "hdmi-stream.v1": 24 };
+    const FRAME_MAGIC = "HDMV";
+    const H264_MAGIC = "HDMH";
+    const H264_KEY_MAGIC = "HDMK";
+    const TILE_MAGIC = "HDMT";
+    // Decoding further behind than this is given up on until the next
+    // keyframe.
+    const MAX_DECODE_QUEUE = 30;
+    const STATS_WINDOW = 2000; // ms, matching the server's stats period
+    // Clock offset estimation: a few time syncs in a row, again now and
+    // then, keeping the one with the shortest round trip. Frames are
+    // acked no more often than the server uses them.
+    const SYNC_ROUNDS = 5;
+    const SYNC_SPACING = 200; // ms
+    const SYNC_EVERY = 60000; // ms
+    const ACK_INTERVAL = 250; // ms
+    // Close codes for a session the server ended on purpose, from
+    // protocol/control.go. The viewer waits to be clicked rather than
+    // reconnect.
+    const ENDED_SESSIONS = {
+        4000: "Session expired, click to resume",
+        4001: "Session ended while idle, click to resume",
+        4002: "Session ended by an administrator, click to reconnect",
+    };
+
+    const canvas = document.getElementById("screen");
+    const ctx2d = canvas.getContext("2d");
+    const overlay = document.getElementById("overlay");
+    const pauseButton = document.getElementById("pause");
+    const snapshotButton = document.getElementById("snapshot");
+    const field = (id) => document.getElementById(id);
+
+    // ?stream= picks a named stream and ?token= is passed on, so the page
+    // URL is all a viewer needs to be sent. ?recording= plays back a
+    // recording from /api/recordings instead. ?delta=0 turns down delta
+    // mode when the server offers it, and ?x=&y=&w=&h= crops the picture
+    // to that region of the source.
+    const page = new URLSearchParams(location.search);
+    const stream = page.get("stream") || "";
+    const token = page.get("token") || "";
+    const recording = page.get("recording") || "";
+    const noDelta = page.get("delta") === "0";
+    const CROP_PARAMS = ["x", "y", "w", "h"];
+
+    function endpoint(path, perStream = true) {
+        // Relative to the page, so a proxy's path prefix is kept.
+        const url = new URL(stream && perStream ? path + "/" + encodeURIComponent(stream) : path, location.href);
+        if (token) {
+            url.searchParams.set("token", token);
+        }
+        return url;
+    }
+
+    let socket = null;
+    let headerSize = 24;
+    let paused = false;
+    let lastJPEG = null;
+    let lastSeq = 0;
+    // Pictures waiting for the decoder: a whole frame, then any tiles to
+    // draw over it, which cannot be skipped.
+    let pending = [];
+    let decoding = false;
+    let decoder = null; // VideoDecoder for H.264, made at a keyframe
+    let retryDelay = 1000;
+    let samples = []; // {at, bytes} per received frame
+    let heartbeat = null; // interval sending heartbeats, with require_activity
+    let syncTimer = null;
+    let syncs = []; // {rtt, offset} of this round of time syncs
+    let clockOffset = null; // µs to add to the local clock for the server's
+    let lastAck = 0;
+
+    function showOverlay(text) {
+        overlay.textContent = text;
+        overlay.hidden = !text;
+        overlay.classList.remove("resume");
+    }
+
+    function setState(text) {
+        field("state").textContent = text;
+    }
+
+    function send(msg) {
+        if (socket && socket.readyState === WebSocket.OPEN) {
+            socket.send(JSON.stringify(msg));
+        }
+    }
+
+    // nowMicros is the local wall clock in microseconds, the unit of the
+    // server's timestamps.
+    function nowMicros() {
+        return Math.round((performance.timeOrigin + performance.now()) * 1000);
+    }
+
+    function startTimeSync() {
+        syncs = [];
+        for (let i = 0; i < SYNC_ROUNDS; i++) {
+            setTimeout(() => send({ type: "time_sync", client_ts: nowMicros() }), i * SYNC_SPACING);
+        }
+    }
+
+    // onTimeSync takes one round: the offset is the server's clock less
+    // the local one, assuming the trip each way took as long.
+    function onTimeSync(msg) {
+        const t3 = nowMicros();
+        const rtt = (t3 - msg.client_ts) - (msg.server_send_ts - msg.server_recv_ts);
+        const offset = ((msg.server_recv_ts - msg.client_ts) + (msg.server_send_ts - t3)) / 2;
+        syncs.push({ rtt, offset });
+        const best = syncs.reduce((a, b) => (b.rtt < a.rtt ? b : a));
+        clockOffset = Math.round(best.offset);
+    }
+
+    function connect() {
+        const url = recording
+            ? endpoint("ws/replay/" + encodeURIComponent(recording), false)
+            : endpoint("ws");
+        if (!recording) {
+            for (const k of CROP_PARAMS) {
+                if (page.has(k)) {
+                    url.searchParams.set(k, page.get(k));
+                }
+            }
+        }
+        url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+        setState("connecting");
+        socket = new WebSocket(url, SUBPROTOCOLS);
+        socket.binaryType = "arraybuffer";
+
+        socket.onopen = () => {
+            headerSize = HEADER_SIZES[socket.protocol] || 24;
+            retryDelay = 1000;
+            setState("connected");
+            if (paused) {
+                send({ type: "pause" });
+            }
+        };
+        socket.onmessage = (ev) => {
+            if (typeof ev.data === "string") {
+                onControl(JSON.parse(ev.data));
+            } else {
+                onBinary(ev.data);
+            }
+        };
+        socket.onclose = (ev) => {
+            socket = null;
+            clearInterval(heartbeat);
+            clearInterval(syncTimer);
+            clockOffset = null;
+            // The next connection starts over at a keyframe.
+            closeDecoder();
+            if (ENDED_SESSIONS[ev.code]) {
+                setState("session ended (" + ev.code + ")");
+                showOverlay(ENDED_SESSIONS[ev.code]);
+                overlay.classList.add("resume");
+                return;
+            }
+            // 1001 is the server shutting down; anything else may be a
+            // network blip. Either way, try again with a growing delay.
+            setState("disconnected (" + ev.code + ")");
+            showOverlay("Reconnecting…");
+            setTimeout(connect, retryDelay);
+            retryDelay = Math.min(retryDelay * 2, 30000);
+        };
+    }
+
+    function onControl(msg) {
+        switch (msg.type) {
+        case "hello":
+            setState("connected as " + msg.conn_id);
+            field("signal").textContent = "ok"; // until told otherwise
+            if (msg.video === "h264" && !("VideoDecoder" in window)) {
+                showOverlay("This browser cannot decode H.264 (no WebCodecs)");
+            }
+            if (msg.audio) {
+                // The viewer does not play audio; save the bandwidth.
+                send({ type: "audio_off" });
+            }
+            if (msg.delta && !noDelta) {
+                send({ type: "delta_on" });
+            }
+            if (!recording) {
+                startTimeSync();
+                syncTimer = setInterval(startTimeSync, SYNC_EVERY);
+            }
+            if (msg.session && msg.session.require_activity) {
+                // Only a tab someone can see counts as being watched.
+                heartbeat = setInterval(() => {
+                    if (document.visibilityState === "visible") {
+                        send({ type: "heartbeat" });
+                    }
+                }, msg.session.idle_ms / 3);
+            }
+            break;
+        case "status":
+            showOverlay(msg.state === "starting" ? "Starting capture…" : msg.state);
+            break;
+        case "signal":
+            // The server keeps sending frames that say so; this is for
+            // the stats line.
+            field("signal").textContent = msg.present ? "ok" : "none";
+            break;
+        case "device":
+            // The server keeps the connection and waits for the card.
+            field("signal").textContent = msg.present ? "ok" : "no device";
+            break;
+        case "stats":
+            field("drops").textContent = (msg.drop_rate * 100).toFixed(1) + "%";
+            field("quality").textContent = msg.quality +
+                (msg.fps_divisor > 1 ? " (1/" + msg.fps_divisor + " frames)" : "") +
+                (msg.delta_saving !== undefined ? ", delta saves " + (msg.delta_saving * 100).toFixed(0) + "%" : "");
+            if (msg.latency) {
+                field("latency").textContent = msg.latency.capture_p50_ms.toFixed(0) + " ms (p95 " +
+                    msg.latency.capture_p95_ms.toFixed(0) + " ms)";
+            }
+            break;
+        case "crop":
+            if (msg.clamped) {
+                console.warn(msg.reason);
+            }
+            break;
+        case "time_sync":
+            onTimeSync(msg);
+            break;
+        case "eof":
+            showOverlay("End of recording");
+            break;
+        case "error":
+            showOverlay("Server: " + msg.reason);
+            break;
+        }
+    }
+
+    function onBinary(buf) {
+        if (buf.byteLength < headerSize) {
+            return;
+        }
+        const view = new DataView(buf);
+        const magic = String.fromCharCode(view.getUint8(0), view.getUint8(1), view.getUint8(2), view.getUint8(3));
+        if (magic !== FRAME_MAGIC && magic !== H264_MAGIC && magic !== H264_KEY_MAGIC && magic !== TILE_MAGIC) {
+            return; // audio
+        }
+        const length = view.getUint32(headerSize - 4);
+        if (headerSize + length > buf.byteLength) {
+            return;
+        }
+        lastSeq = Number(view.getBigUint64(4));
+        ack(lastSeq);
+        if (magic === TILE_MAGIC) {
+            samples.push({ at: performance.now(), bytes: buf.byteLength });
+            onTiles(view, length);
+            return;
+        }
+        if (magic !== FRAME_MAGIC) {
+            samples.push({ at: performance.now(), bytes: buf.byteLength });
+            decodeH264(new Uint8Array(buf, headerSize, length), magic === H264_KEY_MAGIC,
+                Number(view.getBigInt64(12)));
+            return;
+        }
+        const jpeg = new Blob([new Uint8Array(buf, headerSize, length)], { type: "image/jpeg" });
+        samples.push({ at: performance.now(), bytes: buf.byteLength });
+        lastJPEG = jpeg;
+        snapshotButton.disabled = false;
+        showOverlay("");
+
+        // Only the newest frame is worth decoding; one that arrives while
+        // the decoder is busy replaces whatever is waiting.
+        pending = [{ jpeg }];
+        if (!decoding) {
+            decodeNext();
+        }
+    }
+
+    // ack tells the server when frame seq arrived, in its clock, once the
+    // offset is known.
+    function ack(seq) {
+        const now = performance.now();
+        if (clockOffset === null || now - lastAck < ACK_INTERVAL) {
+            return;
+        }
+        lastAck = now;
+        send({ type: "frame_ack", seq, recv_ts: nowMicros() + clockOffset });
+    }
+
+    // onTiles queues the tiles of a delta message to be drawn over the
+    // picture so far.
+    function onTiles(view, length) {
+        if (length < 8) {
+            return;
+        }
+        const size = view.getUint16(headerSize + 4);
+        const count = view.getUint16(headerSize + 6);
+        let off = headerSize + 8;
+        for (let i = 0; i < count && off + 8 <= headerSize + length; i++) {
+            const col = view.getUint16(off);
+            const row = view.getUint16(off + 2);
+            const n = view.getUint32(off + 4);
+            off += 8;
+            const jpeg = new Blob([new Uint8Array(view.buffer, off, n)], { type: "image/jpeg" });
+            off += n;
+            pending.push({ jpeg, x: col * size, y: row * size });
+        }
+        lastJPEG = null; // snapshots come from the canvas instead
+        if (!decoding) {
+            decodeNext();
+        }
+    }
+
+    async function decodeNext() {
+        decoding = true;
+        while (pending.length) {
+            const item = pending.shift();
+            try {
+                const bitmap = await createImageBitmap(item.jpeg);
+                if (item.x === undefined && (canvas.width !== bitmap.width || canvas.height !== bitmap.height)) {
+                    canvas.width = bitmap.width;
+                    canvas.height = bitmap.height;
+                    field("size").textContent = bitmap.width + "×" + bitmap.height;
+                }
+                ctx2d.drawImage(bitmap, item.x || 0, item.y || 0);
+                bitmap.close();
+            } catch (err) {
+                console.warn("frame decode failed", err);
+            }
+        }
+        decoding = false;
+    }
+
+    // decodeH264 feeds an Annex-B access unit to the decoder, starting a
+    // new one at each keyframe after an error or a reconnect.
+    function decodeH264(data, key, timestamp) {
+        if (!("VideoDecoder" in window)) {
+            return;
+        }
+        if (decoder && decoder.decodeQueueSize > MAX_DECODE_QUEUE) {
+            console.warn("H.264 decoder behind, waiting for a keyframe");
+            closeDecoder();
+        }
+        if (!decoder) {
+            if (!key) {
+                return;
+            }
+            const codec = avcCodec(data);
+            if (!codec) {
+                return;
+            }
+            decoder = new VideoDecoder({
+                output: drawVideoFrame,
+                error: (err) => {
+                    console.warn("H.264 decode failed", err);
+                    decoder = null;
+                },
+            });
+            decoder.configure({ codec: codec, optimizeForLatency: true });
+        }
+        decoder.decode(new EncodedVideoChunk({
+            type: key ? "key" : "delta",
+            timestamp: timestamp,
+            data: data,
+        }));
+    }
+
+    function closeDecoder() {
+        if (decoder && decoder.state !== "closed") {
+            decoder.close();
+        }
+        decoder = null;
+    }
+
+    // avcCodec builds the "avc1.PPCCLL" codec string from the profile,
+    // constraint flags and level in the access unit's SPS.
+    function avcCodec(data) {
+        for (let i = 0; i + 6 < data.length; i++) {
+            if (data[i] === 0 && data[i + 1] === 0 && data[i + 2] === 1 && (data[i + 3] & 0x1f) === 7) {
+                const hex = (b) => b.toString(16).padStart(2, "0");
+                return "avc1." + hex(data[i + 4]) + hex(data[i + 5]) + hex(data[i + 6]);
+            }
+        }
+        return null;
+    }
+
+    function drawVideoFrame(frame) {
+        const w = frame.displayWidth;
+        const h = frame.displayHeight;
+        if (canvas.width !== w || canvas.height !== h) {
+            canvas.width = w;
+            canvas.height = h;
+            field("size").textContent = w + "×" + h;
+        }
+        ctx2d.drawImage(frame, 0, 0);
+        frame.close();
+        snapshotButton.disabled = false;
+        lastJPEG = null; // snapshots come from the canvas instead
+        showOverlay("");
+    }
+
+    function updateRates() {
+        const now = performance.now();
+        samples = samples.filter((s) => now - s.at <= STATS_WINDOW);
+        const secs = STATS_WINDOW / 1000;
+        const bytes = samples.reduce((n, s) => n + s.bytes, 0);
+        field("fps").textContent = (samples.length / secs).toFixed(1);
+        field("bitrate").textContent = formatBits(bytes * 8 / secs);
+    }
+
+    function formatBits(bps) {
+        if (bps >= 1e6) {
+            return (bps / 1e6).toFixed(1) + " Mbit/s";
+        }
+        return (bps / 1e3).toFixed(0) + " kbit/s";
+    }
+
+    overlay.addEventListener("click", () => {
+        if (overlay.classList.contains("resume") && !socket) {
+            showOverlay("");
+            connect();
+        }
+    });
+
+    pauseButton.addEventListener("click", () => {
+        paused = !paused;
+        send({ type: paused ? "pause" : "resume" });
+        pauseButton.textContent = paused ? "Resume" : "Pause";
+    });
+
+    // The snapshot is the frame on screen, exactly as the server sent it;
+    // H.264 has no JPEG to save, so the canvas is encoded instead.
+    snapshotButton.addEventListener("click", () => {
+        if (lastJPEG) {
+            download(lastJPEG);
+        } else {
+            canvas.toBlob((blob) => blob && download(blob), "image/jpeg", 0.92);
+        }
+    });
+
+    function download(blob) {
+        const a = document.createElement("a");
+        a.href = URL.createObjectURL(blob);
+        a.download = "snapshot-" + (stream || "default") + "-" + lastSeq + ".jpg";
+        document.body.appendChild(a);
+        a.click();
+        a.remove();
+        setTimeout(() => URL.revokeObjectURL(a.href), 1000);
+    }
+
+    setInterval(updateRates, 500);
+    connect();
+})();
@@ -0,0 +1,112 @@
+// Package web serves the built-in viewer page.
+//
+// The viewer connects to the websocket next to the page it was loaded
+// from, so every URL it uses is relative and it keeps working behind a
+// reverse proxy that mounts the server under a path prefix.
+package web
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "embed"
+    "encoding/hex"
+    "fmt"
+    "html/template"
+    "io/fs"
+    "net/http"
+    "runtime/debug"
+    "time"
+)
+
+//go:embed static
+var static embed.FS
+
+// Version identifies the build: the VCS revision when the binary was
+// built from a checkout, the module version when installed with go
+// install, and "dev" otherwise.
+func Version() string {
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return "dev"
+    }
+    for _, s := range info.Settings {
+        if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+            return s.Value[:12]
+        }
+    }
+    if v := info.Main.Version; v != "" && v != "(devel)" {
+        return v
+    }
+    return "dev"
+}
+
+// Handler serves the viewer at / and its assets beside it. Unknown paths
+// get 404.
+func Handler() http.Handler {
+    assets, err := fs.Sub(static, "static")
+    if err != nil {
+        panic(err) // the embed pattern guarantees the directory
+    }
+    version := assetVersion(assets)
+    index := renderIndex(assets, version)
+    files := http.FileServer(http.FS(assets))
+    started := time.Now()
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            w.Header().Set("Allow", "GET, HEAD")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        switch r.URL.Path {
+        case "/", "/index.html":
+            // The page names the current asset version, so it must
+            // always be revalidated.
+            w.Header().Set("Cache-Control", "no-cache")
+            http.ServeContent(w, r, "index.html", started, bytes.NewReader(index))
+            return
+        case "/index.tmpl.html":
+            http.NotFound(w, r)
+            return
+        }
+        if r.URL.Query().Get("v") == version {
+            w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+        } else {
+            w.Header().Set("Cache-Control", "no-cache")
+        }
+        files.ServeHTTP(w, r)
+    })
+}
+
+// assetVersion names the assets in their URLs by a hash of their
+// contents rather than by Version, which is "dev" for many different
+// builds and a revision for a checkout with uncommitted changes, so a
+// URL cached as immutable only ever means the one set of assets.
+func assetVersion(assets fs.FS) string {
+    h := sha256.New()
+    err := fs.WalkDir(assets, ".", func(path string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return err
+        }
+        b, err := fs.ReadFile(assets, path)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(h, "%s\x00%d\x00", path, len(b))
+        h.Write(b)
+        return nil
+    })
+    if err != nil {
+        panic(err) // embedded files can always be read
+    }
+    return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+func renderIndex(assets fs.FS, version string) []byte {
+    t := template.Must(template.ParseFS(assets, "index.tmpl.html"))
+    var b bytes.Buffer
+    if err := t.Execute(&b, struct{ Version string }{version}); err != nil {
+        panic(err)
+    }
+    return b.Bytes()
+}
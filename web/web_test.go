@@ -0,0 +1,61 @@
+package web
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "testing"
+    "testing/fstest"
+)
+
+func get(t *testing.T, h http.Handler, path string) *http.Response {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+    return rec.Result()
+}
+
+func TestAssetCaching(t *testing.T) {
+    h := Handler()
+    resp := get(t, h, "/")
+    page, _ := io.ReadAll(resp.Body)
+    if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+        t.Errorf("page Cache-Control %q", cc)
+    }
+    m := regexp.MustCompile(`viewer\.js\?v=([0-9a-f]+)"`).FindSubmatch(page)
+    if m == nil {
+        t.Fatalf("no versioned script in the page:\n%s", page)
+    }
+    v := string(m[1])
+
+    for path, want := range map[string]string{
+        "/viewer.js?v=" + v: "public, max-age=31536000, immutable",
+        "/viewer.js?v=dev":  "no-cache",
+        "/viewer.js":        "no-cache",
+    } {
+        resp := get(t, h, path)
+        if resp.StatusCode != http.StatusOK {
+            t.Errorf("%s: %d", path, resp.StatusCode)
+        }
+        if cc := resp.Header.Get("Cache-Control"); cc != want {
+            t.Errorf("%s: Cache-Control %q, want %q", path, cc, want)
+        }
+    }
+}
+
+// Builds that say the same Version, such as two dev builds, name their
+// assets apart whenever the assets differ.
+func TestAssetVersionFollowsContents(t *testing.T) {
+    a := fstest.MapFS{"viewer.js": {Data: []byte("one")}, "viewer.css": {Data: []byte("body{}")}}
+    b := fstest.MapFS{"viewer.js": {Data: []byte("two")}, "viewer.css": {Data: []byte("body{}")}}
+    // The same bytes split differently between files.
+    c := fstest.MapFS{"viewer.js": {Data: []byte("on")}, "viewer.css": {Data: []byte("ebody{}")}}
+    va, vb, vc := assetVersion(a), assetVersion(b), assetVersion(c)
+    if va == vb || va == vc {
+        t.Errorf("versions %s, %s, %s; want each different", va, vb, vc)
+    }
+    if assetVersion(a) != va {
+        t.Error("version of the same assets changed")
+    }
+}
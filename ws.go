@@ -0,0 +1,696 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/auth"
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/Cdaprod/hdmi-streaming-app/quota"
+    "github.com/Cdaprod/hdmi-streaming-app/stream"
+    "github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{Subprotocols: protocol.Subprotocols}
+
+var authn *auth.Authenticator
+
+// writeWait bounds every write so a stalled peer cannot block the writer.
+const writeWait = 10 * time.Second
+
+// reaped counts connections closed for missing pongs.
+var reaped atomic.Uint64
+
+// wsConns tracks running websocket handlers. http.Server.Shutdown does not
+// wait for hijacked connections, so main waits on this before closing the
+// capture device.
+var wsConns sync.WaitGroup
+
+// client is one websocket viewer. Frames and control replies are written
+// from different goroutines, so writes go through writeMu.
+type client struct {
+    id      string
+    stream  *stream.Stream
+    log     *slog.Logger
+    conn    *websocket.Conn
+    token   config.Token
+    session *session
+    // version is the protocol the upgrade settled on.
+    version protocol.Version
+    writeMu sync.Mutex
+
+    // delivered counts frames taken off the subscription, for the
+    // pacing goroutine's drop rate. excused counts drops that happened
+    // during a replay, whose frames the client gets from the history.
+    delivered atomic.Uint64
+    excused   atomic.Uint64
+    replaying atomic.Bool
+
+    // resume carries a resume's from_seq to the writer, and spoke is
+    // closed on the client's first control message.
+    resume    chan uint64
+    spoke     chan struct{}
+    spokeOnce sync.Once
+    // lastSeq is the newest frame the writer has handled, needKey holds
+    // back H.264 until a keyframe the client can decode from, and
+    // noSignal and deviceLost are what the client was last told about
+    // the input and the device. Only the writer touches them.
+    lastSeq    uint64
+    needKey    bool
+    noSignal   bool
+    deviceLost bool
+    // In delta mode shown holds the tile hashes of the picture the
+    // client has, nil until it is sent a whole frame; keyAt is when that
+    // frame was captured and keySize what it took to send. Only the
+    // writer touches them. deltaFull counts the bytes whole frames would
+    // have taken, and deltaSent those sent instead, for the stats.
+    shown     []uint64
+    shownSize [2]int
+    keyAt     time.Time
+    keySize   int
+    deltaFull atomic.Uint64
+    deltaSent atomic.Uint64
+    // lat matches the client's frame acks against what was sent.
+    lat latency
+
+    mu     sync.Mutex
+    params protocol.Params
+    crop   protocol.Rect
+    paused bool
+    delta  bool
+    // level indexes adaptLevels; dec picks which frames survive its
+    // divisor, by capture time.
+    level int
+    dec   hub.Decimator
+}
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+    // Reject before upgrading so browsers see a plain 403, 404 or 429.
+    tok, err := authn.Check(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    st, ok := streamFor(w, r, "/ws")
+    if !ok {
+        return
+    }
+    if !admitToken(w, tok) {
+        return
+    }
+    crop, err := parseCrop(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    fps, ok := parseFPS(r.URL.Query(), 0)
+    if !ok {
+        http.Error(w, "invalid fps", http.StatusBadRequest)
+        return
+    }
+    release, ok := admit(w, r)
+    if !ok {
+        return
+    }
+    defer release()
+    frames := st.Hub
+
+    wsConns.Add(1)
+    defer wsConns.Done()
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        slog.Warn("websocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+        return
+    }
+    defer conn.Close()
+
+    id := newConnID()
+    c := &client{
+        id:      id,
+        stream:  st,
+        log:     slog.With("conn", id, "stream", st.Name),
+        conn:    conn,
+        version: protocol.Negotiated(conn.Subprotocol()),
+        resume:  make(chan uint64, 1),
+        spoke:   make(chan struct{}),
+        needKey: true,
+        token:   tok,
+    }
+    c.session = newSession(true, c.endSession)
+    sub := frames.SubscribeViewer(hub.DefaultBuffer)
+    sub.SetFPS(fps)
+    defer frames.Unsubscribe(sub)
+    defer viewers.add(&viewer{
+        id:        id,
+        kind:      viewerWebsocket,
+        stream:    st.Name,
+        remote:    limiter.ClientIP(r),
+        token:     tok.ID,
+        connected: time.Now(),
+        sub:       sub,
+        session:   c.session,
+        latency:   c.lat.snapshot,
+    })()
+
+    start := time.Now()
+    c.log.Info("client connected", "remote", r.RemoteAddr, "subprotocol", conn.Subprotocol())
+    defer func() {
+        c.log.Info("client disconnected",
+            "remote", r.RemoteAddr,
+            "subprotocol", conn.Subprotocol(),
+            "duration", time.Since(start).Round(time.Millisecond),
+            "frames_sent", sub.FramesSent(),
+            "bytes_sent", sub.BytesSent(),
+            "frames_dropped", sub.Dropped())
+    }()
+
+    hello := protocol.NewHello(id, c.version)
+    hello.Video = st.Video()
+    if sc := st.Config; sc.AudioDevice != "" {
+        hello.Audio = &protocol.AudioFormat{Encoding: "s16le", Rate: sc.AudioRate, Channels: sc.AudioChannels}
+        sub.SetAudio(true)
+    }
+    if cfg.Delta && st.JPEG() && c.version.Has(protocol.TypeDeltaOn) {
+        hello.Delta = &protocol.DeltaFormat{TileSize: protocol.DeltaTileSize, KeyframeMS: cfg.DeltaKeyframe.Milliseconds()}
+    }
+    hello.Session = sessionLimits()
+    if err := c.writeJSON(hello); err != nil {
+        return
+    }
+    if !crop.Empty() {
+        // Answered as a set_crop would be.
+        if err := c.setCrop(crop); err != nil {
+            return
+        }
+    }
+    if st := frames.State(); st != hub.StateRunning {
+        // Subscribing has woken an on-demand hub; say so rather than
+        // leave the viewer staring at nothing while the device opens.
+        c.writeJSON(protocol.NewStatus(string(hub.StateStarting)))
+    }
+
+    // The handler outlasts the goroutines it starts, so shutdown waiting
+    // on wsConns waits for them too.
+    ctx, cancel := context.WithCancel(r.Context())
+    var running sync.WaitGroup
+    defer func() {
+        cancel()
+        conn.Close()
+        running.Wait()
+    }()
+    running.Add(3)
+    go func() {
+        defer running.Done()
+        err := c.readLoop(sub)
+        frames.Unsubscribe(sub)
+        if isTimeout(err) {
+            reaped.Add(1)
+            c.log.Info("client missed pongs, closing")
+            conn.Close()
+        }
+    }()
+    go func() {
+        defer running.Done()
+        c.session.watch(ctx)
+    }()
+    go func() {
+        defer running.Done()
+        c.paceLoop(ctx, sub)
+    }()
+    c.writeLoop(ctx, sub)
+}
+
+// writeLoop sends frames and keepalive pings until the subscription ends,
+// a write fails, or ctx is done. Shutdown is announced to the client with
+// 1001 Going Away.
+func (c *client) writeLoop(ctx context.Context, sub *hub.Subscriber) {
+    ping := time.NewTicker(cfg.PingInterval)
+    defer ping.Stop()
+    if from, ok := c.awaitResume(ctx); ok {
+        if err := c.replay(ctx, sub, from); err != nil {
+            c.writeFailed(err)
+            return
+        }
+    }
+    for {
+        select {
+        case <-ping.C:
+            if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+                return
+            }
+        case <-ctx.Done():
+            c.close(websocket.CloseGoingAway, "server shutting down")
+            return
+        case f, ok := <-sub.Frames():
+            if !ok {
+                if err := sub.Err(); err != nil {
+                    c.close(websocket.CloseInternalServerErr, err.Error())
+                }
+                return
+            }
+            // A still has no sequence number and is never replayed.
+            if f.Seq != 0 && f.Seq <= c.lastSeq {
+                f.Release()
+                continue // already replayed
+            }
+            c.delivered.Add(1)
+            c.lastSeq = max(c.lastSeq, f.Seq)
+            err := c.writeFrame(sub, f)
+            f.Release()
+            if err != nil {
+                c.writeFailed(err)
+                return
+            }
+        case from := <-c.resume:
+            if err := c.replay(ctx, sub, from); err != nil {
+                c.writeFailed(err)
+                return
+            }
+        case a := <-sub.Audio():
+            if err := c.writeAudio(sub, a); err != nil {
+                c.writeFailed(err)
+                return
+            }
+        }
+    }
+}
+
+// readLoop handles control messages until the connection fails. The read
+// deadline allows two missed pongs; every pong or message pushes it out.
+func (c *client) readLoop(sub *hub.Subscriber) error {
+    c.handlePongs()
+    for {
+        typ, data, err := c.conn.ReadMessage()
+        if err != nil {
+            return err
+        }
+        received := time.Now()
+        c.heard(true)
+        if typ != websocket.TextMessage {
+            continue
+        }
+        msg, err := protocol.ParseControl(data)
+        if err != nil || msg.Type != protocol.TypeResume {
+            c.spokeOnce.Do(func() { close(c.spoke) })
+        }
+        if err != nil {
+            if err := c.writeJSON(protocol.NewError(err.Error())); err != nil {
+                return err
+            }
+            continue
+        }
+        if !c.version.Has(msg.Type) {
+            if err := c.writeJSON(protocol.NewError(msg.Type + " needs a newer protocol than " + c.version.String())); err != nil {
+                return err
+            }
+            continue
+        }
+        switch msg.Type {
+        case protocol.TypeTimeSync:
+            if err := c.writeTimeSync(msg.ClientTS, received); err != nil {
+                return err
+            }
+            continue
+        case protocol.TypeFrameAck:
+            c.lat.ack(msg.Seq, msg.RecvTS, received)
+            continue
+        case protocol.TypeSetCrop:
+            if err := c.setCrop(msg.Rect); err != nil {
+                return err
+            }
+            continue
+        }
+        c.mu.Lock()
+        switch msg.Type {
+        case protocol.TypeSetParams:
+            c.params = msg.Params
+            sub.SetFPS(msg.FPS)
+        case protocol.TypePause:
+            c.paused = true
+        case protocol.TypeResume:
+            c.paused = false
+            if msg.FromSeq != nil {
+                select {
+                case c.resume <- *msg.FromSeq:
+                default: // one replay at a time
+                }
+            }
+            c.spokeOnce.Do(func() { close(c.spoke) })
+        case protocol.TypeAudioOff:
+            sub.SetAudio(false)
+        case protocol.TypeAudioOn:
+            sub.SetAudio(c.stream.Config.AudioDevice != "")
+        case protocol.TypeDeltaOff:
+            c.delta = false
+        case protocol.TypeDeltaOn:
+            c.delta = cfg.Delta && c.stream.JPEG()
+        }
+        c.mu.Unlock()
+    }
+}
+
+// setCrop fits r to the source and takes it as the client's crop,
+// telling the client what it got if its protocol can be told. A crop
+// outside the source is refused, and the old one kept. H.264 frames
+// cannot be cropped.
+func (c *client) setCrop(r protocol.Rect) error {
+    if !c.stream.JPEG() {
+        return c.writeJSON(protocol.NewError("crop is not supported for H.264 streams"))
+    }
+    r, reason, err := fitCrop(c.stream.Hub, r)
+    if err != nil {
+        return c.writeJSON(protocol.NewError(err.Error()))
+    }
+    c.mu.Lock()
+    c.crop = r
+    c.mu.Unlock()
+    if !c.version.Has(protocol.TypeCrop) {
+        return nil
+    }
+    return c.writeJSON(protocol.NewCrop(r, reason))
+}
+
+// handlePongs sets the read deadline, and a pong handler to push it out.
+func (c *client) handlePongs() {
+    c.heard(false)
+    c.conn.SetPongHandler(func(string) error {
+        c.heard(false)
+        return nil
+    })
+}
+
+// heard pushes out the read deadline for a pong or, when message is set,
+// anything the client sent, which also counts as session activity. Pongs
+// do too unless require_activity is set.
+func (c *client) heard(message bool) {
+    pongWait := 2*cfg.PingInterval + cfg.PingInterval/2
+    c.conn.SetReadDeadline(time.Now().Add(pongWait))
+    if message || !cfg.RequireActivity {
+        c.session.touch()
+    }
+}
+
+// writeFrame sends f shaped by the client's parameters and adaptive
+// level, or skips it when the client is paused or over its frame rate.
+// H.264 frames are sent as they are, and only pausing skips them. A switch
+// between live and placeholder frames is announced first, even to a
+// paused client, and so is the device going away or coming back to
+// clients whose protocol has device messages. In
+// delta mode only the changed tiles are sent, unless the client has asked
+// for a different size or a crop.
+func (c *client) writeFrame(sub *hub.Subscriber, f *hub.Frame) error {
+    if f.DeviceLost != c.deviceLost {
+        c.deviceLost = f.DeviceLost
+        if c.version.Has(protocol.TypeDevice) {
+            if err := c.writeJSON(protocol.NewDevice(!f.DeviceLost)); err != nil {
+                return err
+            }
+        }
+    }
+    if f.Placeholder != c.noSignal {
+        c.noSignal = f.Placeholder
+        if err := c.writeJSON(protocol.NewSignal(!f.Placeholder)); err != nil {
+            return err
+        }
+    }
+    if f.Format == capture.FormatH264 {
+        return c.writeH264(sub, f)
+    }
+    c.mu.Lock()
+    p := c.params
+    p.Crop = c.crop
+    delta := c.delta && p.Width == 0 && p.Height == 0 && p.Crop.Empty()
+    skip := c.paused
+    if lvl := adaptLevels[c.level]; c.level > 0 {
+        p.Quality = lvl.quality(c.baseQuality())
+        if lvl.divisor != c.dec.Divisor() {
+            c.dec.SetDivisor(lvl.divisor)
+        }
+        skip = skip || !c.dec.Allow(f.Seq, f.Timestamp)
+    }
+    c.mu.Unlock()
+    if skip {
+        return nil
+    }
+    if delta {
+        return c.writeDelta(sub, f, p)
+    }
+    c.shown = nil
+
+    payload, err := c.stream.Hub.Render(f, p)
+    if err != nil {
+        c.log.Warn("encode failed", "seq", f.Seq, "err", err)
+        return nil
+    }
+    return c.writeVideo(sub, f, payload)
+}
+
+// writeDelta sends the tiles of f that differ from the picture the
+// client has. A whole frame is sent instead when the client has none,
+// the size has changed, the keyframe interval is up or most tiles
+// changed, where tiles would save little.
+func (c *client) writeDelta(sub *hub.Subscriber, f *hub.Frame, p protocol.Params) error {
+    t, err := c.stream.Hub.Tiles(f, protocol.DeltaTileSize)
+    if err != nil {
+        c.log.Warn("tiling failed", "seq", f.Seq, "err", err)
+        return nil
+    }
+    var changed []int
+    key := c.shown == nil || c.shownSize != [2]int{t.Width, t.Height} ||
+        f.Timestamp.Sub(c.keyAt) >= cfg.DeltaKeyframe
+    if !key {
+        for i, h := range t.Hashes {
+            if h != c.shown[i] {
+                changed = append(changed, i)
+            }
+        }
+        key = len(changed) > len(t.Hashes)/2
+    }
+    if key {
+        payload, err := c.stream.Hub.Render(f, p)
+        if err != nil {
+            c.log.Warn("encode failed", "seq", f.Seq, "err", err)
+            return nil
+        }
+        if err := c.writeVideo(sub, f, payload); err != nil {
+            return err
+        }
+        c.shown = append(c.shown[:0], t.Hashes...)
+        c.shownSize = [2]int{t.Width, t.Height}
+        c.keyAt = f.Timestamp
+        c.keySize = c.version.HeaderSize() + len(payload)
+        c.deltaFull.Add(uint64(c.keySize))
+        c.deltaSent.Add(uint64(c.keySize))
+        return nil
+    }
+    c.deltaFull.Add(uint64(c.keySize))
+    if len(changed) == 0 {
+        return nil
+    }
+    q := p.Quality
+    if q == 0 {
+        q = c.stream.Hub.Quality()
+    }
+    msg := protocol.Tiles{Width: t.Width, Height: t.Height, TileSize: t.Size}
+    for _, i := range changed {
+        b, err := t.JPEG(i, q)
+        if err != nil {
+            c.log.Warn("encode failed", "seq", f.Seq, "err", err)
+            return nil
+        }
+        msg.Tiles = append(msg.Tiles, protocol.Tile{Col: i % t.Cols, Row: i / t.Cols, JPEG: b})
+    }
+    payload, err := protocol.EncodeTiles(msg)
+    if err != nil {
+        c.log.Warn("frame too large", "seq", f.Seq, "err", err)
+        return nil
+    }
+    n, err := c.writeBinary(protocol.FrameHeader{
+        Magic:     protocol.TileMagic,
+        Seq:       f.Seq,
+        Timestamp: f.Timestamp.UnixMicro(),
+    }, payload)
+    if err != nil {
+        return err
+    }
+    c.lat.sentAt(f.Seq, f.Timestamp, time.Now())
+    for _, i := range changed {
+        c.shown[i] = t.Hashes[i]
+    }
+    sub.Sent(n)
+    c.deltaSent.Add(uint64(n))
+    return charge(c.token, n)
+}
+
+// writeH264 sends f unless the client is paused. After a pause the client
+// waits for a keyframe, since what it missed cannot be skipped over.
+func (c *client) writeH264(sub *hub.Subscriber, f *hub.Frame) error {
+    c.mu.Lock()
+    paused := c.paused
+    c.mu.Unlock()
+    if paused {
+        c.needKey = true
+        return nil
+    }
+    if c.needKey && !f.Key {
+        return nil
+    }
+    c.needKey = false
+    return c.writeVideo(sub, f, f.Data)
+}
+
+// writeVideo sends payload under a header describing f.
+func (c *client) writeVideo(sub *hub.Subscriber, f *hub.Frame, payload []byte) error {
+    if len(payload) > protocol.MaxPayload {
+        c.log.Warn("frame too large", "seq", f.Seq, "size", len(payload))
+        return nil
+    }
+    n, err := c.writeBinary(protocol.FrameHeader{
+        Magic:     f.Magic(),
+        Seq:       f.Seq,
+        Timestamp: f.Timestamp.UnixMicro(),
+    }, payload)
+    if err != nil {
+        return err
+    }
+    c.lat.sentAt(f.Seq, f.Timestamp, time.Now())
+    sub.Sent(n)
+    return charge(c.token, n)
+}
+
+// writeBinary sends payload under h in the client's protocol version,
+// stamped with the time it goes out, and returns the bytes sent.
+func (c *client) writeBinary(h protocol.FrameHeader, payload []byte) (int, error) {
+    var buf [protocol.HeaderSizeV2]byte
+    hdr := buf[:c.version.HeaderSize()]
+    h.Length = uint32(len(payload))
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    now := time.Now()
+    c.conn.SetWriteDeadline(now.Add(writeWait))
+    h.SendTS = now.UnixMicro()
+    if err := c.version.EncodeHeader(hdr, h); err != nil {
+        return 0, err
+    }
+    // WriteMessage would copy the frame into a message of its own; a
+    // writer sends the header and the shared payload as they are.
+    w, err := c.conn.NextWriter(websocket.BinaryMessage)
+    if err != nil {
+        return 0, err
+    }
+    w.Write(hdr)
+    w.Write(payload)
+    if err := w.Close(); err != nil {
+        return 0, err
+    }
+    return len(hdr) + len(payload), nil
+}
+
+// writeAudio sends an audio chunk unless the client is paused.
+func (c *client) writeAudio(sub *hub.Subscriber, a *hub.AudioChunk) error {
+    c.mu.Lock()
+    paused := c.paused
+    c.mu.Unlock()
+    if paused {
+        return nil
+    }
+    if len(a.Data) > protocol.MaxPayload {
+        return nil
+    }
+    n, err := c.writeBinary(protocol.FrameHeader{
+        Magic:     protocol.AudioMagic,
+        Seq:       a.Seq,
+        Timestamp: a.Timestamp.UnixMicro(),
+    }, a.Data)
+    if err != nil {
+        return err
+    }
+    sub.SentAudio(n)
+    return charge(c.token, n)
+}
+
+// baseQuality is the JPEG quality the client asked for, before any
+// adaptive step down. The caller holds c.mu.
+func (c *client) baseQuality() int {
+    if c.params.Quality != 0 {
+        return c.params.Quality
+    }
+    return c.stream.Hub.Quality()
+}
+
+func (c *client) writeJSON(v interface{}) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+    return c.conn.WriteJSON(v)
+}
+
+// writeTimeSync answers a time sync that arrived at received, stamping
+// the answer as late as it can.
+func (c *client) writeTimeSync(clientTS int64, received time.Time) error {
+    ts := protocol.NewTimeSync(clientTS, received.UnixMicro())
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+    ts.ServerSendTS = time.Now().UnixMicro()
+    return c.conn.WriteJSON(ts)
+}
+
+// tryWriteJSON is writeJSON for messages that can be skipped: it sends
+// nothing while another write holds the connection, so the caller is not
+// held up behind a client that has stopped reading.
+func (c *client) tryWriteJSON(v interface{}) error {
+    if !c.writeMu.TryLock() {
+        return nil
+    }
+    defer c.writeMu.Unlock()
+    c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+    return c.conn.WriteJSON(v)
+}
+
+// writeFailed ends the connection after a failed send. A token over its
+// byte budget is told why; any other failure means the connection is
+// gone.
+func (c *client) writeFailed(err error) {
+    var qerr *quota.Error
+    if errors.As(err, &qerr) {
+        c.log.Info("token used its daily byte budget, closing", "token", qerr.Token)
+        c.close(websocket.ClosePolicyViolation, "quota exceeded")
+        return
+    }
+    c.log.Debug("write failed", "err", err)
+}
+
+// close sends a close frame carrying reason. Control frame payloads are
+// capped at 125 bytes, two of which hold the code.
+func (c *client) close(code int, reason string) {
+    if len(reason) > 123 {
+        reason = reason[:123]
+    }
+    msg := websocket.FormatCloseMessage(code, reason)
+    c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// newConnID returns a short random ID for correlating a connection's log
+// lines with the browser's.
+func newConnID() string {
+    b := make([]byte, 4)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+func isTimeout(err error) bool {
+    var ne net.Error
+    return errors.As(err, &ne) && ne.Timeout()
+}
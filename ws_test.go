@@ -0,0 +1,384 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/Cdaprod/hdmi-streaming-app/capture"
+    "github.com/Cdaprod/hdmi-streaming-app/config"
+    "github.com/Cdaprod/hdmi-streaming-app/hub"
+    "github.com/Cdaprod/hdmi-streaming-app/protocol"
+    "github.com/gorilla/websocket"
+)
+
+// dialWS opens a websocket to srv's path.
+func dialWS(t *testing.T, srv *httptest.Server, path string) *websocket.Conn {
+    t.Helper()
+    conn, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, path), nil)
+    if err != nil {
+        if resp != nil {
+            t.Fatalf("dial %s: %v (%s)", path, err, resp.Status)
+        }
+        t.Fatalf("dial %s: %v", path, err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    return conn
+}
+
+// readUntilClosed reads from conn until the server closes it or timeout
+// passes, and reports how long that took.
+func readUntilClosed(conn *websocket.Conn, timeout time.Duration) (time.Duration, bool) {
+    start := time.Now()
+    conn.SetReadDeadline(start.Add(timeout))
+    for {
+        if _, _, err := conn.ReadMessage(); err != nil {
+            if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+                return 0, false
+            }
+            return time.Since(start), true
+        }
+    }
+}
+
+func TestWebsocketReapsClientWithoutPongs(t *testing.T) {
+    c := config.Default()
+    c.PingInterval = 50 * time.Millisecond
+    setupServer(t, c)
+    startStream(t, "default", capture.NewSyntheticSource(160, 96, 10), nil)
+    srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+    defer srv.Close()
+
+    live := dialWS(t, srv, "/ws")
+    dead := dialWS(t, srv, "/ws")
+    // Reading still answers pings unless the handler is replaced; this
+    // client reads everything but never sends a pong.
+    dead.SetPingHandler(func(string) error { return nil })
+
+    before := reaped.Load()
+    pongWait := 2*c.PingInterval + c.PingInterval/2
+    liveClosed := make(chan bool, 1)
+    go func() {
+        _, closed := readUntilClosed(live, 10*pongWait)
+        liveClosed <- closed
+    }()
+    took, closed := readUntilClosed(dead, 20*pongWait)
+    if !closed {
+        t.Fatal("client that stopped answering pings was not closed")
+    }
+    if took < pongWait-c.PingInterval/2 {
+        t.Errorf("closed after %v, before two pings went unanswered", took)
+    }
+    if n := reaped.Load() - before; n != 1 {
+        t.Errorf("reaped %d connections, want 1", n)
+    }
+
+    // The client that answers pings, by reading, kept streaming.
+    if <-liveClosed {
+        t.Error("client answering pings was closed")
+    }
+}
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+// records returns the JSON log records with the given message.
+func (b *logBuffer) records(t *testing.T, msg string) []map[string]any {
+    t.Helper()
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    var out []map[string]any
+    for _, line := range bytes.Split(b.buf.Bytes(), []byte("\n")) {
+        if len(line) == 0 {
+            continue
+        }
+        var rec map[string]any
+        if err := json.Unmarshal(line, &rec); err != nil {
+            t.Fatalf("log line %q: %v", line, err)
+        }
+        if rec["msg"] == msg {
+            out = append(out, rec)
+        }
+    }
+    return out
+}
+
+// captureLogs sends the default logger's output to a buffer until the
+// test ends.
+func captureLogs(t *testing.T) *logBuffer {
+    b := &logBuffer{}
+    old := slog.Default()
+    slog.SetDefault(slog.New(slog.NewJSONHandler(b, nil)))
+    t.Cleanup(func() { slog.SetDefault(old) })
+    return b
+}
+
+func TestWebsocketHelloAndDisconnectLog(t *testing.T) {
+    logs := captureLogs(t)
+    setupServer(t, config.Default())
+    startStream(t, "default", capture.NewSyntheticSource(160, 96, 30), nil)
+    srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+    defer srv.Close()
+    conn := dialWS(t, srv, "/ws")
+
+    typ, data, err := conn.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if typ != websocket.TextMessage {
+        t.Fatalf("first message is type %d, want a text hello", typ)
+    }
+    var hello map[string]any
+    if err := json.Unmarshal(data, &hello); err != nil {
+        t.Fatal(err)
+    }
+    id, _ := hello["conn_id"].(string)
+    if hello["type"] != "hello" || len(id) != 8 || hello["version"] != float64(1) || hello["video"] != "jpeg" {
+        t.Errorf("hello = %s", data)
+    }
+    for _, k := range []string{"audio", "delta", "session"} {
+        if _, ok := hello[k]; ok {
+            t.Errorf("hello has %s without it configured: %s", k, data)
+        }
+    }
+
+    var frames, payload int
+    for frames < 3 {
+        typ, data, err := conn.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if typ != websocket.BinaryMessage {
+            continue
+        }
+        h, body, err := protocol.DecodeFrame(data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if h.Seq == 0 {
+            continue // the startup still
+        }
+        frames++
+        payload += len(body)
+    }
+    conn.Close()
+    wsConns.Wait()
+
+    connected := logs.records(t, "client connected")
+    if len(connected) != 1 || connected[0]["conn"] != id {
+        t.Fatalf("connect log %v does not carry conn %s", connected, id)
+    }
+    gone := logs.records(t, "client disconnected")
+    if len(gone) != 1 {
+        t.Fatalf("%d disconnect lines, want 1", len(gone))
+    }
+    rec := gone[0]
+    if rec["conn"] != id || rec["stream"] != "default" {
+        t.Errorf("disconnect log %v is not for conn %s", rec, id)
+    }
+    sent, _ := rec["frames_sent"].(float64)
+    bytesSent, _ := rec["bytes_sent"].(float64)
+    if sent < float64(frames) || bytesSent < float64(payload) {
+        t.Errorf("frames_sent %v, bytes_sent %v; the client read %d frames of %d bytes", rec["frames_sent"], rec["bytes_sent"], frames, payload)
+    }
+    if _, ok := rec["duration"]; !ok {
+        t.Error("disconnect log has no duration")
+    }
+}
+
+func TestWebsocketReturnsBuffersAfterDisconnect(t *testing.T) {
+    setupServer(t, config.Default())
+    before := capture.BuffersInUse()
+    // An on-demand device is closed once the last viewer goes, so nothing
+    // should hold on to a frame buffer after that.
+    startStream(t, "default", capture.NewSyntheticSource(160, 96, 60), func(h *hub.Hub) {
+        h.OnDemand = true
+        h.IdleTimeout = 50 * time.Millisecond
+    })
+    srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+    defer srv.Close()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        // Half the viewers ask for a smaller frame, so the hub renders
+        // as well as passing the encoder's output through.
+        conn := dialWS(t, srv, "/ws")
+        if i%2 == 1 {
+            if err := conn.WriteJSON(map[string]any{"type": "set_params", "width": 80}); err != nil {
+                t.Fatal(err)
+            }
+        }
+        wg.Add(1)
+        go func(n int) {
+            defer wg.Done()
+            defer conn.Close()
+            for frames := 0; frames < 10*n+5; {
+                typ, _, err := conn.ReadMessage()
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                if typ == websocket.BinaryMessage {
+                    frames++
+                }
+            }
+        }(i)
+    }
+    wg.Wait()
+    wsConns.Wait()
+
+    deadline := time.Now().Add(5 * time.Second)
+    for capture.BuffersInUse() != before {
+        if time.Now().After(deadline) {
+            t.Fatalf("%d frame buffers still in use after every viewer left", capture.BuffersInUse()-before)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// unplugSource is a synthetic source whose device is lost after lostAt
+// frames and stays gone for one attempt to open it again.
+type unplugSource struct {
+    *capture.SyntheticSource
+    reads, lostAt int
+    lost          bool
+}
+
+func (s *unplugSource) ReadFrame() (capture.Frame, error) {
+    s.reads++
+    if s.reads == s.lostAt {
+        s.lost = true
+        return capture.Frame{}, &capture.DeviceLostError{Device: "synthetic", Err: syscall.ENODEV}
+    }
+    return s.SyntheticSource.ReadFrame()
+}
+
+func (s *unplugSource) Open(device string) error {
+    if s.lost {
+        s.lost = false
+        return syscall.ENOENT
+    }
+    return s.SyntheticSource.Open(device)
+}
+
+// TestWebsocketVersions has a client of each version ask for everything
+// V2 added while the device is unplugged and comes back, and checks a V1
+// client is sent none of it: no delta tiles, device reports, time sync
+// answers or crops, and only V1 headers.
+func TestWebsocketVersions(t *testing.T) {
+    for _, v := range []protocol.Version{protocol.V1, protocol.V2} {
+        t.Run(v.String(), func(t *testing.T) {
+            c := config.Default()
+            c.Delta = true
+            setupServer(t, c)
+            startStream(t, "default", &unplugSource{SyntheticSource: capture.NewSyntheticSource(160, 96, 30), lostAt: 10}, nil)
+            srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+            defer srv.Close()
+            d := websocket.Dialer{Subprotocols: []string{v.Subprotocol()}}
+            conn, _, err := d.Dial(wsURL(srv, "/ws"), nil)
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer conn.Close()
+            if got := protocol.Negotiated(conn.Subprotocol()); got != v {
+                t.Fatalf("negotiated %v", got)
+            }
+
+            var hello protocol.Hello
+            if err := conn.ReadJSON(&hello); err != nil {
+                t.Fatal(err)
+            }
+            if hello.Version != v || (hello.Delta != nil) != (v == protocol.V2) {
+                t.Errorf("hello %+v", hello)
+            }
+            now := time.Now().UnixMicro()
+            asked := []protocol.Control{
+                {Type: protocol.TypeDeltaOn},
+                {Type: protocol.TypeTimeSync, ClientTS: now},
+                {Type: protocol.TypeFrameAck, Seq: 1, RecvTS: now},
+            }
+            for _, m := range asked {
+                if err := conn.WriteJSON(m); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            // Read until the device has gone and come back, then ask for
+            // a crop and read until it is answered one way or another.
+            texts := map[string]int{}
+            magics := map[[4]byte]int{}
+            var lost, back, cropped bool
+            conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+            for !cropped {
+                typ, data, err := conn.ReadMessage()
+                if err != nil {
+                    t.Fatalf("after %v and %q: %v", texts, magics, err)
+                }
+                if typ == websocket.BinaryMessage {
+                    h, _, err := v.Decode(data)
+                    if err != nil {
+                        t.Fatalf("binary message in %v: %v", v, err)
+                    }
+                    magics[h.Magic]++
+                    continue
+                }
+                var m struct {
+                    Type    string `json:"type"`
+                    Present bool   `json:"present"`
+                }
+                if err := json.Unmarshal(data, &m); err != nil {
+                    t.Fatal(err)
+                }
+                texts[m.Type]++
+                if !v.Has(m.Type) {
+                    t.Errorf("%v client sent %s", v, data)
+                }
+                switch {
+                case m.Type == protocol.TypeSignal && !m.Present:
+                    lost = true
+                case m.Type == protocol.TypeSignal && lost && !back:
+                    back = true
+                    if err := conn.WriteJSON(protocol.Control{Type: protocol.TypeSetCrop, Rect: protocol.Rect{W: 80, H: 48}}); err != nil {
+                        t.Fatal(err)
+                    }
+                case back && (m.Type == protocol.TypeCrop || m.Type == protocol.TypeError && texts[protocol.TypeError] == len(asked)+1):
+                    cropped = true
+                }
+            }
+
+            if v == protocol.V1 {
+                // Each V2 message asked for is refused instead.
+                if texts[protocol.TypeError] != len(asked)+1 {
+                    t.Errorf("%d errors for %d V2 messages", texts[protocol.TypeError], len(asked)+1)
+                }
+                if magics[protocol.TileMagic] != 0 || magics[protocol.FrameMagic] == 0 {
+                    t.Errorf("V1 client sent %v", magics)
+                }
+                return
+            }
+            for _, typ := range []string{protocol.TypeTimeSync, protocol.TypeDevice, protocol.TypeCrop} {
+                if texts[typ] == 0 {
+                    t.Errorf("V2 client was sent no %s; got %v", typ, texts)
+                }
+            }
+            if texts[protocol.TypeError] != 0 || magics[protocol.TileMagic] == 0 {
+                t.Errorf("V2 client got %v and %v, want tiles and no errors", texts, magics)
+            }
+        })
+    }
+}